@@ -36,13 +36,20 @@ type ec2API interface {
 	DescribeImportSnapshotTasks(ctx context.Context, params *ec2.DescribeImportSnapshotTasksInput,
 		optFns ...func(*ec2.Options),
 	) (*ec2.DescribeImportSnapshotTasksOutput, error)
+	CancelImportTask(ctx context.Context, params *ec2.CancelImportTaskInput, optFns ...func(*ec2.Options),
+	) (*ec2.CancelImportTaskOutput, error)
 	DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput,
 		optFns ...func(*ec2.Options),
 	) (*ec2.DescribeSnapshotsOutput, error)
 	DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options),
 	) (*ec2.DeleteSnapshotOutput, error)
+	DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options),
+	) (*ec2.DescribeRegionsOutput, error)
 	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options),
 	) (*ec2.CreateTagsOutput, error)
+	EnableImageDeprecation(ctx context.Context, params *ec2.EnableImageDeprecationInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.EnableImageDeprecationOutput, error)
 }
 
 type s3API interface {
@@ -50,6 +57,10 @@ type s3API interface {
 	) (*s3.HeadBucketOutput, error)
 	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options),
 	) (*s3.CreateBucketOutput, error)
+	GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options),
+	) (*s3.GetBucketLocationOutput, error)
+	GetPublicAccessBlock(ctx context.Context, params *s3.GetPublicAccessBlockInput, optFns ...func(*s3.Options),
+	) (*s3.GetPublicAccessBlockOutput, error)
 	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options),
 	) (*s3.HeadObjectOutput, error)
 	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options),
@@ -0,0 +1,382 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+// mockAccountID is the account of the fake AWS APIs.
+const mockAccountID = "123456789012"
+
+// mockRegions are the regions enabled for the account of the fake AWS APIs.
+var mockRegions = []string{"us-east-1", "us-east-2", "us-west-2", "eu-central-1", "eu-west-1"}
+
+// useMock replaces the API clients with in-memory fakes that record their calls in rec.
+func (u *Uploader) useMock(rec *provider.Recorder) {
+	cloud := &mockCloud{
+		rec:       rec,
+		images:    make(map[string]mockImage),
+		snapshots: make(map[string]map[string]string),
+		tasks:     make(map[string]string),
+		buckets:   make(map[string]string),
+		objects:   make(map[string]bool),
+	}
+	u.ec2 = func(_ context.Context, region string) (ec2API, error) {
+		return &mockEC2{cloud: cloud, region: region}, nil
+	}
+	u.s3 = func(context.Context) (s3API, error) {
+		return &mockS3{cloud: cloud}, nil
+	}
+	u.s3uploader = func(context.Context) (s3UploaderAPI, error) {
+		return &mockS3{cloud: cloud}, nil
+	}
+	u.sts = func(context.Context) (stsAPI, error) {
+		return &mockS3{cloud: cloud}, nil
+	}
+}
+
+// Mocked reports whether the uploader uses fake API clients, see provider.WithMock.
+func (u *Uploader) Mocked() bool {
+	return u.opts.Mock != nil
+}
+
+// mockCloud is the state shared by the fake API clients of an uploader.
+// It only keeps what uploads read back, e.g. registered images and uploaded blobs.
+type mockCloud struct {
+	rec *provider.Recorder
+
+	mux    sync.Mutex
+	nextID int
+	// images are the registered images, keyed by AMI ID.
+	images map[string]mockImage
+	// snapshots maps snapshot IDs to their tags.
+	snapshots map[string]map[string]string
+	// tasks maps import task IDs to the imported snapshot IDs.
+	tasks map[string]string
+	// buckets maps bucket names to their location constraint.
+	buckets map[string]string
+	// objects holds the bucket and key of uploaded objects, separated by a slash.
+	objects map[string]bool
+}
+
+type mockImage struct {
+	region string
+	image  ec2types.Image
+}
+
+// record records the call and locks the state until the returned function is called.
+func (c *mockCloud) record(operation string, input any) func() {
+	c.rec.Record(string(config.ProviderAWS), operation, input)
+	c.mux.Lock()
+	return c.mux.Unlock
+}
+
+func (c *mockCloud) newID(prefix string) string {
+	c.nextID++
+	return fmt.Sprintf("%s-%017x", prefix, c.nextID)
+}
+
+// mockEC2 is the fake EC2 API of a region.
+type mockEC2 struct {
+	cloud  *mockCloud
+	region string
+}
+
+func (m *mockEC2) DescribeImages(_ context.Context, params *ec2.DescribeImagesInput, _ ...func(*ec2.Options),
+) (*ec2.DescribeImagesOutput, error) {
+	defer m.cloud.record("ec2.DescribeImages", params)()
+	out := &ec2.DescribeImagesOutput{}
+	for id, img := range m.cloud.images {
+		if img.region != m.region || (len(params.ImageIds) > 0 && !slices.Contains(params.ImageIds, id)) {
+			continue
+		}
+		if !mockFiltersMatch(params.Filters, img.image.Name, img.image.Tags) {
+			continue
+		}
+		out.Images = append(out.Images, img.image)
+	}
+	return out, nil
+}
+
+func (m *mockEC2) ModifyImageAttribute(_ context.Context, params *ec2.ModifyImageAttributeInput, _ ...func(*ec2.Options),
+) (*ec2.ModifyImageAttributeOutput, error) {
+	defer m.cloud.record("ec2.ModifyImageAttribute", params)()
+	return &ec2.ModifyImageAttributeOutput{}, nil
+}
+
+func (m *mockEC2) RegisterImage(_ context.Context, params *ec2.RegisterImageInput, _ ...func(*ec2.Options),
+) (*ec2.RegisterImageOutput, error) {
+	defer m.cloud.record("ec2.RegisterImage", params)()
+	id := m.cloud.newID("ami")
+	m.cloud.images[id] = mockImage{
+		region: m.region,
+		image: ec2types.Image{
+			ImageId:             &id,
+			Name:                params.Name,
+			Description:         params.Description,
+			BlockDeviceMappings: params.BlockDeviceMappings,
+			State:               ec2types.ImageStateAvailable,
+		},
+	}
+	return &ec2.RegisterImageOutput{ImageId: &id}, nil
+}
+
+func (m *mockEC2) CopyImage(_ context.Context, params *ec2.CopyImageInput, _ ...func(*ec2.Options),
+) (*ec2.CopyImageOutput, error) {
+	defer m.cloud.record("ec2.CopyImage", params)()
+	source, ok := m.cloud.images[aws.ToString(params.SourceImageId)]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "InvalidAMIID.NotFound", Message: "source image not found"}
+	}
+	id := m.cloud.newID("ami")
+	snapshotID := m.cloud.newID("snap")
+	m.cloud.snapshots[snapshotID] = map[string]string{}
+	m.cloud.images[id] = mockImage{
+		region: m.region,
+		image: ec2types.Image{
+			ImageId:     &id,
+			Name:        params.Name,
+			Description: source.image.Description,
+			BlockDeviceMappings: []ec2types.BlockDeviceMapping{{
+				DeviceName: source.image.BlockDeviceMappings[0].DeviceName,
+				Ebs:        &ec2types.EbsBlockDevice{SnapshotId: &snapshotID},
+			}},
+			State: ec2types.ImageStateAvailable,
+		},
+	}
+	return &ec2.CopyImageOutput{ImageId: &id}, nil
+}
+
+func (m *mockEC2) DeregisterImage(_ context.Context, params *ec2.DeregisterImageInput, _ ...func(*ec2.Options),
+) (*ec2.DeregisterImageOutput, error) {
+	defer m.cloud.record("ec2.DeregisterImage", params)()
+	delete(m.cloud.images, aws.ToString(params.ImageId))
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (m *mockEC2) ImportSnapshot(_ context.Context, params *ec2.ImportSnapshotInput, _ ...func(*ec2.Options),
+) (*ec2.ImportSnapshotOutput, error) {
+	defer m.cloud.record("ec2.ImportSnapshot", params)()
+	taskID := m.cloud.newID("import-snap")
+	snapshotID := m.cloud.newID("snap")
+	m.cloud.tasks[taskID] = snapshotID
+	m.cloud.snapshots[snapshotID] = map[string]string{}
+	return &ec2.ImportSnapshotOutput{ImportTaskId: &taskID}, nil
+}
+
+func (m *mockEC2) DescribeImportSnapshotTasks(_ context.Context, params *ec2.DescribeImportSnapshotTasksInput,
+	_ ...func(*ec2.Options),
+) (*ec2.DescribeImportSnapshotTasksOutput, error) {
+	defer m.cloud.record("ec2.DescribeImportSnapshotTasks", params)()
+	out := &ec2.DescribeImportSnapshotTasksOutput{}
+	for _, taskID := range params.ImportTaskIds {
+		snapshotID, ok := m.cloud.tasks[taskID]
+		if !ok {
+			continue
+		}
+		out.ImportSnapshotTasks = append(out.ImportSnapshotTasks, ec2types.ImportSnapshotTask{
+			ImportTaskId: &taskID,
+			SnapshotTaskDetail: &ec2types.SnapshotTaskDetail{
+				SnapshotId: &snapshotID,
+				Status:     toPtr(string(ec2types.SnapshotStateCompleted)),
+			},
+		})
+	}
+	return out, nil
+}
+
+func (m *mockEC2) CancelImportTask(_ context.Context, params *ec2.CancelImportTaskInput, _ ...func(*ec2.Options),
+) (*ec2.CancelImportTaskOutput, error) {
+	defer m.cloud.record("ec2.CancelImportTask", params)()
+	return &ec2.CancelImportTaskOutput{}, nil
+}
+
+func (m *mockEC2) DescribeSnapshots(_ context.Context, params *ec2.DescribeSnapshotsInput, _ ...func(*ec2.Options),
+) (*ec2.DescribeSnapshotsOutput, error) {
+	defer m.cloud.record("ec2.DescribeSnapshots", params)()
+	out := &ec2.DescribeSnapshotsOutput{}
+	for id, tags := range m.cloud.snapshots {
+		if !mockFiltersMatch(params.Filters, nil, mockTags(tags)) {
+			continue
+		}
+		out.Snapshots = append(out.Snapshots, ec2types.Snapshot{SnapshotId: &id})
+	}
+	return out, nil
+}
+
+func (m *mockEC2) DeleteSnapshot(_ context.Context, params *ec2.DeleteSnapshotInput, _ ...func(*ec2.Options),
+) (*ec2.DeleteSnapshotOutput, error) {
+	defer m.cloud.record("ec2.DeleteSnapshot", params)()
+	delete(m.cloud.snapshots, aws.ToString(params.SnapshotId))
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func (m *mockEC2) DescribeRegions(_ context.Context, params *ec2.DescribeRegionsInput, _ ...func(*ec2.Options),
+) (*ec2.DescribeRegionsOutput, error) {
+	defer m.cloud.record("ec2.DescribeRegions", params)()
+	out := &ec2.DescribeRegionsOutput{}
+	for _, region := range mockRegions {
+		out.Regions = append(out.Regions, ec2types.Region{RegionName: toPtr(region)})
+	}
+	return out, nil
+}
+
+func (m *mockEC2) CreateTags(_ context.Context, params *ec2.CreateTagsInput, _ ...func(*ec2.Options),
+) (*ec2.CreateTagsOutput, error) {
+	defer m.cloud.record("ec2.CreateTags", params)()
+	for _, resource := range params.Resources {
+		if img, ok := m.cloud.images[resource]; ok {
+			img.image.Tags = append(img.image.Tags, params.Tags...)
+			m.cloud.images[resource] = img
+		}
+		if tags, ok := m.cloud.snapshots[resource]; ok {
+			for _, tag := range params.Tags {
+				tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (m *mockEC2) EnableImageDeprecation(_ context.Context, params *ec2.EnableImageDeprecationInput,
+	_ ...func(*ec2.Options),
+) (*ec2.EnableImageDeprecationOutput, error) {
+	defer m.cloud.record("ec2.EnableImageDeprecation", params)()
+	return &ec2.EnableImageDeprecationOutput{}, nil
+}
+
+// mockS3 is the fake S3 and STS API.
+type mockS3 struct {
+	cloud *mockCloud
+}
+
+func (m *mockS3) HeadBucket(_ context.Context, params *s3.HeadBucketInput, _ ...func(*s3.Options),
+) (*s3.HeadBucketOutput, error) {
+	defer m.cloud.record("s3.HeadBucket", params)()
+	if _, ok := m.cloud.buckets[aws.ToString(params.Bucket)]; !ok {
+		return nil, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *mockS3) CreateBucket(_ context.Context, params *s3.CreateBucketInput, _ ...func(*s3.Options),
+) (*s3.CreateBucketOutput, error) {
+	defer m.cloud.record("s3.CreateBucket", params)()
+	var constraint string
+	if params.CreateBucketConfiguration != nil {
+		constraint = string(params.CreateBucketConfiguration.LocationConstraint)
+	}
+	m.cloud.buckets[aws.ToString(params.Bucket)] = constraint
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (m *mockS3) GetBucketLocation(_ context.Context, params *s3.GetBucketLocationInput, _ ...func(*s3.Options),
+) (*s3.GetBucketLocationOutput, error) {
+	defer m.cloud.record("s3.GetBucketLocation", params)()
+	constraint, ok := m.cloud.buckets[aws.ToString(params.Bucket)]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchBucket"}
+	}
+	return &s3.GetBucketLocationOutput{LocationConstraint: s3types.BucketLocationConstraint(constraint)}, nil
+}
+
+func (m *mockS3) GetPublicAccessBlock(_ context.Context, params *s3.GetPublicAccessBlockInput, _ ...func(*s3.Options),
+) (*s3.GetPublicAccessBlockOutput, error) {
+	defer m.cloud.record("s3.GetPublicAccessBlock", params)()
+	return nil, &smithy.GenericAPIError{Code: "NoSuchPublicAccessBlockConfiguration"}
+}
+
+func (m *mockS3) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...func(*s3.Options),
+) (*s3.HeadObjectOutput, error) {
+	defer m.cloud.record("s3.HeadObject", params)()
+	if !m.cloud.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)] {
+		return nil, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func (m *mockS3) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options),
+) (*s3.DeleteObjectOutput, error) {
+	defer m.cloud.record("s3.DeleteObject", params)()
+	delete(m.cloud.objects, aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// Upload reads the whole body, like a real upload, and reports its CRC32C.
+func (m *mockS3) Upload(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3manager.Uploader),
+) (*s3manager.UploadOutput, error) {
+	m.cloud.rec.Record(string(config.ProviderAWS), "s3.PutObject", input)
+	hash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(hash, input.Body); err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	m.cloud.mux.Lock()
+	defer m.cloud.mux.Unlock()
+	m.cloud.objects[aws.ToString(input.Bucket)+"/"+aws.ToString(input.Key)] = true
+	return &s3manager.UploadOutput{
+		Key:            input.Key,
+		ChecksumCRC32C: toPtr(base64.StdEncoding.EncodeToString(hash.Sum(nil))),
+	}, nil
+}
+
+func (m *mockS3) GetCallerIdentity(_ context.Context, params *sts.GetCallerIdentityInput, _ ...func(*sts.Options),
+) (*sts.GetCallerIdentityOutput, error) {
+	defer m.cloud.record("sts.GetCallerIdentity", params)()
+	return &sts.GetCallerIdentityOutput{
+		Account: toPtr(mockAccountID),
+		Arn:     toPtr("arn:aws:iam::" + mockAccountID + ":user/uplosi-mock"),
+	}, nil
+}
+
+// mockFiltersMatch reports whether a resource with the name and tags matches all filters.
+// Only the name and tag filters used by the uploader are supported.
+func mockFiltersMatch(filters []ec2types.Filter, name *string, tags []ec2types.Tag) bool {
+	for _, filter := range filters {
+		key := aws.ToString(filter.Name)
+		switch {
+		case key == "name":
+			if !slices.Contains(filter.Values, aws.ToString(name)) {
+				return false
+			}
+		case strings.HasPrefix(key, "tag:"):
+			idx := slices.IndexFunc(tags, func(tag ec2types.Tag) bool {
+				return aws.ToString(tag.Key) == strings.TrimPrefix(key, "tag:") && slices.Contains(filter.Values, aws.ToString(tag.Value))
+			})
+			if idx < 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func mockTags(tags map[string]string) []ec2types.Tag {
+	ec2Tags := make([]ec2types.Tag, 0, len(tags))
+	for key, value := range tags {
+		ec2Tags = append(ec2Tags, ec2types.Tag{Key: toPtr(key), Value: toPtr(value)})
+	}
+	return ec2Tags
+}
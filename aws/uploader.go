@@ -7,13 +7,22 @@ SPDX-License-Identifier: Apache-2.0
 package aws
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -23,11 +32,21 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/aws/smithy-go"
 	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
 )
 
 const (
 	waitInterval = 15 * time.Second // 15 seconds
 	maxWait      = 30 * time.Minute // 30 minutes
+
+	// allRegionsWildcard can be used in the replication regions to replicate
+	// to all regions enabled for the account.
+	allRegionsWildcard = "*"
+
+	// nameTag and versionTag identify the images uploaded for a config,
+	// so existing versions can be listed.
+	nameTag    = "uplosi-name"
+	versionTag = "uplosi-version"
 )
 
 var errAMIDoesNotExist = errors.New("ami does not exist")
@@ -36,27 +55,223 @@ var errAMIDoesNotExist = errors.New("ami does not exist")
 type Uploader struct {
 	config config.Config
 
-	log *log.Logger
+	// ec2, s3, s3uploader and sts create the API clients, so tests can replace them with fakes.
+	ec2        func(ctx context.Context, region string) (ec2API, error)
+	s3         func(ctx context.Context) (s3API, error)
+	s3uploader func(ctx context.Context) (s3UploaderAPI, error)
+	sts        func(ctx context.Context) (stsAPI, error)
+
+	httpClient *http.Client
+	confirm    config.ConfirmFunc
+	log        *slog.Logger
+	steps      provider.StepTimer
+	checksums  map[string]string
+	opts       provider.Options
+	// expiresAt is the expiry time of the current upload, or zero if the config has no TTL.
+	expiresAt time.Time
+	// amiNames maps replication regions to their AMI names,
+	// which may differ from the AMI name in the source region.
+	amiNames map[string]string
+}
+
+// Option configures an Uploader.
+type Option func(*Uploader)
+
+// WithLogger sets the structured logger used by the uploader.
+// By default, log output is discarded.
+func WithLogger(log *slog.Logger) Option {
+	return func(u *Uploader) {
+		u.log = log.With("provider", "aws")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to communicate with the AWS APIs,
+// e.g. to use a proxy or custom CA certificates.
+// AWS_CA_BUNDLE cannot be combined with a custom client, configure the
+// certificates on the client's transport instead.
+// By default, the SDK's default client is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(u *Uploader) {
+		u.httpClient = client
+	}
+}
+
+// WithProviderOptions sets the options shared by all providers, like provider.WithMetrics or provider.WithClock.
+func WithProviderOptions(opts ...provider.Option) Option {
+	return func(u *Uploader) {
+		u.opts.Apply(opts...)
+	}
+}
+
+// WithConfirm sets a callback that approves overwriting existing images
+// and publishing images before these actions are performed.
+// Declining to overwrite aborts the upload with config.ErrNotConfirmed.
+// By default, all actions are performed without confirmation.
+func WithConfirm(confirm config.ConfirmFunc) Option {
+	return func(u *Uploader) {
+		u.confirm = confirm
+	}
 }
 
-func NewUploader(config config.Config, log *log.Logger) (*Uploader, error) {
-	return &Uploader{
+func NewUploader(config config.Config, opts ...Option) (*Uploader, error) {
+	u := &Uploader{
 		config: config,
-		log:    log,
-	}, nil
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts:   provider.NewOptions(),
+	}
+	u.ec2 = u.newEC2
+	u.s3 = u.newS3
+	u.s3uploader = u.newS3Uploader
+	u.sts = u.newSTS
+	for _, opt := range opts {
+		opt(u)
+	}
+	if u.opts.Mock != nil {
+		u.useMock(u.opts.Mock)
+	}
+	return u, nil
+}
+
+func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, size int64) (refs []string, retErr error) {
+	// Images are streamed to S3, so the size is only needed for metrics. An unknown size isn't recorded.
+	size, _ = provider.ImageSize(image, size)
+	defer func() { provider.RecordUpload(u.opts.Metrics, string(config.ProviderAWS), size, retErr) }()
+	image, err := provider.EnforceSize(image, size)
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := provider.RequireRaw(image); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	return u.upload(ctx, image, "")
 }
 
-func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, _ int64) (refs []string, retErr error) {
-	allRegions := make([]string, 0, len(u.config.AWS.ReplicationRegions)+1)
+// CanImportURL reports whether the image can be imported from the URL.
+// EC2 imports snapshots from S3 URLs of the form s3://bucket/key.
+func (u *Uploader) CanImportURL(src *url.URL) bool {
+	return src.Scheme == "s3" && src.Host != "" && strings.TrimPrefix(src.Path, "/") != ""
+}
+
+// ImportURL creates the image from a raw image in S3, without uploading it first.
+// The bucket must be readable by the vmimport service role.
+func (u *Uploader) ImportURL(ctx context.Context, src *url.URL) (refs []string, retErr error) {
+	defer func() { provider.RecordUpload(u.opts.Metrics, string(config.ProviderAWS), 0, retErr) }()
+	if !u.CanImportURL(src) {
+		return nil, fmt.Errorf("importing image from %s URL is not supported", src.Scheme)
+	}
+	return u.upload(ctx, nil, src.String())
+}
+
+// Preflight verifies the credentials with sts:GetCallerIdentity and checks that images can be described
+// in the primary region (as dry run) and that the bucket is accessible, if it already exists.
+func (u *Uploader) Preflight(ctx context.Context) error {
+	stsC, err := u.sts(ctx)
+	if err != nil {
+		return fmt.Errorf("creating sts client: %w", err)
+	}
+	identity, err := stsC.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return preflightError(err, "validating credentials")
+	}
+	u.log.Info("Credentials are valid", "account", aws.ToString(identity.Account), "arn", aws.ToString(identity.Arn))
+
+	region := u.config.AWS.Region
+	ec2C, err := u.ec2(ctx, region)
+	if err != nil {
+		return fmt.Errorf("creating ec2 client: %w", err)
+	}
+	_, err = ec2C.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		DryRun: toPtr(true),
+	})
+	if err := dryRunResult(err); err != nil {
+		return preflightError(err, fmt.Sprintf("describing images in region %s", region))
+	}
+	if u.config.AWS.Bucket == "" {
+		return nil
+	}
+	exists, err := u.bucketExists(ctx)
+	if err != nil {
+		return preflightError(err, fmt.Sprintf("accessing bucket %s", u.config.AWS.Bucket))
+	}
+	if !exists {
+		return nil
+	}
+	if err := u.checkBlobACL(ctx); err != nil {
+		return preflightError(err, fmt.Sprintf("checking blob acl for bucket %s", u.config.AWS.Bucket))
+	}
+	return nil
+}
+
+// dryRunResult returns the error of a dry run request,
+// which is nil if the request would have succeeded.
+func dryRunResult(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
+		return nil
+	}
+	return err
+}
+
+// preflightError marks errors caused by missing credentials or permissions
+// with provider.ErrPermissionDenied and adds a hint on how to fix them.
+func preflightError(err error, action string) error {
+	var signingErr *v4.SigningError
+	if errors.As(err, &signingErr) {
+		return fmt.Errorf("%s: %w: no valid credentials found, configure them e.g. with AWS_PROFILE or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY: %w",
+			action, provider.ErrPermissionDenied, err)
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "InvalidClientTokenId", "ExpiredToken", "SignatureDoesNotMatch", "AuthFailure":
+			return fmt.Errorf("%s: %w: credentials are invalid or expired, refresh them and try again: %w",
+				action, provider.ErrPermissionDenied, err)
+		case "AccessDenied", "UnauthorizedOperation", "Forbidden":
+			return fmt.Errorf("%s: %w: grant the IAM permissions needed for the upload to the caller: %w",
+				action, provider.ErrPermissionDenied, err)
+		}
+	}
+	return fmt.Errorf("%s: %w", action, err)
+}
+
+// upload creates the image from a snapshot, which is either given by the config,
+// imported from the source URL or uploaded from the image.
+func (u *Uploader) upload(ctx context.Context, image io.Reader, sourceURL string) (refs []string, retErr error) {
+	u.steps = provider.NewStepTimer(string(config.ProviderAWS), u.opts, u.log)
+	u.checksums = nil
+	replicationRegions, err := u.replicationRegions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolving replication regions: %w", err)
+	}
+	if err := u.renderAMINames(replicationRegions); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	allRegions := make([]string, 0, len(replicationRegions)+1)
 	allRegions = append(allRegions, u.config.AWS.Region)
-	allRegions = append(allRegions, u.config.AWS.ReplicationRegions...)
+	allRegions = append(allRegions, replicationRegions...)
 	amiIDs := make(map[string]string, len(allRegions))
 
+	deprecateAt, err := deprecationTime(u.config.AWS, u.opts.Clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	u.expiresAt, err = u.config.ExpiresAt(u.opts.Clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+
 	accountID, err := u.accountID(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("getting account ID: %w", err)
 	}
-	u.log.Printf("Uploading image to AWS account %s", accountID)
+	u.log.Info("Uploading image", "account", accountID, "region", u.config.AWS.Region)
+
+	if u.config.AWS.SnapshotID == "" && sourceURL == "" {
+		if err := u.checkBucketRegion(ctx); err != nil {
+			return nil, fmt.Errorf("pre-flight: %w", err)
+		}
+	}
 
 	// Ensure new image can be uploaded by deleting existing resources using the same name.
 	for _, region := range allRegions {
@@ -64,32 +279,24 @@ func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, _ int64) (re
 			return nil, fmt.Errorf("pre-cleaning: ensuring no image under the name %s in region %s: %w", u.config.Name, region, err)
 		}
 	}
-	if err := u.ensureSnapshotDeleted(ctx); err != nil {
-		return nil, fmt.Errorf("pre-cleaning: ensuring no snapshot using the same name exists: %w", err)
-	}
-	if err := u.ensureBlobDeleted(ctx); err != nil {
-		return nil, fmt.Errorf("pre-cleaning: ensuring no blob using the same name exists: %w", err)
-	}
-
-	// Ensure bucket exists.
-	// While the blob is only created temporarily, the bucket is persistent.
-	if err := u.ensureBucket(ctx); err != nil {
-		return nil, fmt.Errorf("ensuring bucket exists: %w", err)
-	}
 
 	// create primary image
-	if err := u.uploadBlob(ctx, image); err != nil {
-		return nil, fmt.Errorf("uploading image to s3: %w", err)
-	}
-	defer func(retErr *error) {
-		if err := u.ensureBlobDeleted(ctx); err != nil {
-			*retErr = errors.Join(*retErr, fmt.Errorf("post-cleaning: deleting temporary blob from s3: %w", err))
+	snapshotID := u.config.AWS.SnapshotID
+	switch {
+	case snapshotID != "":
+		u.log.Info("Using existing snapshot", "snapshot", snapshotID, "region", u.config.AWS.Region)
+	case sourceURL != "":
+		snapshotID, err = u.importSnapshotFromURL(ctx, sourceURL)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		snapshotID, err = u.uploadSnapshot(ctx, image)
+		if err != nil {
+			return nil, err
 		}
-	}(&retErr)
-	snapshotID, err := u.importSnapshot(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("importing snapshot: %w", err)
 	}
+	stepDone := u.steps.Start("create")
 	primaryAMIID, err := u.createImageFromSnapshot(ctx, snapshotID)
 	if err != nil {
 		return nil, fmt.Errorf("creating image from snapshot: %w", err)
@@ -98,11 +305,13 @@ func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, _ int64) (re
 	if err := u.waitForImage(ctx, primaryAMIID, u.config.AWS.Region); err != nil {
 		return nil, fmt.Errorf("waiting for primary image to become available: %w", err)
 	}
+	stepDone()
 
 	// replicate image
-	for _, region := range u.config.AWS.ReplicationRegions {
+	stepDone = u.steps.Start("replicate")
+	for _, region := range replicationRegions {
 		if _, alreadyReplicated := amiIDs[region]; alreadyReplicated {
-			u.log.Printf("image was already replicated in region %s. Skipping.", region)
+			u.log.Debug("Image was already replicated. Skipping.", "region", region)
 			continue
 		}
 		amiID, err := u.replicateImage(ctx, primaryAMIID, region)
@@ -111,24 +320,167 @@ func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, _ int64) (re
 		}
 		amiIDs[region] = amiID
 	}
-
-	// wait for replication, tag, publish
-	amiARNs := make([]string, 0, len(allRegions))
-	for _, region := range allRegions {
+	for _, region := range replicationRegions {
 		if err := u.waitForImage(ctx, amiIDs[region], region); err != nil {
 			return nil, fmt.Errorf("waiting for image to become available in region %s: %w", region, err)
 		}
+	}
+	stepDone()
+
+	// tag, deprecate, publish
+	stepDone = u.steps.Start("publish")
+	publish, err := u.confirmPublish()
+	if err != nil {
+		return nil, err
+	}
+	amiARNs := make([]string, 0, len(allRegions))
+	for _, region := range allRegions {
 		if err := u.tagImageAndSnapshot(ctx, amiIDs[region], region); err != nil {
 			return nil, fmt.Errorf("tagging image in region %s: %w", region, err)
 		}
-		if err := u.publishImage(ctx, amiIDs[region], region); err != nil {
-			return nil, fmt.Errorf("publishing image in region %s: %w", region, err)
+		if !deprecateAt.IsZero() {
+			if err := u.deprecateImage(ctx, amiIDs[region], region, deprecateAt); err != nil {
+				return nil, fmt.Errorf("scheduling image deprecation in region %s: %w", region, err)
+			}
+		}
+		if publish {
+			if err := u.publishImage(ctx, amiIDs[region], region); err != nil {
+				return nil, fmt.Errorf("publishing image in region %s: %w", region, err)
+			}
+		}
+		if err := u.shareImage(ctx, amiIDs[region], region); err != nil {
+			return nil, fmt.Errorf("sharing image in region %s: %w", region, err)
 		}
 		amiARNs = append(amiARNs, getAMIARN(region, accountID, amiIDs[region]))
 	}
+	stepDone()
 	return amiARNs, nil
 }
 
+// renderAMINames renders the AMI name for every replication region.
+func (u *Uploader) renderAMINames(replicationRegions []string) error {
+	u.amiNames = make(map[string]string, len(replicationRegions))
+	for _, region := range replicationRegions {
+		if region == u.config.AWS.Region {
+			continue
+		}
+		regional, err := u.config.RenderAWSRegion(region)
+		if err != nil {
+			return fmt.Errorf("rendering AMI name for region %s: %w", region, err)
+		}
+		u.amiNames[region] = regional.AWS.AMIName
+	}
+	return nil
+}
+
+// amiName returns the AMI name in the given region.
+func (u *Uploader) amiName(region string) string {
+	if name, ok := u.amiNames[region]; ok {
+		return name
+	}
+	return u.config.AWS.AMIName
+}
+
+// StepDurations returns how long each step of the last upload took, keyed by step name.
+func (u *Uploader) StepDurations() map[string]time.Duration {
+	return u.steps.Durations()
+}
+
+// Checksums returns the checksums of the blob uploaded by the last upload, keyed by algorithm.
+// It is empty if no blob was uploaded, e.g. because the image was imported from a URL.
+func (u *Uploader) Checksums() map[string]string {
+	return maps.Clone(u.checksums)
+}
+
+// WriteObject writes the data to the object with the given key in the configured bucket.
+func (u *Uploader) WriteObject(ctx context.Context, key string, data []byte) error {
+	uploadC, err := u.s3uploader(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = uploadC.Upload(ctx, &s3.PutObjectInput{
+		Bucket: &u.config.AWS.Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// uploadSnapshot uploads the image to a temporary blob in s3 and imports it as snapshot.
+func (u *Uploader) uploadSnapshot(ctx context.Context, image io.Reader) (snapshotID string, retErr error) {
+	if err := u.ensureSnapshotDeleted(ctx); err != nil {
+		return "", fmt.Errorf("pre-cleaning: ensuring no snapshot using the same name exists: %w", err)
+	}
+	if err := u.ensureBlobDeleted(ctx); err != nil {
+		return "", fmt.Errorf("pre-cleaning: ensuring no blob using the same name exists: %w", err)
+	}
+
+	// Ensure bucket exists.
+	// While the blob is only created temporarily, the bucket is persistent.
+	if err := u.ensureBucket(ctx); err != nil {
+		return "", fmt.Errorf("ensuring bucket exists: %w", err)
+	}
+	if err := u.checkBlobACL(ctx); err != nil {
+		return "", fmt.Errorf("checking blob acl: %w", err)
+	}
+
+	stepDone := u.steps.Start("upload")
+	if err := u.uploadBlob(ctx, image); err != nil {
+		return "", fmt.Errorf("uploading image to s3: %w", err)
+	}
+	stepDone()
+	defer func(retErr *error) {
+		if err := u.ensureBlobDeleted(ctx); err != nil {
+			*retErr = errors.Join(*retErr, fmt.Errorf("post-cleaning: deleting temporary blob from s3: %w", err))
+		}
+	}(&retErr)
+	stepDone = u.steps.Start("import")
+	snapshotID, err := u.importSnapshot(ctx, u.snapshotDiskContainer(""))
+	if err != nil {
+		return "", fmt.Errorf("importing snapshot: %w", err)
+	}
+	stepDone()
+	return snapshotID, nil
+}
+
+// importSnapshotFromURL imports the raw image at the S3 URL as snapshot.
+func (u *Uploader) importSnapshotFromURL(ctx context.Context, sourceURL string) (string, error) {
+	if err := u.ensureSnapshotDeleted(ctx); err != nil {
+		return "", fmt.Errorf("pre-cleaning: ensuring no snapshot using the same name exists: %w", err)
+	}
+	stepDone := u.steps.Start("import")
+	snapshotID, err := u.importSnapshot(ctx, u.snapshotDiskContainer(sourceURL))
+	if err != nil {
+		return "", fmt.Errorf("importing snapshot: %w", err)
+	}
+	stepDone()
+	return snapshotID, nil
+}
+
+// replicationRegions returns the regions the image is replicated to.
+// The wildcard "*" expands to all regions enabled for the account.
+func (u *Uploader) replicationRegions(ctx context.Context) ([]string, error) {
+	var enabledRegions []string
+	if slices.Contains(u.config.AWS.ReplicationRegions, allRegionsWildcard) {
+		ec2C, err := u.ec2(ctx, u.config.AWS.Region)
+		if err != nil {
+			return nil, fmt.Errorf("creating ec2 client: %w", err)
+		}
+		resp, err := ec2C.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+		if err != nil {
+			return nil, fmt.Errorf("describing regions: %w", err)
+		}
+		for _, region := range resp.Regions {
+			if region.RegionName == nil {
+				continue
+			}
+			enabledRegions = append(enabledRegions, *region.RegionName)
+		}
+		u.log.Info("Replicating image to all enabled regions", "regions", enabledRegions)
+	}
+	return expandReplicationRegions(u.config.AWS.ReplicationRegions, u.config.AWS.Region, enabledRegions), nil
+}
+
 func (u *Uploader) bucketExists(ctx context.Context) (bool, error) {
 	s3C, err := u.s3(ctx)
 	if err != nil {
@@ -148,6 +500,37 @@ func (u *Uploader) bucketExists(ctx context.Context) (bool, error) {
 	return false, err
 }
 
+// checkBucketRegion ensures that an existing bucket is located in the primary region.
+// The check is skipped if the bucket doesn't exist yet or cross-region buckets are allowed.
+// The location is requested directly, as requests to the bucket itself fail with a redirect
+// if the bucket is located in another region than the client.
+func (u *Uploader) checkBucketRegion(ctx context.Context) error {
+	if u.config.AWS.AllowCrossRegionBucket.UnwrapOr(false) {
+		return nil
+	}
+	s3C, err := u.s3(ctx)
+	if err != nil {
+		return err
+	}
+	bucket := u.config.AWS.Bucket
+	resp, err := s3C.GetBucketLocation(ctx, &s3.GetBucketLocationInput{
+		Bucket: &bucket,
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchBucket" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting location of bucket %s: %w", bucket, err)
+	}
+	bucketRegion := bucketLocationToRegion(resp.LocationConstraint)
+	if bucketRegion != u.config.AWS.Region {
+		return fmt.Errorf("bucket %s is located in region %s, but region is set to %s (set allowCrossRegionBucket to skip this check)",
+			bucket, bucketRegion, u.config.AWS.Region)
+	}
+	return nil
+}
+
 func (u *Uploader) ensureBucket(ctx context.Context) error {
 	s3C, err := u.s3(ctx)
 	if err != nil {
@@ -159,10 +542,10 @@ func (u *Uploader) ensureBucket(ctx context.Context) error {
 		return fmt.Errorf("checking if bucket %s exists: %w", bucket, err)
 	}
 	if exists {
-		u.log.Printf("Bucket %s exists", bucket)
+		u.log.Debug("Bucket exists", "bucket", bucket)
 		return nil
 	}
-	u.log.Printf("Bucket %s doesn't exist. Creating.", bucket)
+	u.log.Info("Bucket doesn't exist. Creating.", "bucket", bucket)
 	var createBucketConfig *s3types.CreateBucketConfiguration
 	if u.config.AWS.BucketLocationConstraint != "" {
 		createBucketConfig = &s3types.CreateBucketConfiguration{
@@ -186,15 +569,86 @@ func (u *Uploader) uploadBlob(ctx context.Context, img io.Reader) error {
 	if err != nil {
 		return err
 	}
-	u.log.Printf("Uploading os image as temporary blob %s", blobName)
+	u.log.Info("Uploading os image as temporary blob", "bucket", u.config.AWS.Bucket, "blob", blobName)
 
-	_, err = uploadC.Upload(ctx, &s3.PutObjectInput{
+	// S3 verifies the CRC32C of every part, the checksums of the whole blob are computed while reading it.
+	sums := provider.NewChecksummer(provider.ChecksumCRC32C, provider.ChecksumSHA256)
+	out, err := uploadC.Upload(ctx, &s3.PutObjectInput{
 		Bucket:            &u.config.AWS.Bucket,
 		Key:               &blobName,
-		Body:              img,
-		ChecksumAlgorithm: s3types.ChecksumAlgorithmSha256,
+		Body:              io.TeeReader(img, sums),
+		ChecksumAlgorithm: s3types.ChecksumAlgorithmCrc32c,
+		StorageClass:      s3types.StorageClass(u.config.AWS.StorageClass),
+		Tagging:           blobTagging(u.config.AWS.BlobTags),
+		ACL:               s3types.ObjectCannedACL(u.config.AWS.BlobACL),
 	})
-	return err
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessControlListNotSupported" {
+		return fmt.Errorf("bucket %s has ACLs disabled by its object ownership setting, enable ACLs or remove blobACL: %w", u.config.AWS.Bucket, err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := verifyBlobChecksum(out.ChecksumCRC32C, sums); err != nil {
+		return err
+	}
+	u.checksums = sums.Sums()
+	return nil
+}
+
+// verifyBlobChecksum compares the CRC32C reported by S3 with the locally computed one.
+// Multipart uploads report a checksum of the part checksums (suffixed with the number of parts),
+// which S3 already verified part by part, so only checksums of single part uploads are compared.
+func verifyBlobChecksum(reported *string, sums *provider.Checksummer) error {
+	if reported == nil || strings.Contains(*reported, "-") {
+		return nil
+	}
+	want := base64.StdEncoding.EncodeToString(sums.Sum(provider.ChecksumCRC32C))
+	if *reported != want {
+		return fmt.Errorf("checksum mismatch: s3 reported crc32c %s, uploaded data has %s", *reported, want)
+	}
+	return nil
+}
+
+// checkBlobACL fails if the blob ACL grants public access, but the public access block of the bucket
+// blocks or ignores public ACLs, so the blob wouldn't be readable as requested.
+// Public access blocks of the account aren't checked, as reading them requires additional permissions.
+func (u *Uploader) checkBlobACL(ctx context.Context) error {
+	acl := s3types.ObjectCannedACL(u.config.AWS.BlobACL)
+	if acl != s3types.ObjectCannedACLPublicRead && acl != s3types.ObjectCannedACLAuthenticatedRead {
+		return nil
+	}
+	s3C, err := u.s3(ctx)
+	if err != nil {
+		return err
+	}
+	bucket := u.config.AWS.Bucket
+	out, err := s3C.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: &bucket})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchPublicAccessBlockConfiguration" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting public access block of bucket %s: %w", bucket, err)
+	}
+	block := out.PublicAccessBlockConfiguration
+	if block != nil && (aws.ToBool(block.BlockPublicAcls) || aws.ToBool(block.IgnorePublicAcls)) {
+		return fmt.Errorf("blob acl %s requested, but the public access block of bucket %s blocks public ACLs: "+
+			"allow public ACLs for the bucket or remove blobACL", acl, bucket)
+	}
+	return nil
+}
+
+// blobTagging encodes the tags as URL query parameters, as expected by S3.
+func blobTagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := make(url.Values, len(tags))
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return toPtr(values.Encode())
 }
 
 func (u *Uploader) ensureBlobDeleted(ctx context.Context) error {
@@ -210,7 +664,7 @@ func (u *Uploader) ensureBlobDeleted(ctx context.Context) error {
 		return fmt.Errorf("checking if bucket %s exists: %w", bucket, err)
 	}
 	if !bucketExists {
-		u.log.Printf("Bucket %s doesn't exist. Nothing to clean up.", bucket)
+		u.log.Debug("Bucket doesn't exist. Nothing to clean up.", "bucket", bucket)
 		return nil
 	}
 
@@ -220,13 +674,13 @@ func (u *Uploader) ensureBlobDeleted(ctx context.Context) error {
 	})
 	var apiError smithy.APIError
 	if errors.As(err, &apiError) && apiError.ErrorCode() == "NotFound" {
-		u.log.Printf("Blob %s in %s doesn't exist. Nothing to clean up.", blobName, bucket)
+		u.log.Debug("Blob doesn't exist. Nothing to clean up.", "bucket", bucket, "blob", blobName)
 		return nil
 	}
 	if err != nil {
 		return err
 	}
-	u.log.Printf("Deleting blob %s", blobName)
+	u.log.Info("Deleting blob", "bucket", bucket, "blob", blobName)
 	_, err = s3C.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: &bucket,
 		Key:    &blobName,
@@ -234,38 +688,73 @@ func (u *Uploader) ensureBlobDeleted(ctx context.Context) error {
 	return err
 }
 
-func (u *Uploader) importSnapshot(ctx context.Context) (string, error) {
-	blobName := u.config.AWS.BlobName
+// snapshotDiskContainer returns the source of the snapshot import.
+// If sourceURL is empty, the temporary blob in the configured bucket is imported.
+func (u *Uploader) snapshotDiskContainer(sourceURL string) *ec2types.SnapshotDiskContainer {
+	container := &ec2types.SnapshotDiskContainer{
+		Description: toPtr(u.config.AWS.SnapshotName),
+		Format:      toPtr(string(ec2types.DiskImageFormatRaw)),
+	}
+	if sourceURL != "" {
+		container.Url = toPtr(sourceURL)
+		return container
+	}
+	container.UserBucket = &ec2types.UserBucket{
+		S3Bucket: toPtr(u.config.AWS.Bucket),
+		S3Key:    toPtr(u.config.AWS.BlobName),
+	}
+	return container
+}
+
+func (u *Uploader) importSnapshot(ctx context.Context, container *ec2types.SnapshotDiskContainer) (string, error) {
 	snapshotName := u.config.AWS.SnapshotName
 	ec2C, err := u.ec2(ctx, u.config.AWS.Region)
 	if err != nil {
 		return "", fmt.Errorf("creating ec2 client: %w", err)
 	}
-	u.log.Printf("Importing %s as snapshot %s", blobName, snapshotName)
+	source := aws.ToString(container.Url)
+	if container.UserBucket != nil {
+		source = aws.ToString(container.UserBucket.S3Key)
+	}
+	u.log.Info("Importing blob as snapshot", "blob", source, "snapshot", snapshotName, "region", u.config.AWS.Region)
 
 	importResp, err := ec2C.ImportSnapshot(ctx, &ec2.ImportSnapshotInput{
 		ClientData: &ec2types.ClientData{
 			Comment: &snapshotName,
 		},
-		Description: &snapshotName,
-		DiskContainer: &ec2types.SnapshotDiskContainer{
-			Description: &snapshotName,
-			Format:      toPtr(string(ec2types.DiskImageFormatRaw)),
-			UserBucket: &ec2types.UserBucket{
-				S3Bucket: &u.config.AWS.Bucket,
-				S3Key:    &blobName,
-			},
-		},
+		Description:   &snapshotName,
+		DiskContainer: container,
 	})
 	if err != nil {
-		log.Println(bucketPermissionHelpText)
+		u.log.Warn(bucketPermissionHelpText)
 		return "", fmt.Errorf("importing snapshot: %w", err)
 	}
 	if importResp.ImportTaskId == nil {
 		return "", fmt.Errorf("importing snapshot: no import task ID returned")
 	}
-	u.log.Printf("Waiting for snapshot %s to be ready", snapshotName)
-	return waitForSnapshotImport(ctx, ec2C, *importResp.ImportTaskId)
+	u.log.Info("Waiting for snapshot to be ready", "snapshot", snapshotName, "importTask", *importResp.ImportTaskId)
+	return awaitSnapshotImport(ctx, ec2C, *importResp.ImportTaskId, u.opts.Clock, u.log)
+}
+
+// awaitSnapshotImport waits for the import task to complete. If waiting is aborted while the task is still running,
+// e.g. because the context is canceled or the import times out, the task is canceled so it doesn't keep running and incur costs.
+// Tasks that already completed or failed are not canceled.
+func awaitSnapshotImport(ctx context.Context, ec2C ec2API, importTaskID string, clock provider.Clock, log *slog.Logger) (string, error) {
+	snapshotID, running, err := waitForSnapshotImport(ctx, ec2C, importTaskID, clock, log)
+	if err == nil || !running {
+		return snapshotID, err
+	}
+	log.Warn("Canceling snapshot import", "importTask", importTaskID)
+	// The context may already be canceled, so the task is canceled with a fresh timeout.
+	cancelCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	if _, cancelErr := ec2C.CancelImportTask(cancelCtx, &ec2.CancelImportTaskInput{
+		ImportTaskId: &importTaskID,
+		CancelReason: toPtr("upload aborted: " + err.Error()),
+	}); cancelErr != nil {
+		log.Warn("Canceling snapshot import failed, the task may keep running", "importTask", importTaskID, "err", cancelErr)
+	}
+	return "", err
 }
 
 func (u *Uploader) ensureSnapshotDeleted(ctx context.Context) error {
@@ -280,7 +769,7 @@ func (u *Uploader) ensureSnapshotDeleted(ctx context.Context) error {
 		return fmt.Errorf("finding snapshots: %w", err)
 	}
 	for _, snapshot := range snapshots {
-		u.log.Printf("Deleting snapshot %s in %s", snapshot, region)
+		u.log.Info("Deleting snapshot", "snapshot", snapshot, "region", region)
 		_, err = ec2C.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{
 			SnapshotId: toPtr(snapshot),
 		})
@@ -298,15 +787,28 @@ func (u *Uploader) ensureImageDeleted(ctx context.Context, region string) error
 	}
 	amiID, err := u.findImage(ctx, region)
 	if err == errAMIDoesNotExist {
-		u.log.Printf("Image %s in %s doesn't exist. Nothing to clean up.", u.config.Name, region)
+		u.log.Debug("Image doesn't exist. Nothing to clean up.", "image", u.amiName(region), "region", region)
 		return nil
 	}
 	snapshotID, err := getBackingSnapshotID(ctx, ec2C, amiID)
 	if err == errAMIDoesNotExist {
-		u.log.Printf("Image %s doesn't exist. Nothing to clean up.", amiID)
+		u.log.Debug("Image doesn't exist. Nothing to clean up.", "ami", amiID, "region", region)
 		return nil
 	}
-	u.log.Printf("Deleting image %s in %s with backing snapshot", amiID, region)
+	if err := u.confirm.ConfirmOverwrite(u.config, amiID); err != nil {
+		return err
+	}
+	if u.config.AWS.SnapshotID != "" && snapshotID == u.config.AWS.SnapshotID {
+		// The existing image is backed by the snapshot we are about to register again.
+		u.log.Info("Deleting image", "ami", amiID, "region", region)
+		if _, err := ec2C.DeregisterImage(ctx, &ec2.DeregisterImageInput{
+			ImageId: &amiID,
+		}); err != nil {
+			return fmt.Errorf("deleting image: %w", err)
+		}
+		return nil
+	}
+	u.log.Info("Deleting image with backing snapshot", "ami", amiID, "region", region)
 	_, err = ec2C.DeregisterImage(ctx, &ec2.DeregisterImageInput{
 		ImageId: &amiID,
 	})
@@ -354,44 +856,78 @@ func (u *Uploader) createImageFromSnapshot(ctx context.Context, snapshotID strin
 	if err != nil {
 		return "", fmt.Errorf("creating ec2 client: %w", err)
 	}
-	u.log.Printf("Creating image %s in %s", imageName, u.config.AWS.Region)
+	u.log.Info("Creating image", "image", imageName, "region", u.config.AWS.Region)
+
+	createReq, err := ec2C.RegisterImage(ctx, u.registerImageInput(snapshotID))
+	if err != nil {
+		return "", fmt.Errorf("creating image: %w", err)
+	}
+	if createReq.ImageId == nil {
+		return "", fmt.Errorf("creating image: no image ID returned")
+	}
+	return *createReq.ImageId, nil
+}
 
+// registerImageInput returns the request for registering an AMI from the given snapshot.
+func (u *Uploader) registerImageInput(snapshotID string) *ec2.RegisterImageInput {
+	rootDeviceName := u.config.AWS.RootDeviceName
+	if rootDeviceName == "" {
+		rootDeviceName = "/dev/xvda"
+	}
 	// TODO(malt3): make UEFI var store configurable (secure boot)
-	createReq, err := ec2C.RegisterImage(ctx, &ec2.RegisterImageInput{
-		Name:         &imageName,
+	input := &ec2.RegisterImageInput{
+		Name:         toPtr(u.config.AWS.AMIName),
 		Architecture: ec2types.ArchitectureValuesX8664,
 		BlockDeviceMappings: []ec2types.BlockDeviceMapping{
 			{
-				DeviceName: toPtr("/dev/xvda"),
-				Ebs: &ec2types.EbsBlockDevice{
-					DeleteOnTermination: toPtr(true),
-					SnapshotId:          &snapshotID,
-				},
+				DeviceName: toPtr(rootDeviceName),
+				Ebs:        u.ebsBlockDevice(snapshotID),
 			},
 		},
 		BootMode:           ec2types.BootModeValuesUefi,
 		Description:        toPtr(u.config.AWS.AMIDescription),
 		EnaSupport:         toPtr(true),
-		RootDeviceName:     toPtr("/dev/xvda"),
-		TpmSupport:         ec2types.TpmSupportValuesV20,
+		RootDeviceName:     toPtr(rootDeviceName),
 		VirtualizationType: toPtr("hvm"),
-	})
-	if err != nil {
-		return "", fmt.Errorf("creating image: %w", err)
 	}
-	if createReq.ImageId == nil {
-		return "", fmt.Errorf("creating image: no image ID returned")
+	// NitroTPM requires UEFI boot mode, which is set above.
+	// An unset value keeps TPM support enabled.
+	if u.config.AWS.TPMSupport != "none" {
+		input.TpmSupport = ec2types.TpmSupportValuesV20
 	}
-	return *createReq.ImageId, nil
+	// Instances launched from the AMI require IMDSv2 if set.
+	if u.config.AWS.IMDSSupport != "" {
+		input.ImdsSupport = ec2types.ImdsSupportValues(u.config.AWS.IMDSSupport)
+	}
+	return input
+}
+
+// ebsBlockDevice returns the root volume of the image.
+// Unset volume settings use the defaults of the account.
+func (u *Uploader) ebsBlockDevice(snapshotID string) *ec2types.EbsBlockDevice {
+	device := &ec2types.EbsBlockDevice{
+		DeleteOnTermination: toPtr(true),
+		SnapshotId:          &snapshotID,
+	}
+	if u.config.AWS.VolumeType != "" {
+		device.VolumeType = ec2types.VolumeType(u.config.AWS.VolumeType)
+	}
+	if u.config.AWS.IOPS > 0 {
+		device.Iops = toPtr(int32(u.config.AWS.IOPS))
+	}
+	if u.config.AWS.Throughput > 0 {
+		device.Throughput = toPtr(int32(u.config.AWS.Throughput))
+	}
+	return device
 }
 
 func (u *Uploader) replicateImage(ctx context.Context, amiID string, targetRegion string) (string, error) {
-	imageName := u.config.AWS.AMIName
+	imageName := u.amiName(targetRegion)
 	ec2C, err := u.ec2(ctx, targetRegion)
 	if err != nil {
 		return "", fmt.Errorf("creating ec2 client: %w", err)
 	}
-	u.log.Printf("Replicating image %s to %s", imageName, targetRegion)
+	u.log.Info("Replicating image", "image", imageName, "region", targetRegion)
 
 	replicateReq, err := ec2C.CopyImage(ctx, &ec2.CopyImageInput{
 		Name:          &imageName,
@@ -412,10 +948,7 @@ func (u *Uploader) findImage(ctx context.Context, region string) (string, error)
 	if err != nil {
 		return "", fmt.Errorf("creating ec2 client: %w", err)
 	}
-	imageName := u.config.AWS.AMIName
-	if err != nil {
-		return "", fmt.Errorf("inferring image name: %w", err)
-	}
+	imageName := u.amiName(region)
 
 	snapshots, err := ec2C.DescribeImages(ctx, &ec2.DescribeImagesInput{
 		Filters: []ec2types.Filter{
@@ -441,7 +974,7 @@ func (u *Uploader) findImage(ctx context.Context, region string) (string, error)
 }
 
 func (u *Uploader) waitForImage(ctx context.Context, amiID, region string) error {
-	u.log.Printf("Waiting for image %s in %s to be created", amiID, region)
+	u.log.Info("Waiting for image to be created", "ami", amiID, "region", region)
 	ec2C, err := u.ec2(ctx, region)
 	if err != nil {
 		return fmt.Errorf("creating ec2 client: %w", err)
@@ -457,24 +990,18 @@ func (u *Uploader) waitForImage(ctx context.Context, amiID, region string) error
 }
 
 func (u *Uploader) tagImageAndSnapshot(ctx context.Context, amiID, region string) error {
-	imageName := u.config.AWS.AMIName
 	ec2C, err := u.ec2(ctx, region)
 	if err != nil {
 		return fmt.Errorf("creating ec2 client: %w", err)
 	}
-	u.log.Printf("Tagging backing snapshot of image %s in %s", amiID, region)
+	u.log.Info("Tagging backing snapshot of image", "ami", amiID, "region", region)
 	snapshotID, err := getBackingSnapshotID(ctx, ec2C, amiID)
 	if err != nil {
 		return fmt.Errorf("getting backing snapshot ID: %w", err)
 	}
 	_, err = ec2C.CreateTags(ctx, &ec2.CreateTagsInput{
 		Resources: []string{amiID, snapshotID},
-		Tags: []ec2types.Tag{
-			{
-				Key:   toPtr("Name"),
-				Value: toPtr(imageName),
-			},
-		},
+		Tags:      u.imageTags(region),
 	})
 	if err != nil {
 		return fmt.Errorf("tagging ami and snapshot: %w", err)
@@ -482,16 +1009,147 @@ func (u *Uploader) tagImageAndSnapshot(ctx context.Context, amiID, region string
 	return nil
 }
 
-func (u *Uploader) publishImage(ctx context.Context, amiID, region string) error {
+// imageTags returns the tags of the image and its backing snapshot in the given region.
+func (u *Uploader) imageTags(region string) []ec2types.Tag {
+	tags := []ec2types.Tag{
+		{
+			Key:   toPtr("Name"),
+			Value: toPtr(u.amiName(region)),
+		},
+		{
+			Key:   toPtr(nameTag),
+			Value: toPtr(u.config.Name),
+		},
+		{
+			Key:   toPtr(versionTag),
+			Value: toPtr(u.config.ImageVersion),
+		},
+	}
+	if !u.expiresAt.IsZero() {
+		tags = append(tags, ec2types.Tag{
+			Key:   toPtr(config.ExpiryTag),
+			Value: toPtr(u.expiresAt.Format(time.RFC3339)),
+		})
+	}
+	return tags
+}
+
+// UpdateMetadata updates the tags and description of the existing AMI in the primary and all replication regions,
+// without uploading the image again. The backing snapshots are not modified.
+// It fails before modifying any image if the AMI doesn't exist in one of the regions.
+func (u *Uploader) UpdateMetadata(ctx context.Context) error {
+	replicationRegions, err := u.replicationRegions(ctx)
+	if err != nil {
+		return fmt.Errorf("resolving replication regions: %w", err)
+	}
+	if err := u.renderAMINames(replicationRegions); err != nil {
+		return err
+	}
+	allRegions := append([]string{u.config.AWS.Region}, replicationRegions...)
+
+	amiIDs := make(map[string]string, len(allRegions))
+	for _, region := range allRegions {
+		amiID, err := u.findImage(ctx, region)
+		if errors.Is(err, errAMIDoesNotExist) {
+			return fmt.Errorf("image %s not found in region %s: %w", u.amiName(region), region, err)
+		}
+		if err != nil {
+			return fmt.Errorf("finding image in region %s: %w", region, err)
+		}
+		amiIDs[region] = amiID
+	}
+
+	for _, region := range allRegions {
+		if err := u.updateImageMetadata(ctx, amiIDs[region], region); err != nil {
+			return fmt.Errorf("updating image metadata in region %s: %w", region, err)
+		}
+	}
+	return nil
+}
+
+func (u *Uploader) updateImageMetadata(ctx context.Context, amiID, region string) error {
+	ec2C, err := u.ec2(ctx, region)
+	if err != nil {
+		return fmt.Errorf("creating ec2 client: %w", err)
+	}
+	u.log.Info("Updating image metadata", "ami", amiID, "region", region)
+	if _, err := ec2C.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{amiID},
+		Tags:      u.imageTags(region),
+	}); err != nil {
+		return fmt.Errorf("tagging ami: %w", err)
+	}
+	if _, err := ec2C.ModifyImageAttribute(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId:     &amiID,
+		Description: &ec2types.AttributeValue{Value: toPtr(u.config.AWS.AMIDescription)},
+	}); err != nil {
+		return fmt.Errorf("updating ami description: %w", err)
+	}
+	return nil
+}
+
+// ImageVersions returns the versions of the images uploaded for the config's name in the primary region.
+// Only images tagged by uplosi are considered.
+func (u *Uploader) ImageVersions(ctx context.Context) ([]string, error) {
+	ec2C, err := u.ec2(ctx, u.config.AWS.Region)
+	if err != nil {
+		return nil, fmt.Errorf("creating ec2 client: %w", err)
+	}
+	paginator := ec2.NewDescribeImagesPaginator(ec2C, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		Filters: []ec2types.Filter{
+			{
+				Name:   toPtr("tag:" + nameTag),
+				Values: []string{u.config.Name},
+			},
+		},
+	})
+	var versions []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing images: %w", err)
+		}
+		versions = append(versions, imageVersions(page.Images)...)
+	}
+	return versions, nil
+}
+
+// imageVersions returns the values of the version tags of the images.
+func imageVersions(images []ec2types.Image) []string {
+	var versions []string
+	for _, image := range images {
+		for _, tag := range image.Tags {
+			if tag.Key != nil && *tag.Key == versionTag && tag.Value != nil {
+				versions = append(versions, *tag.Value)
+			}
+		}
+	}
+	return versions
+}
+
+// confirmPublish reports whether the image should be published.
+// Declining to publish keeps the image private.
+func (u *Uploader) confirmPublish() (bool, error) {
 	if !u.config.AWS.Publish.UnwrapOr(false) {
-		return nil
+		return false, nil
 	}
+	ok, err := u.confirm.ConfirmPublish(u.config)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		u.log.Warn("Publishing was declined, the image stays private", "image", u.config.AWS.AMIName)
+	}
+	return ok, nil
+}
 
+func (u *Uploader) publishImage(ctx context.Context, amiID, region string) error {
 	ec2C, err := u.ec2(ctx, region)
 	if err != nil {
 		return fmt.Errorf("creating ec2 client: %w", err)
 	}
-	u.log.Printf("Publishing ami %s in %s", amiID, region)
+	u.log.Info("Publishing image", "ami", amiID, "region", region)
 
 	_, err = ec2C.ModifyImageAttribute(ctx, &ec2.ModifyImageAttributeInput{
 		ImageId: &amiID,
@@ -509,6 +1167,58 @@ func (u *Uploader) publishImage(ctx context.Context, amiID, region string) error
 	return nil
 }
 
+// shareImage grants launch permission for the image to the configured organizations and organizational units.
+func (u *Uploader) shareImage(ctx context.Context, amiID, region string) error {
+	permissions := organizationLaunchPermissions(u.config.AWS.OrganizationARNs, u.config.AWS.OrganizationalUnitARNs)
+	if len(permissions) == 0 {
+		return nil
+	}
+	ec2C, err := u.ec2(ctx, region)
+	if err != nil {
+		return fmt.Errorf("creating ec2 client: %w", err)
+	}
+	u.log.Info("Sharing image", "ami", amiID, "region", region,
+		"organizations", u.config.AWS.OrganizationARNs, "organizationalUnits", u.config.AWS.OrganizationalUnitARNs)
+
+	_, err = ec2C.ModifyImageAttribute(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId:          &amiID,
+		LaunchPermission: &ec2types.LaunchPermissionModifications{Add: permissions},
+	})
+	if err != nil {
+		return fmt.Errorf("granting launch permission: %w", err)
+	}
+	return nil
+}
+
+// organizationLaunchPermissions returns the launch permissions granting access to the organizations and organizational units.
+func organizationLaunchPermissions(orgARNs, ouARNs []string) []ec2types.LaunchPermission {
+	permissions := make([]ec2types.LaunchPermission, 0, len(orgARNs)+len(ouARNs))
+	for _, arn := range orgARNs {
+		permissions = append(permissions, ec2types.LaunchPermission{OrganizationArn: toPtr(arn)})
+	}
+	for _, arn := range ouARNs {
+		permissions = append(permissions, ec2types.LaunchPermission{OrganizationalUnitArn: toPtr(arn)})
+	}
+	return permissions
+}
+
+func (u *Uploader) deprecateImage(ctx context.Context, amiID, region string, deprecateAt time.Time) error {
+	ec2C, err := u.ec2(ctx, region)
+	if err != nil {
+		return fmt.Errorf("creating ec2 client: %w", err)
+	}
+	u.log.Info("Scheduling image deprecation", "ami", amiID, "region", region, "deprecateAt", deprecateAt)
+
+	_, err = ec2C.EnableImageDeprecation(ctx, &ec2.EnableImageDeprecationInput{
+		ImageId:     &amiID,
+		DeprecateAt: &deprecateAt,
+	})
+	if err != nil {
+		return fmt.Errorf("enabling image deprecation: %w", err)
+	}
+	return nil
+}
+
 func (u *Uploader) accountID(ctx context.Context) (string, error) {
 	stsC, err := u.sts(ctx)
 	if err != nil {
@@ -524,60 +1234,70 @@ func (u *Uploader) accountID(ctx context.Context) (string, error) {
 	return *resp.Account, nil
 }
 
-func (u *Uploader) ec2(ctx context.Context, region string) (ec2API, error) {
-	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+func (u *Uploader) newEC2(ctx context.Context, region string) (ec2API, error) {
+	cfg, err := u.loadConfig(ctx, region)
 	if err != nil {
 		return nil, err
 	}
 	return ec2.NewFromConfig(cfg), nil
 }
 
-func (u *Uploader) s3(ctx context.Context) (s3API, error) {
-	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(u.config.AWS.Region))
+func (u *Uploader) newS3(ctx context.Context) (s3API, error) {
+	cfg, err := u.loadConfig(ctx, u.config.AWS.Region)
 	if err != nil {
 		return nil, err
 	}
 	return s3.NewFromConfig(cfg), nil
 }
 
-func (u *Uploader) s3uploader(ctx context.Context) (s3UploaderAPI, error) {
-	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(u.config.AWS.Region))
+func (u *Uploader) newS3Uploader(ctx context.Context) (s3UploaderAPI, error) {
+	cfg, err := u.loadConfig(ctx, u.config.AWS.Region)
 	if err != nil {
 		return nil, err
 	}
 	return s3manager.NewUploader(s3.NewFromConfig(cfg)), nil
 }
 
-func (u *Uploader) sts(ctx context.Context) (stsAPI, error) {
-	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(u.config.AWS.Region))
+func (u *Uploader) newSTS(ctx context.Context) (stsAPI, error) {
+	cfg, err := u.loadConfig(ctx, u.config.AWS.Region)
 	if err != nil {
 		return nil, err
 	}
 	return sts.NewFromConfig(cfg), nil
 }
 
+func (u *Uploader) loadConfig(ctx context.Context, region string) (aws.Config, error) {
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(region)}
+	if u.httpClient != nil {
+		opts = append(opts, awsconfig.WithHTTPClient(u.httpClient))
+	}
+	return awsconfig.LoadDefaultConfig(ctx, opts...)
+}
+
 const bucketPermissionHelpText = "Importing snapshot failed with \"deleted\" status. This may indicate a missing service role for the AWS service \"vmie.amazonaws.com\" to access the snapshot. See https://docs.aws.amazon.com/vm-import/latest/userguide/required-permissions.html#vmimport-role for details."
 
-func waitForSnapshotImport(ctx context.Context, ec2C ec2API, importTaskID string) (string, error) {
-	start := time.Now()
+// waitForSnapshotImport polls the import task until it completes.
+// It additionally reports whether the task may still be running if waiting failed.
+func waitForSnapshotImport(ctx context.Context, ec2C ec2API, importTaskID string, clock provider.Clock, log *slog.Logger) (snapshotID string, running bool, err error) {
+	start := clock.Now()
 	for {
-		if time.Since(start) > maxWait {
-			return "", fmt.Errorf("importing snapshot: timeout")
+		if clock.Since(start) > maxWait {
+			return "", true, fmt.Errorf("importing snapshot: timeout")
 		}
 		taskResp, err := ec2C.DescribeImportSnapshotTasks(ctx, &ec2.DescribeImportSnapshotTasksInput{
 			ImportTaskIds: []string{importTaskID},
 		})
 		if err != nil {
-			return "", fmt.Errorf("describing import snapshot task: %w", err)
+			return "", true, fmt.Errorf("describing import snapshot task: %w", err)
 		}
 		if len(taskResp.ImportSnapshotTasks) == 0 {
-			return "", fmt.Errorf("describing import snapshot task: no tasks returned")
+			return "", true, fmt.Errorf("describing import snapshot task: no tasks returned")
 		}
 		if taskResp.ImportSnapshotTasks[0].SnapshotTaskDetail == nil {
-			return "", fmt.Errorf("describing import snapshot task: no snapshot task detail returned")
+			return "", true, fmt.Errorf("describing import snapshot task: no snapshot task detail returned")
 		}
 		if taskResp.ImportSnapshotTasks[0].SnapshotTaskDetail.Status == nil {
-			return "", fmt.Errorf("describing import snapshot task: no status returned")
+			return "", true, fmt.Errorf("describing import snapshot task: no status returned")
 		}
 		var statusMessage string
 		if taskResp.ImportSnapshotTasks[0].SnapshotTaskDetail.StatusMessage != nil {
@@ -590,19 +1310,22 @@ func waitForSnapshotImport(ctx context.Context, ec2C ec2API, importTaskID string
 			// continue waiting
 		case string(ec2types.SnapshotStateCompleted):
 			// done
-			return *taskResp.ImportSnapshotTasks[0].SnapshotTaskDetail.SnapshotId, nil
+			return *taskResp.ImportSnapshotTasks[0].SnapshotTaskDetail.SnapshotId, false, nil
 		case string(ec2types.SnapshotStateError):
-			return "", fmt.Errorf("importing snapshot: task failed with message %q", statusMessage)
+			return "", false, fmt.Errorf("importing snapshot: task failed with message %q", statusMessage)
 		case string("deleted"):
-			log.Println(bucketPermissionHelpText)
-			return "", fmt.Errorf("importing snapshot: import state deleted with message %q", statusMessage)
+			log.Warn(bucketPermissionHelpText)
+			return "", false, fmt.Errorf("importing snapshot: import state deleted with message %q", statusMessage)
 		default:
-			return "", fmt.Errorf("importing snapshot: status %s with message %q",
+			return "", false, fmt.Errorf("importing snapshot: status %s with message %q",
 				*taskResp.ImportSnapshotTasks[0].SnapshotTaskDetail.Status,
 				statusMessage,
 			)
 		}
-		time.Sleep(waitInterval)
+		log.Debug("Snapshot import in progress", "importTask", importTaskID, "status", *taskResp.ImportSnapshotTasks[0].SnapshotTaskDetail.Status)
+		if err := clock.Sleep(ctx, waitInterval); err != nil {
+			return "", true, fmt.Errorf("waiting for snapshot import: %w", err)
+		}
 	}
 }
 
@@ -630,6 +1353,64 @@ func getBackingSnapshotID(ctx context.Context, ec2C ec2API, amiID string) (strin
 	return *ebs.SnapshotId, nil
 }
 
+// expandReplicationRegions replaces the wildcard "*" in the configured regions with the
+// enabled regions and removes duplicates as well as the primary region.
+func expandReplicationRegions(configured []string, primary string, enabled []string) []string {
+	var regions []string
+	for _, region := range configured {
+		if region == allRegionsWildcard {
+			regions = append(regions, enabled...)
+			continue
+		}
+		regions = append(regions, region)
+	}
+	expanded := make([]string, 0, len(regions))
+	for _, region := range regions {
+		if region == primary || slices.Contains(expanded, region) {
+			continue
+		}
+		expanded = append(expanded, region)
+	}
+	return expanded
+}
+
+// bucketLocationToRegion converts a bucket location constraint to the region the bucket resides in.
+// Buckets in us-east-1 have an empty location constraint, legacy buckets in eu-west-1 use "EU".
+func bucketLocationToRegion(constraint s3types.BucketLocationConstraint) string {
+	switch constraint {
+	case "":
+		return "us-east-1"
+	case s3types.BucketLocationConstraintEu:
+		return "eu-west-1"
+	default:
+		return string(constraint)
+	}
+}
+
+// deprecationTime returns the time the image should be deprecated at, relative to now.
+// The zero time is returned if the image should not be deprecated.
+func deprecationTime(conf config.AWSConfig, now time.Time) (time.Time, error) {
+	switch {
+	case conf.DeprecateAt != "":
+		deprecateAt, err := time.Parse(time.RFC3339, conf.DeprecateAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing deprecateAt: %w", err)
+		}
+		if !deprecateAt.After(now) {
+			return time.Time{}, fmt.Errorf("deprecateAt %s is not in the future", conf.DeprecateAt)
+		}
+		return deprecateAt, nil
+	case conf.DeprecateAfter != "":
+		after, err := config.ParseDuration(conf.DeprecateAfter)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing deprecateAfter: %w", err)
+		}
+		return now.Add(after), nil
+	default:
+		return time.Time{}, nil
+	}
+}
+
 // getAMIARN returns the arn of the AMI with the given region, account ID and ami ID.
 func getAMIARN(region, accountID, amiID string) string {
 	return fmt.Sprintf("arn:aws:ec2:%s:%s:image/%s", region, accountID, amiID)
@@ -0,0 +1,973 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandReplicationRegions(t *testing.T) {
+	enabled := []string{"eu-central-1", "eu-west-1", "us-east-1", "us-east-2"}
+
+	testCases := map[string]struct {
+		configured []string
+		want       []string
+	}{
+		"no regions": {
+			want: []string{},
+		},
+		"explicit regions": {
+			configured: []string{"us-east-2", "ap-south-1"},
+			want:       []string{"us-east-2", "ap-south-1"},
+		},
+		"primary region and duplicates removed": {
+			configured: []string{"us-east-2", "eu-central-1", "us-east-2"},
+			want:       []string{"us-east-2"},
+		},
+		"wildcard": {
+			configured: []string{"*"},
+			want:       []string{"eu-west-1", "us-east-1", "us-east-2"},
+		},
+		"wildcard and explicit regions": {
+			configured: []string{"ap-south-1", "*", "us-east-1"},
+			want:       []string{"ap-south-1", "eu-west-1", "us-east-1", "us-east-2"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			got := expandReplicationRegions(tc.configured, "eu-central-1", enabled)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
+
+func TestRegisterImageInput(t *testing.T) {
+	testCases := map[string]struct {
+		tpmSupport     string
+		imdsSupport    string
+		rootDeviceName string
+		want           ec2types.TpmSupportValues
+		wantIMDS       ec2types.ImdsSupportValues
+		wantRootDevice string
+	}{
+		"unset": {
+			want:           ec2types.TpmSupportValuesV20,
+			wantRootDevice: "/dev/xvda",
+		},
+		"v2.0": {
+			tpmSupport:     "v2.0",
+			want:           ec2types.TpmSupportValuesV20,
+			wantRootDevice: "/dev/xvda",
+		},
+		"none": {
+			tpmSupport:     "none",
+			wantRootDevice: "/dev/xvda",
+		},
+		"IMDSv2 required": {
+			imdsSupport:    "v2.0",
+			want:           ec2types.TpmSupportValuesV20,
+			wantIMDS:       ec2types.ImdsSupportValuesV20,
+			wantRootDevice: "/dev/xvda",
+		},
+		"custom root device": {
+			rootDeviceName: "/dev/sda1",
+			want:           ec2types.TpmSupportValuesV20,
+			wantRootDevice: "/dev/sda1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u, err := NewUploader(config.Config{
+				AWS: config.AWSConfig{
+					AMIName:        "my-ami",
+					TPMSupport:     tc.tpmSupport,
+					IMDSSupport:    tc.imdsSupport,
+					RootDeviceName: tc.rootDeviceName,
+				},
+			})
+			assert.NoError(err)
+
+			input := u.registerImageInput("snap-0123")
+			assert.Equal(tc.want, input.TpmSupport)
+			assert.Equal(tc.wantIMDS, input.ImdsSupport)
+			assert.Equal(ec2types.BootModeValuesUefi, input.BootMode)
+			assert.Equal("my-ami", *input.Name)
+			assert.Equal("snap-0123", *input.BlockDeviceMappings[0].Ebs.SnapshotId)
+			assert.Equal(tc.wantRootDevice, *input.RootDeviceName)
+			assert.Equal(tc.wantRootDevice, *input.BlockDeviceMappings[0].DeviceName)
+		})
+	}
+}
+
+func TestEBSBlockDevice(t *testing.T) {
+	testCases := map[string]struct {
+		aws            config.AWSConfig
+		wantType       ec2types.VolumeType
+		wantIOPS       *int32
+		wantThroughput *int32
+	}{
+		"account defaults": {},
+		"gp3 with iops and throughput": {
+			aws:            config.AWSConfig{VolumeType: "gp3", IOPS: 6000, Throughput: 500},
+			wantType:       ec2types.VolumeTypeGp3,
+			wantIOPS:       toPtr(int32(6000)),
+			wantThroughput: toPtr(int32(500)),
+		},
+		"io2 with iops": {
+			aws:      config.AWSConfig{VolumeType: "io2", IOPS: 10000},
+			wantType: ec2types.VolumeTypeIo2,
+			wantIOPS: toPtr(int32(10000)),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u, err := NewUploader(config.Config{AWS: tc.aws})
+			assert.NoError(err)
+
+			device := u.registerImageInput("snap-0123").BlockDeviceMappings[0].Ebs
+			assert.Equal("snap-0123", *device.SnapshotId)
+			assert.True(*device.DeleteOnTermination)
+			assert.Equal(tc.wantType, device.VolumeType)
+			assert.Equal(tc.wantIOPS, device.Iops)
+			assert.Equal(tc.wantThroughput, device.Throughput)
+		})
+	}
+}
+
+func TestSnapshotDiskContainer(t *testing.T) {
+	assert := assert.New(t)
+	u, err := NewUploader(config.Config{
+		AWS: config.AWSConfig{
+			Bucket:       "my-bucket",
+			BlobName:     "my-blob",
+			SnapshotName: "my-snapshot",
+		},
+	})
+	assert.NoError(err)
+
+	container := u.snapshotDiskContainer("")
+	assert.Equal("my-snapshot", *container.Description)
+	assert.Equal("RAW", *container.Format)
+	assert.Equal("my-bucket", *container.UserBucket.S3Bucket)
+	assert.Equal("my-blob", *container.UserBucket.S3Key)
+	assert.Nil(container.Url)
+
+	container = u.snapshotDiskContainer("s3://other-bucket/image.raw")
+	assert.Equal("s3://other-bucket/image.raw", *container.Url)
+	assert.Nil(container.UserBucket)
+}
+
+func TestCanImportURL(t *testing.T) {
+	testCases := map[string]struct {
+		src  string
+		want bool
+	}{
+		"s3 URL":         {src: "s3://my-bucket/images/image.raw", want: true},
+		"missing key":    {src: "s3://my-bucket/"},
+		"missing bucket": {src: "s3:///image.raw"},
+		"https URL":      {src: "https://example.com/image.raw"},
+		"gs URL":         {src: "gs://my-bucket/image.raw"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			src, err := url.Parse(tc.src)
+			assert.NoError(err)
+			u, err := NewUploader(config.Config{})
+			assert.NoError(err)
+			assert.Equal(tc.want, u.CanImportURL(src))
+		})
+	}
+}
+
+func TestRenderAMINames(t *testing.T) {
+	assert := assert.New(t)
+	conf := config.Config{
+		Provider:     "aws",
+		Name:         "my-image",
+		ImageVersion: "1.0.0",
+		AWS: config.AWSConfig{
+			Region:             "us-east-1",
+			ReplicationRegions: []string{"us-west-1"},
+			AMIName:            "{{.Name}}-{{.Version}}{{if .Region}}-{{.Region}}{{end}}",
+			Bucket:             "my-bucket",
+		},
+	}
+	assert.NoError(conf.SetDefaults())
+	assert.NoError(conf.Render(func(string) ([]byte, error) { return nil, nil }))
+	u, err := NewUploader(conf)
+	assert.NoError(err)
+
+	assert.NoError(u.renderAMINames([]string{"us-east-1", "us-west-1", "eu-central-1"}))
+	assert.Equal("my-image-1.0.0", u.amiName("us-east-1"))
+	assert.Equal("my-image-1.0.0-us-west-1", u.amiName("us-west-1"))
+	assert.Equal("my-image-1.0.0-eu-central-1", u.amiName("eu-central-1"))
+}
+
+func TestImageTags(t *testing.T) {
+	assert := assert.New(t)
+	u, err := NewUploader(config.Config{
+		Name:         "my-image",
+		ImageVersion: "1.0.0",
+		AWS: config.AWSConfig{
+			Region:  "us-east-1",
+			AMIName: "my-ami",
+		},
+	})
+	assert.NoError(err)
+	u.amiNames = map[string]string{"us-west-1": "my-ami-us-west-1"}
+
+	tagValues := func(tags []ec2types.Tag) map[string]string {
+		values := make(map[string]string, len(tags))
+		for _, tag := range tags {
+			values[*tag.Key] = *tag.Value
+		}
+		return values
+	}
+	assert.Equal(map[string]string{
+		"Name":           "my-ami",
+		"uplosi-name":    "my-image",
+		"uplosi-version": "1.0.0",
+	}, tagValues(u.imageTags("us-east-1")))
+	assert.Equal("my-ami-us-west-1", tagValues(u.imageTags("us-west-1"))["Name"])
+
+	u.expiresAt = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal("2025-01-02T03:04:05Z", tagValues(u.imageTags("us-east-1"))["expiry"])
+}
+
+func TestOrganizationLaunchPermissions(t *testing.T) {
+	assert := assert.New(t)
+	assert.Empty(organizationLaunchPermissions(nil, nil))
+	assert.Equal([]ec2types.LaunchPermission{
+		{OrganizationArn: toPtr("arn:aws:organizations::123456789012:organization/o-a1b2c3d4e5")},
+		{OrganizationalUnitArn: toPtr("arn:aws:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cd34ef56")},
+	}, organizationLaunchPermissions(
+		[]string{"arn:aws:organizations::123456789012:organization/o-a1b2c3d4e5"},
+		[]string{"arn:aws:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cd34ef56"},
+	))
+}
+
+func TestStepDurations(t *testing.T) {
+	assert := assert.New(t)
+	u, err := NewUploader(config.Config{})
+	assert.NoError(err)
+	assert.Empty(u.StepDurations())
+
+	u.steps = provider.NewStepTimer(string(config.ProviderAWS), u.opts, u.log)
+	u.steps.Start("upload")()
+	u.steps.Start("replicate")()
+	first := u.StepDurations()["replicate"]
+	u.steps.Start("replicate")()
+
+	durations := u.StepDurations()
+	assert.Len(durations, 2)
+	assert.Contains(durations, "upload")
+	assert.GreaterOrEqual(durations["replicate"], first)
+
+	durations["upload"] = 0
+	delete(durations, "replicate")
+	assert.Len(u.StepDurations(), 2)
+}
+
+func TestWithMetrics(t *testing.T) {
+	assert := assert.New(t)
+	metrics := &stepMetrics{}
+	u, err := NewUploader(config.Config{}, WithProviderOptions(provider.WithMetrics(metrics)))
+	assert.NoError(err)
+
+	u.steps = provider.NewStepTimer(string(config.ProviderAWS), u.opts, u.log)
+	u.steps.Start("upload")()
+	u.steps.Start("replicate")()
+	assert.Equal([]string{"aws/upload", "aws/replicate"}, metrics.steps)
+
+	// Without metrics, nothing is reported.
+	u, err = NewUploader(config.Config{}, WithProviderOptions(provider.WithMetrics(nil)))
+	assert.NoError(err)
+	u.steps = provider.NewStepTimer(string(config.ProviderAWS), u.opts, u.log)
+	assert.NotPanics(func() { u.steps.Start("upload")() })
+}
+
+// stepMetrics records the steps observed.
+type stepMetrics struct {
+	provider.NopMetrics
+	steps []string
+}
+
+func (m *stepMetrics) ObserveDuration(provider, step string, _ time.Duration) {
+	m.steps = append(m.steps, provider+"/"+step)
+}
+
+func TestLoadConfigHTTPClient(t *testing.T) {
+	assert := assert.New(t)
+	// A CA bundle can only be applied to the SDK's default client.
+	t.Setenv("AWS_CA_BUNDLE", "")
+	client := &http.Client{}
+
+	u, err := NewUploader(config.Config{}, WithHTTPClient(client))
+	assert.NoError(err)
+	cfg, err := u.loadConfig(context.Background(), "eu-central-1")
+	assert.NoError(err)
+	assert.Same(client, cfg.HTTPClient)
+	assert.Equal("eu-central-1", cfg.Region)
+}
+
+func TestConfirmPublish(t *testing.T) {
+	testCases := map[string]struct {
+		publish     bool
+		confirm     config.ConfirmFunc
+		wantPublish bool
+		wantErr     bool
+	}{
+		"publishing disabled": {
+			confirm: func(string, config.Config) (bool, error) {
+				panic("unexpected confirmation")
+			},
+		},
+		"no confirmation callback": {
+			publish:     true,
+			wantPublish: true,
+		},
+		"confirmed": {
+			publish:     true,
+			confirm:     func(string, config.Config) (bool, error) { return true, nil },
+			wantPublish: true,
+		},
+		"declined": {
+			publish: true,
+			confirm: func(string, config.Config) (bool, error) { return false, nil },
+		},
+		"confirmation error": {
+			publish: true,
+			confirm: func(string, config.Config) (bool, error) { return false, errors.New("failed") },
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u, err := NewUploader(config.Config{
+				AWS: config.AWSConfig{Publish: config.Some(tc.publish)},
+			}, WithConfirm(tc.confirm))
+			assert.NoError(err)
+
+			publish, err := u.confirmPublish()
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantPublish, publish)
+		})
+	}
+}
+
+func TestImageVersions(t *testing.T) {
+	assert := assert.New(t)
+	images := []ec2types.Image{
+		{Tags: []ec2types.Tag{
+			{Key: toPtr(nameTag), Value: toPtr("my-image")},
+			{Key: toPtr(versionTag), Value: toPtr("1.0.0")},
+		}},
+		{Tags: []ec2types.Tag{
+			{Key: toPtr(versionTag), Value: toPtr("1.0.1")},
+		}},
+		{Tags: []ec2types.Tag{
+			{Key: toPtr("other"), Value: toPtr("2.0.0")},
+		}},
+	}
+
+	assert.Equal([]string{"1.0.0", "1.0.1"}, imageVersions(images))
+	assert.Empty(imageVersions(nil))
+}
+
+func TestDeprecationTime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := map[string]struct {
+		conf    config.AWSConfig
+		want    time.Time
+		wantErr bool
+	}{
+		"unset": {},
+		"deprecateAt": {
+			conf: config.AWSConfig{DeprecateAt: "2024-06-01T12:00:00Z"},
+			want: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		"deprecateAt in the past": {
+			conf:    config.AWSConfig{DeprecateAt: "2023-06-01T12:00:00Z"},
+			wantErr: true,
+		},
+		"invalid deprecateAt": {
+			conf:    config.AWSConfig{DeprecateAt: "2024-06-01"},
+			wantErr: true,
+		},
+		"deprecateAfter days": {
+			conf: config.AWSConfig{DeprecateAfter: "90d"},
+			want: now.AddDate(0, 0, 90),
+		},
+		"deprecateAfter duration": {
+			conf: config.AWSConfig{DeprecateAfter: "36h"},
+			want: now.Add(36 * time.Hour),
+		},
+		"negative deprecateAfter": {
+			conf:    config.AWSConfig{DeprecateAfter: "-1h"},
+			wantErr: true,
+		},
+		"invalid deprecateAfter": {
+			conf:    config.AWSConfig{DeprecateAfter: "soon"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			got, err := deprecationTime(tc.conf, now)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.True(tc.want.Equal(got), "want %s, got %s", tc.want, got)
+		})
+	}
+}
+
+func TestBlobTagging(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(blobTagging(nil))
+	assert.Nil(blobTagging(map[string]string{}))
+	assert.Equal("cost-center=os+images&team=a%2Fb", *blobTagging(map[string]string{
+		"team":        "a/b",
+		"cost-center": "os images",
+	}))
+}
+
+func TestVerifyBlobChecksum(t *testing.T) {
+	testCases := map[string]struct {
+		reported *string
+		wantErr  bool
+	}{
+		"matching checksum": {reported: toPtr("yZRlqg==")},
+		"mismatching checksum": {
+			reported: toPtr("AAAAAA=="),
+			wantErr:  true,
+		},
+		"multipart checksum": {reported: toPtr("AAAAAA==-3")},
+		"no checksum":        {},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			sums := provider.NewChecksummer(provider.ChecksumCRC32C)
+			_, _ = sums.Write([]byte("hello world"))
+			err := verifyBlobChecksum(tc.reported, sums)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDryRunResult(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(dryRunResult(&smithy.GenericAPIError{Code: "DryRunOperation"}))
+	assert.NoError(dryRunResult(nil))
+	err := &smithy.GenericAPIError{Code: "UnauthorizedOperation"}
+	assert.ErrorIs(dryRunResult(err), err)
+}
+
+func TestPreflightError(t *testing.T) {
+	testCases := map[string]struct {
+		err           error
+		wantForbidden bool
+		wantHint      string
+	}{
+		"missing credentials": {
+			err:           &v4.SigningError{Err: errors.New("failed to retrieve credentials")},
+			wantForbidden: true,
+			wantHint:      "AWS_PROFILE",
+		},
+		"expired credentials": {
+			err:           &smithy.GenericAPIError{Code: "ExpiredToken"},
+			wantForbidden: true,
+			wantHint:      "refresh them",
+		},
+		"missing permission": {
+			err:           &smithy.GenericAPIError{Code: "UnauthorizedOperation"},
+			wantForbidden: true,
+			wantHint:      "IAM permissions",
+		},
+		"other error": {
+			err: errors.New("connection refused"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			err := preflightError(tc.err, "describing images")
+			assert.ErrorIs(err, tc.err)
+			assert.ErrorContains(err, "describing images")
+			assert.Equal(tc.wantForbidden, errors.Is(err, provider.ErrPermissionDenied))
+			assert.ErrorContains(err, tc.wantHint)
+		})
+	}
+}
+
+func TestAwaitSnapshotImport(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testCases := map[string]struct {
+		ctx         context.Context
+		status      string
+		describeErr error
+		wantErr     bool
+		wantCancel  bool
+	}{
+		"completed": {
+			ctx:    context.Background(),
+			status: "completed",
+		},
+		"failed": {
+			ctx:     context.Background(),
+			status:  "error",
+			wantErr: true,
+		},
+		"context canceled": {
+			ctx:        canceled,
+			status:     "active",
+			wantErr:    true,
+			wantCancel: true,
+		},
+		"describe error": {
+			ctx:         context.Background(),
+			describeErr: errors.New("throttled"),
+			wantErr:     true,
+			wantCancel:  true,
+		},
+		"timeout": {
+			ctx:        context.Background(),
+			status:     "active",
+			wantErr:    true,
+			wantCancel: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			ec2C := &stubEC2{status: tc.status, describeErr: tc.describeErr}
+			clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			snapshotID, err := awaitSnapshotImport(tc.ctx, ec2C, "import-snap-1", clock, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if tc.wantErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+				assert.Equal("snap-1", snapshotID)
+			}
+			if tc.wantCancel {
+				assert.Equal([]string{"import-snap-1"}, ec2C.canceled)
+			} else {
+				assert.Empty(ec2C.canceled)
+			}
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	testCases := map[string]struct {
+		identityErr error
+		describeErr error
+		wantErr     bool
+	}{
+		"success": {
+			describeErr: &smithy.GenericAPIError{Code: "DryRunOperation"},
+		},
+		"invalid credentials": {
+			identityErr: &smithy.GenericAPIError{Code: "InvalidClientTokenId"},
+			wantErr:     true,
+		},
+		"missing permission": {
+			describeErr: &smithy.GenericAPIError{Code: "UnauthorizedOperation"},
+			wantErr:     true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u, err := NewUploader(config.Config{AWS: config.AWSConfig{Region: "eu-central-1"}})
+			assert.NoError(err)
+			ec2C := &stubEC2{describeImagesErr: tc.describeErr}
+			var ec2Region string
+			u.ec2 = func(_ context.Context, region string) (ec2API, error) {
+				ec2Region = region
+				return ec2C, nil
+			}
+			u.sts = func(context.Context) (stsAPI, error) {
+				return &stubSTS{err: tc.identityErr}, nil
+			}
+
+			err = u.Preflight(context.Background())
+			if tc.wantErr {
+				assert.ErrorIs(err, provider.ErrPermissionDenied)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal("eu-central-1", ec2Region)
+		})
+	}
+}
+
+func TestShareImage(t *testing.T) {
+	assert := assert.New(t)
+	u, err := NewUploader(config.Config{AWS: config.AWSConfig{
+		OrganizationalUnitARNs: []string{"arn:aws:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cd34ef56"},
+	}})
+	assert.NoError(err)
+	ec2C := &stubEC2{}
+	u.ec2 = func(context.Context, string) (ec2API, error) { return ec2C, nil }
+
+	assert.NoError(u.shareImage(context.Background(), "ami-1", "us-east-1"))
+	assert.NoError(u.publishImage(context.Background(), "ami-1", "us-east-1"))
+	assert.Len(ec2C.modified, 2)
+	assert.Equal("ami-1", *ec2C.modified[0].ImageId)
+	assert.Equal("arn:aws:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cd34ef56", *ec2C.modified[0].LaunchPermission.Add[0].OrganizationalUnitArn)
+	assert.Equal(ec2types.PermissionGroupAll, ec2C.modified[1].LaunchPermission.Add[0].Group)
+
+	// Without organizations, no launch permission is granted.
+	u.config.AWS.OrganizationalUnitARNs = nil
+	assert.NoError(u.shareImage(context.Background(), "ami-1", "us-east-1"))
+	assert.Len(ec2C.modified, 2)
+}
+
+func TestCheckBucketRegion(t *testing.T) {
+	testCases := map[string]struct {
+		region     string
+		location   s3types.BucketLocationConstraint
+		err        error
+		allowCross bool
+		wantErr    bool
+	}{
+		"same region": {
+			region:   "eu-central-1",
+			location: "eu-central-1",
+		},
+		"us-east-1 has no location constraint": {
+			region: "us-east-1",
+		},
+		"cross region": {
+			region:   "eu-central-1",
+			location: "us-west-2",
+			wantErr:  true,
+		},
+		"cross region allowed": {
+			region:     "eu-central-1",
+			location:   "us-west-2",
+			allowCross: true,
+		},
+		"missing bucket": {
+			region: "eu-central-1",
+			err:    &smithy.GenericAPIError{Code: "NoSuchBucket"},
+		},
+		"access denied": {
+			region:  "eu-central-1",
+			err:     &smithy.GenericAPIError{Code: "AccessDenied"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u, err := NewUploader(config.Config{AWS: config.AWSConfig{
+				Region:                 tc.region,
+				Bucket:                 "bucket",
+				AllowCrossRegionBucket: config.Some(tc.allowCross),
+			}})
+			assert.NoError(err)
+			u.s3 = func(context.Context) (s3API, error) { return &stubS3{location: tc.location, err: tc.err}, nil }
+
+			err = u.checkBucketRegion(context.Background())
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestWriteObject(t *testing.T) {
+	assert := assert.New(t)
+	u, err := NewUploader(config.Config{AWS: config.AWSConfig{Region: "eu-central-1", Bucket: "bucket"}})
+	assert.NoError(err)
+	uploader := &stubS3Uploader{}
+	u.s3uploader = func(context.Context) (s3UploaderAPI, error) { return uploader, nil }
+
+	assert.NoError(u.WriteObject(context.Background(), "manifests/image.json", []byte("{}")))
+	assert.Equal("bucket", *uploader.input.Bucket)
+	assert.Equal("manifests/image.json", *uploader.input.Key)
+	body, err := io.ReadAll(uploader.input.Body)
+	assert.NoError(err)
+	assert.Equal([]byte("{}"), body)
+}
+
+func TestCheckBlobACL(t *testing.T) {
+	testCases := map[string]struct {
+		acl     string
+		block   *s3types.PublicAccessBlockConfiguration
+		err     error
+		wantErr bool
+	}{
+		"no acl": {
+			block: &s3types.PublicAccessBlockConfiguration{BlockPublicAcls: toPtr(true)},
+		},
+		"private acl": {
+			acl:   "private",
+			block: &s3types.PublicAccessBlockConfiguration{BlockPublicAcls: toPtr(true)},
+		},
+		"public acl allowed": {
+			acl:   "public-read",
+			block: &s3types.PublicAccessBlockConfiguration{BlockPublicPolicy: toPtr(true)},
+		},
+		"no public access block": {
+			acl: "public-read",
+			err: &smithy.GenericAPIError{Code: "NoSuchPublicAccessBlockConfiguration"},
+		},
+		"public acls blocked": {
+			acl:     "public-read",
+			block:   &s3types.PublicAccessBlockConfiguration{BlockPublicAcls: toPtr(true)},
+			wantErr: true,
+		},
+		"public acls ignored": {
+			acl:     "authenticated-read",
+			block:   &s3types.PublicAccessBlockConfiguration{IgnorePublicAcls: toPtr(true)},
+			wantErr: true,
+		},
+		"access denied": {
+			acl:     "public-read",
+			err:     &smithy.GenericAPIError{Code: "AccessDenied"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u, err := NewUploader(config.Config{AWS: config.AWSConfig{Bucket: "bucket", BlobACL: tc.acl}})
+			assert.NoError(err)
+			u.s3 = func(context.Context) (s3API, error) { return &stubS3{publicAccessBlock: tc.block, err: tc.err}, nil }
+
+			err = u.checkBlobACL(context.Background())
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+type stubEC2 struct {
+	ec2API
+	status            string
+	describeErr       error
+	describeImagesErr error
+	canceled          []string
+	modified          []*ec2.ModifyImageAttributeInput
+}
+
+func (s *stubEC2) DescribeImages(context.Context, *ec2.DescribeImagesInput, ...func(*ec2.Options),
+) (*ec2.DescribeImagesOutput, error) {
+	if s.describeImagesErr != nil {
+		return nil, s.describeImagesErr
+	}
+	return &ec2.DescribeImagesOutput{}, nil
+}
+
+func (s *stubEC2) ModifyImageAttribute(_ context.Context, params *ec2.ModifyImageAttributeInput, _ ...func(*ec2.Options),
+) (*ec2.ModifyImageAttributeOutput, error) {
+	s.modified = append(s.modified, params)
+	return &ec2.ModifyImageAttributeOutput{}, nil
+}
+
+func (s *stubEC2) DescribeImportSnapshotTasks(_ context.Context, params *ec2.DescribeImportSnapshotTasksInput, _ ...func(*ec2.Options),
+) (*ec2.DescribeImportSnapshotTasksOutput, error) {
+	if s.describeErr != nil {
+		return nil, s.describeErr
+	}
+	return &ec2.DescribeImportSnapshotTasksOutput{
+		ImportSnapshotTasks: []ec2types.ImportSnapshotTask{{
+			ImportTaskId: toPtr(params.ImportTaskIds[0]),
+			SnapshotTaskDetail: &ec2types.SnapshotTaskDetail{
+				Status:     toPtr(s.status),
+				SnapshotId: toPtr("snap-1"),
+			},
+		}},
+	}, nil
+}
+
+func (s *stubEC2) CancelImportTask(ctx context.Context, params *ec2.CancelImportTaskInput, _ ...func(*ec2.Options),
+) (*ec2.CancelImportTaskOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.canceled = append(s.canceled, *params.ImportTaskId)
+	return &ec2.CancelImportTaskOutput{}, nil
+}
+
+// stubS3Uploader records the last uploaded object.
+type stubS3Uploader struct {
+	input *s3.PutObjectInput
+}
+
+func (s *stubS3Uploader) Upload(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3manager.Uploader),
+) (*s3manager.UploadOutput, error) {
+	s.input = input
+	return &s3manager.UploadOutput{}, nil
+}
+
+type stubS3 struct {
+	s3API
+	publicAccessBlock *s3types.PublicAccessBlockConfiguration
+	location          s3types.BucketLocationConstraint
+	err               error
+}
+
+func (s *stubS3) GetBucketLocation(context.Context, *s3.GetBucketLocationInput, ...func(*s3.Options),
+) (*s3.GetBucketLocationOutput, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &s3.GetBucketLocationOutput{LocationConstraint: s.location}, nil
+}
+
+func (s *stubS3) GetPublicAccessBlock(context.Context, *s3.GetPublicAccessBlockInput, ...func(*s3.Options),
+) (*s3.GetPublicAccessBlockOutput, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &s3.GetPublicAccessBlockOutput{PublicAccessBlockConfiguration: s.publicAccessBlock}, nil
+}
+
+type stubSTS struct {
+	err error
+}
+
+func (s *stubSTS) GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, ...func(*sts.Options),
+) (*sts.GetCallerIdentityOutput, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &sts.GetCallerIdentityOutput{Account: toPtr("123456789012"), Arn: toPtr("arn:aws:iam::123456789012:user/uplosi")}, nil
+}
+
+// fakeClock advances by the slept duration instead of waiting.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.now.Sub(t)
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func TestUploadMock(t *testing.T) {
+	assert := assert.New(t)
+	conf := config.Config{
+		Provider:     "aws",
+		Name:         "my-image",
+		ImageVersion: "1.0.0",
+		AWS: config.AWSConfig{
+			Region:             "us-east-1",
+			ReplicationRegions: []string{"eu-central-1"},
+			Bucket:             "my-bucket",
+			Publish:            config.Some(true),
+		},
+	}
+	assert.NoError(conf.SetDefaults())
+	assert.NoError(conf.Render(func(string) ([]byte, error) { return nil, nil }))
+	rec := &provider.Recorder{}
+	u, err := NewUploader(conf, WithProviderOptions(provider.WithMock(rec)))
+	assert.NoError(err)
+	assert.True(u.Mocked())
+
+	image := bytes.Repeat([]byte{0xaa}, 4096)
+	refs, err := u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+	assert.NoError(err)
+	assert.Len(refs, 2)
+	assert.Contains(refs[0], "arn:aws:ec2:us-east-1:"+mockAccountID+":image/ami-")
+	assert.Contains(refs[1], "arn:aws:ec2:eu-central-1:"+mockAccountID+":image/ami-")
+	assert.Len(u.Checksums(), 2)
+	ops := mockOperations(rec.Calls())
+	assert.Contains(ops, "s3.PutObject")
+	assert.Contains(ops, "ec2.ImportSnapshot")
+	assert.Contains(ops, "ec2.RegisterImage")
+	assert.Contains(ops, "ec2.CopyImage")
+	assert.Contains(ops, "ec2.ModifyImageAttribute")
+	assert.NotContains(ops, "ec2.DeregisterImage")
+
+	// Uploading again replaces the images of the first upload.
+	_, err = u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+	assert.NoError(err)
+	assert.Contains(mockOperations(rec.Calls()), "ec2.DeregisterImage")
+
+	versions, err := u.ImageVersions(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"1.0.0"}, versions)
+}
+
+func mockOperations(calls []provider.Call) []string {
+	ops := make([]string, 0, len(calls))
+	for _, call := range calls {
+		ops = append(ops, call.Operation)
+	}
+	return ops
+}
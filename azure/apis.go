@@ -61,6 +61,9 @@ type azureGalleriesAPI interface {
 	) (armcomputev5.GalleriesClientGetResponse, error)
 	NewListPager(options *armcomputev5.GalleriesClientListOptions,
 	) *runtime.Pager[armcomputev5.GalleriesClientListResponse]
+	NewListByResourceGroupPager(resourceGroupName string,
+		options *armcomputev5.GalleriesClientListByResourceGroupOptions,
+	) *runtime.Pager[armcomputev5.GalleriesClientListByResourceGroupResponse]
 	BeginCreateOrUpdate(ctx context.Context, resourceGroupName string,
 		galleryName string, gallery armcomputev5.Gallery,
 		options *armcomputev5.GalleriesClientBeginCreateOrUpdateOptions,
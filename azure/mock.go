@@ -0,0 +1,422 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	armcomputev5 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+// useMock replaces the API clients and the credential with in-memory fakes that record their calls in rec.
+func (u *Uploader) useMock(rec *provider.Recorder) {
+	cloud := &mockCloud{
+		rec:            rec,
+		subscriptionID: u.config.Azure.SubscriptionID,
+		disks:          make(map[string]armcomputev5.Disk),
+		managedImages:  make(map[string]armcomputev5.Image),
+		galleries:      make(map[string]armcomputev5.Gallery),
+		definitions:    make(map[string]armcomputev5.GalleryImage),
+		versions:       make(map[string]armcomputev5.GalleryImageVersion),
+	}
+	u.cred = &mockCredential{cloud: cloud}
+	u.disks = &mockDisks{cloud: cloud}
+	u.managedImages = &mockManagedImages{cloud: cloud}
+	u.galleries = &mockGalleries{cloud: cloud}
+	u.image = &mockGalleryImages{cloud: cloud}
+	u.imageVersions = &mockImageVersions{cloud: cloud}
+	u.communityVersions = &mockCommunityVersions{cloud: cloud}
+	u.gallerySharing = &mockGallerySharing{cloud: cloud}
+	u.blob = func(sasBlobURL string) (azurePageblobAPI, error) {
+		return &mockPageblob{cloud: cloud, url: sasBlobURL}, nil
+	}
+}
+
+// Mocked reports whether the uploader uses fake API clients, see provider.WithMock.
+func (u *Uploader) Mocked() bool {
+	return u.opts.Mock != nil
+}
+
+// mockCloud is the state shared by the fake API clients of an uploader.
+// Resources are keyed by their resource group and name, separated by slashes.
+type mockCloud struct {
+	rec            *provider.Recorder
+	subscriptionID string
+
+	mux           sync.Mutex
+	disks         map[string]armcomputev5.Disk
+	managedImages map[string]armcomputev5.Image
+	galleries     map[string]armcomputev5.Gallery
+	definitions   map[string]armcomputev5.GalleryImage
+	versions      map[string]armcomputev5.GalleryImageVersion
+}
+
+// record records the call and locks the state until the returned function is called.
+func (c *mockCloud) record(operation string, input any) func() {
+	c.rec.Record(string(config.ProviderAzure), operation, input)
+	c.mux.Lock()
+	return c.mux.Unlock
+}
+
+// resourceID returns the ID of a compute resource in the resource group.
+// The type and name alternate in names, e.g. "galleries", "my-gallery", "images", "my-image".
+func (c *mockCloud) resourceID(rg string, names ...string) *string {
+	id := path.Join(append([]string{"/subscriptions", c.subscriptionID, "resourceGroups", rg, "providers/Microsoft.Compute"}, names...)...)
+	return &id
+}
+
+// mockNotFound is the error the fake APIs return for resources that don't exist.
+func mockNotFound(name string) error {
+	return &azcore.ResponseError{ErrorCode: "ResourceNotFound", StatusCode: http.StatusNotFound, RawResponse: &http.Response{
+		StatusCode: http.StatusNotFound,
+		Status:     fmt.Sprintf("%d resource %s not found", http.StatusNotFound, name),
+	}}
+}
+
+// mockPoller is a long-running operation that is done immediately.
+type mockPoller[T any] struct {
+	result T
+}
+
+func newMockPoller[T any](result T) (*runtime.Poller[T], error) {
+	return runtime.NewPoller(nil, runtime.Pipeline{}, &runtime.NewPollerOptions[T]{Handler: &mockPoller[T]{result: result}})
+}
+
+func (p *mockPoller[T]) Done() bool {
+	return true
+}
+
+func (p *mockPoller[T]) Poll(context.Context) (*http.Response, error) {
+	return nil, nil
+}
+
+func (p *mockPoller[T]) Result(_ context.Context, out *T) error {
+	*out = p.result
+	return nil
+}
+
+// newMockPager returns a pager with a single page.
+func newMockPager[T any](page T) *runtime.Pager[T] {
+	return runtime.NewPager(runtime.PagingHandler[T]{
+		More: func(T) bool { return false },
+		Fetcher: func(context.Context, *T) (T, error) {
+			return page, nil
+		},
+	})
+}
+
+type mockCredential struct {
+	cloud *mockCloud
+}
+
+func (c *mockCredential) GetToken(_ context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	defer c.cloud.record("credential.GetToken", opts)()
+	return azcore.AccessToken{Token: "mock-token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+type mockDisks struct {
+	cloud *mockCloud
+}
+
+func (m *mockDisks) Get(_ context.Context, rg string, diskName string, _ *armcomputev5.DisksClientGetOptions,
+) (armcomputev5.DisksClientGetResponse, error) {
+	defer m.cloud.record("disks.Get", path.Join(rg, diskName))()
+	disk, ok := m.cloud.disks[path.Join(rg, diskName)]
+	if !ok {
+		return armcomputev5.DisksClientGetResponse{}, mockNotFound(diskName)
+	}
+	return armcomputev5.DisksClientGetResponse{Disk: disk}, nil
+}
+
+func (m *mockDisks) BeginCreateOrUpdate(_ context.Context, rg string, diskName string, disk armcomputev5.Disk,
+	_ *armcomputev5.DisksClientBeginCreateOrUpdateOptions,
+) (*runtime.Poller[armcomputev5.DisksClientCreateOrUpdateResponse], error) {
+	defer m.cloud.record("disks.BeginCreateOrUpdate", disk)()
+	disk.ID = m.cloud.resourceID(rg, "disks", diskName)
+	disk.Name = &diskName
+	m.cloud.disks[path.Join(rg, diskName)] = disk
+	return newMockPoller(armcomputev5.DisksClientCreateOrUpdateResponse{Disk: disk})
+}
+
+func (m *mockDisks) BeginDelete(_ context.Context, rg string, diskName string, _ *armcomputev5.DisksClientBeginDeleteOptions,
+) (*runtime.Poller[armcomputev5.DisksClientDeleteResponse], error) {
+	defer m.cloud.record("disks.BeginDelete", path.Join(rg, diskName))()
+	delete(m.cloud.disks, path.Join(rg, diskName))
+	return newMockPoller(armcomputev5.DisksClientDeleteResponse{})
+}
+
+func (m *mockDisks) BeginGrantAccess(_ context.Context, rg string, diskName string, grantAccessData armcomputev5.GrantAccessData,
+	_ *armcomputev5.DisksClientBeginGrantAccessOptions,
+) (*runtime.Poller[armcomputev5.DisksClientGrantAccessResponse], error) {
+	defer m.cloud.record("disks.BeginGrantAccess", grantAccessData)()
+	if _, ok := m.cloud.disks[path.Join(rg, diskName)]; !ok {
+		return nil, mockNotFound(diskName)
+	}
+	access := armcomputev5.AccessURI{
+		AccessSAS: toPtr(fmt.Sprintf("https://mock.blob.core.windows.net/%s/abcd?sv=mock", diskName)),
+	}
+	if grantAccessData.GetSecureVMGuestStateSAS != nil && *grantAccessData.GetSecureVMGuestStateSAS {
+		access.SecurityDataAccessSAS = toPtr(fmt.Sprintf("https://mock.blob.core.windows.net/%s/vmgs?sv=mock", diskName))
+	}
+	return newMockPoller(armcomputev5.DisksClientGrantAccessResponse{AccessURI: access})
+}
+
+func (m *mockDisks) BeginRevokeAccess(_ context.Context, rg string, diskName string, _ *armcomputev5.DisksClientBeginRevokeAccessOptions,
+) (*runtime.Poller[armcomputev5.DisksClientRevokeAccessResponse], error) {
+	defer m.cloud.record("disks.BeginRevokeAccess", path.Join(rg, diskName))()
+	return newMockPoller(armcomputev5.DisksClientRevokeAccessResponse{})
+}
+
+type mockManagedImages struct {
+	cloud *mockCloud
+}
+
+func (m *mockManagedImages) Get(_ context.Context, rg string, imageName string, _ *armcomputev5.ImagesClientGetOptions,
+) (armcomputev5.ImagesClientGetResponse, error) {
+	defer m.cloud.record("images.Get", path.Join(rg, imageName))()
+	image, ok := m.cloud.managedImages[path.Join(rg, imageName)]
+	if !ok {
+		return armcomputev5.ImagesClientGetResponse{}, mockNotFound(imageName)
+	}
+	return armcomputev5.ImagesClientGetResponse{Image: image}, nil
+}
+
+func (m *mockManagedImages) BeginCreateOrUpdate(_ context.Context, rg string, imageName string, parameters armcomputev5.Image,
+	_ *armcomputev5.ImagesClientBeginCreateOrUpdateOptions,
+) (*runtime.Poller[armcomputev5.ImagesClientCreateOrUpdateResponse], error) {
+	defer m.cloud.record("images.BeginCreateOrUpdate", parameters)()
+	parameters.ID = m.cloud.resourceID(rg, "images", imageName)
+	parameters.Name = &imageName
+	m.cloud.managedImages[path.Join(rg, imageName)] = parameters
+	return newMockPoller(armcomputev5.ImagesClientCreateOrUpdateResponse{Image: parameters})
+}
+
+func (m *mockManagedImages) BeginDelete(_ context.Context, rg string, imageName string, _ *armcomputev5.ImagesClientBeginDeleteOptions,
+) (*runtime.Poller[armcomputev5.ImagesClientDeleteResponse], error) {
+	defer m.cloud.record("images.BeginDelete", path.Join(rg, imageName))()
+	delete(m.cloud.managedImages, path.Join(rg, imageName))
+	return newMockPoller(armcomputev5.ImagesClientDeleteResponse{})
+}
+
+type mockGalleries struct {
+	cloud *mockCloud
+}
+
+func (m *mockGalleries) Get(_ context.Context, rg string, galleryName string, _ *armcomputev5.GalleriesClientGetOptions,
+) (armcomputev5.GalleriesClientGetResponse, error) {
+	defer m.cloud.record("galleries.Get", path.Join(rg, galleryName))()
+	gallery, ok := m.cloud.galleries[path.Join(rg, galleryName)]
+	if !ok {
+		return armcomputev5.GalleriesClientGetResponse{}, mockNotFound(galleryName)
+	}
+	return armcomputev5.GalleriesClientGetResponse{Gallery: gallery}, nil
+}
+
+func (m *mockGalleries) NewListPager(_ *armcomputev5.GalleriesClientListOptions,
+) *runtime.Pager[armcomputev5.GalleriesClientListResponse] {
+	defer m.cloud.record("galleries.List", nil)()
+	var page armcomputev5.GalleriesClientListResponse
+	for _, gallery := range m.cloud.galleries {
+		page.Value = append(page.Value, &gallery)
+	}
+	return newMockPager(page)
+}
+
+func (m *mockGalleries) NewListByResourceGroupPager(rg string, _ *armcomputev5.GalleriesClientListByResourceGroupOptions,
+) *runtime.Pager[armcomputev5.GalleriesClientListByResourceGroupResponse] {
+	defer m.cloud.record("galleries.ListByResourceGroup", rg)()
+	var page armcomputev5.GalleriesClientListByResourceGroupResponse
+	for key, gallery := range m.cloud.galleries {
+		if path.Dir(key) == rg {
+			page.Value = append(page.Value, &gallery)
+		}
+	}
+	return newMockPager(page)
+}
+
+func (m *mockGalleries) BeginCreateOrUpdate(_ context.Context, rg string, galleryName string, gallery armcomputev5.Gallery,
+	_ *armcomputev5.GalleriesClientBeginCreateOrUpdateOptions,
+) (*runtime.Poller[armcomputev5.GalleriesClientCreateOrUpdateResponse], error) {
+	defer m.cloud.record("galleries.BeginCreateOrUpdate", gallery)()
+	gallery.ID = m.cloud.resourceID(rg, "galleries", galleryName)
+	gallery.Name = &galleryName
+	m.cloud.galleries[path.Join(rg, galleryName)] = gallery
+	return newMockPoller(armcomputev5.GalleriesClientCreateOrUpdateResponse{Gallery: gallery})
+}
+
+type mockGallerySharing struct {
+	cloud *mockCloud
+}
+
+// BeginUpdate enables community sharing of the gallery with a public name derived from its name prefix.
+func (m *mockGallerySharing) BeginUpdate(_ context.Context, rg string, galleryName string, sharingUpdate armcomputev5.SharingUpdate,
+	_ *armcomputev5.GallerySharingProfileClientBeginUpdateOptions,
+) (*runtime.Poller[armcomputev5.GallerySharingProfileClientUpdateResponse], error) {
+	defer m.cloud.record("gallerySharingProfile.BeginUpdate", sharingUpdate)()
+	gallery, ok := m.cloud.galleries[path.Join(rg, galleryName)]
+	if !ok {
+		return nil, mockNotFound(galleryName)
+	}
+	info := gallery.Properties.SharingProfile.CommunityGalleryInfo
+	if info != nil && sharingUpdate.OperationType != nil &&
+		*sharingUpdate.OperationType == armcomputev5.SharingUpdateOperationTypesEnableCommunity {
+		info.CommunityGalleryEnabled = toPtr(true)
+		info.PublicNames = []*string{toPtr(*info.PublicNamePrefix + "-00000000-0000-0000-0000-000000000000")}
+	}
+	return newMockPoller(armcomputev5.GallerySharingProfileClientUpdateResponse{SharingUpdate: sharingUpdate})
+}
+
+type mockGalleryImages struct {
+	cloud *mockCloud
+}
+
+func (m *mockGalleryImages) Get(_ context.Context, rg string, galleryName string, galleryImageName string,
+	_ *armcomputev5.GalleryImagesClientGetOptions,
+) (armcomputev5.GalleryImagesClientGetResponse, error) {
+	defer m.cloud.record("galleryImages.Get", path.Join(rg, galleryName, galleryImageName))()
+	image, ok := m.cloud.definitions[path.Join(rg, galleryName, galleryImageName)]
+	if !ok {
+		return armcomputev5.GalleryImagesClientGetResponse{}, mockNotFound(galleryImageName)
+	}
+	return armcomputev5.GalleryImagesClientGetResponse{GalleryImage: image}, nil
+}
+
+func (m *mockGalleryImages) BeginCreateOrUpdate(_ context.Context, rg string, galleryName string, galleryImageName string,
+	galleryImage armcomputev5.GalleryImage, _ *armcomputev5.GalleryImagesClientBeginCreateOrUpdateOptions,
+) (*runtime.Poller[armcomputev5.GalleryImagesClientCreateOrUpdateResponse], error) {
+	defer m.cloud.record("galleryImages.BeginCreateOrUpdate", galleryImage)()
+	if _, ok := m.cloud.galleries[path.Join(rg, galleryName)]; !ok {
+		return nil, mockNotFound(galleryName)
+	}
+	galleryImage.ID = m.cloud.resourceID(rg, "galleries", galleryName, "images", galleryImageName)
+	galleryImage.Name = &galleryImageName
+	m.cloud.definitions[path.Join(rg, galleryName, galleryImageName)] = galleryImage
+	return newMockPoller(armcomputev5.GalleryImagesClientCreateOrUpdateResponse{GalleryImage: galleryImage})
+}
+
+func (m *mockGalleryImages) BeginDelete(_ context.Context, rg string, galleryName string, galleryImageName string,
+	_ *armcomputev5.GalleryImagesClientBeginDeleteOptions,
+) (*runtime.Poller[armcomputev5.GalleryImagesClientDeleteResponse], error) {
+	defer m.cloud.record("galleryImages.BeginDelete", path.Join(rg, galleryName, galleryImageName))()
+	delete(m.cloud.definitions, path.Join(rg, galleryName, galleryImageName))
+	return newMockPoller(armcomputev5.GalleryImagesClientDeleteResponse{})
+}
+
+type mockImageVersions struct {
+	cloud *mockCloud
+}
+
+// Get returns the image version. Its replication to all target regions is always completed.
+func (m *mockImageVersions) Get(_ context.Context, rg string, galleryName string, galleryImageName string, galleryImageVersionName string,
+	_ *armcomputev5.GalleryImageVersionsClientGetOptions,
+) (armcomputev5.GalleryImageVersionsClientGetResponse, error) {
+	key := path.Join(rg, galleryName, galleryImageName, galleryImageVersionName)
+	defer m.cloud.record("galleryImageVersions.Get", key)()
+	version, ok := m.cloud.versions[key]
+	if !ok {
+		return armcomputev5.GalleryImageVersionsClientGetResponse{}, mockNotFound(galleryImageVersionName)
+	}
+	status := &armcomputev5.ReplicationStatus{AggregatedState: toPtr(armcomputev5.AggregatedReplicationStateCompleted)}
+	for _, region := range version.Properties.PublishingProfile.TargetRegions {
+		status.Summary = append(status.Summary, &armcomputev5.RegionalReplicationStatus{
+			Region:   region.Name,
+			State:    toPtr(armcomputev5.ReplicationStateCompleted),
+			Progress: toPtr[int32](100),
+		})
+	}
+	version.Properties.ReplicationStatus = status
+	return armcomputev5.GalleryImageVersionsClientGetResponse{GalleryImageVersion: version}, nil
+}
+
+func (m *mockImageVersions) NewListByGalleryImagePager(rg string, galleryName string, galleryImageName string,
+	_ *armcomputev5.GalleryImageVersionsClientListByGalleryImageOptions,
+) *runtime.Pager[armcomputev5.GalleryImageVersionsClientListByGalleryImageResponse] {
+	defer m.cloud.record("galleryImageVersions.ListByGalleryImage", path.Join(rg, galleryName, galleryImageName))()
+	var page armcomputev5.GalleryImageVersionsClientListByGalleryImageResponse
+	for key, version := range m.cloud.versions {
+		if path.Dir(key) == path.Join(rg, galleryName, galleryImageName) {
+			page.Value = append(page.Value, &version)
+		}
+	}
+	return newMockPager(page)
+}
+
+func (m *mockImageVersions) BeginCreateOrUpdate(_ context.Context, rg string, galleryName string, galleryImageName string,
+	galleryImageVersionName string, galleryImageVersion armcomputev5.GalleryImageVersion,
+	_ *armcomputev5.GalleryImageVersionsClientBeginCreateOrUpdateOptions,
+) (*runtime.Poller[armcomputev5.GalleryImageVersionsClientCreateOrUpdateResponse], error) {
+	defer m.cloud.record("galleryImageVersions.BeginCreateOrUpdate", galleryImageVersion)()
+	if _, ok := m.cloud.definitions[path.Join(rg, galleryName, galleryImageName)]; !ok {
+		return nil, mockNotFound(galleryImageName)
+	}
+	galleryImageVersion.ID = m.cloud.resourceID(rg,
+		"galleries", galleryName, "images", galleryImageName, "versions", galleryImageVersionName)
+	galleryImageVersion.Name = &galleryImageVersionName
+	m.cloud.versions[path.Join(rg, galleryName, galleryImageName, galleryImageVersionName)] = galleryImageVersion
+	return newMockPoller(armcomputev5.GalleryImageVersionsClientCreateOrUpdateResponse{GalleryImageVersion: galleryImageVersion})
+}
+
+func (m *mockImageVersions) BeginDelete(_ context.Context, rg string, galleryName string, galleryImageName string,
+	galleryImageVersionName string, _ *armcomputev5.GalleryImageVersionsClientBeginDeleteOptions,
+) (*runtime.Poller[armcomputev5.GalleryImageVersionsClientDeleteResponse], error) {
+	key := path.Join(rg, galleryName, galleryImageName, galleryImageVersionName)
+	defer m.cloud.record("galleryImageVersions.BeginDelete", key)()
+	delete(m.cloud.versions, key)
+	return newMockPoller(armcomputev5.GalleryImageVersionsClientDeleteResponse{})
+}
+
+type mockCommunityVersions struct {
+	cloud *mockCloud
+}
+
+func (m *mockCommunityVersions) Get(_ context.Context, location string,
+	publicGalleryName, galleryImageName, galleryImageVersionName string,
+	_ *armcomputev5.CommunityGalleryImageVersionsClientGetOptions,
+) (armcomputev5.CommunityGalleryImageVersionsClientGetResponse, error) {
+	defer m.cloud.record("communityGalleryImageVersions.Get", path.Join(location, publicGalleryName, galleryImageName, galleryImageVersionName))()
+	id := path.Join("/CommunityGalleries", publicGalleryName, "Images", galleryImageName, "Versions", galleryImageVersionName)
+	return armcomputev5.CommunityGalleryImageVersionsClientGetResponse{
+		CommunityGalleryImageVersion: armcomputev5.CommunityGalleryImageVersion{
+			Name:       &galleryImageVersionName,
+			Location:   &location,
+			Identifier: &armcomputev5.CommunityGalleryIdentifier{UniqueID: &id},
+		},
+	}, nil
+}
+
+// mockPageblob is the fake page blob behind a SAS URL. It reads the pages, but doesn't store them.
+type mockPageblob struct {
+	cloud *mockCloud
+	url   string
+}
+
+func (m *mockPageblob) UploadPages(_ context.Context, body io.ReadSeekCloser, contentRange blob.HTTPRange,
+	_ *pageblob.UploadPagesOptions,
+) (pageblob.UploadPagesResponse, error) {
+	m.cloud.rec.Record(string(config.ProviderAzure), "pageblob.UploadPages", contentRange)
+	n, err := io.Copy(io.Discard, body)
+	if err != nil {
+		return pageblob.UploadPagesResponse{}, fmt.Errorf("reading pages: %w", err)
+	}
+	if n != contentRange.Count {
+		return pageblob.UploadPagesResponse{}, fmt.Errorf("uploading pages to %s: body has %d bytes, range has %d", m.url, n, contentRange.Count)
+	}
+	return pageblob.UploadPagesResponse{}, nil
+}
@@ -9,19 +9,27 @@ package azure
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	armcomputev5 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
 	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
 )
 
 const (
@@ -29,11 +37,18 @@ const (
 	uploadAccessDuration = 86400   // 24 hours
 	pageSizeMax          = 4194304 // 4MiB
 	pageSizeMin          = 512     // 512 bytes
+
+	// replicationTimeout is how long to wait for the replication of an image version to all target regions.
+	replicationTimeout = 3 * time.Hour
+
+	// armTokenScope is the scope of tokens for the Azure Resource Manager.
+	armTokenScope = "https://management.azure.com/.default"
 )
 
 // Uploader can upload and remove os images on Azure.
 type Uploader struct {
 	config           config.Config
+	cred             azcore.TokenCredential
 	pollingFrequency time.Duration
 	pollOpts         *runtime.PollUntilDoneOptions
 
@@ -46,66 +61,199 @@ type Uploader struct {
 	communityVersions azureCommunityGalleryImageVersionAPI
 	gallerySharing    azureGallerySharingProfileAPI
 
-	log *log.Logger
+	httpClient *http.Client
+	confirm    config.ConfirmFunc
+	log        *slog.Logger
+	steps      provider.StepTimer
+	checksums  map[string]string
+	opts       provider.Options
+	// expiresAt is the expiry time of the current upload, or zero if the config has no TTL.
+	expiresAt time.Time
+	// endOfLife is the end of life date of the current image version, or zero if none is configured.
+	endOfLife time.Time
+	// replicationProgress is called with the replication progress of every region while waiting for replication.
+	replicationProgress ReplicationProgressFunc
+}
+
+// Option configures an Uploader.
+type Option func(*Uploader)
+
+// WithLogger sets the structured logger used by the uploader.
+// By default, log output is discarded.
+func WithLogger(log *slog.Logger) Option {
+	return func(u *Uploader) {
+		u.log = log.With("provider", "azure")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to communicate with the Azure APIs,
+// e.g. to use a proxy or custom CA certificates.
+// By default, the SDK's default client is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(u *Uploader) {
+		u.httpClient = client
+	}
+}
+
+// WithProviderOptions sets the options shared by all providers, like provider.WithMetrics or provider.WithClock.
+func WithProviderOptions(opts ...provider.Option) Option {
+	return func(u *Uploader) {
+		u.opts.Apply(opts...)
+	}
+}
+
+// WithConfirm sets a callback that approves overwriting existing images
+// before they are deleted, and uploading images to a community gallery, which publishes them.
+// Declining either action aborts the upload with config.ErrNotConfirmed.
+// By default, all actions are performed without confirmation.
+func WithConfirm(confirm config.ConfirmFunc) Option {
+	return func(u *Uploader) {
+		u.confirm = confirm
+	}
+}
+
+// ReplicationProgressFunc receives the replication state of a region
+// (e.g. Replicating or Completed) and its progress in percent.
+type ReplicationProgressFunc func(region, state string, progress int)
+
+// WithReplicationProgress sets a function that is called with the replication progress of every target region
+// while waiting for the replication of the image version, if azure.waitForReplication is enabled.
+func WithReplicationProgress(fn ReplicationProgressFunc) Option {
+	return func(u *Uploader) {
+		u.replicationProgress = fn
+	}
 }
 
 // NewUploader creates a new config.
-func NewUploader(config config.Config, log *log.Logger) (*Uploader, error) {
+func NewUploader(config config.Config, opts ...Option) (*Uploader, error) {
+	u := &Uploader{
+		config:           config,
+		pollingFrequency: pollingFrequency,
+		pollOpts:         &runtime.PollUntilDoneOptions{Frequency: pollingFrequency},
+		log:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts:             provider.NewOptions(),
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+	if u.opts.Mock != nil {
+		u.useMock(u.opts.Mock)
+		return u, nil
+	}
+
 	subscriptionID := config.Azure.SubscriptionID
+	clientOpts := u.clientOptions()
+	armOpts := &arm.ClientOptions{ClientOptions: clientOpts}
 
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	cred, err := azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{ClientOptions: clientOpts})
 	if err != nil {
 		return nil, err
 	}
-	diskClient, err := armcomputev5.NewDisksClient(subscriptionID, cred, nil)
+	u.cred = cred
+	u.disks, err = armcomputev5.NewDisksClient(subscriptionID, cred, armOpts)
 	if err != nil {
 		return nil, err
 	}
-	managedImagesClient, err := armcomputev5.NewImagesClient(subscriptionID, cred, nil)
+	u.managedImages, err = armcomputev5.NewImagesClient(subscriptionID, cred, armOpts)
 	if err != nil {
 		return nil, err
 	}
-	galleriesClient, err := armcomputev5.NewGalleriesClient(subscriptionID, cred, nil)
+	u.galleries, err = armcomputev5.NewGalleriesClient(subscriptionID, cred, armOpts)
 	if err != nil {
 		return nil, err
 	}
-	galleriesImageClient, err := armcomputev5.NewGalleryImagesClient(subscriptionID, cred, nil)
+	u.image, err = armcomputev5.NewGalleryImagesClient(subscriptionID, cred, armOpts)
 	if err != nil {
 		return nil, err
 	}
-	galleriesImageVersionClient, err := armcomputev5.NewGalleryImageVersionsClient(subscriptionID, cred, nil)
+	u.imageVersions, err = armcomputev5.NewGalleryImageVersionsClient(subscriptionID, cred, armOpts)
 	if err != nil {
 		return nil, err
 	}
-	communityImageVersionClient, err := armcomputev5.NewCommunityGalleryImageVersionsClient(subscriptionID, cred, nil)
+	u.communityVersions, err = armcomputev5.NewCommunityGalleryImageVersionsClient(subscriptionID, cred, armOpts)
 	if err != nil {
 		return nil, err
 	}
-	gallerySharingClient, err := armcomputev5.NewGallerySharingProfileClient(subscriptionID, cred, nil)
+	u.gallerySharing, err = armcomputev5.NewGallerySharingProfileClient(subscriptionID, cred, armOpts)
 	if err != nil {
 		return nil, err
 	}
+	u.blob = func(sasBlobURL string) (azurePageblobAPI, error) {
+		return pageblob.NewClientWithNoCredential(sasBlobURL, &pageblob.ClientOptions{ClientOptions: clientOpts})
+	}
+	return u, nil
+}
 
-	return &Uploader{
-		config:           config,
-		pollingFrequency: pollingFrequency,
-		pollOpts:         &runtime.PollUntilDoneOptions{Frequency: pollingFrequency},
-		disks:            diskClient,
-		managedImages:    managedImagesClient,
-		blob: func(sasBlobURL string) (azurePageblobAPI, error) {
-			return pageblob.NewClientWithNoCredential(sasBlobURL, nil)
-		},
-		galleries:         galleriesClient,
-		image:             galleriesImageClient,
-		imageVersions:     galleriesImageVersionClient,
-		communityVersions: communityImageVersionClient,
-		gallerySharing:    gallerySharingClient,
-		log:               log,
-	}, nil
+// clientOptions returns the options shared by all Azure SDK clients.
+func (u *Uploader) clientOptions() azcore.ClientOptions {
+	var opts azcore.ClientOptions
+	if u.httpClient != nil {
+		opts.Transport = u.httpClient
+	}
+	return opts
+}
+
+// Preflight acquires a token for the Azure Resource Manager and lists the image galleries of the resource group,
+// which verifies that the subscription and the resource group are accessible.
+func (u *Uploader) Preflight(ctx context.Context) error {
+	if _, err := u.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{armTokenScope}}); err != nil {
+		return fmt.Errorf("acquiring token: %w: log in with \"az login\" or configure a service principal or managed identity: %w",
+			provider.ErrPermissionDenied, err)
+	}
+	rg := u.config.Azure.ResourceGroup
+	pager := u.galleries.NewListByResourceGroupPager(rg, nil)
+	if _, err := pager.NextPage(ctx); err != nil {
+		return preflightError(err, fmt.Sprintf("listing image galleries of resource group %s in subscription %s", rg, u.config.Azure.SubscriptionID))
+	}
+	return nil
+}
+
+// preflightError marks errors caused by missing permissions with provider.ErrPermissionDenied
+// and adds a hint on how to fix them.
+func preflightError(err error, action string) error {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("%s: %w: assign a role with write access to the resource group, e.g. Contributor: %w",
+				action, provider.ErrPermissionDenied, err)
+		case http.StatusNotFound:
+			return fmt.Errorf("%s: check that subscriptionID and resourceGroup exist: %w", action, err)
+		}
+	}
+	return fmt.Errorf("%s: %w", action, err)
 }
 
 // Upload uploads an OS image to Azure.
 func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, size int64) (refs []string, retErr error) {
+	u.steps = provider.NewStepTimer(string(config.ProviderAzure), u.opts, u.log)
+	u.checksums = nil
+	size, err := provider.ImageSize(image, size)
+	defer func() { provider.RecordUpload(u.opts.Metrics, string(config.ProviderAzure), size, retErr) }()
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	image, err = provider.EnforceSize(image, size)
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := provider.RequireRaw(image); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := provider.CheckOSDiskSize(u.config.Azure.OSDiskSizeGB, size); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	u.expiresAt, err = u.config.ExpiresAt(u.opts.Clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	u.endOfLife, err = endOfLifeDate(u.config.Azure, u.opts.Clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := u.confirmPublish(); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
 	// Ensure new image can be uploaded by deleting existing resources using the same name.
 	if err := u.ensureImageVersionDeleted(ctx); err != nil {
 		return nil, fmt.Errorf("pre-cleaning: ensuring no image version using the same name exists: %w", err)
@@ -126,11 +274,13 @@ func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, size int64)
 		return nil, fmt.Errorf("ensuring image definition exists: %w", err)
 	}
 
+	stepDone := u.steps.Start("upload")
 	vhdReader := newVHDReader(image, uint64(size), [16]byte{}, time.Time{})
 	diskID, err := u.createDisk(ctx, DiskTypeNormal, vhdReader, nil, int64(vhdReader.ContainerSize()))
 	if err != nil {
 		return nil, fmt.Errorf("creating disk: %w", err)
 	}
+	stepDone()
 	defer func(retErr *error) {
 		// cleanup temp disk
 		if err := u.ensureDiskDeleted(ctx); err != nil {
@@ -138,14 +288,24 @@ func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, size int64)
 		}
 	}(&retErr)
 
+	stepDone = u.steps.Start("create")
 	managedImageID, err := u.createManagedImage(ctx, diskID)
 	if err != nil {
 		return nil, fmt.Errorf("creating managed image: %w", err)
 	}
+	stepDone()
+	// Creating the image version includes replicating it to all target regions.
+	stepDone = u.steps.Start("replicate")
 	unsharedImageVersionID, err := u.createImageVersion(ctx, managedImageID)
 	if err != nil {
 		return nil, fmt.Errorf("creating image version: %w", err)
 	}
+	if u.config.Azure.WaitForReplication.UnwrapOr(false) {
+		if err := u.waitForReplication(ctx); err != nil {
+			return nil, fmt.Errorf("waiting for replication: %w", err)
+		}
+	}
+	stepDone()
 
 	imageReference, err := u.getImageReference(ctx, unsharedImageVersionID)
 	if err != nil {
@@ -155,12 +315,22 @@ func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, size int64)
 	return []string{imageReference}, nil
 }
 
+// StepDurations returns how long each step of the last upload took, keyed by step name.
+func (u *Uploader) StepDurations() map[string]time.Duration {
+	return u.steps.Durations()
+}
+
+// Checksums returns the checksums of the os image uploaded by the last upload, keyed by algorithm.
+func (u *Uploader) Checksums() map[string]string {
+	return maps.Clone(u.checksums)
+}
+
 // createDisk creates and initializes (uploads contents of) an azure disk.
 func (u *Uploader) createDisk(ctx context.Context, diskType DiskType, img io.Reader, vmgs io.ReadSeeker, size int64) (string, error) {
 	rg := u.config.Azure.ResourceGroup
 	diskName := u.config.Azure.DiskName
 
-	u.log.Printf("Creating disk %s in %s", diskName, rg)
+	u.log.Info("Creating disk", "disk", diskName, "resourceGroup", rg)
 	if diskType == DiskTypeWithVMGS && vmgs == nil {
 		return "", errors.New("cannot create disk with vmgs: vmgs reader is nil")
 	}
@@ -194,7 +364,7 @@ func (u *Uploader) createDisk(ctx context.Context, diskType DiskType, img io.Rea
 		return "", fmt.Errorf("waiting for disk to be created: %w", err)
 	}
 
-	u.log.Printf("Granting temporary upload permissions via SAS token")
+	u.log.Info("Granting temporary upload permissions via SAS token", "disk", diskName)
 	accessGrant := armcomputev5.GrantAccessData{
 		Access:                   toPtr(armcomputev5.AccessLevelWrite),
 		DurationInSeconds:        toPtr(int32(uploadAccessDuration)),
@@ -209,8 +379,9 @@ func (u *Uploader) createDisk(ctx context.Context, diskType DiskType, img io.Rea
 		return "", fmt.Errorf("waiting for sas token: %w", err)
 	}
 
+	skipZeroPages := u.config.Azure.SkipZeroPages.UnwrapOr(true)
 	if requestVMGSSAS {
-		u.log.Printf("Uploading vmgs")
+		u.log.Info("Uploading vmgs", "disk", diskName)
 		vmgsSize, err := vmgs.Seek(0, io.SeekEnd)
 		if err != nil {
 			return "", err
@@ -221,18 +392,21 @@ func (u *Uploader) createDisk(ctx context.Context, diskType DiskType, img io.Rea
 		if accesPollerResp.SecurityDataAccessSAS == nil {
 			return "", errors.New("uploading vmgs: grant access returned no vmgs sas")
 		}
-		if err := uploadBlob(ctx, *accesPollerResp.SecurityDataAccessSAS, vmgs, vmgsSize, u.blob); err != nil {
+		if err := uploadBlob(ctx, *accesPollerResp.SecurityDataAccessSAS, vmgs, vmgsSize, skipZeroPages, u.blob); err != nil {
 			return "", fmt.Errorf("uploading vmgs: %w", err)
 		}
 	}
 
-	u.log.Printf("Uploading os image")
+	u.log.Info("Uploading os image", "disk", diskName, "skipZeroPages", skipZeroPages)
 	if accesPollerResp.AccessSAS == nil {
 		return "", errors.New("uploading disk: grant access returned no disk sas")
 	}
-	if err := uploadBlob(ctx, *accesPollerResp.AccessSAS, img, size, u.blob); err != nil {
+	// Pages are verified with their MD5 by Azure, the image is hashed while it is read.
+	sums := provider.NewChecksummer(provider.ChecksumMD5)
+	if err := uploadBlob(ctx, *accesPollerResp.AccessSAS, io.TeeReader(img, sums), size, skipZeroPages, u.blob); err != nil {
 		return "", fmt.Errorf("uploading image: %w", err)
 	}
+	u.checksums = sums.Sums()
 
 	revokePoller, err := u.disks.BeginRevokeAccess(ctx, rg, diskName, &armcomputev5.DisksClientBeginRevokeAccessOptions{})
 	if err != nil {
@@ -255,11 +429,11 @@ func (u *Uploader) ensureDiskDeleted(ctx context.Context) error {
 
 	getOpts := &armcomputev5.DisksClientGetOptions{}
 	if _, err := u.disks.Get(ctx, rg, diskName, getOpts); err != nil {
-		u.log.Printf("Disk %s in %s doesn't exist. Nothing to clean up.", diskName, rg)
+		u.log.Debug("Disk doesn't exist. Nothing to clean up.", "disk", diskName, "resourceGroup", rg)
 		return nil
 	}
 
-	u.log.Printf("Deleting disk %s in %s", diskName, rg)
+	u.log.Info("Deleting disk", "disk", diskName, "resourceGroup", rg)
 	deleteOpts := &armcomputev5.DisksClientBeginDeleteOptions{}
 	deletePoller, err := u.disks.BeginDelete(ctx, rg, diskName, deleteOpts)
 	if err != nil {
@@ -274,27 +448,11 @@ func (u *Uploader) ensureDiskDeleted(ctx context.Context) error {
 
 func (u *Uploader) createManagedImage(ctx context.Context, diskID string) (string, error) {
 	rg := u.config.Azure.ResourceGroup
-	location := u.config.Azure.Location
 	imgName := u.config.Azure.DiskName
 
-	u.log.Printf("Creating managed image %s in %s", imgName, rg)
-	image := armcomputev5.Image{
-		Location: &location,
-		Properties: &armcomputev5.ImageProperties{
-			HyperVGeneration: toPtr(armcomputev5.HyperVGenerationTypesV2),
-			StorageProfile: &armcomputev5.ImageStorageProfile{
-				OSDisk: &armcomputev5.ImageOSDisk{
-					OSState: toPtr(armcomputev5.OperatingSystemStateTypesGeneralized),
-					OSType:  toPtr(armcomputev5.OperatingSystemTypesLinux),
-					ManagedDisk: &armcomputev5.SubResource{
-						ID: &diskID,
-					},
-				},
-			},
-		},
-	}
+	u.log.Info("Creating managed image", "image", imgName, "resourceGroup", rg)
 	opts := &armcomputev5.ImagesClientBeginCreateOrUpdateOptions{}
-	createPoller, err := u.managedImages.BeginCreateOrUpdate(ctx, rg, imgName, image, opts)
+	createPoller, err := u.managedImages.BeginCreateOrUpdate(ctx, rg, imgName, u.managedImage(diskID), opts)
 	if err != nil {
 		return "", fmt.Errorf("creating managed image: %w", err)
 	}
@@ -310,17 +468,40 @@ func (u *Uploader) createManagedImage(ctx context.Context, diskID string) (strin
 	return *createdImage.ID, nil
 }
 
+// managedImage returns the managed image to create from the uploaded disk.
+func (u *Uploader) managedImage(diskID string) armcomputev5.Image {
+	osDisk := &armcomputev5.ImageOSDisk{
+		OSState: toPtr(armcomputev5.OperatingSystemStateTypesGeneralized),
+		OSType:  toPtr(armcomputev5.OperatingSystemTypesLinux),
+		ManagedDisk: &armcomputev5.SubResource{
+			ID: &diskID,
+		},
+	}
+	if u.config.Azure.OSDiskSizeGB > 0 {
+		osDisk.DiskSizeGB = toPtr(int32(u.config.Azure.OSDiskSizeGB))
+	}
+	return armcomputev5.Image{
+		Location: toPtr(u.config.Azure.Location),
+		Properties: &armcomputev5.ImageProperties{
+			HyperVGeneration: toPtr(armcomputev5.HyperVGenerationTypesV2),
+			StorageProfile: &armcomputev5.ImageStorageProfile{
+				OSDisk: osDisk,
+			},
+		},
+	}
+}
+
 func (u *Uploader) ensureManagedImageDeleted(ctx context.Context) error {
 	rg := u.config.Azure.ResourceGroup
 	imgName := u.config.Azure.DiskName
 
 	getOpts := &armcomputev5.ImagesClientGetOptions{}
 	if _, err := u.managedImages.Get(ctx, rg, imgName, getOpts); err != nil {
-		u.log.Printf("Managed image %s in %s doesn't exist. Nothing to clean up.", imgName, rg)
+		u.log.Debug("Managed image doesn't exist. Nothing to clean up.", "image", imgName, "resourceGroup", rg)
 		return nil
 	}
 
-	u.log.Printf("Deleting managed image %s in %s", imgName, rg)
+	u.log.Info("Deleting managed image", "image", imgName, "resourceGroup", rg)
 	deleteOpts := &armcomputev5.ImagesClientBeginDeleteOptions{}
 	deletePoller, err := u.managedImages.BeginDelete(ctx, rg, imgName, deleteOpts)
 	if err != nil {
@@ -333,6 +514,22 @@ func (u *Uploader) ensureManagedImageDeleted(ctx context.Context) error {
 	return nil
 }
 
+// confirmPublish returns an error unless publishing is confirmed, if the image is uploaded to a community gallery.
+// All images of a community gallery are public, so declining aborts the upload instead of keeping the image private.
+func (u *Uploader) confirmPublish() error {
+	if u.config.Azure.SharingProfile != "community" {
+		return nil
+	}
+	ok, err := u.confirm.ConfirmPublish(u.config)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: publishing image in community gallery %s", config.ErrNotConfirmed, u.config.Azure.SharedImageGallery)
+	}
+	return nil
+}
+
 // ensureSIG creates a SIG if it does not exist yet.
 func (u *Uploader) ensureSIG(ctx context.Context) error {
 	rg := u.config.Azure.ResourceGroup
@@ -342,7 +539,7 @@ func (u *Uploader) ensureSIG(ctx context.Context) error {
 
 	resp, err := u.galleries.Get(ctx, rg, sigName, &armcomputev5.GalleriesClientGetOptions{})
 	if err == nil {
-		u.log.Printf("Image gallery %s in %s exists", sigName, rg)
+		u.log.Debug("Image gallery exists", "gallery", sigName, "resourceGroup", rg)
 		if resp.Gallery.Properties == nil {
 			return errors.New("image gallery has no properties")
 		}
@@ -357,7 +554,7 @@ func (u *Uploader) ensureSIG(ctx context.Context) error {
 		}
 		return nil
 	}
-	u.log.Printf("Creating image gallery %s in %s", sigName, rg)
+	u.log.Info("Creating image gallery", "gallery", sigName, "resourceGroup", rg)
 	var communityGalleryInfo *armcomputev5.CommunityGalleryInfo
 	if u.config.Azure.SharingProfile == "community" {
 		communityGalleryInfo = &armcomputev5.CommunityGalleryInfo{
@@ -412,21 +609,34 @@ func sharingProfilePermissionFromString(s string) *armcomputev5.GallerySharingPe
 func (u *Uploader) ensureImageDefinition(ctx context.Context) error {
 	rg := u.config.Azure.ResourceGroup
 	sigName := u.config.Azure.SharedImageGallery
-	attestVariant := u.config.Azure.AttestationVariant
 	defName := u.config.Azure.ImageDefinitionName
 
 	_, err := u.image.Get(ctx, rg, sigName, defName, &armcomputev5.GalleryImagesClientGetOptions{})
 	if err == nil {
-		u.log.Printf("Image definition %s/%s in %s exists", sigName, defName, rg)
+		u.log.Debug("Image definition exists", "gallery", sigName, "imageDefinition", defName, "resourceGroup", rg)
 		return nil
 	}
-	u.log.Printf("Creating image definition  %s/%s in %s", sigName, defName, rg)
+	u.log.Info("Creating image definition", "gallery", sigName, "imageDefinition", defName, "resourceGroup", rg)
+	opts := &armcomputev5.GalleryImagesClientBeginCreateOrUpdateOptions{}
+	createPoller, err := u.image.BeginCreateOrUpdate(ctx, rg, sigName, defName, u.galleryImage(), opts)
+	if err != nil {
+		return fmt.Errorf("creating image definition: %w", err)
+	}
+	if _, err = createPoller.PollUntilDone(ctx, u.pollOpts); err != nil {
+		return fmt.Errorf("waiting for image definition to be created: %w", err)
+	}
+
+	return nil
+}
+
+// galleryImage returns the image definition to create.
+func (u *Uploader) galleryImage() armcomputev5.GalleryImage {
 	var securityType string
 	// TODO(malt3): This needs to allow the *Supported or the normal variant
 	// based on wether a VMGS was provided or not.
 	// VMGS provided: ConfidentialVM
 	// No VMGS provided: ConfidentialVMSupported
-	switch strings.ToLower(attestVariant) {
+	switch strings.ToLower(u.config.Azure.AttestationVariant) {
 	case "azure-sev-snp", "azure-tdx":
 		securityType = string("ConfidentialVMSupported")
 	case "azure-trustedlaunch":
@@ -441,25 +651,41 @@ func (u *Uploader) ensureImageDefinition(ctx context.Context) error {
 				Publisher: &u.config.Azure.Publisher,
 				SKU:       &u.config.Azure.SKU,
 			},
-			OSState:      toPtr(armcomputev5.OperatingSystemStateTypesGeneralized),
-			OSType:       toPtr(armcomputev5.OperatingSystemTypesLinux),
-			Architecture: toPtr(armcomputev5.ArchitectureX64),
-			Features: []*armcomputev5.GalleryImageFeature{
-				{Name: toPtr("SecurityType"), Value: &securityType},
-			},
+			OSState:          toPtr(armcomputev5.OperatingSystemStateTypesGeneralized),
+			OSType:           toPtr(armcomputev5.OperatingSystemTypesLinux),
+			Architecture:     toPtr(armcomputev5.ArchitectureX64),
+			Features:         u.galleryImageFeatures(securityType),
 			HyperVGeneration: toPtr(armcomputev5.HyperVGenerationV2),
 		},
 	}
-	opts := &armcomputev5.GalleryImagesClientBeginCreateOrUpdateOptions{}
-	createPoller, err := u.image.BeginCreateOrUpdate(ctx, rg, sigName, defName, galleryImage, opts)
-	if err != nil {
-		return fmt.Errorf("creating image definition: %w", err)
-	}
-	if _, err = createPoller.PollUntilDone(ctx, u.pollOpts); err != nil {
-		return fmt.Errorf("waiting for image definition to be created: %w", err)
+	if u.config.Azure.PlanName != "" {
+		galleryImage.Properties.PurchasePlan = &armcomputev5.ImagePurchasePlan{
+			Name:      toPtr(u.config.Azure.PlanName),
+			Publisher: toPtr(u.config.Azure.PlanPublisher),
+			Product:   toPtr(u.config.Azure.PlanProduct),
+		}
 	}
+	return galleryImage
+}
 
-	return nil
+// galleryImageFeatures returns the security type and the configured features of the image definition,
+// sorted by name.
+func (u *Uploader) galleryImageFeatures(securityType string) []*armcomputev5.GalleryImageFeature {
+	features := []*armcomputev5.GalleryImageFeature{
+		{Name: toPtr("SecurityType"), Value: &securityType},
+	}
+	names := make([]string, 0, len(u.config.Azure.Features))
+	for name := range u.config.Azure.Features {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		features = append(features, &armcomputev5.GalleryImageFeature{
+			Name:  toPtr(name),
+			Value: toPtr(u.config.Azure.Features[name]),
+		})
+	}
+	return features
 }
 
 func (u *Uploader) createImageVersion(ctx context.Context, imageID string) (string, error) {
@@ -468,7 +694,7 @@ func (u *Uploader) createImageVersion(ctx context.Context, imageID string) (stri
 	verName := u.config.ImageVersion
 	defName := u.config.Azure.ImageDefinitionName
 
-	u.log.Printf("Creating image version %s/%s/%s in %s", sigName, defName, verName, rg)
+	u.log.Info("Creating image version", "gallery", sigName, "imageDefinition", defName, "version", verName, "resourceGroup", rg)
 	imageVersion := armcomputev5.GalleryImageVersion{
 		Location: &u.config.Azure.Location,
 		Properties: &armcomputev5.GalleryImageVersionProperties{
@@ -483,10 +709,16 @@ func (u *Uploader) createImageVersion(ctx context.Context, imageID string) (stri
 			PublishingProfile: &armcomputev5.GalleryImageVersionPublishingProfile{
 				ReplicaCount:    toPtr[int32](1),
 				ReplicationMode: toPtr(armcomputev5.ReplicationModeFull),
-				TargetRegions:   replication(u.config.Azure.Location, u.config.Azure.ReplicationRegions, 1),
+				TargetRegions:   u.targetRegions(),
 			},
 		},
 	}
+	if !u.expiresAt.IsZero() {
+		imageVersion.Tags = map[string]*string{config.ExpiryTag: toPtr(u.expiresAt.Format(time.RFC3339))}
+	}
+	if !u.endOfLife.IsZero() {
+		imageVersion.Properties.PublishingProfile.EndOfLifeDate = toPtr(u.endOfLife)
+	}
 
 	if u.config.Azure.AdditionalSignatures != nil {
 		var value []*string
@@ -526,6 +758,75 @@ func (u *Uploader) createImageVersion(ctx context.Context, imageID string) (stri
 	return *createdImage.ID, nil
 }
 
+// waitForReplication polls the replication status of the image version until
+// it is completed in all target regions, reporting the progress of every region.
+// It fails if the replication fails in a region or doesn't complete within replicationTimeout.
+func (u *Uploader) waitForReplication(ctx context.Context) error {
+	rg := u.config.Azure.ResourceGroup
+	sigName := u.config.Azure.SharedImageGallery
+	verName := u.config.ImageVersion
+	defName := u.config.Azure.ImageDefinitionName
+
+	ctx, cancel := context.WithTimeout(ctx, replicationTimeout)
+	defer cancel()
+	getOpts := &armcomputev5.GalleryImageVersionsClientGetOptions{
+		Expand: toPtr(armcomputev5.ReplicationStatusTypesReplicationStatus),
+	}
+	for {
+		resp, err := u.imageVersions.Get(ctx, rg, sigName, defName, verName, getOpts)
+		if err != nil {
+			return fmt.Errorf("getting replication status: %w", err)
+		}
+		var status *armcomputev5.ReplicationStatus
+		if resp.Properties != nil {
+			status = resp.Properties.ReplicationStatus
+		}
+		done, err := u.replicationDone(status)
+		if err != nil || done {
+			return err
+		}
+		if err := u.opts.Clock.Sleep(ctx, u.pollingFrequency); err != nil {
+			return err
+		}
+	}
+}
+
+// replicationDone reports the replication progress of every region and
+// returns whether the replication completed in all regions.
+func (u *Uploader) replicationDone(status *armcomputev5.ReplicationStatus) (bool, error) {
+	if status == nil || len(status.Summary) == 0 {
+		u.log.Debug("Replication status not available yet")
+		return false, nil
+	}
+	done := true
+	for _, region := range status.Summary {
+		if region == nil || region.Region == nil || region.State == nil {
+			done = false
+			continue
+		}
+		var progress int32
+		if region.Progress != nil {
+			progress = *region.Progress
+		}
+		u.log.Info("Replicating image version", "region", *region.Region, "state", *region.State, "progress", progress)
+		if u.replicationProgress != nil {
+			u.replicationProgress(*region.Region, string(*region.State), int(progress))
+		}
+		switch *region.State {
+		case armcomputev5.ReplicationStateCompleted:
+		case armcomputev5.ReplicationStateFailed:
+			details := ""
+			if region.Details != nil {
+				details = *region.Details
+			}
+			return false, fmt.Errorf("replication to %s failed: %s", *region.Region, details)
+		default:
+			done = false
+		}
+	}
+	return done, nil
+}
+
 func (u *Uploader) ensureImageVersionDeleted(ctx context.Context) error {
 	rg := u.config.Azure.ResourceGroup
 	sigName := u.config.Azure.SharedImageGallery
@@ -534,11 +835,14 @@ func (u *Uploader) ensureImageVersionDeleted(ctx context.Context) error {
 
 	getOpts := &armcomputev5.GalleryImageVersionsClientGetOptions{}
 	if _, err := u.imageVersions.Get(ctx, rg, sigName, defName, verName, getOpts); err != nil {
-		u.log.Printf("Image version %s in %s/%s/%s doesn't exist. Nothing to clean up.", verName, rg, sigName, defName)
+		u.log.Debug("Image version doesn't exist. Nothing to clean up.", "gallery", sigName, "imageDefinition", defName, "version", verName, "resourceGroup", rg)
 		return nil
 	}
+	if err := u.confirm.ConfirmOverwrite(u.config, defName+"/"+verName); err != nil {
+		return err
+	}
 
-	u.log.Printf("Deleting image version %s in %s/%s/%s", verName, rg, sigName, defName)
+	u.log.Info("Deleting image version", "gallery", sigName, "imageDefinition", defName, "version", verName, "resourceGroup", rg)
 	deleteOpts := &armcomputev5.GalleryImageVersionsClientBeginDeleteOptions{}
 	deletePoller, err := u.imageVersions.BeginDelete(ctx, rg, sigName, defName, verName, deleteOpts)
 	if err != nil {
@@ -551,6 +855,33 @@ func (u *Uploader) ensureImageVersionDeleted(ctx context.Context) error {
 	return nil
 }
 
+// ImageVersions returns the versions of the image definition in the shared image gallery.
+// If the gallery or image definition doesn't exist yet, no versions are returned.
+func (u *Uploader) ImageVersions(ctx context.Context) ([]string, error) {
+	rg := u.config.Azure.ResourceGroup
+	sigName := u.config.Azure.SharedImageGallery
+	defName := u.config.Azure.ImageDefinitionName
+
+	pager := u.imageVersions.NewListByGalleryImagePager(rg, sigName, defName, nil)
+	var versions []string
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing image versions: %w", err)
+		}
+		for _, version := range page.Value {
+			if version.Name != nil {
+				versions = append(versions, *version.Name)
+			}
+		}
+	}
+	return versions, nil
+}
+
 // getImageReference returns the image reference to use for the image version.
 // If the shared image gallery is a community gallery, the community identifier is returned.
 // Otherwise, the unshared identifier is returned.
@@ -570,7 +901,7 @@ func (u *Uploader) getImageReference(ctx context.Context, unsharedID string) (st
 		galleryResp.Properties.SharingProfile.CommunityGalleryInfo == nil ||
 		galleryResp.Properties.SharingProfile.CommunityGalleryInfo.CommunityGalleryEnabled == nil ||
 		!*galleryResp.Properties.SharingProfile.CommunityGalleryInfo.CommunityGalleryEnabled {
-		u.log.Printf("Image gallery %s in %s is not shared. Using private identifier", sigName, rg)
+		u.log.Debug("Image gallery is not shared. Using private identifier", "gallery", sigName, "resourceGroup", rg)
 		return unsharedID, nil
 	}
 	if galleryResp.Properties == nil ||
@@ -582,7 +913,7 @@ func (u *Uploader) getImageReference(ctx context.Context, unsharedID string) (st
 		return "", fmt.Errorf("image gallery %s in %s is a community gallery but has no public names", sigName, rg)
 	}
 	communityGalleryName := *galleryResp.Properties.SharingProfile.CommunityGalleryInfo.PublicNames[0]
-	u.log.Printf("Image gallery %s in %s is shared. Using community identifier in %s", sigName, rg, communityGalleryName)
+	u.log.Debug("Image gallery is shared. Using community identifier", "gallery", sigName, "resourceGroup", rg, "communityGallery", communityGalleryName)
 	opts := &armcomputev5.CommunityGalleryImageVersionsClientGetOptions{}
 	communityVersionResp, err := u.communityVersions.Get(ctx, location, communityGalleryName, defName, verName, opts)
 	if err != nil {
@@ -594,33 +925,75 @@ func (u *Uploader) getImageReference(ctx context.Context, unsharedID string) (st
 	return *communityVersionResp.Identifier.UniqueID, nil
 }
 
-func uploadBlob(ctx context.Context, sasURL string, disk io.Reader, size int64, uploader sasBlobUploader) error {
+// uploadBlob uploads size bytes read from disk to the page blob behind sasURL.
+// Pages are written in chunks of at most pageSizeMax bytes. A trailing partial page
+// is padded with zeros, as page blobs only accept writes aligned to pageSizeMin.
+// If skipZeroPages is set, pages only containing zeros are not written, which speeds
+// up uploading sparse images. This relies on the target blob being zero-initialized.
+// Each write carries the MD5 of its pages, so corrupted writes are rejected by Azure.
+func uploadBlob(ctx context.Context, sasURL string, disk io.Reader, size int64, skipZeroPages bool, uploader sasBlobUploader) error {
 	uploadClient, err := uploader(sasURL)
 	if err != nil {
 		return fmt.Errorf("uploading blob: %w", err)
 	}
 	var offset int64
-	var chunksize int
 	chunk := make([]byte, pageSizeMax)
-	var readErr error
 	for offset < size {
-		chunksize, readErr = io.ReadAtLeast(disk, chunk, 1)
-		if readErr != nil {
+		readSize := min(int64(pageSizeMax), size-offset)
+		if _, err := io.ReadFull(disk, chunk[:readSize]); err != nil {
 			return fmt.Errorf("reading from disk: %w", err)
 		}
-		if err := uploadChunk(ctx, uploadClient, bytes.NewReader(chunk[:chunksize]), offset, int64(chunksize)); err != nil {
-			return fmt.Errorf("uploading chunk: %w", err)
+		alignedSize := alignUp(readSize, pageSizeMin)
+		clear(chunk[readSize:alignedSize])
+
+		pageRanges := [][2]int64{{0, alignedSize}}
+		if skipZeroPages {
+			pageRanges = nonZeroPageRanges(chunk[:alignedSize], pageSizeMin)
+		}
+		for _, pageRange := range pageRanges {
+			start, end := pageRange[0], pageRange[1]
+			if err := uploadChunk(ctx, uploadClient, chunk[start:end], offset+start); err != nil {
+				return fmt.Errorf("uploading chunk: %w", err)
+			}
 		}
-		offset += int64(chunksize)
+		offset += readSize
 	}
 	return nil
 }
 
-func uploadChunk(ctx context.Context, uploader azurePageblobAPI, chunk io.ReadSeeker, offset, chunksize int64) error {
-	_, err := uploader.UploadPages(ctx, &readSeekNopCloser{chunk}, blob.HTTPRange{
+// nonZeroPageRanges returns the [start, end) ranges of consecutive pages in data
+// that contain at least one non-zero byte. len(data) must be a multiple of pageSize.
+func nonZeroPageRanges(data []byte, pageSize int64) [][2]int64 {
+	var ranges [][2]int64
+	rangeStart := int64(-1)
+	for pageStart := int64(0); pageStart < int64(len(data)); pageStart += pageSize {
+		isZero := !slices.ContainsFunc(data[pageStart:pageStart+pageSize], func(b byte) bool { return b != 0 })
+		switch {
+		case !isZero && rangeStart < 0:
+			rangeStart = pageStart
+		case isZero && rangeStart >= 0:
+			ranges = append(ranges, [2]int64{rangeStart, pageStart})
+			rangeStart = -1
+		}
+	}
+	if rangeStart >= 0 {
+		ranges = append(ranges, [2]int64{rangeStart, int64(len(data))})
+	}
+	return ranges
+}
+
+func alignUp(n, alignment int64) int64 {
+	return (n + alignment - 1) / alignment * alignment
+}
+
+func uploadChunk(ctx context.Context, uploader azurePageblobAPI, chunk []byte, offset int64) error {
+	chunkMD5 := md5.Sum(chunk)
+	_, err := uploader.UploadPages(ctx, &readSeekNopCloser{bytes.NewReader(chunk)}, blob.HTTPRange{
 		Offset: offset,
-		Count:  chunksize,
-	}, nil)
+		Count:  int64(len(chunk)),
+	}, &pageblob.UploadPagesOptions{
+		TransactionalValidation: blob.TransferValidationTypeMD5(chunkMD5[:]),
+	})
 	return err
 }
 
@@ -636,6 +1009,27 @@ func toPtr[T any](t T) *T {
 	return &t
 }
 
+// targetRegions returns the replication targets of the image version.
+// If no target regions are configured, the image is replicated to the
+// location and all replication regions with a single replica each.
+func (u *Uploader) targetRegions() []*armcomputev5.TargetRegion {
+	if len(u.config.Azure.TargetRegions) == 0 {
+		return replication(u.config.Azure.Location, u.config.Azure.ReplicationRegions, 1)
+	}
+	targetRegions := make([]*armcomputev5.TargetRegion, 0, len(u.config.Azure.TargetRegions))
+	for _, region := range u.config.Azure.TargetRegions {
+		targetRegion := &armcomputev5.TargetRegion{
+			Name:                 toPtr(region.Name),
+			RegionalReplicaCount: toPtr(int32(region.ReplicaCount)),
+		}
+		if region.StorageAccountType != "" {
+			targetRegion.StorageAccountType = toPtr(armcomputev5.StorageAccountType(region.StorageAccountType))
+		}
+		targetRegions = append(targetRegions, targetRegion)
+	}
+	return targetRegions
+}
+
 func replication(location string, regions []string, count int32) []*armcomputev5.TargetRegion {
 	targetRegions := []*armcomputev5.TargetRegion{
 		{
@@ -655,3 +1049,23 @@ func replication(location string, regions []string, count int32) []*armcomputev5
 
 	return targetRegions
 }
+
+// endOfLifeDate returns the end of life date of the image version, relative to now.
+// It is configured either as RFC 3339 timestamp or as duration after now.
+// The zero time is returned if no end of life date is configured.
+func endOfLifeDate(conf config.AzureConfig, now time.Time) (time.Time, error) {
+	if conf.EndOfLifeDate == "" {
+		return time.Time{}, nil
+	}
+	if endOfLife, err := time.Parse(time.RFC3339, conf.EndOfLifeDate); err == nil {
+		if !endOfLife.After(now) {
+			return time.Time{}, fmt.Errorf("endOfLifeDate %s is not in the future", conf.EndOfLifeDate)
+		}
+		return endOfLife, nil
+	}
+	after, err := config.ParseDuration(conf.EndOfLifeDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing endOfLifeDate: must be an RFC 3339 timestamp or a duration: %w", err)
+	}
+	return now.Add(after).UTC(), nil
+}
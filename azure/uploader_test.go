@@ -0,0 +1,555 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	armcomputev5 "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadBlob(t *testing.T) {
+	// small sparse image: data, a hole spanning multiple pages and a trailing partial page
+	image := make([]byte, 5*pageSizeMin+100)
+	copy(image, bytes.Repeat([]byte{0xaa}, 600))
+	copy(image[4*pageSizeMin:], bytes.Repeat([]byte{0xbb}, pageSizeMin+100))
+
+	testCases := map[string]struct {
+		data          func() (io.Reader, int64)
+		skipZeroPages bool
+		wantWrites    int
+	}{
+		"vhd with zero pages skipped": {
+			data: func() (io.Reader, int64) {
+				vhd := newVHDReader(bytes.NewReader(image), uint64(len(image)), [16]byte{}, time.Time{})
+				return vhd, int64(vhd.ContainerSize())
+			},
+			skipZeroPages: true,
+			wantWrites:    3, // image data before and after the hole, vhd footer
+		},
+		"vhd without skipping zero pages": {
+			data: func() (io.Reader, int64) {
+				vhd := newVHDReader(bytes.NewReader(image), uint64(len(image)), [16]byte{}, time.Time{})
+				return vhd, int64(vhd.ContainerSize())
+			},
+			wantWrites: 1,
+		},
+		"unaligned raw data is padded": {
+			data: func() (io.Reader, int64) {
+				return bytes.NewReader(image), int64(len(image))
+			},
+			skipZeroPages: true,
+			wantWrites:    2,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			data, size := tc.data()
+			want, err := io.ReadAll(io.LimitReader(data, size))
+			assert.NoError(err)
+			data, size = tc.data()
+
+			stub := &stubPageblob{}
+			err = uploadBlob(context.Background(), "sas-url", data, size, tc.skipZeroPages,
+				func(string) (azurePageblobAPI, error) { return stub, nil },
+			)
+			assert.NoError(err)
+
+			assert.Len(stub.writes, tc.wantWrites)
+			for _, write := range stub.writes {
+				assert.Zero(write.Offset%pageSizeMin, "offset %d not page aligned", write.Offset)
+				assert.Zero(write.Count%pageSizeMin, "count %d not page aligned", write.Count)
+			}
+			got := stub.contents()
+			assert.Zero(len(got) % pageSizeMin)
+			assert.Equal(want, got[:len(want)])
+			assert.Equal(make([]byte, len(got)-len(want)), got[len(want):])
+		})
+	}
+}
+
+func TestGalleryImagePurchasePlan(t *testing.T) {
+	testCases := map[string]struct {
+		azConfig config.AzureConfig
+		wantPlan *armcomputev5.ImagePurchasePlan
+	}{
+		"no plan": {
+			azConfig: config.AzureConfig{},
+		},
+		"plan set": {
+			azConfig: config.AzureConfig{
+				PlanName:      "plan",
+				PlanPublisher: "publisher",
+				PlanProduct:   "product",
+			},
+			wantPlan: &armcomputev5.ImagePurchasePlan{
+				Name:      toPtr("plan"),
+				Publisher: toPtr("publisher"),
+				Product:   toPtr("product"),
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u := &Uploader{config: config.Config{Azure: tc.azConfig}}
+
+			image := u.galleryImage()
+			assert.Equal(tc.wantPlan, image.Properties.PurchasePlan)
+		})
+	}
+}
+
+func TestGalleryImageFeatures(t *testing.T) {
+	testCases := map[string]struct {
+		azConfig     config.AzureConfig
+		wantFeatures map[string]string
+	}{
+		"security type only": {
+			azConfig:     config.AzureConfig{AttestationVariant: "azure-trustedlaunch"},
+			wantFeatures: map[string]string{"SecurityType": "TrustedLaunch"},
+		},
+		"additional features": {
+			azConfig: config.AzureConfig{
+				AttestationVariant: "azure-sev-snp",
+				Features: map[string]string{
+					"IsHibernateSupported":          "False",
+					"IsAcceleratedNetworkSupported": "True",
+				},
+			},
+			wantFeatures: map[string]string{
+				"SecurityType":                  "ConfidentialVMSupported",
+				"IsAcceleratedNetworkSupported": "True",
+				"IsHibernateSupported":          "False",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u := &Uploader{config: config.Config{Azure: tc.azConfig}}
+
+			features := u.galleryImage().Properties.Features
+			// The security type comes first, followed by the configured features in alphabetical order.
+			assert.Equal("SecurityType", *features[0].Name)
+			got := make(map[string]string)
+			var names []string
+			for _, feature := range features {
+				got[*feature.Name] = *feature.Value
+				names = append(names, *feature.Name)
+			}
+			assert.Equal(tc.wantFeatures, got)
+			assert.IsNonDecreasing(names[1:])
+		})
+	}
+}
+
+func TestManagedImageOSDiskSize(t *testing.T) {
+	assert := assert.New(t)
+	u := &Uploader{config: config.Config{Azure: config.AzureConfig{Location: "westeurope"}}}
+
+	image := u.managedImage("disk-id")
+	assert.Equal("westeurope", *image.Location)
+	assert.Equal("disk-id", *image.Properties.StorageProfile.OSDisk.ManagedDisk.ID)
+	assert.Nil(image.Properties.StorageProfile.OSDisk.DiskSizeGB)
+
+	u.config.Azure.OSDiskSizeGB = 30
+	image = u.managedImage("disk-id")
+	assert.Equal(int32(30), *image.Properties.StorageProfile.OSDisk.DiskSizeGB)
+}
+
+func TestConfirmPublish(t *testing.T) {
+	testCases := map[string]struct {
+		sharingProfile   string
+		confirm          config.ConfirmFunc
+		wantNotConfirmed bool
+	}{
+		"private gallery": {
+			sharingProfile: "private",
+			confirm:        func(string, config.Config) (bool, error) { return false, nil },
+		},
+		"community gallery confirmed": {
+			sharingProfile: "community",
+			confirm:        func(string, config.Config) (bool, error) { return true, nil },
+		},
+		"community gallery declined": {
+			sharingProfile:   "community",
+			confirm:          func(string, config.Config) (bool, error) { return false, nil },
+			wantNotConfirmed: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			u := &Uploader{
+				config:  config.Config{Azure: config.AzureConfig{SharingProfile: tc.sharingProfile}},
+				confirm: tc.confirm,
+			}
+			err := u.confirmPublish()
+			if tc.wantNotConfirmed {
+				assert.ErrorIs(t, err, config.ErrNotConfirmed)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestEndOfLifeDate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := map[string]struct {
+		endOfLifeDate string
+		want          time.Time
+		wantErr       bool
+	}{
+		"unset": {},
+		"timestamp": {
+			endOfLifeDate: "2025-06-01T12:00:00+02:00",
+			want:          time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC),
+		},
+		"timestamp in the past": {
+			endOfLifeDate: "2023-06-01T12:00:00Z",
+			wantErr:       true,
+		},
+		"days": {
+			endOfLifeDate: "365d",
+			want:          now.AddDate(0, 0, 365),
+		},
+		"duration": {
+			endOfLifeDate: "36h",
+			want:          now.Add(36 * time.Hour),
+		},
+		"negative duration": {
+			endOfLifeDate: "-1h",
+			wantErr:       true,
+		},
+		"date without time": {
+			endOfLifeDate: "2025-06-01",
+			wantErr:       true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			got, err := endOfLifeDate(config.AzureConfig{EndOfLifeDate: tc.endOfLifeDate}, now)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.True(tc.want.Equal(got), "want %s, got %s", tc.want, got)
+		})
+	}
+}
+
+type stubPageblob struct {
+	writes []blob.HTTPRange
+	data   map[int64][]byte
+}
+
+func (s *stubPageblob) UploadPages(_ context.Context, body io.ReadSeekCloser, contentRange blob.HTTPRange,
+	opts *pageblob.UploadPagesOptions,
+) (pageblob.UploadPagesResponse, error) {
+	if s.data == nil {
+		s.data = make(map[int64][]byte)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return pageblob.UploadPagesResponse{}, err
+	}
+	// Azure rejects writes whose content doesn't match the transactional MD5.
+	if opts == nil {
+		return pageblob.UploadPagesResponse{}, errors.New("missing transactional md5")
+	}
+	wantMD5, ok := opts.TransactionalValidation.(blob.TransferValidationTypeMD5)
+	dataMD5 := md5.Sum(data)
+	if !ok || !bytes.Equal(wantMD5, dataMD5[:]) {
+		return pageblob.UploadPagesResponse{}, errors.New("md5 mismatch")
+	}
+	s.writes = append(s.writes, contentRange)
+	s.data[contentRange.Offset] = data
+	return pageblob.UploadPagesResponse{}, nil
+}
+
+// contents returns the blob contents, with unwritten pages being zero.
+func (s *stubPageblob) contents() []byte {
+	var size int64
+	for _, write := range s.writes {
+		size = max(size, write.Offset+write.Count)
+	}
+	out := make([]byte, size)
+	for offset, data := range s.data {
+		copy(out[offset:], data)
+	}
+	return out
+}
+
+func TestPreflight(t *testing.T) {
+	testCases := map[string]struct {
+		tokenErr      error
+		listErr       error
+		wantErr       bool
+		wantForbidden bool
+	}{
+		"accessible": {},
+		"no credentials": {
+			tokenErr:      errors.New("DefaultAzureCredential: failed to acquire a token"),
+			wantErr:       true,
+			wantForbidden: true,
+		},
+		"missing role assignment": {
+			listErr:       &azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: "AuthorizationFailed"},
+			wantErr:       true,
+			wantForbidden: true,
+		},
+		"resource group not found": {
+			listErr: &azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: "ResourceGroupNotFound"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			galleries := &stubGalleries{listErr: tc.listErr}
+			u := &Uploader{
+				config:    config.Config{Azure: config.AzureConfig{SubscriptionID: "sub", ResourceGroup: "rg"}},
+				cred:      &stubCredential{err: tc.tokenErr},
+				galleries: galleries,
+			}
+			err := u.Preflight(context.Background())
+			if tc.wantErr {
+				assert.Error(err)
+				assert.Equal(tc.wantForbidden, errors.Is(err, provider.ErrPermissionDenied))
+				return
+			}
+			assert.NoError(err)
+			assert.Equal("rg", galleries.listedResourceGroup)
+		})
+	}
+}
+
+type stubCredential struct {
+	err error
+}
+
+func (c *stubCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, c.err
+}
+
+type stubGalleries struct {
+	azureGalleriesAPI
+	listErr             error
+	listedResourceGroup string
+}
+
+func (g *stubGalleries) NewListByResourceGroupPager(resourceGroupName string, _ *armcomputev5.GalleriesClientListByResourceGroupOptions,
+) *runtime.Pager[armcomputev5.GalleriesClientListByResourceGroupResponse] {
+	g.listedResourceGroup = resourceGroupName
+	return runtime.NewPager(runtime.PagingHandler[armcomputev5.GalleriesClientListByResourceGroupResponse]{
+		More: func(armcomputev5.GalleriesClientListByResourceGroupResponse) bool { return false },
+		Fetcher: func(context.Context, *armcomputev5.GalleriesClientListByResourceGroupResponse) (armcomputev5.GalleriesClientListByResourceGroupResponse, error) {
+			return armcomputev5.GalleriesClientListByResourceGroupResponse{}, g.listErr
+		},
+	})
+}
+
+func TestWaitForReplication(t *testing.T) {
+	summary := func(states ...armcomputev5.ReplicationState) *armcomputev5.ReplicationStatus {
+		status := &armcomputev5.ReplicationStatus{}
+		for i, state := range states {
+			status.Summary = append(status.Summary, &armcomputev5.RegionalReplicationStatus{
+				Region:   toPtr([]string{"westeurope", "eastus"}[i]),
+				State:    toPtr(state),
+				Progress: toPtr[int32](50),
+				Details:  toPtr("quota exceeded"),
+			})
+		}
+		return status
+	}
+
+	testCases := map[string]struct {
+		statuses    []*armcomputev5.ReplicationStatus
+		getErr      error
+		wantGets    int
+		wantReports int
+		wantErr     bool
+	}{
+		"completed": {
+			statuses:    []*armcomputev5.ReplicationStatus{summary(armcomputev5.ReplicationStateCompleted, armcomputev5.ReplicationStateCompleted)},
+			wantGets:    1,
+			wantReports: 2,
+		},
+		"completed after polling": {
+			statuses: []*armcomputev5.ReplicationStatus{
+				nil,
+				summary(armcomputev5.ReplicationStateCompleted, armcomputev5.ReplicationStateReplicating),
+				summary(armcomputev5.ReplicationStateCompleted, armcomputev5.ReplicationStateCompleted),
+			},
+			wantGets:    3,
+			wantReports: 4,
+		},
+		"failed": {
+			statuses:    []*armcomputev5.ReplicationStatus{summary(armcomputev5.ReplicationStateReplicating, armcomputev5.ReplicationStateFailed)},
+			wantGets:    1,
+			wantReports: 2,
+			wantErr:     true,
+		},
+		"get error": {
+			getErr:   errors.New("get failed"),
+			wantGets: 1,
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			versions := &stubImageVersions{statuses: tc.statuses, getErr: tc.getErr}
+			var reports int
+			u := &Uploader{
+				config:           config.Config{ImageVersion: "1.2.3", Azure: config.AzureConfig{ResourceGroup: "rg"}},
+				imageVersions:    versions,
+				pollingFrequency: time.Millisecond,
+				opts:             provider.NewOptions(),
+				log:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+				replicationProgress: func(region, state string, progress int) {
+					reports++
+					assert.NotEmpty(region)
+					assert.Equal(50, progress)
+				},
+			}
+			err := u.waitForReplication(context.Background())
+			if tc.wantErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+			assert.Equal(tc.wantGets, versions.gets)
+			assert.Equal(tc.wantReports, reports)
+			assert.Equal(armcomputev5.ReplicationStatusTypesReplicationStatus, *versions.expand)
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		u := &Uploader{
+			imageVersions:    &stubImageVersions{statuses: []*armcomputev5.ReplicationStatus{nil}},
+			pollingFrequency: time.Hour,
+			opts:             provider.NewOptions(),
+			log:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		}
+		assert.ErrorIs(t, u.waitForReplication(ctx), context.Canceled)
+	})
+}
+
+type stubImageVersions struct {
+	azureGalleriesImageVersionAPI
+	// statuses are returned by consecutive calls to Get, the last one is repeated.
+	statuses []*armcomputev5.ReplicationStatus
+	getErr   error
+	gets     int
+	expand   *armcomputev5.ReplicationStatusTypes
+}
+
+func (s *stubImageVersions) Get(_ context.Context, _, _, _, _ string, opts *armcomputev5.GalleryImageVersionsClientGetOptions,
+) (armcomputev5.GalleryImageVersionsClientGetResponse, error) {
+	s.expand = opts.Expand
+	s.gets++
+	if s.getErr != nil {
+		return armcomputev5.GalleryImageVersionsClientGetResponse{}, s.getErr
+	}
+	status := s.statuses[min(s.gets, len(s.statuses))-1]
+	return armcomputev5.GalleryImageVersionsClientGetResponse{
+		GalleryImageVersion: armcomputev5.GalleryImageVersion{
+			Properties: &armcomputev5.GalleryImageVersionProperties{ReplicationStatus: status},
+		},
+	}, nil
+}
+
+func TestUploadMock(t *testing.T) {
+	testCases := map[string]struct {
+		sharingProfile string
+		wantRef        string
+	}{
+		"private gallery": {
+			wantRef: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/galleries/gallery/images/definition/versions/1.0.0",
+		},
+		"community gallery": {
+			sharingProfile: "community",
+			wantRef:        "/CommunityGalleries/prefix-00000000-0000-0000-0000-000000000000/Images/definition/Versions/1.0.0",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := config.Config{
+				ImageVersion: "1.0.0",
+				Azure: config.AzureConfig{
+					SubscriptionID:      "sub",
+					Location:            "westeurope",
+					ResourceGroup:       "rg",
+					SharedImageGallery:  "gallery",
+					SharingProfile:      tc.sharingProfile,
+					SharingNamePrefix:   "prefix",
+					ImageDefinitionName: "definition",
+					DiskName:            "disk",
+					WaitForReplication:  config.Some(true),
+				},
+			}
+			rec := &provider.Recorder{}
+			u, err := NewUploader(conf, WithProviderOptions(provider.WithMock(rec)))
+			assert.NoError(err)
+			assert.True(u.Mocked())
+			assert.NoError(u.Preflight(context.Background()))
+
+			image := bytes.Repeat([]byte{0xaa}, 1<<20)
+			refs, err := u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+			assert.NoError(err)
+			assert.Equal([]string{tc.wantRef}, refs)
+			assert.Len(u.Checksums(), 1)
+
+			// Uploading again replaces the image version of the first upload.
+			_, err = u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+			assert.NoError(err)
+			var ops []string
+			for _, call := range rec.Calls() {
+				ops = append(ops, call.Operation)
+			}
+			assert.Contains(ops, "pageblob.UploadPages")
+			assert.Contains(ops, "galleryImageVersions.BeginCreateOrUpdate")
+			assert.Contains(ops, "galleryImageVersions.BeginDelete")
+
+			versions, err := u.ImageVersions(context.Background())
+			assert.NoError(err)
+			assert.Equal([]string{"1.0.0"}, versions)
+		})
+	}
+}
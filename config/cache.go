@@ -0,0 +1,117 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync"
+)
+
+// RenderCache caches the rendered variants of a config file, e.g. for long-running services
+// that render the same variants repeatedly. It is safe for concurrent use.
+//
+// A cached variant is reused as long as all files read while rendering it,
+// like the imageVersionFile, still have the same content and all glob patterns resolved while rendering it
+// still match the same files.
+// The files are therefore read on every call, but the variant is only rendered again if one of them changed.
+type RenderCache struct {
+	file ConfigFile
+	opts []RenderOption
+
+	mux     sync.Mutex
+	entries map[string]renderCacheEntry
+}
+
+type renderCacheEntry struct {
+	cfg Config
+	// inputs maps the files read while rendering to the digest of their content.
+	inputs map[string][sha256.Size]byte
+	// globs maps the glob patterns resolved while rendering to the files they matched.
+	globs map[string][]string
+}
+
+// NewRenderCache returns a cache for the variants of the config file.
+// The options are used for every render.
+// Without WithTime, cached variants keep the time they were rendered at.
+// The config file must not be modified while the cache is in use.
+func NewRenderCache(file ConfigFile, opts ...RenderOption) *RenderCache {
+	return &RenderCache{
+		file:    file,
+		opts:    opts,
+		entries: make(map[string]renderCacheEntry),
+	}
+}
+
+// RenderedVariant returns the rendered variant like ConfigFile.RenderedVariant,
+// rendering it only if it is not cached or one of its input files changed.
+// Errors are not cached.
+func (c *RenderCache) RenderedVariant(fileLookup fileLookupFn, name string) (Config, error) {
+	glob := newRenderOptions(c.opts).glob
+	c.mux.Lock()
+	entry, ok := c.entries[name]
+	c.mux.Unlock()
+	if ok && inputsUnchanged(fileLookup, entry.inputs) && globsUnchanged(glob, entry.globs) {
+		return entry.cfg.Clone(), nil
+	}
+
+	inputs := make(map[string][sha256.Size]byte)
+	globs := make(map[string][]string)
+	var inputsMux sync.Mutex
+	recordingLookup := func(file string) ([]byte, error) {
+		data, err := fileLookup(file)
+		if err != nil {
+			return nil, err
+		}
+		inputsMux.Lock()
+		inputs[file] = sha256.Sum256(data)
+		inputsMux.Unlock()
+		return data, nil
+	}
+	recordingGlob := func(pattern string) ([]string, error) {
+		matches, err := glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		inputsMux.Lock()
+		globs[pattern] = slices.Clone(matches)
+		inputsMux.Unlock()
+		return matches, nil
+	}
+	opts := append(slices.Clip(c.opts), WithGlob(recordingGlob))
+	cfg, err := c.file.RenderedVariant(recordingLookup, name, opts...)
+	if err != nil {
+		return Config{}, err
+	}
+
+	c.mux.Lock()
+	c.entries[name] = renderCacheEntry{cfg: cfg.Clone(), inputs: inputs, globs: globs}
+	c.mux.Unlock()
+	return cfg, nil
+}
+
+// inputsUnchanged reports whether all files still have the recorded content.
+func inputsUnchanged(fileLookup fileLookupFn, inputs map[string][sha256.Size]byte) bool {
+	for file, digest := range inputs {
+		data, err := fileLookup(file)
+		if err != nil || sha256.Sum256(data) != digest {
+			return false
+		}
+	}
+	return true
+}
+
+// globsUnchanged reports whether all glob patterns still match the recorded files.
+func globsUnchanged(glob globFn, globs map[string][]string) bool {
+	for pattern, matches := range globs {
+		current, err := glob(pattern)
+		if err != nil || !slices.Equal(current, matches) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"path"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderCache(t *testing.T) {
+	assert := assert.New(t)
+	base := fullConfig()
+	base.ImageVersion = ""
+	base.ImageVersionFile = "version.txt"
+	cache := NewRenderCache(ConfigFile{
+		Base: base,
+		Variants: map[string]Config{
+			"a": {Name: "image-a"},
+			"b": {Name: "image-b"},
+		},
+	})
+	lookup := &countingFileLookup{files: map[string][]byte{"version.txt": []byte("1.0.0")}}
+
+	first, err := cache.RenderedVariant(lookup.Lookup, "a")
+	assert.NoError(err)
+	assert.Equal("1.0.0", first.ImageVersion)
+	assert.Equal(1, lookup.count())
+
+	// Unchanged inputs are only read to compare them.
+	second, err := cache.RenderedVariant(lookup.Lookup, "a")
+	assert.NoError(err)
+	assert.Equal(first, second)
+	assert.Equal(2, lookup.count())
+
+	// Cached configs can be modified by the caller.
+	second.AWS.ReplicationRegions[0] = "modified"
+	third, err := cache.RenderedVariant(lookup.Lookup, "a")
+	assert.NoError(err)
+	assert.Equal(first, third)
+
+	// A changed version file invalidates the cache.
+	lookup.set("version.txt", []byte("1.0.1"))
+	changed, err := cache.RenderedVariant(lookup.Lookup, "a")
+	assert.NoError(err)
+	assert.Equal("1.0.1", changed.ImageVersion)
+
+	_, err = cache.RenderedVariant(lookup.Lookup, "c")
+	assert.ErrorIs(err, ErrVariantNotFound)
+}
+
+func TestRenderCacheGlob(t *testing.T) {
+	assert := assert.New(t)
+	base := fullConfig()
+	base.ImageVersion = ""
+	base.ImageVersionFile = "build/*/version.txt"
+	lookup := &countingFileLookup{files: map[string][]byte{"build/x86_64/version.txt": []byte("1.0.0")}}
+	cache := NewRenderCache(ConfigFile{
+		Base:     base,
+		Variants: map[string]Config{"a": {Name: "image-a"}},
+	}, WithGlob(lookup.Glob))
+
+	first, err := cache.RenderedVariant(lookup.Lookup, "a")
+	assert.NoError(err)
+	assert.Equal("1.0.0", first.ImageVersion)
+
+	// A second file matching the pattern invalidates the cache.
+	lookup.set("build/aarch64/version.txt", []byte("1.0.1"))
+	_, err = cache.RenderedVariant(lookup.Lookup, "a")
+	assert.ErrorContains(err, "matches 2 files")
+}
+
+func TestRenderCacheConcurrent(t *testing.T) {
+	// Renders are only identical with the same time.
+	frozen := WithTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cache := NewRenderCache(fullConfigFile(), frozen)
+	lookup := &countingFileLookup{}
+	conf := fullConfigFile()
+	want := make(map[string]Config)
+	for _, name := range []string{"a", "b"} {
+		cfg, err := conf.RenderedVariant(lookup.Lookup, name, frozen)
+		assert.NoError(t, err)
+		want[name] = cfg
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		name := []string{"a", "b"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg, err := cache.RenderedVariant(lookup.Lookup, name)
+			assert.NoError(t, err)
+			// The cache renders with additional options, which Equal ignores.
+			assert.True(t, cfg.Equal(want[name]))
+		}()
+	}
+	wg.Wait()
+}
+
+// countingFileLookup serves files from memory and counts the lookups.
+type countingFileLookup struct {
+	mux     sync.Mutex
+	files   map[string][]byte
+	lookups int
+}
+
+func (l *countingFileLookup) Lookup(name string) ([]byte, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.lookups++
+	return stubFileLookup(l.files).Lookup(name)
+}
+
+// Glob returns the names of the files matching the pattern, without counting it as a lookup.
+func (l *countingFileLookup) Glob(pattern string) ([]string, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	var matches []string
+	for name := range l.files {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, name)
+		}
+	}
+	slices.Sort(matches)
+	return matches, nil
+}
+
+func (l *countingFileLookup) set(name string, data []byte) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.files[name] = data
+}
+
+func (l *countingFileLookup) count() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.lookups
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+)
+
+// ErrImageNameCollision is returned if multiple variants create an image with the same name in the same place.
+var ErrImageNameCollision = errors.New("image name collision")
+
+// ErrManifestCollision is returned if multiple variants write their manifest to the same file,
+// so all but the last manifest would be overwritten.
+var ErrManifestCollision = errors.New("manifest collision")
+
+// imageTarget identifies an image created by an upload.
+type imageTarget struct {
+	provider Provider
+	// scope is where the name must be unique, e.g. the region or project.
+	scope string
+	name  string
+}
+
+// imageTargets returns the images an upload with the rendered config creates.
+// Images in AWS replication regions are included, unless they are given by the wildcard,
+// which can only be expanded with access to the account.
+// Custom providers don't create known images.
+func (c *Config) imageTargets() ([]imageTarget, error) {
+	provider, err := c.ResolveProvider()
+	if err != nil {
+		return nil, err
+	}
+	switch provider {
+	case ProviderAWS:
+		targets := []imageTarget{{provider: provider, scope: c.AWS.Region, name: c.AWS.AMIName}}
+		for _, region := range c.AWS.ReplicationRegions {
+			if region == "*" || region == c.AWS.Region {
+				continue
+			}
+			regional, err := c.RenderAWSRegion(region)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, imageTarget{provider: provider, scope: region, name: regional.AWS.AMIName})
+		}
+		return targets, nil
+	case ProviderAzure:
+		scope := path.Join(c.Azure.SubscriptionID, c.Azure.ResourceGroup, c.Azure.SharedImageGallery, c.Azure.ImageDefinitionName)
+		return []imageTarget{{provider: provider, scope: scope, name: c.ImageVersion}}, nil
+	case ProviderGCP:
+		return []imageTarget{{provider: provider, scope: c.GCP.Project, name: c.GCP.ImageName}}, nil
+	case ProviderOpenStack:
+		return []imageTarget{{provider: provider, scope: c.OpenStack.Cloud, name: c.OpenStack.ImageName}}, nil
+	case ProviderScaleway:
+		scope := path.Join(c.Scaleway.ProjectID, c.Scaleway.Zone)
+		return []imageTarget{{provider: provider, scope: scope, name: c.Scaleway.ImageName}}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// checkImageNameCollisions returns an error for each image that is created by more than one of the rendered configs.
+// The configs are given in the order of names, which is the order collisions are reported in.
+func checkImageNameCollisions(names []string, configs map[string]Config) error {
+	owners := make(map[imageTarget]string)
+	var errs error
+	for _, name := range names {
+		cfg := configs[name]
+		targets, err := cfg.imageTargets()
+		if err != nil {
+			return fmt.Errorf("config for variant %s: %w", name, err)
+		}
+		for _, target := range targets {
+			owner, ok := owners[target]
+			if !ok {
+				owners[target] = name
+				continue
+			}
+			if owner == name {
+				continue
+			}
+			errs = errors.Join(errs, fmt.Errorf("%w: variants %s and %s both create %s image %q in %s",
+				ErrImageNameCollision, owner, name, target.provider, target.name, target.scope))
+		}
+	}
+	return errs
+}
+
+// manifestTargets returns where an upload with the rendered config writes its manifest, described for error messages.
+func (c *Config) manifestTargets() []string {
+	var targets []string
+	if c.Manifest.Path != "" {
+		targets = append(targets, fmt.Sprintf("%q", filepath.Clean(c.Manifest.Path)))
+	}
+	if c.Manifest.Key != "" {
+		var bucket string
+		switch Provider(c.Provider) {
+		case ProviderAWS:
+			bucket = c.AWS.Bucket
+		case ProviderGCP:
+			bucket = c.GCP.Bucket
+		case ProviderScaleway:
+			bucket = path.Join(c.Scaleway.Zone, c.Scaleway.Bucket)
+		}
+		targets = append(targets, fmt.Sprintf("%q in %s bucket %s", c.Manifest.Key, c.Provider, bucket))
+	}
+	return targets
+}
+
+// checkManifestCollisions returns an error for each manifest file or object that is written by more than one of the rendered configs.
+// The configs are given in the order of names, which is the order collisions are reported in.
+func checkManifestCollisions(names []string, configs map[string]Config) error {
+	owners := make(map[string]string)
+	var errs error
+	for _, name := range names {
+		cfg := configs[name]
+		for _, target := range cfg.manifestTargets() {
+			owner, ok := owners[target]
+			if !ok {
+				owners[target] = name
+				continue
+			}
+			errs = errors.Join(errs, fmt.Errorf("%w: variants %s and %s both write the manifest %s", ErrManifestCollision, owner, name, target))
+		}
+	}
+	return errs
+}
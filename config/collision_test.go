@@ -0,0 +1,173 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFileForEachImageNameCollision(t *testing.T) {
+	base := Config{
+		Provider: "aws",
+		Name:     "my-image",
+		AWS: AWSConfig{
+			Region: "us-east-1",
+			Bucket: "my-bucket",
+		},
+		GCP: validConfig().GCP,
+	}
+	testCases := map[string]struct {
+		variants    map[string]Config
+		wantErrText []string
+	}{
+		"distinct names": {
+			variants: map[string]Config{
+				"a": {Name: "image-a"},
+				"b": {Name: "image-b"},
+			},
+		},
+		"same name in same region": {
+			variants: map[string]Config{
+				"a": {},
+				"b": {},
+			},
+			wantErrText: []string{"variants a and b", `"my-image-0.0.0"`, "us-east-1"},
+		},
+		"same name in different regions": {
+			variants: map[string]Config{
+				"a": {},
+				"b": {AWS: AWSConfig{Region: "eu-west-1"}},
+			},
+		},
+		"same name in replication region": {
+			variants: map[string]Config{
+				"a": {AWS: AWSConfig{ReplicationRegions: []string{"eu-west-1"}}},
+				"b": {AWS: AWSConfig{Region: "eu-west-1"}},
+			},
+			wantErrText: []string{"variants a and b", `"my-image-0.0.0"`, "eu-west-1"},
+		},
+		"region specific names in replication regions": {
+			variants: map[string]Config{
+				"a": {AWS: AWSConfig{AMIName: "{{.Name}}-{{.Region}}", ReplicationRegions: []string{"eu-west-1"}}},
+				"b": {AWS: AWSConfig{AMIName: "{{.Name}}-{{.Region}}", Region: "eu-west-1"}},
+			},
+		},
+		"same name with different providers": {
+			variants: map[string]Config{
+				"a": {GCP: GCPConfig{ImageName: "my-image-0-0-0"}},
+				"b": {Provider: "gcp", GCP: GCPConfig{ImageName: "my-image-0-0-0"}},
+			},
+		},
+		"same name in same GCP project": {
+			variants: map[string]Config{
+				"a": {Provider: "gcp", GCP: GCPConfig{ImageName: "my-image"}},
+				"b": {Provider: "gcp", GCP: GCPConfig{ImageName: "my-image"}},
+				"c": {Provider: "gcp", GCP: GCPConfig{ImageName: "my-image"}},
+			},
+			wantErrText: []string{"variants a and b", "variants a and c", `gcp image "my-image"`},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := ConfigFile{Base: base.Clone(), Variants: tc.variants}
+
+			var called bool
+			err := conf.ForEach(func(string, Config) error {
+				called = true
+				return nil
+			}, stubFileLookup{}.Lookup)
+			if len(tc.wantErrText) > 0 {
+				assert.ErrorIs(err, ErrImageNameCollision)
+				for _, text := range tc.wantErrText {
+					assert.ErrorContains(err, text)
+				}
+				assert.False(called)
+				return
+			}
+			assert.NoError(err)
+			assert.True(called)
+		})
+	}
+}
+
+func TestConfigFileForEachManifestCollision(t *testing.T) {
+	base := Config{
+		Provider:     "aws",
+		Name:         "my-image",
+		ImageVersion: "1.0.0",
+		AWS: AWSConfig{
+			Region:  "us-east-1",
+			Bucket:  "my-bucket",
+			AMIName: "{{.Name}}-{{.Vars.variant}}",
+		},
+	}
+	testCases := map[string]struct {
+		variants    map[string]Config
+		wantErrText []string
+	}{
+		"no manifests": {
+			variants: map[string]Config{
+				"a": {Vars: map[string]string{"variant": "a"}},
+				"b": {Vars: map[string]string{"variant": "b"}},
+			},
+		},
+		"distinct paths": {
+			variants: map[string]Config{
+				"a": {Vars: map[string]string{"variant": "a"}, Manifest: ManifestConfig{Path: "manifests/{{.Vars.variant}}.json"}},
+				"b": {Vars: map[string]string{"variant": "b"}, Manifest: ManifestConfig{Path: "manifests/{{.Vars.variant}}.json"}},
+			},
+		},
+		"same path": {
+			variants: map[string]Config{
+				"a": {Vars: map[string]string{"variant": "a"}, Manifest: ManifestConfig{Path: "manifest.json"}},
+				"b": {Vars: map[string]string{"variant": "b"}, Manifest: ManifestConfig{Path: "./manifest.json"}},
+			},
+			wantErrText: []string{"variants a and b", `"manifest.json"`},
+		},
+		"same rendered path": {
+			variants: map[string]Config{
+				"a": {Vars: map[string]string{"variant": "a"}, Manifest: ManifestConfig{Path: "manifests/{{.Version}}.json"}},
+				"b": {Vars: map[string]string{"variant": "b"}, Manifest: ManifestConfig{Path: "manifests/{{.Version}}.json"}},
+			},
+			wantErrText: []string{"variants a and b", `"manifests/1.0.0.json"`},
+		},
+		"same key in same bucket": {
+			variants: map[string]Config{
+				"a": {Vars: map[string]string{"variant": "a"}, Manifest: ManifestConfig{Key: "manifest.json"}},
+				"b": {Vars: map[string]string{"variant": "b"}, Manifest: ManifestConfig{Key: "manifest.json"}},
+			},
+			wantErrText: []string{"variants a and b", `"manifest.json" in aws bucket my-bucket`},
+		},
+		"same key in different buckets": {
+			variants: map[string]Config{
+				"a": {Vars: map[string]string{"variant": "a"}, Manifest: ManifestConfig{Key: "manifest.json"}},
+				"b": {Vars: map[string]string{"variant": "b"}, AWS: AWSConfig{Bucket: "other-bucket"}, Manifest: ManifestConfig{Key: "manifest.json"}},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := ConfigFile{Base: base.Clone(), Variants: tc.variants}
+
+			err := conf.ForEach(func(string, Config) error { return nil }, stubFileLookup{}.Lookup)
+			if len(tc.wantErrText) > 0 {
+				assert.ErrorIs(err, ErrManifestCollision)
+				for _, text := range tc.wantErrText {
+					assert.ErrorContains(err, text)
+				}
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
@@ -7,28 +7,55 @@ SPDX-License-Identifier: Apache-2.0
 package config
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"html/template"
+	"maps"
+	"os"
+	"path/filepath"
 	"reflect"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	uplositemplate "github.com/edgelesssys/uplosi/template"
 
 	"dario.cat/mergo"
+	"github.com/BurntSushi/toml"
 )
 
+var (
+	// ErrVariantNotFound is returned if a requested variant doesn't exist in the config file.
+	ErrVariantNotFound = errors.New("variant not found")
+	// ErrVariantExists is returned if a variant is added to a config file that already has a variant of the same name.
+	ErrVariantExists = errors.New("variant already exists")
+	// ErrMissingProviderConfig is returned if a variant switches to another provider
+	// without a config section for that provider.
+	ErrMissingProviderConfig = errors.New("missing provider config")
+	// ErrImageDigestUnavailable is returned if a template uses the image digest
+	// before it was set on the config.
+	ErrImageDigestUnavailable = errors.New("image digest not available")
+)
+
+// shortDigestLength is the number of hex characters returned by the sha256short template function.
+const shortDigestLength = 12
+
 var defaultConfig = Config{
 	ImageVersion: "0.0.0",
 	AWS: AWSConfig{
-		ReplicationRegions: []string{},
-		AMIName:            "{{.Name}}-{{.Version}}",
-		AMIDescription:     "{{.Name}}-{{.Version}}",
-		BlobName:           "{{.Name}}-{{.Version}}.raw",
-		SnapshotName:       "{{.Name}}-{{.Version}}",
-		Publish:            Some(false),
+		ReplicationRegions:     []string{},
+		AMIName:                "{{.Name}}-{{.Version}}",
+		AMIDescription:         "{{.Name}}-{{.Version}}",
+		BlobName:               "{{.Name}}-{{.Version}}.raw",
+		StorageClass:           "STANDARD",
+		SnapshotName:           "{{.Name}}-{{.Version}}",
+		TPMSupport:             "v2.0",
+		RootDeviceName:         "/dev/xvda",
+		Publish:                Some(false),
+		AllowCrossRegionBucket: Some(false),
 	},
 	Azure: AzureConfig{
 		AttestationVariant:  "azure-sev-snp",
@@ -38,59 +65,452 @@ var defaultConfig = Config{
 		Offer:               "Linux",
 		SKU:                 "{{.Name}}-{{.VersionMajor}}",
 		Publisher:           "Contoso",
+		SkipZeroPages:       Some(true),
 	},
 	GCP: GCPConfig{
 		ImageName:   "{{.Name}}-{{replaceAll .Version \".\" \"-\"}}",
 		ImageFamily: "{{.Name}}",
 		BlobName:    "{{.Name}}-{{replaceAll .Version \".\" \"-\"}}.tar.gz",
+		GuestOSFeatures: []string{
+			"GVNIC",
+			"SEV_CAPABLE",
+			"SEV_SNP_CAPABLE",
+			"VIRTIO_SCSI_MULTIQUEUE",
+			"UEFI_COMPATIBLE",
+		},
+		State:                "ACTIVE",
+		Sharing:              GCPSharingAllAuthenticatedUsers,
+		ConfirmAllUsers:      Some(false),
+		DeprecateOldInFamily: Some(false),
+		SkipZeroBlocks:       Some(true),
 	},
 	OpenStack: OpenStackConfig{
 		ImageName:  "{{.Name}}-{{.Version}}",
 		Visibility: "public",
 		Protected:  Some(false),
 	},
+	Scaleway: ScalewayConfig{
+		ObjectName: "{{.Name}}-{{.Version}}.qcow2",
+		ImageName:  "{{.Name}}-{{.Version}}",
+		Arch:       "x86_64",
+	},
 }
 
 type Config struct {
-	Provider         string          `toml:"provider"`
-	ImageVersion     string          `toml:"imageVersion"`
-	ImageVersionFile string          `toml:"imageVersionFile"`
-	Name             string          `toml:"name"`
-	AWS              AWSConfig       `toml:"aws,omitempty"`
-	Azure            AzureConfig     `toml:"azure,omitempty"`
-	GCP              GCPConfig       `toml:"gcp,omitempty"`
-	OpenStack        OpenStackConfig `toml:"openstack,omitempty"`
+	Provider            string          `toml:"provider"`
+	ImageVersion        string          `toml:"imageVersion"`
+	ImageVersionFile    string          `toml:"imageVersionFile"`
+	ImageVersionFileKey string          `toml:"imageVersionFileKey,omitempty"`
+	Name                string          `toml:"name"`
+	TTL                 string          `toml:"ttl,omitempty"`
+	AWS                 AWSConfig       `toml:"aws,omitempty"`
+	Azure               AzureConfig     `toml:"azure,omitempty"`
+	GCP                 GCPConfig       `toml:"gcp,omitempty"`
+	OpenStack           OpenStackConfig `toml:"openstack,omitempty"`
+	Scaleway            ScalewayConfig  `toml:"scaleway,omitempty"`
+	Manifest            ManifestConfig  `toml:"manifest,omitempty"`
+	// Vars are additional values available to templates as {{.Vars.<key>}},
+	// e.g. the dimension values of variants created by ExpandMatrix.
+	Vars map[string]string `toml:"vars,omitempty"`
+	// ImageDigest is the hex encoded sha256 digest of the (decompressed) image.
+	// It is not read from config files but set by the caller once the image is known,
+	// and must be set before rendering templates that use it.
+	ImageDigest string `toml:"-"`
+	// Warnings collects non-fatal issues found while rendering, e.g. truncated descriptions.
+	Warnings []string `toml:"-"`
 }
 
 func (c *Config) Merge(other Config) error {
-	return mergo.Merge(c, other, mergo.WithOverride, mergo.WithTransformers(&OptionTransformer{}))
+	return c.MergeWithOptions(other, mergo.WithOverride)
+}
+
+// MergeWithOptions merges other into the config with the given mergo options instead of mergo.WithOverride,
+// e.g. without options to only fill fields that are empty in the config, or with mergo.WithAppendSlice.
+// The OptionTransformer is always used for options. Transformers passed with mergo.WithTransformers
+// are used for all other types.
+func (c *Config) MergeWithOptions(other Config, opts ...func(*mergo.Config)) error {
+	var mergeConfig mergo.Config
+	for _, opt := range opts {
+		opt(&mergeConfig)
+	}
+	transformers := transformerChain{&OptionTransformer{}, mergeConfig.Transformers}
+	return mergo.Merge(c, other, append(slices.Clip(opts), mergo.WithTransformers(transformers))...)
+}
+
+// MergeVerbose is like Merge, but additionally returns the paths of the fields that were changed by other,
+// using the keys of the config file, e.g. "aws.amiName".
+// Fields that other sets to their current value are not reported.
+func (c *Config) MergeVerbose(other Config) (changed []string, err error) {
+	before := c.Clone()
+	if err := c.Merge(other); err != nil {
+		return nil, err
+	}
+	return changedFields("", reflect.ValueOf(before), reflect.ValueOf(*c)), nil
+}
+
+// changedFields returns the paths of all fields of the structs a and b that are not equal.
+// Nested structs are compared field by field, options, slices and maps as a whole.
+// Fields that are not part of the config file format are ignored.
+func changedFields(prefix string, a, b reflect.Value) []string {
+	var changed []string
+	for i := range a.NumField() {
+		field := a.Type().Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if !field.IsExported() || key == "-" {
+			continue
+		}
+		if key == "" {
+			key = field.Name
+		}
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		if field.Type.Kind() == reflect.Struct && !field.Type.Implements(optionType) {
+			changed = append(changed, changedFields(path, a.Field(i), b.Field(i))...)
+			continue
+		}
+		if !equalValues(a.Field(i), b.Field(i)) {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// Clone returns a deep copy of the config.
+// Slices and maps are copied, so the clone can be mutated without affecting the original.
+func (c *Config) Clone() Config {
+	clone := *c
+	clone.Vars = maps.Clone(c.Vars)
+	clone.AWS.ReplicationRegions = slices.Clone(c.AWS.ReplicationRegions)
+	clone.AWS.BlobTags = maps.Clone(c.AWS.BlobTags)
+	clone.AWS.OrganizationARNs = slices.Clone(c.AWS.OrganizationARNs)
+	clone.AWS.OrganizationalUnitARNs = slices.Clone(c.AWS.OrganizationalUnitARNs)
+	clone.Azure.ReplicationRegions = slices.Clone(c.Azure.ReplicationRegions)
+	clone.Azure.TargetRegions = slices.Clone(c.Azure.TargetRegions)
+	clone.Azure.AdditionalSignatures = slices.Clone(c.Azure.AdditionalSignatures)
+	clone.Azure.Features = maps.Clone(c.Azure.Features)
+	clone.GCP.ReplicationLocations = slices.Clone(c.GCP.ReplicationLocations)
+	clone.GCP.GuestOSFeatures = slices.Clone(c.GCP.GuestOSFeatures)
+	clone.GCP.BlobTags = maps.Clone(c.GCP.BlobTags)
+	clone.GCP.Licenses = slices.Clone(c.GCP.Licenses)
+	clone.OpenStack.Tags = slices.Clone(c.OpenStack.Tags)
+	clone.OpenStack.Properties = maps.Clone(c.OpenStack.Properties)
+	clone.Warnings = slices.Clone(c.Warnings)
+	return clone
+}
+
+// Equal reports whether both configs are equal.
+// Unset options are equal regardless of their stored value,
+// and nil slices and maps are equal to empty ones.
+// Unexported fields, like the state kept to render AMI names for replication regions, are ignored like by Hash.
+func (c *Config) Equal(other Config) bool {
+	return equalValues(reflect.ValueOf(*c), reflect.ValueOf(other))
+}
+
+func equalValues(a, b reflect.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	if a.Type().Implements(optionType) {
+		if a.FieldByName("Valid").Bool() != b.FieldByName("Valid").Bool() {
+			return false
+		}
+		return !a.FieldByName("Valid").Bool() || equalValues(a.FieldByName("Val"), b.FieldByName("Val"))
+	}
+
+	switch a.Kind() {
+	case reflect.Struct:
+		for i := range a.NumField() {
+			if !a.Type().Field(i).IsExported() {
+				continue
+			}
+			if !equalValues(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := range a.Len() {
+			if !equalValues(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			bVal := b.MapIndex(iter.Key())
+			if !bVal.IsValid() || !equalValues(iter.Value(), bVal) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a.Equal(b)
+	}
+}
+
+// optionType is implemented by all Option types.
+var optionType = reflect.TypeOf((*interface{ IsSome() bool })(nil)).Elem()
+
+// EncodeTOML returns the TOML encoding of the config.
+// Fields that are not part of the config file format, like warnings, are omitted.
+func (c *Config) EncodeTOML() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(c); err != nil {
+		return nil, fmt.Errorf("encoding config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ResolvedVersion returns the image version the config resolves to,
+// e.g. to compare it against the last uploaded version and skip unchanged builds.
+// It should be called on a rendered config, as rendering reads the version file.
+// An error is returned if the version is not resolved yet, like AutoVersion.
+func (c *Config) ResolvedVersion() (string, error) {
+	if !imageVersionPattern.MatchString(c.ImageVersion) {
+		return "", fmt.Errorf("image version %q is not resolved", c.ImageVersion)
+	}
+	return c.ImageVersion, nil
+}
+
+// ExpiryTag is the tag or label that is set to the expiry time of images uploaded with a TTL.
+const ExpiryTag = "expiry"
+
+// ExpiresAt returns the expiry time of an image uploaded at now, which is now plus the TTL.
+// It returns the zero time if no TTL is set.
+func (c *Config) ExpiresAt(now time.Time) (time.Time, error) {
+	if c.TTL == "" {
+		return time.Time{}, nil
+	}
+	ttl, err := ParseDuration(c.TTL)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing ttl: %w", err)
+	}
+	return now.Add(ttl).UTC(), nil
+}
+
+// ParseDuration parses a positive duration, either as a number of days like "90d"
+// or in the format accepted by time.ParseDuration.
+func ParseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q: %w", days, err)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+	return d, nil
+}
+
+// IsPublishing reports whether uploading with this config makes the image
+// available outside of the owning account for the selected provider.
+// It should be called on a rendered config.
+func (c *Config) IsPublishing() bool {
+	provider, err := c.ResolveProvider()
+	if err != nil {
+		return false
+	}
+	switch provider {
+	case ProviderAWS:
+		// Sharing with organizations or organizational units makes the image available to other accounts.
+		return c.AWS.Publish.UnwrapOr(false) || len(c.AWS.OrganizationARNs) > 0 || len(c.AWS.OrganizationalUnitARNs) > 0
+	case ProviderAzure:
+		return c.Azure.SharingProfile == "community"
+	case ProviderGCP:
+		return c.GCP.Sharing != GCPSharingPrivate
+	case ProviderOpenStack:
+		return c.OpenStack.Visibility == "" || c.OpenStack.Visibility == "public" || c.OpenStack.Visibility == "community"
+	case ProviderScaleway:
+		// Scaleway images are only available within their project.
+		return false
+	default:
+		return false
+	}
+}
+
+// DefaultConfig returns a copy of the defaults that SetDefaults fills unset fields with,
+// e.g. to show the effective defaults to users.
+func DefaultConfig() Config {
+	return defaultConfig.Clone()
 }
 
 func (c *Config) SetDefaults() error {
-	return mergo.Merge(c, defaultConfig, mergo.WithTransformers(&OptionTransformer{}))
+	// Merge a copy, so the defaults don't share slices with the config.
+	return c.MergeWithOptions(DefaultConfig())
+}
+
+// RenderOption configures how template strings are rendered.
+type RenderOption func(*renderOptions)
+
+type renderOptions struct {
+	funcs map[string]any
+	// region is the AWS region available to templates as {{.Region}}.
+	region string
+	// now is the time used by the time functions of templates.
+	now time.Time
+	// nowErr is returned by the time functions if the time could not be determined.
+	nowErr error
+	// glob resolves glob patterns in the imageVersionFile.
+	glob globFn
+	// imageDigest computes the image digest if a template uses it and the config doesn't set it.
+	imageDigest func() (string, error)
+	// regionOverride replaces the configured region of the provider, if set.
+	regionOverride string
+}
+
+// globFn returns the names of all files matching the pattern, like filepath.Glob.
+type globFn func(pattern string) ([]string, error)
+
+// sourceDateEpochEnv is the environment variable of the reproducible builds specification
+// that fixes the time used by template functions: https://reproducible-builds.org/specs/source-date-epoch/
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// WithTime freezes the time used by the time functions of templates, like now and date,
+// so renders with the same time and inputs produce identical output.
+// Without this option, the time is taken from SOURCE_DATE_EPOCH if set, otherwise the current time is used.
+func WithTime(t time.Time) RenderOption {
+	return func(o *renderOptions) {
+		o.now = t.UTC()
+	}
+}
+
+// WithFuncMap makes additional functions available to template strings.
+// They are added on top of the default functions and replace functions of the same name.
+// Functions should be pure, so rendering a config stays deterministic.
+func WithFuncMap(funcs map[string]any) RenderOption {
+	return func(o *renderOptions) {
+		if o.funcs == nil {
+			o.funcs = make(map[string]any, len(funcs))
+		}
+		maps.Copy(o.funcs, funcs)
+	}
+}
+
+// WithGlob sets the function resolving a glob pattern in the imageVersionFile to the files matching it.
+// It should list the files known to the file lookup passed to Render, e.g. if that doesn't read from the local filesystem.
+// Without this option, filepath.Glob is used.
+func WithGlob(glob func(pattern string) ([]string, error)) RenderOption {
+	return func(o *renderOptions) {
+		o.glob = glob
+	}
+}
+
+// WithImageDigest sets the function computing the image digest, if a template uses it
+// (via sha256short or .ImageDigest) and Config.ImageDigest is unset.
+// This allows skipping the computation, e.g. reading or downloading the whole image, if no template needs the digest.
+// The computed digest is stored in the rendered config. The function may be called once per render, so it should cache its result.
+func WithImageDigest(fn func() (string, error)) RenderOption {
+	return func(o *renderOptions) {
+		o.imageDigest = fn
+	}
+}
+
+// WithRegionOverride replaces the configured region (AWS) or location (Azure, GCP) of the rendered config,
+// e.g. to test against a sandbox region without changing the config.
+// It is applied after the templates are rendered. An empty region keeps the configured one.
+func WithRegionOverride(region string) RenderOption {
+	return func(o *renderOptions) {
+		o.regionOverride = region
+	}
+}
+
+func newRenderOptions(opts []RenderOption) renderOptions {
+	var o renderOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.now.IsZero() {
+		o.now, o.nowErr = renderTime()
+	}
+	if o.glob == nil {
+		o.glob = filepath.Glob
+	}
+	return o
+}
+
+// renderTime returns the time given by SOURCE_DATE_EPOCH or the current time.
+func renderTime() (time.Time, error) {
+	epoch, ok := os.LookupEnv(sourceDateEpochEnv)
+	if !ok || epoch == "" {
+		return time.Now().UTC(), nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing %s: %w", sourceDateEpochEnv, err)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// timeFuncMap returns the template functions that depend on the render time.
+func (o renderOptions) timeFuncMap() map[string]any {
+	return map[string]any{
+		"now": func() (time.Time, error) {
+			return o.now, o.nowErr
+		},
+		"date": func(layout string) (string, error) {
+			return o.now.Format(layout), o.nowErr
+		},
+	}
 }
 
 // Render renders the config by evaluating the version file and all template strings.
-func (c *Config) Render(fileLookup func(name string) ([]byte, error)) error {
-	if err := c.renderVersion(fileLookup); err != nil {
+func (c *Config) Render(fileLookup func(name string) ([]byte, error), opts ...RenderOption) error {
+	o := newRenderOptions(opts)
+
+	if err := c.renderVersion(fileLookup, o.glob); err != nil {
 		return err
 	}
+	c.ImageVersion = zeroFillVersion(c.ImageVersion)
 
-	if err := c.renderTemplates(c); err != nil {
+	if err := c.renderTemplates(c, o); err != nil {
+		return err
+	}
+	// The AMI name is rendered again for every replication region by RenderAWSRegion.
+	c.AWS.amiNameTemplate = c.AWS.AMIName
+	c.AWS.renderTime = o.now
+	c.AWS.renderOptions = slices.Clip(opts)
+	if err := c.renderTemplates(&c.AWS, o); err != nil {
+		return err
+	}
+	if err := c.renderTemplates(&c.Azure, o); err != nil {
+		return err
+	}
+	if err := c.renderTemplates(&c.GCP, o); err != nil {
 		return err
 	}
-	if err := c.renderTemplates(&c.AWS); err != nil {
+	if err := c.renderTemplates(&c.OpenStack, o); err != nil {
 		return err
 	}
-	if err := c.renderTemplates(&c.Azure); err != nil {
+	if err := c.renderTemplates(&c.Scaleway, o); err != nil {
 		return err
 	}
-	if err := c.renderTemplates(&c.GCP); err != nil {
+	if err := c.renderTemplates(&c.Manifest, o); err != nil {
 		return err
 	}
-	if err := c.renderTemplates(&c.OpenStack); err != nil {
+	if err := c.renderDescriptionFiles(fileLookup); err != nil {
 		return err
 	}
+	c.Provider = string(normalizeProvider(c.Provider))
+	c.overrideRegion(o.regionOverride)
+	c.normalizeRegions()
 
 	v := Validator{}
 
@@ -101,36 +521,103 @@ func (c *Config) Render(fileLookup func(name string) ([]byte, error)) error {
 	return nil
 }
 
-func (c *Config) renderVersion(fileLookup func(name string) ([]byte, error)) error {
+// overrideRegion replaces the region of the provider with the given one, unless it is empty.
+// Providers without a region are left unchanged.
+func (c *Config) overrideRegion(region string) {
+	if region == "" {
+		return
+	}
+	switch Provider(c.Provider) {
+	case ProviderAWS:
+		c.AWS.Region = region
+	case ProviderAzure:
+		c.Azure.Location = region
+	case ProviderGCP:
+		c.GCP.Location = region
+	}
+}
+
+// normalizeRegions trims and lowercases the regions and locations,
+// so values like "US-East-1 " are accepted instead of failing in the SDKs.
+func (c *Config) normalizeRegions() {
+	normalize := func(region string) string {
+		return strings.ToLower(strings.TrimSpace(region))
+	}
+	// The slices may be shared with the unrendered config.
+	normalizeAll := func(regions []string) []string {
+		if regions == nil {
+			return nil
+		}
+		normalized := make([]string, len(regions))
+		for i, region := range regions {
+			normalized[i] = normalize(region)
+		}
+		return normalized
+	}
+	c.AWS.Region = normalize(c.AWS.Region)
+	c.AWS.ReplicationRegions = normalizeAll(c.AWS.ReplicationRegions)
+	c.Azure.Location = normalize(c.Azure.Location)
+	c.GCP.Location = normalize(c.GCP.Location)
+	c.GCP.ReplicationLocations = normalizeAll(c.GCP.ReplicationLocations)
+}
+
+func (c *Config) renderVersion(fileLookup func(name string) ([]byte, error), glob globFn) error {
 	if len(c.ImageVersionFile) == 0 {
 		return nil
 	}
-	ver, err := fileLookup(c.ImageVersionFile)
+	ver, err := lookupVersionFile(fileLookup, glob, c.ImageVersionFile)
 	if err != nil {
-		return err
+		return fmt.Errorf("imageVersionFile: %w", err)
+	}
+	version := strings.TrimSpace(string(ver))
+	if version == "" {
+		return fmt.Errorf("imageVersionFile %q is empty", c.ImageVersionFile)
 	}
-	c.ImageVersion = strings.TrimSpace(string(ver))
+	if c.ImageVersionFileKey != "" {
+		version, err = versionFromKey(ver, c.ImageVersionFileKey)
+		if err != nil {
+			return fmt.Errorf("imageVersionFile %q: %w", c.ImageVersionFile, err)
+		}
+	}
+	// Version files often use the "v" prefix of git tags.
+	c.ImageVersion = strings.TrimPrefix(version, "v")
 	return nil
 }
 
-func (c *Config) renderTemplates(configStruct any) error {
+func (c *Config) renderTemplates(configStruct any, o renderOptions) error {
 	numFields := reflect.TypeOf(configStruct).Elem().NumField()
 	for i := 0; i < numFields; i++ {
 		typeField := reflect.TypeOf(configStruct).Elem().Field(i)
 		name := typeField.Name
 		tag := typeField.Tag
 		field := reflect.ValueOf(configStruct).Elem().Field(i)
-		if err := c.renderFieldTemplate(name, field, tag); err != nil {
+		if err := c.renderFieldTemplate(name, field, tag, o); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// zeroFillVersion appends missing minor and patch components to short versions, so "1.2" becomes "1.2.0".
+// Other values are returned unchanged and left to validation.
+func zeroFillVersion(version string) string {
+	if !shortVersionPattern.MatchString(version) {
+		return version
+	}
+	for strings.Count(version, ".") < 2 {
+		version += ".0"
+	}
+	return version
+}
+
 func (c *Config) fieldTemplateData() fieldTemplateData {
 	var VersionMajor, VersionMinor, VersionPatch string
 	versionParts := strings.Split(c.ImageVersion, ".")
-	if len(versionParts) == 3 {
+	if c.ImageVersion != "" && len(versionParts) <= 3 {
+		// Missing minor and patch components are zero-filled, so "1.2" is treated as "1.2.0".
+		for len(versionParts) < 3 {
+			versionParts = append(versionParts, "0")
+		}
 		VersionMajor = versionParts[0]
 		VersionMinor = versionParts[1]
 		VersionPatch = versionParts[2]
@@ -141,72 +628,292 @@ func (c *Config) fieldTemplateData() fieldTemplateData {
 		VersionMajor: VersionMajor,
 		VersionMinor: VersionMinor,
 		VersionPatch: VersionPatch,
+		Vars:         c.Vars,
+		imageDigest: func() (string, error) {
+			return c.ImageDigest, nil
+		},
 	}
 }
 
-func (c *Config) renderFieldTemplate(name string, field reflect.Value, tag reflect.StructTag) error {
+func (c *Config) renderFieldTemplate(name string, field reflect.Value, tag reflect.StructTag, o renderOptions) error {
 	if tag.Get("template") != "true" {
 		return nil
 	}
+	if field.Kind() == reflect.Map && field.Type().Key().Kind() == reflect.String &&
+		field.Type().Elem().Kind() == reflect.String && field.CanSet() {
+		return c.renderMapTemplate(name, field, o)
+	}
 	if field.Kind() != reflect.String || !field.CanSet() {
-		return fmt.Errorf("field %s must be settable a string", name)
+		return fmt.Errorf("field %s must be settable a string or map of strings", name)
 	}
-	tmpl, err := template.New(name).Funcs(uplositemplate.DefaultFuncMap()).Parse(field.String())
+	renderedField, err := c.renderTemplate(name, field.String(), o)
 	if err != nil {
-		return err
+		return fmt.Errorf("field %s: %w", name, err)
 	}
-	renderedField := new(strings.Builder)
-	if err := tmpl.Execute(renderedField, c.fieldTemplateData()); err != nil {
-		return err
+	field.SetString(renderedField)
+	return nil
+}
+
+// renderMapTemplate renders the values of a map of strings.
+// The rendered values are stored in a new map, as the original map may be shared with other configs.
+func (c *Config) renderMapTemplate(name string, field reflect.Value, o renderOptions) error {
+	if field.IsNil() {
+		return nil
 	}
-	field.SetString(renderedField.String())
+	rendered := reflect.MakeMapWithSize(field.Type(), field.Len())
+	iter := field.MapRange()
+	for iter.Next() {
+		key := iter.Key().String()
+		renderedValue, err := c.renderTemplate(name+"."+key, iter.Value().String(), o)
+		if err != nil {
+			return fmt.Errorf("field %s key %s: %w", name, key, err)
+		}
+		rendered.SetMapIndex(iter.Key(), reflect.ValueOf(renderedValue).Convert(field.Type().Elem()))
+	}
+	field.Set(rendered)
 	return nil
 }
 
+// TemplateFields returns the paths of all config fields that support templates, using the keys of the config file,
+// e.g. "aws.amiName". For maps, like "aws.blobTags", the values support templates.
+// The paths are derived from the struct tags used by Render, e.g. to tell users in editors or documentation
+// which fields support templates.
+func TemplateFields() []string {
+	return templateFields("", reflect.TypeOf(Config{}))
+}
+
+func templateFields(prefix string, typ reflect.Type) []string {
+	var paths []string
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if !field.IsExported() || key == "-" {
+			continue
+		}
+		if key == "" {
+			key = field.Name
+		}
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		if field.Tag.Get("template") == "true" {
+			paths = append(paths, path)
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct && !field.Type.Implements(optionType) {
+			paths = append(paths, templateFields(path, field.Type)...)
+		}
+	}
+	return paths
+}
+
+// RenderAWSRegion returns a copy of the rendered config with the AMI name rendered for the given AWS region,
+// which is available to the template as {{.Region}}. Render leaves the region empty,
+// so the AMI name of the source region is the one rendered by Render.
+// Configs that were not rendered by Render are returned unchanged.
+// The AMI name is rendered with the options passed to Render, e.g. its functions, followed by opts.
+// Unless another time is given, the AMI name is rendered with the time used by Render.
+func (c *Config) RenderAWSRegion(region string, opts ...RenderOption) (Config, error) {
+	out := c.Clone()
+	if c.AWS.amiNameTemplate == "" {
+		return out, nil
+	}
+	o := newRenderOptions(slices.Concat(c.AWS.renderOptions, []RenderOption{WithTime(c.AWS.renderTime)}, opts))
+	o.region = region
+	amiName, err := c.renderTemplate("AMIName", c.AWS.amiNameTemplate, o)
+	if err != nil {
+		return Config{}, fmt.Errorf("field AMIName: %w", err)
+	}
+	out.AWS.AMIName = amiName
+
+	v := Validator{}
+	if err := v.Validate(context.TODO(), out); err != nil {
+		return Config{}, fmt.Errorf("config for region %s: %w", region, err)
+	}
+	return out, nil
+}
+
+// RenderString evaluates an arbitrary template string against the config,
+// the same way template fields are rendered by Render.
+func (c *Config) RenderString(tmpl string, opts ...RenderOption) (string, error) {
+	return c.renderTemplate("RenderString", tmpl, newRenderOptions(opts))
+}
+
+func (c *Config) renderTemplate(name, text string, o renderOptions) (string, error) {
+	tmpl, err := template.New(name).
+		Funcs(uplositemplate.DefaultFuncMap()).
+		Funcs(c.funcMap(o)).
+		Funcs(o.timeFuncMap()).
+		Funcs(o.funcs).
+		Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing template: %w", err)
+	}
+	data := c.fieldTemplateData()
+	data.imageDigest = func() (string, error) {
+		return c.imageDigest(o)
+	}
+	data.Region = o.region
+	rendered := new(strings.Builder)
+	if err := tmpl.Execute(rendered, data); err != nil {
+		return "", fmt.Errorf("rendering template: %w", err)
+	}
+	return rendered.String(), nil
+}
+
+// funcMap returns template functions that depend on the config.
+func (c *Config) funcMap(o renderOptions) map[string]any {
+	return map[string]any{
+		"sha256short": func() (string, error) {
+			return c.sha256short(o)
+		},
+	}
+}
+
+// sha256short returns the first characters of the image digest.
+func (c *Config) sha256short(o renderOptions) (string, error) {
+	digest, err := c.imageDigest(o)
+	if err != nil {
+		return "", err
+	}
+	if len(digest) < shortDigestLength {
+		return "", ErrImageDigestUnavailable
+	}
+	return digest[:shortDigestLength], nil
+}
+
+// imageDigest returns the image digest of the config.
+// If it is unset, it is computed with the function set by WithImageDigest and stored in the config.
+func (c *Config) imageDigest(o renderOptions) (string, error) {
+	if c.ImageDigest != "" || o.imageDigest == nil {
+		return c.ImageDigest, nil
+	}
+	digest, err := o.imageDigest()
+	if err != nil {
+		return "", fmt.Errorf("computing image digest: %w", err)
+	}
+	c.ImageDigest = digest
+	return digest, nil
+}
+
 type fieldTemplateData struct {
 	Name         string
 	Version      string
 	VersionMajor string
 	VersionMinor string
 	VersionPatch string
+	Vars         map[string]string
+	// Region is the destination region while rendering AMI names for AWS replication regions
+	// and empty otherwise.
+	Region string
+
+	imageDigest func() (string, error)
+}
+
+// ImageDigest returns the image digest, available to templates as {{.ImageDigest}}.
+func (d fieldTemplateData) ImageDigest() (string, error) {
+	return d.imageDigest()
 }
 
 type AWSConfig struct {
-	Region                   string       `toml:"region,omitempty"`
-	ReplicationRegions       []string     `toml:"replicationRegions,omitempty"`
-	AMIName                  string       `toml:"amiName,omitempty" template:"true"`
-	AMIDescription           string       `toml:"amiDescription,omitempty" template:"true"`
-	Bucket                   string       `toml:"bucket,omitempty" template:"true"`
-	BucketLocationConstraint string       `toml:"bucketLocationConstraint,omitempty" template:"false"`
-	BlobName                 string       `toml:"blobName,omitempty" template:"true"`
-	SnapshotName             string       `toml:"snapshotName,omitempty" template:"true"`
-	Publish                  Option[bool] `toml:"publish,omitempty"`
+	Region                   string            `toml:"region,omitempty"`
+	ReplicationRegions       []string          `toml:"replicationRegions,omitempty"`
+	AMIName                  string            `toml:"amiName,omitempty" template:"true"`
+	AMIDescription           string            `toml:"amiDescription,omitempty" template:"true"`
+	AMIDescriptionFile       string            `toml:"amiDescriptionFile,omitempty"`
+	Bucket                   string            `toml:"bucket,omitempty" template:"true"`
+	BucketLocationConstraint string            `toml:"bucketLocationConstraint,omitempty" template:"false"`
+	BlobName                 string            `toml:"blobName,omitempty" template:"true"`
+	BlobTags                 map[string]string `toml:"blobTags,omitempty" template:"true"`
+	BlobACL                  string            `toml:"blobACL,omitempty"`
+	StorageClass             string            `toml:"storageClass,omitempty"`
+	SnapshotName             string            `toml:"snapshotName,omitempty" template:"true"`
+	SnapshotID               string            `toml:"snapshotID,omitempty"`
+	TPMSupport               string            `toml:"tpmSupport,omitempty"`
+	IMDSSupport              string            `toml:"imdsSupport,omitempty"`
+	RootDeviceName           string            `toml:"rootDeviceName,omitempty"`
+	VolumeType               string            `toml:"volumeType,omitempty"`
+	IOPS                     int               `toml:"iops,omitempty"`
+	Throughput               int               `toml:"throughput,omitempty"`
+	DeprecateAt              string            `toml:"deprecateAt,omitempty"`
+	DeprecateAfter           string            `toml:"deprecateAfter,omitempty"`
+	Publish                  Option[bool]      `toml:"publish,omitempty"`
+	OrganizationARNs         []string          `toml:"organizationArns,omitempty"`
+	OrganizationalUnitARNs   []string          `toml:"organizationalUnitArns,omitempty"`
+	AllowCrossRegionBucket   Option[bool]      `toml:"allowCrossRegionBucket,omitempty"`
+
+	// amiNameTemplate is the AMI name before rendering, used to render it for replication regions.
+	amiNameTemplate string
+	// renderTime is the time the config was rendered at, so replication regions use the same time.
+	renderTime time.Time
+	// renderOptions are the options the config was rendered with, so replication regions use the same functions.
+	renderOptions []RenderOption
 }
 
 type AzureConfig struct {
-	SubscriptionID       string   `toml:"subscriptionID,omitempty"`
-	Location             string   `toml:"location,omitempty"`
-	ReplicationRegions   []string `toml:"replicationRegions,omitempty"`
-	ResourceGroup        string   `toml:"resourceGroup,omitempty" template:"true"`
-	AttestationVariant   string   `toml:"attestationVariant,omitempty" template:"true"`
-	SharedImageGallery   string   `toml:"sharedImageGallery,omitempty" template:"true"`
-	SharingProfile       string   `toml:"sharingProfile,omitempty" template:"true"`
-	SharingNamePrefix    string   `toml:"sharingNamePrefix,omitempty" template:"true"`
-	ImageDefinitionName  string   `toml:"imageDefinitionName,omitempty" template:"true"`
-	Offer                string   `toml:"offer,omitempty" template:"true"`
-	SKU                  string   `toml:"sku,omitempty" template:"true"`
-	Publisher            string   `toml:"publisher,omitempty" template:"true"`
-	DiskName             string   `toml:"diskName,omitempty" template:"true"`
-	AdditionalSignatures []string `toml:"additionalSignatures,omitempty"`
+	SubscriptionID       string              `toml:"subscriptionID,omitempty"`
+	Location             string              `toml:"location,omitempty"`
+	ReplicationRegions   []string            `toml:"replicationRegions,omitempty"`
+	TargetRegions        []AzureTargetRegion `toml:"targetRegions,omitempty"`
+	ResourceGroup        string              `toml:"resourceGroup,omitempty" template:"true"`
+	AttestationVariant   string              `toml:"attestationVariant,omitempty" template:"true"`
+	SharedImageGallery   string              `toml:"sharedImageGallery,omitempty" template:"true"`
+	SharingProfile       string              `toml:"sharingProfile,omitempty" template:"true"`
+	SharingNamePrefix    string              `toml:"sharingNamePrefix,omitempty" template:"true"`
+	ImageDefinitionName  string              `toml:"imageDefinitionName,omitempty" template:"true"`
+	Offer                string              `toml:"offer,omitempty" template:"true"`
+	SKU                  string              `toml:"sku,omitempty" template:"true"`
+	Publisher            string              `toml:"publisher,omitempty" template:"true"`
+	DiskName             string              `toml:"diskName,omitempty" template:"true"`
+	AdditionalSignatures []string            `toml:"additionalSignatures,omitempty"`
+	SkipZeroPages        Option[bool]        `toml:"skipZeroPages,omitempty"`
+	PlanName             string              `toml:"planName,omitempty"`
+	PlanPublisher        string              `toml:"planPublisher,omitempty"`
+	PlanProduct          string              `toml:"planProduct,omitempty"`
+	OSDiskSizeGB         int                 `toml:"osDiskSizeGB,omitempty"`
+	Features             map[string]string   `toml:"features,omitempty"`
+	WaitForReplication   Option[bool]        `toml:"waitForReplication,omitempty"`
+	EndOfLifeDate        string              `toml:"endOfLifeDate,omitempty"`
+}
+
+// AzureTargetRegion describes a region an image version is replicated to.
+type AzureTargetRegion struct {
+	Name               string `toml:"name"`
+	ReplicaCount       int    `toml:"replicaCount,omitempty"`
+	StorageAccountType string `toml:"storageAccountType,omitempty"`
 }
 
+// Sharing settings of GCP images.
+const (
+	// GCPSharingPrivate keeps the image private to the project.
+	GCPSharingPrivate = "private"
+	// GCPSharingAllAuthenticatedUsers allows all users signed in with a Google account to use the image.
+	GCPSharingAllAuthenticatedUsers = "allAuthenticatedUsers"
+	// GCPSharingAllUsers allows everyone to use the image, including anonymous users.
+	GCPSharingAllUsers = "allUsers"
+)
+
 type GCPConfig struct {
-	Project     string `toml:"project,omitempty"`
-	Location    string `toml:"location,omitempty"`
-	ImageName   string `toml:"imageName,omitempty" template:"true"`
-	ImageFamily string `toml:"imageFamily,omitempty" template:"true"`
-	Bucket      string `toml:"bucket,omitempty" template:"true"`
-	BlobName    string `toml:"blobName,omitempty" template:"true"`
+	Project              string            `toml:"project,omitempty"`
+	SourceProject        string            `toml:"sourceProject,omitempty"`
+	Location             string            `toml:"location,omitempty"`
+	ReplicationLocations []string          `toml:"replicationLocations,omitempty"`
+	ImageName            string            `toml:"imageName,omitempty" template:"true"`
+	ImageFamily          string            `toml:"imageFamily,omitempty" template:"true"`
+	Description          string            `toml:"description,omitempty" template:"true"`
+	State                string            `toml:"state,omitempty"`
+	Bucket               string            `toml:"bucket,omitempty" template:"true"`
+	BlobName             string            `toml:"blobName,omitempty" template:"true"`
+	BlobTags             map[string]string `toml:"blobTags,omitempty" template:"true"`
+	BlobACL              string            `toml:"blobACL,omitempty"`
+	GuestOSFeatures      []string          `toml:"guestOSFeatures,omitempty"`
+	Licenses             []string          `toml:"licenses,omitempty"`
+	Sharing              string            `toml:"sharing,omitempty"`
+	ConfirmAllUsers      Option[bool]      `toml:"confirmAllUsers,omitempty"`
+	OSDiskSizeGB         int               `toml:"osDiskSizeGB,omitempty"`
+	DeprecateOldInFamily Option[bool]      `toml:"deprecateOldInFamily,omitempty"`
+	SkipZeroBlocks       Option[bool]      `toml:"skipZeroBlocks,omitempty"`
 }
 
 type OpenStackConfig struct {
@@ -221,15 +928,125 @@ type OpenStackConfig struct {
 	Properties map[string]string `toml:"properties"`
 }
 
+type ScalewayConfig struct {
+	Zone       string `toml:"zone,omitempty"`
+	ProjectID  string `toml:"projectID,omitempty"`
+	Bucket     string `toml:"bucket,omitempty" template:"true"`
+	ObjectName string `toml:"objectName,omitempty" template:"true"`
+	ImageName  string `toml:"imageName,omitempty" template:"true"`
+	Arch       string `toml:"arch,omitempty"`
+}
+
+// ManifestConfig configures the JSON manifest written after each successful upload.
+// If neither Path nor Key is set, no manifest is written.
+type ManifestConfig struct {
+	// Path is the local file the manifest is written to.
+	Path string `toml:"path,omitempty" template:"true"`
+	// Key is the object in the bucket of the provider the manifest is written to.
+	Key string `toml:"key,omitempty" template:"true"`
+}
+
+// ParseConfigFile parses a TOML encoded config file, consisting of a base config and variants.
+func ParseConfigFile(data []byte) (ConfigFile, error) {
+	var conf ConfigFile
+	if _, err := toml.Decode(string(data), &conf); err != nil {
+		return ConfigFile{}, fmt.Errorf("decoding config file: %w", err)
+	}
+	return conf, nil
+}
+
+// ParseConfig parses a single TOML encoded config.
+func ParseConfig(data []byte) (Config, error) {
+	var conf Config
+	if _, err := toml.Decode(string(data), &conf); err != nil {
+		return Config{}, fmt.Errorf("decoding config: %w", err)
+	}
+	return conf, nil
+}
+
+// LoadMerged reads the config files at the given paths using fileLookup and merges them in order.
+// Settings in later files override those in earlier files.
+func LoadMerged(paths []string, fileLookup fileLookupFn) (ConfigFile, error) {
+	var merged ConfigFile
+	for _, path := range paths {
+		data, err := fileLookup(path)
+		if err != nil {
+			return ConfigFile{}, fmt.Errorf("reading config file %q: %w", path, err)
+		}
+		conf, err := ParseConfigFile(data)
+		if err != nil {
+			return ConfigFile{}, fmt.Errorf("config file %q: %w", path, err)
+		}
+		if err := merged.Merge(conf); err != nil {
+			return ConfigFile{}, fmt.Errorf("merging config file %q: %w", path, err)
+		}
+	}
+	return merged, nil
+}
+
+// configDirExtensions are the extensions of the files read from config directories.
+var configDirExtensions = []string{".conf", ".toml"}
+
+// LoadDir reads all config files in the directory and merges them in lexical order, like LoadMerged.
+// This allows splitting a config into multiple files, e.g. one per provider in a conf.d directory.
+// The directory is listed on the local filesystem by DirConfigPaths, only the files are read using fileLookup.
+// A directory that doesn't exist is an error wrapping fs.ErrNotExist.
+func LoadDir(dir string, fileLookup fileLookupFn) (ConfigFile, error) {
+	paths, err := DirConfigPaths(dir)
+	if err != nil {
+		return ConfigFile{}, err
+	}
+	return LoadMerged(paths, fileLookup)
+}
+
+// DirConfigPaths returns the paths of the config files in the directory in lexical order.
+// Files ending in .conf or .toml are config files, other files and subdirectories are ignored.
+// A directory that doesn't exist is an error wrapping fs.ErrNotExist.
+func DirConfigPaths(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading config dir %q: %w", dir, err)
+	}
+	// Entries are sorted by file name.
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || !slices.Contains(configDirExtensions, filepath.Ext(entry.Name())) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	return paths, nil
+}
+
 type ConfigFile struct {
 	Base     Config            `toml:"base"`
 	Variants map[string]Config `toml:"variant"`
+	// VariantOrder lists variants that are processed first, in the given order.
+	// All other variants are processed afterwards in alphabetical order.
+	VariantOrder []string `toml:"variantOrder,omitempty"`
+	// SkipDefaults disables filling unset fields with default values when rendering variants.
+	// Unset required fields are then reported by validation instead.
+	SkipDefaults bool `toml:"skipDefaults,omitempty"`
+	// ValidationHooks are run on every rendered variant after the built-in validation.
+	// They are not part of the config file format and need to be set by the caller.
+	ValidationHooks []ValidationHook `toml:"-"`
+	// RenderOptions are used for every render of a variant, before the options passed to RenderedVariant.
+	// They are not part of the config file format and need to be set by the caller.
+	RenderOptions []RenderOption `toml:"-"`
 }
 
 func (c *ConfigFile) Merge(other ConfigFile) error {
 	if err := c.Base.Merge(other.Base); err != nil {
 		return err
 	}
+	if len(other.VariantOrder) > 0 {
+		c.VariantOrder = slices.Clone(other.VariantOrder)
+	}
+	if other.SkipDefaults {
+		c.SkipDefaults = true
+	}
+	c.ValidationHooks = append(c.ValidationHooks, other.ValidationHooks...)
+	c.RenderOptions = append(c.RenderOptions, other.RenderOptions...)
 	if c.Variants == nil && len(other.Variants) > 0 {
 		c.Variants = make(map[string]Config)
 	}
@@ -242,18 +1059,60 @@ func (c *ConfigFile) Merge(other ConfigFile) error {
 		if err := dst.Merge(v); err != nil {
 			return err
 		}
+		c.Variants[k] = dst
+	}
+	return nil
+}
+
+// AddVariant adds a variant to the config file, e.g. when building a config file programmatically.
+// The variant order is left unchanged, so the variant is rendered after the ordered variants.
+func (c *ConfigFile) AddVariant(name string, cfg Config) error {
+	if name == "" {
+		return errors.New("variant name must not be empty")
+	}
+	if _, ok := c.Variants[name]; ok {
+		return fmt.Errorf("%w: %q", ErrVariantExists, name)
+	}
+	if c.Variants == nil {
+		c.Variants = make(map[string]Config)
 	}
+	c.Variants[name] = cfg
 	return nil
 }
 
-func (c *ConfigFile) RenderedVariant(fileLookup fileLookupFn, name string) (Config, error) {
+// RemoveVariant removes a variant from the config file and the variant order.
+// Removing a variant that doesn't exist is a no-op.
+func (c *ConfigFile) RemoveVariant(name string) {
+	delete(c.Variants, name)
+	c.VariantOrder = slices.DeleteFunc(c.VariantOrder, func(ordered string) bool {
+		return ordered == name
+	})
+}
+
+func (c *ConfigFile) RenderedVariant(fileLookup fileLookupFn, name string, opts ...RenderOption) (Config, error) {
+	out, err := c.mergedVariant(name)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := out.Render(fileLookup, append(slices.Clip(c.RenderOptions), opts...)...); err != nil {
+		return Config{}, err
+	}
+	if err := runValidationHooks(c.ValidationHooks, name, out); err != nil {
+		return Config{}, err
+	}
+
+	return out, nil
+}
+
+// mergedVariant returns the variant merged with the base config and the defaults, before rendering.
+func (c *ConfigFile) mergedVariant(name string) (Config, error) {
 	var out Config
 	var vari Config
 	if len(c.Variants) > 0 || len(name) > 0 {
 		var ok bool
 		vari, ok = c.Variants[name]
 		if !ok {
-			return Config{}, errors.New("variant not found")
+			return Config{}, fmt.Errorf("%w: %q", ErrVariantNotFound, name)
 		}
 	}
 	if err := out.Merge(c.Base); err != nil {
@@ -262,17 +1121,43 @@ func (c *ConfigFile) RenderedVariant(fileLookup fileLookupFn, name string) (Conf
 	if err := out.Merge(vari); err != nil {
 		return Config{}, err
 	}
-	if err := out.SetDefaults(); err != nil {
-		return Config{}, err
+	if err := checkProviderOverride(c.Base, out); err != nil {
+		return Config{}, fmt.Errorf("variant %q: %w", name, err)
 	}
-	if err := out.Render(fileLookup); err != nil {
-		return Config{}, err
+	if !c.SkipDefaults {
+		if err := out.SetDefaults(); err != nil {
+			return Config{}, err
+		}
 	}
-
 	return out, nil
 }
 
-func (c *ConfigFile) validateAll(fileLookup fileLookupFn, filters ...variantFilter) error {
+// checkProviderOverride checks that a variant switching to another provider than the base config
+// has a config section for its provider, before the section is filled with defaults.
+// Variants of the base provider are checked by validation instead.
+func checkProviderOverride(base, merged Config) error {
+	provider, err := merged.ResolveProvider()
+	if err != nil {
+		// Unknown providers are reported by validation.
+		return nil
+	}
+	if base.Provider == "" || normalizeProvider(base.Provider) == provider {
+		return nil
+	}
+	section, err := merged.ProviderConfig()
+	if errors.Is(err, ErrNoProviderConfig) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if reflect.ValueOf(section).IsZero() {
+		return fmt.Errorf("%w: provider %s overrides provider %s of the base config, but the %s section is empty",
+			ErrMissingProviderConfig, provider, normalizeProvider(base.Provider), provider)
+	}
+	return nil
+}
+
+func (c *ConfigFile) validateRendered(fileLookup fileLookupFn, filters ...variantFilter) error {
 	var errs error
 	if len(c.Variants) == 0 {
 		_, err := c.RenderedVariant(fileLookup, "")
@@ -281,32 +1166,30 @@ func (c *ConfigFile) validateAll(fileLookup fileLookupFn, filters ...variantFilt
 		}
 	}
 
-	variantNames := make([]string, 0, len(c.Variants))
-	for name := range c.Variants {
-		var filtered bool
-		for _, filter := range filters {
-			if !filter(name) {
-				filtered = true
-				break
-			}
-		}
-		if filtered {
-			continue
-		}
-		variantNames = append(variantNames, name)
+	variantNames, err := c.orderedVariantNames(filters...)
+	if err != nil {
+		return fmt.Errorf("validating variant order: %w", err)
 	}
-	slices.Sort(variantNames)
+	configs := make(map[string]Config, len(variantNames))
 	for _, name := range variantNames {
-		_, err := c.RenderedVariant(fileLookup, name)
+		cfg, err := c.RenderedVariant(fileLookup, name)
 		if err != nil {
 			errs = errors.Join(errs, fmt.Errorf("config for variant %s: %w", name, err))
+			continue
 		}
+		configs[name] = cfg
 	}
-	return errs
+	if errs != nil {
+		return errs
+	}
+	if err := checkImageNameCollisions(variantNames, configs); err != nil {
+		return err
+	}
+	return checkManifestCollisions(variantNames, configs)
 }
 
 func (c *ConfigFile) ForEach(fn func(name string, cfg Config) error, fileLookup fileLookupFn, filters ...variantFilter) error {
-	if err := c.validateAll(fileLookup, filters...); err != nil {
+	if err := c.validateRendered(fileLookup, filters...); err != nil {
 		return err
 	}
 
@@ -317,8 +1200,75 @@ func (c *ConfigFile) ForEach(fn func(name string, cfg Config) error, fileLookup
 		}
 		return fn("", cfg)
 	}
-	variantNames := make([]string, 0, len(c.Variants))
+	variantNames, err := c.orderedVariantNames(filters...)
+	if err != nil {
+		return err
+	}
+	for _, name := range variantNames {
+		cfg, err := c.RenderedVariant(fileLookup, name)
+		if err != nil {
+			return err
+		}
+		if err := fn(name, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachRendered is like ForEach, but additionally passes the TOML encoding
+// of each rendered variant config to fn. This allows reviewing exactly
+// what will be used for a variant before acting on it.
+func (c *ConfigFile) ForEachRendered(fn func(name string, cfg Config, rendered []byte) error, fileLookup fileLookupFn, filters ...variantFilter) error {
+	return c.ForEach(func(name string, cfg Config) error {
+		rendered, err := cfg.EncodeTOML()
+		if err != nil {
+			return fmt.Errorf("config for variant %s: %w", name, err)
+		}
+		return fn(name, cfg, rendered)
+	}, fileLookup, filters...)
+}
+
+// RenderAll returns the rendered configs of all variants matching the filters, keyed by variant name.
+// If the config file has no variants, the rendered base config is returned with an empty name.
+func (c *ConfigFile) RenderAll(fileLookup fileLookupFn, filters ...variantFilter) (map[string]Config, error) {
+	configs := make(map[string]Config, max(1, len(c.Variants)))
+	err := c.ForEach(func(name string, cfg Config) error {
+		configs[name] = cfg
+		return nil
+	}, fileLookup, filters...)
+	if err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// orderedVariantNames returns the names of all variants matching the filters.
+// Variants listed in VariantOrder come first, in the given order,
+// followed by all remaining variants in alphabetical order.
+func (c *ConfigFile) orderedVariantNames(filters ...variantFilter) ([]string, error) {
+	seen := make(map[string]struct{}, len(c.VariantOrder))
+	for _, name := range c.VariantOrder {
+		if _, ok := c.Variants[name]; !ok {
+			return nil, fmt.Errorf("variant %q in variant order does not exist", name)
+		}
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("variant %q appears more than once in variant order", name)
+		}
+		seen[name] = struct{}{}
+	}
+
+	remaining := make([]string, 0, len(c.Variants))
 	for name := range c.Variants {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		remaining = append(remaining, name)
+	}
+	slices.Sort(remaining)
+
+	variantNames := make([]string, 0, len(c.Variants))
+	for _, name := range append(slices.Clone(c.VariantOrder), remaining...) {
 		var filtered bool
 		for _, filter := range filters {
 			if !filter(name) {
@@ -331,19 +1281,17 @@ func (c *ConfigFile) ForEach(fn func(name string, cfg Config) error, fileLookup
 		}
 		variantNames = append(variantNames, name)
 	}
-	slices.Sort(variantNames)
-	for _, name := range variantNames {
-		cfg, err := c.RenderedVariant(fileLookup, name)
-		if err != nil {
-			return err
-		}
-		if err := fn(name, cfg); err != nil {
-			return err
-		}
-	}
-	return nil
+	return variantNames, nil
 }
 
 type fileLookupFn func(name string) ([]byte, error)
 
 type variantFilter func(name string) bool
+
+// FilterSkipCompleted returns a variant filter that skips the given variants,
+// e.g. the variants uploaded successfully by a previous, partially failed run.
+func FilterSkipCompleted(completed []string) variantFilter {
+	return func(name string) bool {
+		return !slices.Contains(completed, name)
+	}
+}
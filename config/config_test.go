@@ -8,39 +8,768 @@ package config
 
 import (
 	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"dario.cat/mergo"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestConfigRenderVersionFromFile(t *testing.T) {
-	assert := assert.New(t)
-	lookup := stubFileLookup{
-		"image-version.txt": []byte("0.0.2"),
+	testCases := map[string]struct {
+		content     string
+		key         string
+		wantVersion string
+		wantErr     string
+	}{
+		"plain version": {
+			content:     "0.0.2",
+			wantVersion: "0.0.2",
+		},
+		"surrounding whitespace": {
+			content:     " 0.0.2\n",
+			wantVersion: "0.0.2",
+		},
+		"v prefix": {
+			content:     "v1.2.3\n",
+			wantVersion: "1.2.3",
+		},
+		"empty": {
+			content: "",
+			wantErr: `imageVersionFile "image-version.txt" is empty`,
+		},
+		"whitespace only": {
+			content: " \n\t\n",
+			wantErr: `imageVersionFile "image-version.txt" is empty`,
+		},
+		"json key": {
+			content:     `{"name": "my-image", "version": "v1.2.3"}`,
+			key:         "version",
+			wantVersion: "1.2.3",
+		},
+		"nested json key": {
+			content:     `{"build": {"version": "1.2.3", "commit": "abc"}}`,
+			key:         "$.build.version",
+			wantVersion: "1.2.3",
+		},
+		"yaml key": {
+			content:     "build:\n  version: 1.2.3\n",
+			key:         "build.version",
+			wantVersion: "1.2.3",
+		},
+		"missing key": {
+			content: `{"build": {"commit": "abc"}}`,
+			key:     "build.version",
+			wantErr: `imageVersionFile "image-version.txt": key "build.version" not found`,
+		},
+		"key below string": {
+			content: `{"build": "abc"}`,
+			key:     "build.version",
+			wantErr: `imageVersionFile "image-version.txt": key "build.version" not found`,
+		},
+		"number value": {
+			content: "version: 1.2\n",
+			key:     "version",
+			wantErr: `imageVersionFile "image-version.txt": value of key "version" is not a string, quote the version`,
+		},
+		"no semantic version": {
+			content: `{"version": "latest"}`,
+			key:     "version",
+			wantErr: `imageVersionFile "image-version.txt": value "latest" of key "version" is not a semantic version`,
+		},
 	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			lookup := stubFileLookup{
+				"image-version.txt": []byte(tc.content),
+			}
+			config := fullConfig()
+			assert.NoError(config.Merge(Config{
+				Name:                "test",
+				ImageVersion:        "0.0.1", // this will be overwritten by the file
+				ImageVersionFile:    "image-version.txt",
+				ImageVersionFileKey: tc.key,
+			}))
+			err := config.Render(lookup.Lookup)
+			if tc.wantErr != "" {
+				assert.EqualError(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantVersion, config.ImageVersion)
+		})
+	}
+}
+
+func TestConfigRenderTemplate(t *testing.T) {
+	assert := assert.New(t)
+	lookup := stubFileLookup{}
 	config := fullConfig()
 	assert.NoError(config.Merge(Config{
-		Name:             "test",
-		ImageVersion:     "0.0.1", // this will be overwritten by the file
-		ImageVersionFile: "image-version.txt",
+		Name:         "name",
+		ImageVersion: "0.0.1",
+		GCP: GCPConfig{
+			ImageName: "prefix-{{.Name}}-{{replaceAll .Version \".\" \"-\"}}-suffix",
+		},
 	}))
 	assert.NoError(config.Render(lookup.Lookup))
-	assert.Equal("0.0.2", config.ImageVersion)
+	assert.Equal("prefix-name-0-0-1-suffix", config.GCP.ImageName)
 }
 
-func TestConfigRenderTemplate(t *testing.T) {
+func TestConfigRenderTemplateMap(t *testing.T) {
 	assert := assert.New(t)
 	lookup := stubFileLookup{}
+	tags := map[string]string{"image": "{{.Name}}-{{.Version}}", "team": "os"}
 	config := fullConfig()
 	assert.NoError(config.Merge(Config{
 		Name:         "name",
 		ImageVersion: "0.0.1",
+		AWS: AWSConfig{
+			BlobTags: tags,
+		},
+	}))
+	assert.NoError(config.Render(lookup.Lookup))
+	assert.Equal(map[string]string{"image": "name-0.0.1", "team": "os"}, config.AWS.BlobTags)
+	// The original map is not modified.
+	assert.Equal("{{.Name}}-{{.Version}}", tags["image"])
+
+	config = fullConfig()
+	assert.NoError(config.Merge(Config{
 		GCP: GCPConfig{
-			ImageName: "prefix-{{.Name}}-{{replaceAll .Version \".\" \"-\"}}-suffix",
+			BlobTags: map[string]string{"image": "{{.Unknown}}"},
+		},
+	}))
+	assert.ErrorContains(config.Render(lookup.Lookup), "BlobTags")
+
+	// Keys are not rendered, and maps that aren't marked as template are left untouched.
+	config = fullConfig()
+	assert.NoError(config.Merge(Config{
+		Name:         "name",
+		ImageVersion: "0.0.1",
+		GCP: GCPConfig{
+			BlobTags: map[string]string{"{{.Name}}": "{{.Version}}"},
+		},
+		OpenStack: OpenStackConfig{
+			Properties: map[string]string{"version": "{{.Version}}"},
 		},
 	}))
 	assert.NoError(config.Render(lookup.Lookup))
-	assert.Equal("prefix-name-0-0-1-suffix", config.GCP.ImageName)
+	assert.Equal(map[string]string{"{{.Name}}": "0.0.1"}, config.GCP.BlobTags)
+	assert.Equal(map[string]string{"version": "{{.Version}}"}, config.OpenStack.Properties)
+}
+
+func TestTemplateFields(t *testing.T) {
+	assert := assert.New(t)
+	fields := TemplateFields()
+	assert.Contains(fields, "aws.amiName")
+	assert.Contains(fields, "aws.blobTags")
+	assert.Contains(fields, "gcp.imageFamily")
+	assert.Contains(fields, "manifest.path")
+	assert.NotContains(fields, "aws.region")
+	assert.NotContains(fields, "provider")
+	// Template fields are only part of the sections, paths use the keys of the config file.
+	for _, field := range fields {
+		assert.Equal(1, strings.Count(field, "."), field)
+	}
+}
+
+func TestConfigRenderTemplateInvalidVersion(t *testing.T) {
+	assert := assert.New(t)
+	lookup := stubFileLookup{}
+	config := fullConfig()
+	assert.NoError(config.Merge(Config{
+		ImageVersion: "0.1.x",
+		GCP: GCPConfig{
+			ImageFamily: "{{semverMajorMinor .Version}}",
+		},
+	}))
+	err := config.Render(lookup.Lookup)
+	assert.ErrorContains(err, "ImageFamily")
+}
+
+func TestConfigRenderTemplateInvalidRegex(t *testing.T) {
+	assert := assert.New(t)
+	lookup := stubFileLookup{}
+	config := fullConfig()
+	assert.NoError(config.Merge(Config{
+		AWS: AWSConfig{
+			AMIName: `{{replaceRegex .Version "(" ""}}`,
+		},
+	}))
+	err := config.Render(lookup.Lookup)
+	assert.ErrorContains(err, "AMIName")
+}
+
+func TestConfigRenderNormalizesRegions(t *testing.T) {
+	assert := assert.New(t)
+	config := fullConfig()
+	config.AWS.Region = " US-East-1 "
+	config.AWS.ReplicationRegions = []string{"EU-West-1\t", "*"}
+	config.Azure.Location = "WestEurope "
+	config.GCP.Location = " US-Central1"
+	config.GCP.ReplicationLocations = []string{"Europe-West3"}
+	unrendered := config.Clone()
+	replicationRegions := config.AWS.ReplicationRegions
+
+	assert.NoError(config.Render(stubFileLookup{}.Lookup))
+	assert.Equal("us-east-1", config.AWS.Region)
+	assert.Equal([]string{"eu-west-1", "*"}, config.AWS.ReplicationRegions)
+	assert.Equal("westeurope", config.Azure.Location)
+	assert.Equal("us-central1", config.GCP.Location)
+	assert.Equal([]string{"europe-west3"}, config.GCP.ReplicationLocations)
+	assert.Equal(unrendered.AWS.ReplicationRegions, replicationRegions)
+
+	unrendered.AWS.Region = "US East 1"
+	assert.ErrorIs(unrendered.Render(stubFileLookup{}.Lookup), ErrInvalidConfig)
+}
+
+func TestConfigRenderWithRegionOverride(t *testing.T) {
+	assert := assert.New(t)
+	config := fullConfig()
+	unrendered := config.Clone()
+
+	assert.NoError(config.Render(stubFileLookup{}.Lookup, WithRegionOverride(" US-East-1")))
+	assert.Equal("us-east-1", config.AWS.Region)
+
+	assert.NoError(unrendered.Render(stubFileLookup{}.Lookup, WithRegionOverride("")))
+	assert.Equal("eu-central-1", unrendered.AWS.Region)
+}
+
+func TestConfigOverrideRegion(t *testing.T) {
+	testCases := map[string]struct {
+		provider  string
+		region    string
+		wantAWS   string
+		wantAzure string
+		wantGCP   string
+	}{
+		"empty region": {
+			provider:  "aws",
+			wantAWS:   "us-east-1",
+			wantAzure: "westeurope",
+			wantGCP:   "us-central1",
+		},
+		"aws": {
+			provider:  "aws",
+			region:    "eu-central-1",
+			wantAWS:   "eu-central-1",
+			wantAzure: "westeurope",
+			wantGCP:   "us-central1",
+		},
+		"azure": {
+			provider:  "azure",
+			region:    "northeurope",
+			wantAWS:   "us-east-1",
+			wantAzure: "northeurope",
+			wantGCP:   "us-central1",
+		},
+		"gcp": {
+			provider:  "gcp",
+			region:    "europe-west3",
+			wantAWS:   "us-east-1",
+			wantAzure: "westeurope",
+			wantGCP:   "europe-west3",
+		},
+		"provider without region": {
+			provider:  "openstack",
+			region:    "europe-west3",
+			wantAWS:   "us-east-1",
+			wantAzure: "westeurope",
+			wantGCP:   "us-central1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			config := Config{
+				Provider: tc.provider,
+				AWS:      AWSConfig{Region: "us-east-1"},
+				Azure:    AzureConfig{Location: "westeurope"},
+				GCP:      GCPConfig{Location: "us-central1"},
+			}
+			config.overrideRegion(tc.region)
+			assert.Equal(tc.wantAWS, config.AWS.Region)
+			assert.Equal(tc.wantAzure, config.Azure.Location)
+			assert.Equal(tc.wantGCP, config.GCP.Location)
+		})
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	assert := assert.New(t)
+	defaults := DefaultConfig()
+	assert.Equal("Contoso", defaults.Azure.Publisher)
+	assert.Equal("{{.Name}}-{{.Version}}", defaults.AWS.AMIName)
+
+	defaults.Azure.Publisher = "modified"
+	defaults.GCP.GuestOSFeatures[0] = "modified"
+	assert.Equal(defaultConfig, DefaultConfig())
+
+	var config Config
+	assert.NoError(config.SetDefaults())
+	config.GCP.GuestOSFeatures[0] = "modified"
+	assert.Equal("GVNIC", DefaultConfig().GCP.GuestOSFeatures[0])
+}
+
+func TestConfigRenderString(t *testing.T) {
+	assert := assert.New(t)
+	config := Config{
+		Name:         "name",
+		ImageVersion: "1.2.3",
+		AWS: AWSConfig{
+			AMIName: "{{.Name}}-{{.Version}}",
+		},
+	}
+
+	rendered, err := config.RenderString(config.AWS.AMIName)
+	assert.NoError(err)
+	assert.Equal("name-1.2.3", rendered)
+	assert.Equal("{{.Name}}-{{.Version}}", config.AWS.AMIName)
+
+	rendered, err = config.RenderString(`{{.VersionMajor}}-{{replaceAll .Version "." "-"}}`)
+	assert.NoError(err)
+	assert.Equal("1-1-2-3", rendered)
+
+	_, err = config.RenderString("{{.Unknown}}")
+	assert.Error(err)
+	_, err = config.RenderString("{{")
+	assert.Error(err)
+}
+
+func TestConfigRenderWithFuncMap(t *testing.T) {
+	assert := assert.New(t)
+	lookup := stubFileLookup{}
+	funcs := map[string]any{
+		"team":       func() string { return "os" },
+		"replaceAll": func(s, _, _ string) string { return "overridden-" + s },
+	}
+	config := fullConfig()
+	assert.NoError(config.Merge(Config{
+		Name:         "name",
+		ImageVersion: "0.0.1",
+		GCP: GCPConfig{
+			ImageName: `{{team}}-{{replaceAll .Version "." "-"}}`,
+		},
+	}))
+
+	unrendered := config.Clone()
+	assert.ErrorContains(unrendered.Render(lookup.Lookup), "team")
+
+	assert.NoError(config.Render(lookup.Lookup, WithFuncMap(funcs)))
+	assert.Equal("os-overridden-0.0.1", config.GCP.ImageName)
+
+	rendered, err := config.RenderString("{{semverMajor .Version}}-{{team}}", WithFuncMap(funcs))
+	assert.NoError(err)
+	assert.Equal("0-os", rendered)
+}
+
+func TestConfigRenderManifestPath(t *testing.T) {
+	assert := assert.New(t)
+	cfg := fullConfig()
+	assert.NoError(cfg.Merge(Config{
+		Name:         "name",
+		ImageVersion: "1.2.3",
+		Vars:         map[string]string{"csp": "aws"},
+		Manifest:     ManifestConfig{Path: "manifests/{{.Name}}-{{.Version}}-{{.Vars.csp}}.json"},
+	}))
+
+	assert.NoError(cfg.Render(stubFileLookup{}.Lookup))
+	assert.Equal("manifests/name-1.2.3-aws.json", cfg.Manifest.Path)
+}
+
+func TestConfigRenderWithTime(t *testing.T) {
+	frozen := time.Date(2024, 2, 29, 13, 14, 15, 0, time.FixedZone("CET", 3600))
+	base := fullConfig()
+	assert.NoError(t, base.Merge(Config{
+		Name:         "name",
+		ImageVersion: "0.0.1",
+		AWS: AWSConfig{
+			AMIName: `{{.Name}}-{{date "20060102150405"}}{{if .Region}}-{{.Region}}{{end}}`,
+		},
+		GCP: GCPConfig{
+			ImageName: `{{.Name}}-{{(now).Unix}}`,
+		},
+	}))
+
+	testCases := map[string]struct {
+		opts            []RenderOption
+		sourceDateEpoch string
+		wantAMIName     string
+		wantImageName   string
+		wantErr         bool
+	}{
+		"frozen time": {
+			opts:          []RenderOption{WithTime(frozen)},
+			wantAMIName:   "name-20240229121415",
+			wantImageName: "name-1709208855",
+		},
+		"SOURCE_DATE_EPOCH": {
+			sourceDateEpoch: "1709208855",
+			wantAMIName:     "name-20240229121415",
+			wantImageName:   "name-1709208855",
+		},
+		"frozen time takes precedence": {
+			opts:            []RenderOption{WithTime(frozen.Add(time.Second))},
+			sourceDateEpoch: "1709208855",
+			wantAMIName:     "name-20240229121416",
+			wantImageName:   "name-1709208856",
+		},
+		"invalid SOURCE_DATE_EPOCH": {
+			sourceDateEpoch: "yesterday",
+			wantErr:         true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			t.Setenv(sourceDateEpochEnv, tc.sourceDateEpoch)
+			lookup := stubFileLookup{}
+
+			first := base.Clone()
+			err := first.Render(lookup.Lookup, tc.opts...)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantAMIName, first.AWS.AMIName)
+			assert.Equal(tc.wantImageName, first.GCP.ImageName)
+
+			second := base.Clone()
+			assert.NoError(second.Render(lookup.Lookup, tc.opts...))
+			firstTOML, err := first.EncodeTOML()
+			assert.NoError(err)
+			secondTOML, err := second.EncodeTOML()
+			assert.NoError(err)
+			assert.Equal(firstTOML, secondTOML)
+
+			// Replication regions use the time of the render.
+			regional, err := first.RenderAWSRegion("us-west-1")
+			assert.NoError(err)
+			assert.Equal(tc.wantAMIName+"-us-west-1", regional.AWS.AMIName)
+		})
+	}
+}
+
+func TestConfigRenderAWSRegion(t *testing.T) {
+	assert := assert.New(t)
+	lookup := stubFileLookup{}
+	config := fullConfig()
+	assert.NoError(config.Merge(Config{
+		Name:         "name",
+		ImageVersion: "0.0.1",
+		AWS: AWSConfig{
+			AMIName: `{{.Name}}-{{.Version}}{{if .Region}}-{{.Region}}{{end}}`,
+		},
+	}))
+
+	unrendered, err := config.RenderAWSRegion("us-west-1")
+	assert.NoError(err)
+	assert.Equal(config.AWS.AMIName, unrendered.AWS.AMIName)
+
+	assert.NoError(config.Render(lookup.Lookup))
+	assert.Equal("name-0.0.1", config.AWS.AMIName)
+
+	regional, err := config.RenderAWSRegion("us-west-1")
+	assert.NoError(err)
+	assert.Equal("name-0.0.1-us-west-1", regional.AWS.AMIName)
+	assert.Equal("name-0.0.1", config.AWS.AMIName)
+
+	config.AWS.amiNameTemplate = "{{.Region}}"
+	_, err = config.RenderAWSRegion("")
+	assert.ErrorIs(err, ErrInvalidConfig)
+}
+
+func TestConfigRenderAWSRegionWithFuncMap(t *testing.T) {
+	assert := assert.New(t)
+	config := fullConfig()
+	config.AWS.AMIName = "{{team}}-{{.Name}}{{if .Region}}-{{.Region}}{{end}}"
+
+	assert.NoError(config.Render(stubFileLookup{}.Lookup, WithFuncMap(map[string]any{"team": func() string { return "infra" }})))
+	assert.Equal("infra-test", config.AWS.AMIName)
+
+	// Functions passed to Render are available in replication regions.
+	regional, err := config.RenderAWSRegion("us-east-1")
+	assert.NoError(err)
+	assert.Equal("infra-test-us-east-1", regional.AWS.AMIName)
+}
+
+func TestConfigEqualRenders(t *testing.T) {
+	assert := assert.New(t)
+	first := fullConfig()
+	second := fullConfig()
+	assert.NoError(first.Render(stubFileLookup{}.Lookup))
+	time.Sleep(time.Millisecond)
+	assert.NoError(second.Render(stubFileLookup{}.Lookup, WithFuncMap(map[string]any{"team": func() string { return "infra" }})))
+
+	// The state kept for replication regions isn't compared.
+	assert.True(first.Equal(second))
+	assert.Equal(first.Hash(), second.Hash())
+}
+
+func TestConfigRenderImageDigest(t *testing.T) {
+	assert := assert.New(t)
+	config := Config{
+		Name:         "name",
+		ImageVersion: "1.2.3",
+	}
+
+	_, err := config.RenderString("{{.Name}}-{{sha256short}}")
+	assert.ErrorIs(err, ErrImageDigestUnavailable)
+
+	config.ImageDigest = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	rendered, err := config.RenderString("{{.Name}}-{{sha256short}}")
+	assert.NoError(err)
+	assert.Equal("name-b94d27b9934d", rendered)
+
+	rendered, err = config.RenderString("{{.ImageDigest}}")
+	assert.NoError(err)
+	assert.Equal(config.ImageDigest, rendered)
+}
+
+func TestConfigRenderLazyImageDigest(t *testing.T) {
+	const digest = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	testCases := map[string]struct {
+		amiName     string
+		digestErr   error
+		wantAMIName string
+		wantCalls   int
+		wantErr     bool
+	}{
+		"digest unused": {
+			amiName:     "my-image",
+			wantAMIName: "my-image",
+		},
+		"sha256short": {
+			amiName:     "my-image-{{sha256short}}",
+			wantAMIName: "my-image-b94d27b9934d",
+			wantCalls:   1,
+		},
+		"image digest field": {
+			amiName:     "my-image-{{.ImageDigest}}",
+			wantAMIName: "my-image-" + digest,
+			wantCalls:   1,
+		},
+		"used twice": {
+			amiName:     "my-image-{{sha256short}}-{{.ImageDigest}}",
+			wantAMIName: "my-image-b94d27b9934d-" + digest,
+			wantCalls:   1,
+		},
+		"computation fails": {
+			amiName:   "my-image-{{sha256short}}",
+			digestErr: ErrImageDigestUnavailable,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var calls int
+			computeDigest := func() (string, error) {
+				calls++
+				if tc.digestErr != nil {
+					return "", tc.digestErr
+				}
+				return digest, nil
+			}
+			config := fullConfig()
+			config.AWS.AMIName = tc.amiName
+
+			err := config.Render(stubFileLookup{}.Lookup, WithImageDigest(computeDigest))
+			assert.Equal(tc.wantCalls, calls)
+			if tc.wantErr {
+				assert.ErrorIs(err, tc.digestErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantAMIName, config.AWS.AMIName)
+		})
+	}
+}
+
+func TestConfigFieldTemplateData(t *testing.T) {
+	testCases := map[string]struct {
+		version   string
+		wantMajor string
+		wantMinor string
+		wantPatch string
+	}{
+		"major only": {
+			version:   "1",
+			wantMajor: "1",
+			wantMinor: "0",
+			wantPatch: "0",
+		},
+		"major and minor": {
+			version:   "1.2",
+			wantMajor: "1",
+			wantMinor: "2",
+			wantPatch: "0",
+		},
+		"full version": {
+			version:   "1.2.3",
+			wantMajor: "1",
+			wantMinor: "2",
+			wantPatch: "3",
+		},
+		"empty version": {},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := Config{ImageVersion: tc.version}
+
+			data := conf.fieldTemplateData()
+			assert.Equal(tc.version, data.Version)
+			assert.Equal(tc.wantMajor, data.VersionMajor)
+			assert.Equal(tc.wantMinor, data.VersionMinor)
+			assert.Equal(tc.wantPatch, data.VersionPatch)
+		})
+	}
+}
+
+func TestConfigRenderShortVersion(t *testing.T) {
+	testCases := map[string]struct {
+		version     string
+		wantVersion string
+		wantAMIName string
+		wantErr     bool
+	}{
+		"major only": {
+			version:     "1",
+			wantVersion: "1.0.0",
+			wantAMIName: "my-image-1.0.0-0",
+		},
+		"major and minor": {
+			version:     "1.2",
+			wantVersion: "1.2.0",
+			wantAMIName: "my-image-1.2.0-0",
+		},
+		"full version": {
+			version:     "1.2.3",
+			wantVersion: "1.2.3",
+			wantAMIName: "my-image-1.2.3-3",
+		},
+		"invalid version": {
+			version: "1.2.x",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			config := fullConfig()
+			config.ImageVersion = tc.version
+			config.AWS.AMIName = "my-image-{{.Version}}-{{.VersionPatch}}"
+
+			err := config.Render(stubFileLookup{}.Lookup)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantVersion, config.ImageVersion)
+			assert.Equal(tc.wantAMIName, config.AWS.AMIName)
+		})
+	}
+}
+
+func TestConfigResolvedVersion(t *testing.T) {
+	assert := assert.New(t)
+	lookup := stubFileLookup{"version.txt": []byte("v1.2.3\n")}
+
+	config := fullConfig()
+	config.ImageVersionFile = "version.txt"
+	assert.NoError(config.Render(lookup.Lookup))
+	version, err := config.ResolvedVersion()
+	assert.NoError(err)
+	assert.Equal("1.2.3", version)
+
+	config = Config{ImageVersion: AutoVersion}
+	_, err = config.ResolvedVersion()
+	assert.Error(err)
+}
+
+func TestConfigIsPublishing(t *testing.T) {
+	testCases := map[string]struct {
+		config Config
+		want   bool
+	}{
+		"aws publish": {
+			config: Config{Provider: "aws", AWS: AWSConfig{Publish: Some(true)}},
+			want:   true,
+		},
+		"aws no publish": {
+			config: Config{Provider: "aws", AWS: AWSConfig{Publish: Some(false)}},
+		},
+		"aws publish unset": {
+			config: Config{Provider: "aws"},
+		},
+		"aws shared with organization": {
+			config: Config{Provider: "aws", AWS: AWSConfig{
+				Publish:          Some(false),
+				OrganizationARNs: []string{"arn:aws:organizations::123456789012:organization/o-a1b2c3d4e5"},
+			}},
+			want: true,
+		},
+		"aws shared with organizational unit": {
+			config: Config{Provider: "aws", AWS: AWSConfig{
+				OrganizationalUnitARNs: []string{"arn:aws:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cd34ef56"},
+			}},
+			want: true,
+		},
+		"azure community": {
+			config: Config{Provider: "azure", Azure: AzureConfig{SharingProfile: "community"}},
+			want:   true,
+		},
+		"azure private": {
+			config: Config{Provider: "azure", Azure: AzureConfig{SharingProfile: "private"}},
+		},
+		"gcp": {
+			config: Config{Provider: "gcp"},
+			want:   true,
+		},
+		"gcp all users": {
+			config: Config{Provider: "gcp", GCP: GCPConfig{Sharing: "allUsers"}},
+			want:   true,
+		},
+		"gcp private": {
+			config: Config{Provider: "gcp", GCP: GCPConfig{Sharing: "private"}},
+		},
+		"openstack public": {
+			config: Config{Provider: "openstack", OpenStack: OpenStackConfig{Visibility: "public"}},
+			want:   true,
+		},
+		"openstack default visibility": {
+			config: Config{Provider: "openstack"},
+			want:   true,
+		},
+		"openstack private": {
+			config: Config{Provider: "openstack", OpenStack: OpenStackConfig{Visibility: "private"}},
+		},
+		"unknown provider": {
+			config: Config{Provider: "foo", AWS: AWSConfig{Publish: Some(true)}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.config.IsPublishing())
+		})
+	}
 }
 
 func TestConfigSetDefaults(t *testing.T) {
@@ -102,6 +831,132 @@ func TestConfigMerge(t *testing.T) {
 	assert.True(dst.AWS.Publish.Unwrap())
 }
 
+func TestConfigMergeWithOptions(t *testing.T) {
+	dst := Config{
+		Name: "dst",
+		AWS: AWSConfig{
+			ReplicationRegions: []string{"eu-west-1"},
+			Publish:            Some(false),
+		},
+	}
+	src := Config{
+		Name:     "src",
+		Provider: "aws",
+		AWS: AWSConfig{
+			ReplicationRegions: []string{"us-east-1"},
+			Publish:            Some(true),
+			TPMSupport:         "v2.0",
+		},
+	}
+
+	testCases := map[string]struct {
+		opts                   []func(*mergo.Config)
+		wantName               string
+		wantReplicationRegions []string
+		wantTPMSupport         string
+	}{
+		"fill only missing fields": {
+			wantName:               "dst",
+			wantReplicationRegions: []string{"eu-west-1"},
+			wantTPMSupport:         "v2.0",
+		},
+		"override": {
+			opts:                   []func(*mergo.Config){mergo.WithOverride},
+			wantName:               "src",
+			wantReplicationRegions: []string{"us-east-1"},
+			wantTPMSupport:         "v2.0",
+		},
+		"append slices": {
+			opts:                   []func(*mergo.Config){mergo.WithOverride, mergo.WithAppendSlice},
+			wantName:               "src",
+			wantReplicationRegions: []string{"eu-west-1", "us-east-1"},
+			wantTPMSupport:         "v2.0",
+		},
+		"custom transformer": {
+			opts:                   []func(*mergo.Config){mergo.WithOverride, mergo.WithTransformers(keepStrings{})},
+			wantName:               "dst",
+			wantReplicationRegions: []string{"us-east-1"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			got := dst.Clone()
+			assert.NoError(got.MergeWithOptions(src, tc.opts...))
+			assert.Equal(tc.wantName, got.Name)
+			assert.Equal(tc.wantReplicationRegions, got.AWS.ReplicationRegions)
+			assert.Equal(tc.wantTPMSupport, got.AWS.TPMSupport)
+			// Options are always merged by the OptionTransformer.
+			assert.Equal(Some(false), got.AWS.Publish)
+		})
+	}
+}
+
+// keepStrings is a transformer that never changes strings.
+type keepStrings struct{}
+
+func (keepStrings) Transformer(typ reflect.Type) func(dst, src reflect.Value) error {
+	if typ.Kind() != reflect.String {
+		return nil
+	}
+	return func(reflect.Value, reflect.Value) error { return nil }
+}
+
+func TestConfigMergeVerbose(t *testing.T) {
+	testCases := map[string]struct {
+		dst         Config
+		src         Config
+		wantChanged []string
+	}{
+		"empty source": {
+			dst: fullConfig(),
+		},
+		"same values": {
+			dst: fullConfig(),
+			src: Config{Name: "test", AWS: AWSConfig{Region: "eu-central-1"}},
+		},
+		"overridden fields": {
+			dst: fullConfig(),
+			src: Config{
+				Name: "other",
+				AWS: AWSConfig{
+					Region:             "eu-central-1",
+					ReplicationRegions: []string{"us-east-1"},
+					// Options that are already set are not overridden.
+					Publish:                Some(false),
+					AllowCrossRegionBucket: Some(true),
+				},
+				GCP: GCPConfig{
+					BlobTags: map[string]string{"team": "os"},
+				},
+				ImageDigest: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+			},
+			wantChanged: []string{"name", "aws.replicationRegions", "aws.allowCrossRegionBucket", "gcp.blobTags"},
+		},
+		"set on empty config": {
+			src: Config{
+				Provider: "aws",
+				Azure:    AzureConfig{SkipZeroPages: Some(true)},
+			},
+			wantChanged: []string{"provider", "azure.skipZeroPages"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			want := tc.dst.Clone()
+			assert.NoError(want.Merge(tc.src))
+
+			changed, err := tc.dst.MergeVerbose(tc.src)
+			assert.NoError(err)
+			assert.Equal(tc.wantChanged, changed)
+			assert.Equal(want, tc.dst)
+		})
+	}
+}
+
 func TestConfigFileMerge(t *testing.T) {
 	assert := assert.New(t)
 	dst := ConfigFile{}
@@ -130,11 +985,566 @@ func TestConfigFileMerge(t *testing.T) {
 	src = fullConfigFile()
 	srcVariant := src.Variants["a"]
 	srcVariant.Name = ""
+	srcVariant.ImageVersion = "1.2.3"
+	src.Variants["a"] = srcVariant
 	assert.NoError(dst.Merge(src))
 	assert.Equal("a", dst.Variants["a"].Name)
+	assert.Equal("1.2.3", dst.Variants["a"].ImageVersion)
 	assert.Equal("test", dst.Variants["b"].Name)
 }
 
+func TestLoadMerged(t *testing.T) {
+	lookup := stubFileLookup{
+		"defaults.conf": []byte(`
+[base]
+provider = "aws"
+name = "org-image"
+
+[base.aws]
+region = "eu-central-1"
+`),
+		"team.conf": []byte(`
+[base]
+name = "team-image"
+
+[variant.a]
+imageVersion = "1.0.0"
+`),
+		"variants.conf": []byte(`
+[variant.a.aws]
+region = "us-east-1"
+
+[variant.b]
+provider = "gcp"
+`),
+		"invalid.conf": []byte(`[base`),
+	}
+
+	testCases := map[string]struct {
+		paths       []string
+		wantErr     string
+		wantName    string
+		wantRegion  string
+		wantVariant Config
+	}{
+		"no files": {},
+		"later files override earlier ones": {
+			paths:      []string{"defaults.conf", "team.conf", "variants.conf"},
+			wantName:   "team-image",
+			wantRegion: "eu-central-1",
+			wantVariant: Config{
+				ImageVersion: "1.0.0",
+				AWS:          AWSConfig{Region: "us-east-1"},
+			},
+		},
+		"parse error names file": {
+			paths:   []string{"defaults.conf", "invalid.conf"},
+			wantErr: `"invalid.conf"`,
+		},
+		"missing file": {
+			paths:   []string{"defaults.conf", "missing.conf"},
+			wantErr: `"missing.conf"`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			conf, err := LoadMerged(tc.paths, lookup.Lookup)
+			if tc.wantErr != "" {
+				assert.ErrorContains(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantName, conf.Base.Name)
+			assert.Equal(tc.wantRegion, conf.Base.AWS.Region)
+			assert.Equal(tc.wantVariant, conf.Variants["a"])
+		})
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"00-base.conf": "[base]\nprovider = \"aws\"\nname = \"base-image\"\n",
+		"aws.toml":     "[base.aws]\nregion = \"eu-central-1\"\n",
+		"azure.toml":   "[base]\nname = \"azure-image\"\n\n[base.azure]\nlocation = \"westeurope\"\n",
+		"README.md":    "not a config file",
+	}
+	for name, content := range files {
+		assert.NoError(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	assert.NoError(os.Mkdir(filepath.Join(dir, "old.toml"), 0o755))
+
+	paths, err := DirConfigPaths(dir)
+	assert.NoError(err)
+	assert.Equal([]string{filepath.Join(dir, "00-base.conf"), filepath.Join(dir, "aws.toml"), filepath.Join(dir, "azure.toml")}, paths)
+
+	// Files are merged in lexical order.
+	conf, err := LoadDir(dir, os.ReadFile)
+	assert.NoError(err)
+	assert.Equal("aws", conf.Base.Provider)
+	assert.Equal("azure-image", conf.Base.Name)
+	assert.Equal("eu-central-1", conf.Base.AWS.Region)
+	assert.Equal("westeurope", conf.Base.Azure.Location)
+
+	// Parse errors name the file.
+	assert.NoError(os.WriteFile(filepath.Join(dir, "gcp.toml"), []byte("[base.gcp"), 0o644))
+	_, err = LoadDir(dir, os.ReadFile)
+	assert.ErrorContains(err, filepath.Join(dir, "gcp.toml"))
+
+	// A missing directory is an error.
+	_, err = LoadDir(filepath.Join(dir, "missing"), os.ReadFile)
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = DirConfigPaths(filepath.Join(dir, "missing"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestConfigEqual(t *testing.T) {
+	testCases := map[string]struct {
+		mutate    func(c *Config)
+		wantEqual bool
+	}{
+		"unchanged": {
+			mutate:    func(*Config) {},
+			wantEqual: true,
+		},
+		"different string": {
+			mutate: func(c *Config) { c.Name = "other" },
+		},
+		"unset options with different values": {
+			mutate:    func(c *Config) { c.AWS.Publish = Option[bool]{Val: true} },
+			wantEqual: true,
+		},
+		"set and unset option": {
+			mutate: func(c *Config) { c.AWS.Publish = Some(false) },
+		},
+		"options with different values": {
+			mutate: func(c *Config) { c.AWS.AllowCrossRegionBucket = Some(false) },
+		},
+		"nil and empty slice": {
+			mutate:    func(c *Config) { c.GCP.Licenses = []string{} },
+			wantEqual: true,
+		},
+		"different slice element": {
+			mutate: func(c *Config) { c.AWS.ReplicationRegions = []string{"us-east-1"} },
+		},
+		"different slice length": {
+			mutate: func(c *Config) { c.AWS.ReplicationRegions = append(c.AWS.ReplicationRegions, "us-east-1") },
+		},
+		"different nested struct in slice": {
+			mutate: func(c *Config) { c.Azure.TargetRegions[0].ReplicaCount = 2 },
+		},
+		"nil and empty map": {
+			mutate:    func(c *Config) { c.OpenStack.Properties = nil },
+			wantEqual: true,
+		},
+		"different map value": {
+			mutate: func(c *Config) { c.OpenStack.Properties = map[string]string{"key": "other"} },
+		},
+		"different map key": {
+			mutate: func(c *Config) { c.OpenStack.Properties = map[string]string{"other": ""} },
+		},
+	}
+
+	newConfig := func() Config {
+		conf := fullConfig()
+		conf.AWS.Publish = None[bool]()
+		conf.AWS.AllowCrossRegionBucket = Some(true)
+		conf.Azure.TargetRegions = []AzureTargetRegion{{Name: "westeurope", ReplicaCount: 1}}
+		conf.OpenStack.Properties = map[string]string{}
+		return conf
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := newConfig()
+			other := newConfig()
+			tc.mutate(&other)
+
+			assert.Equal(tc.wantEqual, conf.Equal(other))
+			assert.Equal(tc.wantEqual, other.Equal(conf))
+		})
+	}
+}
+
+func TestConfigClone(t *testing.T) {
+	assert := assert.New(t)
+	original := fullConfig()
+	original.Azure.TargetRegions = []AzureTargetRegion{{Name: "westeurope", ReplicaCount: 1}}
+	original.Azure.AdditionalSignatures = []string{"sig"}
+	original.OpenStack.Tags = []string{"tag"}
+	original.OpenStack.Properties = map[string]string{"key": "value"}
+	original.AWS.BlobTags = map[string]string{"key": "value"}
+	want := fullConfig()
+	want.Azure.TargetRegions = []AzureTargetRegion{{Name: "westeurope", ReplicaCount: 1}}
+	want.Azure.AdditionalSignatures = []string{"sig"}
+	want.OpenStack.Tags = []string{"tag"}
+	want.OpenStack.Properties = map[string]string{"key": "value"}
+	want.AWS.BlobTags = map[string]string{"key": "value"}
+
+	clone := original.Clone()
+	assert.Equal(original, clone)
+
+	clone.Name = "clone"
+	clone.AWS.ReplicationRegions[0] = "us-east-1"
+	clone.AWS.Publish = Some(false)
+	clone.Azure.TargetRegions[0].ReplicaCount = 2
+	clone.Azure.AdditionalSignatures[0] = "other"
+	clone.OpenStack.Tags[0] = "other"
+	clone.OpenStack.Properties["key"] = "other"
+	clone.AWS.BlobTags["key"] = "other"
+	assert.Equal(want, original)
+}
+
+func TestConfigFileAddVariant(t *testing.T) {
+	assert := assert.New(t)
+	var conf ConfigFile
+
+	assert.NoError(conf.AddVariant("a", Config{Name: "a"}))
+	assert.NoError(conf.AddVariant("b", Config{Name: "b"}))
+	assert.Equal(map[string]Config{"a": {Name: "a"}, "b": {Name: "b"}}, conf.Variants)
+
+	err := conf.AddVariant("a", Config{Name: "other"})
+	assert.ErrorIs(err, ErrVariantExists)
+	assert.Equal("a", conf.Variants["a"].Name)
+	assert.Error(conf.AddVariant("", Config{}))
+}
+
+func TestConfigFileRemoveVariant(t *testing.T) {
+	assert := assert.New(t)
+	conf := ConfigFile{
+		VariantOrder: []string{"b", "a"},
+		Variants:     map[string]Config{"a": {}, "b": {}},
+	}
+
+	conf.RemoveVariant("b")
+	assert.Equal([]string{"a"}, conf.VariantOrder)
+	assert.Equal(map[string]Config{"a": {}}, conf.Variants)
+
+	conf.RemoveVariant("missing")
+	assert.Equal([]string{"a"}, conf.VariantOrder)
+
+	var empty ConfigFile
+	empty.RemoveVariant("a")
+	assert.Nil(empty.Variants)
+}
+
+func TestConfigFileRenderedVariantNotFound(t *testing.T) {
+	assert := assert.New(t)
+	conf := fullConfigFile()
+	_, err := conf.RenderedVariant(stubFileLookup{}.Lookup, "c")
+	assert.ErrorIs(err, ErrVariantNotFound)
+	assert.ErrorContains(err, `"c"`)
+}
+
+func TestConfigFileRenderedVariantSkipDefaults(t *testing.T) {
+	assert := assert.New(t)
+	conf := ConfigFile{
+		Base: Config{
+			Provider: "aws",
+			Name:     "my-image",
+			AWS: AWSConfig{
+				Region:             "us-east-1",
+				ReplicationRegions: []string{"us-west-1"},
+				Bucket:             "my-bucket",
+			},
+		},
+	}
+
+	rendered, err := conf.RenderedVariant(stubFileLookup{}.Lookup, "")
+	assert.NoError(err)
+	assert.Equal("my-image-0.0.0", rendered.AWS.AMIName)
+
+	conf.SkipDefaults = true
+	_, err = conf.RenderedVariant(stubFileLookup{}.Lookup, "")
+	assert.ErrorIs(err, ErrInvalidConfig)
+
+	conf.Base.ImageVersion = "1.0.0"
+	conf.Base.AWS.AMIName = "my-ami"
+	conf.Base.AWS.BlobName = "my-blob"
+	conf.Base.AWS.SnapshotName = "my-snapshot"
+	conf.Base.AWS.Publish = Some(false)
+	rendered, err = conf.RenderedVariant(stubFileLookup{}.Lookup, "")
+	assert.NoError(err)
+	assert.Empty(rendered.AWS.AMIDescription)
+	assert.True(rendered.AWS.AllowCrossRegionBucket.IsNone())
+}
+
+func TestConfigFileValidationHooks(t *testing.T) {
+	errNoTeam := errors.New("name must contain the team code")
+	requireTeam := func(_ string, cfg Config) error {
+		if !strings.HasPrefix(cfg.Name, "os-") {
+			return errNoTeam
+		}
+		return nil
+	}
+	errReserved := errors.New("variant name is reserved")
+	reserved := func(name string, _ Config) error {
+		if name == "reserved" {
+			return errReserved
+		}
+		return nil
+	}
+
+	testCases := map[string]struct {
+		hooks     []ValidationHook
+		variants  map[string]Config
+		wantErrs  []error
+		wantNames []string
+	}{
+		"no hooks": {
+			variants:  map[string]Config{"a": {Name: "image-a"}, "reserved": {Name: "image-b"}},
+			wantNames: []string{"a", "reserved"},
+		},
+		"hooks pass": {
+			hooks:     []ValidationHook{requireTeam, reserved},
+			variants:  map[string]Config{"a": {Name: "os-a"}, "b": {Name: "os-b"}},
+			wantNames: []string{"a", "b"},
+		},
+		"errors of all hooks are reported": {
+			hooks:    []ValidationHook{requireTeam, reserved},
+			variants: map[string]Config{"a": {Name: "os-a"}, "reserved": {Name: "image-b"}},
+			wantErrs: []error{errNoTeam, errReserved, ErrInvalidConfig},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := ConfigFile{
+				Base: Config{
+					Provider: "aws",
+					AWS: AWSConfig{
+						Region:             "us-east-1",
+						ReplicationRegions: []string{"us-west-1"},
+						Bucket:             "my-bucket",
+					},
+				},
+				Variants:        tc.variants,
+				ValidationHooks: tc.hooks,
+			}
+
+			var names []string
+			err := conf.ForEach(func(name string, _ Config) error {
+				names = append(names, name)
+				return nil
+			}, stubFileLookup{}.Lookup)
+			for _, wantErr := range tc.wantErrs {
+				assert.ErrorIs(err, wantErr)
+			}
+			if len(tc.wantErrs) > 0 {
+				assert.ErrorContains(err, "variant reserved")
+				assert.Empty(names)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantNames, names)
+		})
+	}
+}
+
+func TestConfigFileForEachRendered(t *testing.T) {
+	assert := assert.New(t)
+	conf := ConfigFile{
+		Base: Config{
+			Provider: "aws",
+			AWS: AWSConfig{
+				Region:             "us-east-1",
+				ReplicationRegions: []string{"us-west-1"},
+				Bucket:             "my-bucket",
+			},
+		},
+		Variants: map[string]Config{
+			"a": {Name: "image-a"},
+			"b": {Name: "image-b"},
+		},
+	}
+
+	var names []string
+	err := conf.ForEachRendered(func(name string, cfg Config, rendered []byte) error {
+		names = append(names, name)
+		parsed, err := ParseConfig(rendered)
+		assert.NoError(err)
+		assert.Equal(cfg.Name, parsed.Name)
+		assert.Equal(cfg.AWS.AMIName, parsed.AWS.AMIName)
+		assert.Equal(cfg.AWS.Publish, parsed.AWS.Publish)
+		assert.Contains(string(rendered), `amiName = "`+cfg.Name+`-0.0.0"`)
+		return nil
+	}, stubFileLookup{}.Lookup)
+	assert.NoError(err)
+	assert.Equal([]string{"a", "b"}, names)
+}
+
+func TestConfigFileRenderAll(t *testing.T) {
+	base := Config{
+		Provider: "aws",
+		AWS: AWSConfig{
+			Region:             "us-east-1",
+			ReplicationRegions: []string{"us-west-1"},
+			Bucket:             "my-bucket",
+		},
+	}
+	testCases := map[string]struct {
+		variants    map[string]Config
+		filters     []variantFilter
+		wantAMIs    map[string]string
+		wantErrText string
+	}{
+		"base only": {
+			wantAMIs: map[string]string{"": "image-0.0.0"},
+		},
+		"all variants": {
+			variants: map[string]Config{
+				"a": {Name: "image-a"},
+				"b": {Name: "image-b"},
+			},
+			wantAMIs: map[string]string{"a": "image-a-0.0.0", "b": "image-b-0.0.0"},
+		},
+		"filtered variants": {
+			variants: map[string]Config{
+				"a": {Name: "image-a"},
+				"b": {Name: "image-b"},
+			},
+			filters:  []variantFilter{FilterSkipCompleted([]string{"a"})},
+			wantAMIs: map[string]string{"b": "image-b-0.0.0"},
+		},
+		"invalid variant": {
+			variants: map[string]Config{
+				"a":      {Name: "image-a"},
+				"broken": {Name: "image-b", AWS: AWSConfig{StorageClass: "GLACIER"}},
+			},
+			wantErrText: "variant broken",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := ConfigFile{Base: base.Clone(), Variants: tc.variants}
+			conf.Base.Name = "image"
+
+			configs, err := conf.RenderAll(stubFileLookup{}.Lookup, tc.filters...)
+			if tc.wantErrText != "" {
+				assert.ErrorContains(err, tc.wantErrText)
+				return
+			}
+			assert.NoError(err)
+			amis := make(map[string]string, len(configs))
+			for name, cfg := range configs {
+				amis[name] = cfg.AWS.AMIName
+			}
+			assert.Equal(tc.wantAMIs, amis)
+		})
+	}
+}
+
+func TestConfigFileOrderedVariantNames(t *testing.T) {
+	variants := map[string]Config{
+		"a":        {},
+		"b":        {},
+		"base-ami": {},
+		"derived":  {},
+	}
+	testCases := map[string]struct {
+		order   []string
+		filters []variantFilter
+		want    []string
+		wantErr bool
+	}{
+		"alphabetical without order": {
+			want: []string{"a", "b", "base-ami", "derived"},
+		},
+		"ordered variants first": {
+			order: []string{"derived", "base-ami"},
+			want:  []string{"derived", "base-ami", "a", "b"},
+		},
+		"filters apply to ordered variants": {
+			order:   []string{"derived", "base-ami"},
+			filters: []variantFilter{func(name string) bool { return name != "derived" }},
+			want:    []string{"base-ami", "a", "b"},
+		},
+		"skip completed variants": {
+			order:   []string{"derived", "base-ami"},
+			filters: []variantFilter{FilterSkipCompleted([]string{"derived", "a"})},
+			want:    []string{"base-ami", "b"},
+		},
+		"unknown variant in order": {
+			order:   []string{"base-ami", "unknown"},
+			wantErr: true,
+		},
+		"duplicate variant in order": {
+			order:   []string{"base-ami", "base-ami"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := ConfigFile{Variants: variants, VariantOrder: tc.order}
+			got, err := conf.orderedVariantNames(tc.filters...)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := ParseConfigFile([]byte(`
+[base]
+name = "test"
+
+[base.aws]
+region = "eu-central-1"
+publish = false
+
+[variant.a]
+provider = "aws"
+
+[variant.a.aws]
+publish = true
+`))
+	assert.NoError(err)
+	assert.Equal("test", conf.Base.Name)
+	assert.Equal("eu-central-1", conf.Base.AWS.Region)
+	assert.Equal(Some(false), conf.Base.AWS.Publish)
+	assert.Equal("aws", conf.Variants["a"].Provider)
+	assert.Equal(Some(true), conf.Variants["a"].AWS.Publish)
+	assert.False(conf.Variants["a"].AWS.AllowCrossRegionBucket.IsSome())
+
+	_, err = ParseConfigFile([]byte("[base\nname = "))
+	assert.Error(err)
+	_, err = ParseConfigFile([]byte("[base.aws]\npublish = \"yes\""))
+	assert.Error(err)
+}
+
+func TestParseConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	conf, err := ParseConfig([]byte(`
+name = "test"
+
+[openstack]
+hidden = true
+`))
+	assert.NoError(err)
+	assert.Equal("test", conf.Name)
+	assert.Equal(Some(true), conf.OpenStack.Hidden)
+
+	_, err = ParseConfig([]byte(`name = "unterminated`))
+	assert.Error(err)
+}
+
 type stubFileLookup map[string][]byte
 
 func (s stubFileLookup) Lookup(name string) ([]byte, error) {
@@ -194,3 +1604,90 @@ func fullConfigFile() ConfigFile {
 		},
 	}
 }
+
+func TestConfigFileRenderedVariantProviderOverride(t *testing.T) {
+	assert := assert.New(t)
+	azure := validConfig().Azure
+	azure.SharingProfile = ""
+	conf := ConfigFile{
+		Base: Config{
+			Provider: "aws",
+			Name:     "my-image",
+			AWS: AWSConfig{
+				Region: "us-east-1",
+				Bucket: "my-bucket",
+			},
+		},
+		Variants: map[string]Config{
+			"aws":   {},
+			"azure": {Provider: " Azure", Azure: azure},
+			"gcp":   {Provider: "gcp"},
+		},
+	}
+
+	rendered, err := conf.RenderedVariant(stubFileLookup{}.Lookup, "aws")
+	assert.NoError(err)
+	assert.Equal("aws", rendered.Provider)
+
+	// Defaults are applied to the section of the overridden provider.
+	rendered, err = conf.RenderedVariant(stubFileLookup{}.Lookup, "azure")
+	assert.NoError(err)
+	assert.Equal("azure", rendered.Provider)
+	assert.Equal("community", rendered.Azure.SharingProfile)
+	assert.Equal(azure.SubscriptionID, rendered.Azure.SubscriptionID)
+
+	_, err = conf.RenderedVariant(stubFileLookup{}.Lookup, "gcp")
+	assert.ErrorIs(err, ErrMissingProviderConfig)
+	assert.ErrorContains(err, `variant "gcp"`)
+
+	// The section may also be shared through the base config.
+	conf.Base.GCP = validConfig().GCP
+	rendered, err = conf.RenderedVariant(stubFileLookup{}.Lookup, "gcp")
+	assert.NoError(err)
+	assert.Equal("gcp", rendered.Provider)
+}
+
+func TestConfigExpiresAt(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 60*60))
+	testCases := map[string]struct {
+		ttl     string
+		want    time.Time
+		wantErr bool
+	}{
+		"no ttl": {},
+		"days": {
+			ttl:  "30d",
+			want: time.Date(2025, 1, 31, 11, 0, 0, 0, time.UTC),
+		},
+		"duration": {
+			ttl:  "36h",
+			want: time.Date(2025, 1, 2, 23, 0, 0, 0, time.UTC),
+		},
+		"zero days": {
+			ttl:     "0d",
+			wantErr: true,
+		},
+		"negative duration": {
+			ttl:     "-1h",
+			wantErr: true,
+		},
+		"invalid": {
+			ttl:     "one month",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			config := Config{TTL: tc.ttl}
+			got, err := config.ExpiresAt(now)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
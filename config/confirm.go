@@ -0,0 +1,58 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotConfirmed is returned if an action required to continue was declined by a ConfirmFunc.
+var ErrNotConfirmed = errors.New("action not confirmed")
+
+// Actions passed to a ConfirmFunc.
+const (
+	// ActionOverwrite replaces an existing image of the same name.
+	ActionOverwrite = "overwrite"
+	// ActionPublish makes an image available outside of the owning account.
+	ActionPublish = "publish"
+)
+
+// ConfirmFunc approves destructive or publishing actions before they are performed.
+// Returning false declines the action.
+type ConfirmFunc func(action string, cfg Config) (bool, error)
+
+// Confirm asks f whether the action may be performed. A nil ConfirmFunc approves all actions.
+func (f ConfirmFunc) Confirm(action string, cfg Config) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	return f(action, cfg)
+}
+
+// ConfirmOverwrite returns an error wrapping ErrNotConfirmed unless f approves overwriting the existing image.
+// The image is only used to describe the declined action.
+func (f ConfirmFunc) ConfirmOverwrite(cfg Config, image string) error {
+	ok, err := f.Confirm(ActionOverwrite, cfg)
+	if err != nil {
+		return fmt.Errorf("confirming overwrite: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: overwriting image %s", ErrNotConfirmed, image)
+	}
+	return nil
+}
+
+// ConfirmPublish reports whether f approves publishing the image of the config.
+// Declining isn't an error, it is up to the provider whether the image stays private or the upload is aborted.
+func (f ConfirmFunc) ConfirmPublish(cfg Config) (bool, error) {
+	ok, err := f.Confirm(ActionPublish, cfg)
+	if err != nil {
+		return false, fmt.Errorf("confirming publish: %w", err)
+	}
+	return ok, nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmOverwrite(t *testing.T) {
+	testCases := map[string]struct {
+		confirm          ConfirmFunc
+		wantNotConfirmed bool
+		wantErr          bool
+	}{
+		"no confirm func": {},
+		"confirmed": {
+			confirm: func(string, Config) (bool, error) { return true, nil },
+		},
+		"declined": {
+			confirm:          func(string, Config) (bool, error) { return false, nil },
+			wantNotConfirmed: true,
+			wantErr:          true,
+		},
+		"confirmation error": {
+			confirm: func(string, Config) (bool, error) { return false, errors.New("failed") },
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var gotAction string
+			confirm := tc.confirm
+			if confirm != nil {
+				confirm = func(action string, cfg Config) (bool, error) {
+					gotAction = action
+					return tc.confirm(action, cfg)
+				}
+			}
+
+			err := confirm.ConfirmOverwrite(Config{}, "ami-0123")
+			if tc.confirm != nil {
+				assert.Equal(ActionOverwrite, gotAction)
+			}
+			if tc.wantErr {
+				assert.Error(err)
+				assert.Equal(tc.wantNotConfirmed, errors.Is(err, ErrNotConfirmed))
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestConfirmPublish(t *testing.T) {
+	testCases := map[string]struct {
+		confirm     ConfirmFunc
+		wantPublish bool
+		wantErr     bool
+	}{
+		"no confirm func": {
+			wantPublish: true,
+		},
+		"confirmed": {
+			confirm:     func(string, Config) (bool, error) { return true, nil },
+			wantPublish: true,
+		},
+		"declined": {
+			confirm: func(string, Config) (bool, error) { return false, nil },
+		},
+		"confirmation error": {
+			confirm: func(string, Config) (bool, error) { return false, errors.New("failed") },
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var gotAction string
+			confirm := tc.confirm
+			if confirm != nil {
+				confirm = func(action string, cfg Config) (bool, error) {
+					gotAction = action
+					return tc.confirm(action, cfg)
+				}
+			}
+
+			publish, err := confirm.ConfirmPublish(Config{})
+			if tc.confirm != nil {
+				assert.Equal(ActionPublish, gotAction)
+			}
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantPublish, publish)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxAMIDescriptionLength is the maximum length of an AMI description in characters.
+const maxAMIDescriptionLength = 255
+
+// renderDescriptionFiles replaces descriptions with the contents of their description files.
+// It runs after the templates are rendered, so the file contents are used verbatim.
+func (c *Config) renderDescriptionFiles(fileLookup func(name string) ([]byte, error)) error {
+	if len(c.AWS.AMIDescriptionFile) == 0 {
+		return nil
+	}
+	content, err := fileLookup(c.AWS.AMIDescriptionFile)
+	if err != nil {
+		return fmt.Errorf("reading ami description file: %w", err)
+	}
+	description, truncated := sanitizeDescription(string(content), maxAMIDescriptionLength)
+	if truncated {
+		c.Warnings = append(c.Warnings, fmt.Sprintf(
+			"ami description from %s truncated to %d characters", c.AWS.AMIDescriptionFile, maxAMIDescriptionLength,
+		))
+	}
+	c.AWS.AMIDescription = description
+	return nil
+}
+
+// sanitizeDescription turns multiline text into a single line that fits into maxLen characters.
+// Line breaks and other whitespace are collapsed into single spaces and control characters are removed.
+// If the text is too long, it is cut at the last word boundary that fits.
+func sanitizeDescription(text string, maxLen int) (string, bool) {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, text)
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= maxLen {
+		return string(runes), false
+	}
+	truncated := runes[:maxLen]
+	if runes[maxLen] != ' ' {
+		if i := lastIndexRune(truncated, ' '); i > 0 {
+			truncated = truncated[:i]
+		}
+	}
+	return strings.TrimSpace(string(truncated)), true
+}
+
+func lastIndexRune(runes []rune, r rune) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
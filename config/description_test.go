@@ -0,0 +1,96 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeDescription(t *testing.T) {
+	testCases := map[string]struct {
+		text          string
+		maxLen        int
+		want          string
+		wantTruncated bool
+	}{
+		"single line": {
+			text:   "My image",
+			maxLen: 20,
+			want:   "My image",
+		},
+		"multiline": {
+			text:   "# Release notes\n\n- fixed\tbugs\r\n- added features\n",
+			maxLen: 100,
+			want:   "# Release notes - fixed bugs - added features",
+		},
+		"control characters": {
+			text:   "My\x00 image\x1b",
+			maxLen: 20,
+			want:   "My image",
+		},
+		"cut at word boundary": {
+			text:          "one two three",
+			maxLen:        10,
+			want:          "one two",
+			wantTruncated: true,
+		},
+		"cut exactly at word end": {
+			text:          "one two three",
+			maxLen:        7,
+			want:          "one two",
+			wantTruncated: true,
+		},
+		"cut single long word": {
+			text:          strings.Repeat("a", 12),
+			maxLen:        10,
+			want:          strings.Repeat("a", 10),
+			wantTruncated: true,
+		},
+		"count characters instead of bytes": {
+			text:   "äöü",
+			maxLen: 3,
+			want:   "äöü",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			got, truncated := sanitizeDescription(tc.text, tc.maxLen)
+			assert.Equal(tc.want, got)
+			assert.Equal(tc.wantTruncated, truncated)
+			assert.LessOrEqual(len([]rune(got)), tc.maxLen)
+		})
+	}
+}
+
+func TestRenderDescriptionFiles(t *testing.T) {
+	assert := assert.New(t)
+	lookup := stubFileLookup{
+		"notes.md": []byte("Release notes\n\n- {{.Version}} is great\n"),
+		"long.md":  []byte(strings.Repeat("word ", 100)),
+	}
+
+	config := fullConfig()
+	config.AWS.AMIDescriptionFile = "notes.md"
+	assert.NoError(config.Render(lookup.Lookup))
+	assert.Equal("Release notes - {{.Version}} is great", config.AWS.AMIDescription)
+	assert.Empty(config.Warnings)
+
+	config = fullConfig()
+	config.AWS.AMIDescriptionFile = "long.md"
+	assert.NoError(config.Render(lookup.Lookup))
+	assert.LessOrEqual(len(config.AWS.AMIDescription), maxAMIDescriptionLength)
+	assert.Len(config.Warnings, 1)
+
+	config = fullConfig()
+	config.AWS.AMIDescriptionFile = "missing.md"
+	assert.Error(config.Render(lookup.Lookup))
+}
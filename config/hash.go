@@ -0,0 +1,76 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"slices"
+)
+
+// Hash returns the hex encoded SHA-256 of a canonical encoding of the config,
+// e.g. to detect whether a rendered config changed since the last upload.
+//
+// Configs that only differ in the stored value of unset options, nil versus empty slices and maps,
+// or the order of slice elements have the same hash. Warnings are not part of the hash.
+func (c *Config) Hash() string {
+	cfg := c.Clone()
+	cfg.Warnings = nil
+	// Canonical values only consist of maps, slices and basic types, which can always be encoded.
+	data, err := json.Marshal(canonicalValue(reflect.ValueOf(cfg)))
+	if err != nil {
+		panic("config: encoding canonical config: " + err.Error())
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// canonicalValue converts v into a value whose JSON encoding is identical for equal configs.
+// Structs become maps keyed by field name, which JSON encodes with sorted keys.
+// Unexported fields are skipped, as they only hold state derived while rendering.
+func canonicalValue(v reflect.Value) any {
+	if v.Type().Implements(optionType) {
+		if !v.FieldByName("Valid").Bool() {
+			return nil
+		}
+		return canonicalValue(v.FieldByName("Val"))
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := make(map[string]any, v.NumField())
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				fields[v.Type().Field(i).Name] = canonicalValue(v.Field(i))
+			}
+		}
+		return fields
+	case reflect.Slice:
+		// Elements are sorted by their encoding, so the order doesn't matter.
+		elems := make([]json.RawMessage, 0, v.Len())
+		for i := range v.Len() {
+			elem, err := json.Marshal(canonicalValue(v.Index(i)))
+			if err != nil {
+				panic("config: encoding canonical config: " + err.Error())
+			}
+			elems = append(elems, elem)
+		}
+		slices.SortFunc(elems, func(a, b json.RawMessage) int { return slices.Compare(a, b) })
+		return elems
+	case reflect.Map:
+		entries := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries[iter.Key().String()] = canonicalValue(iter.Value())
+		}
+		return entries
+	default:
+		return v.Interface()
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigHash(t *testing.T) {
+	base := func() Config {
+		return Config{
+			Provider:     "aws",
+			Name:         "my-image",
+			ImageVersion: "1.2.3",
+			AWS: AWSConfig{
+				Region:             "eu-central-1",
+				ReplicationRegions: []string{"us-east-1", "eu-west-1"},
+				BlobTags:           map[string]string{"team": "os", "cost-center": "images"},
+				Publish:            Some(true),
+			},
+			Vars: map[string]string{"arch": "x86_64"},
+		}
+	}
+
+	testCases := map[string]struct {
+		modify   func(c *Config)
+		wantSame bool
+	}{
+		"unchanged": {
+			modify:   func(*Config) {},
+			wantSame: true,
+		},
+		"reordered slice": {
+			modify:   func(c *Config) { c.AWS.ReplicationRegions = []string{"eu-west-1", "us-east-1"} },
+			wantSame: true,
+		},
+		"rebuilt map": {
+			modify:   func(c *Config) { c.AWS.BlobTags = map[string]string{"cost-center": "images", "team": "os"} },
+			wantSame: true,
+		},
+		"empty instead of nil": {
+			modify: func(c *Config) {
+				c.GCP.Licenses = []string{}
+				c.OpenStack.Properties = map[string]string{}
+			},
+			wantSame: true,
+		},
+		"unset option with stored value": {
+			modify:   func(c *Config) { c.Azure.SkipZeroPages = Option[bool]{Val: true} },
+			wantSame: true,
+		},
+		"warnings": {
+			modify:   func(c *Config) { c.Warnings = []string{"description truncated"} },
+			wantSame: true,
+		},
+		"changed field": {
+			modify: func(c *Config) { c.ImageVersion = "1.2.4" },
+		},
+		"changed option": {
+			modify: func(c *Config) { c.AWS.Publish = Some(false) },
+		},
+		"unset option": {
+			modify: func(c *Config) { c.AWS.Publish = None[bool]() },
+		},
+		"changed map value": {
+			modify: func(c *Config) { c.Vars["arch"] = "arm64" },
+		},
+		"added slice element": {
+			modify: func(c *Config) { c.AWS.ReplicationRegions = append(c.AWS.ReplicationRegions, "us-west-2") },
+		},
+		"changed digest": {
+			modify: func(c *Config) { c.ImageDigest = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" },
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			want := base()
+			got := base()
+			tc.modify(&got)
+			assert.Len(got.Hash(), 64)
+			if tc.wantSame {
+				assert.Equal(want.Hash(), got.Hash())
+			} else {
+				assert.NotEqual(want.Hash(), got.Hash())
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// RetryingFileLookup wraps a file lookup function, like the one passed to Render, with retries.
+// A failed lookup is attempted up to attempts times in total, waiting backoff before the first retry
+// and doubling the wait after each further failure.
+// Errors that won't go away by retrying, like a missing file or missing permissions, are returned immediately.
+func RetryingFileLookup(fn func(name string) ([]byte, error), attempts int, backoff time.Duration) func(name string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		var err error
+		wait := backoff
+		for attempt := 1; ; attempt++ {
+			var data []byte
+			data, err = fn(name)
+			if err == nil {
+				return data, nil
+			}
+			if attempt >= attempts || isFatalLookupError(err) {
+				return nil, err
+			}
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+// lookupVersionFile reads the file at path with fileLookup.
+// If no file has that literal path and path contains glob metacharacters, as understood by filepath.Match,
+// the pattern is resolved with glob to the single file matching it, which is then read with fileLookup.
+// It fails if the pattern matches no file or more than one file.
+func lookupVersionFile(fileLookup fileLookupFn, glob globFn, path string) ([]byte, error) {
+	data, err := fileLookup(path)
+	if err == nil || !strings.ContainsAny(path, "*?[") {
+		return data, err
+	}
+	matches, globErr := glob(path)
+	if globErr != nil {
+		return nil, fmt.Errorf("resolving %q: %w", path, globErr)
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%q matches no files: %w", path, err)
+	case 1:
+		return fileLookup(matches[0])
+	default:
+		return nil, fmt.Errorf("%q matches %d files, expected exactly one: %s", path, len(matches), strings.Join(matches, ", "))
+	}
+}
+
+func isFatalLookupError(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) ||
+		errors.Is(err, fs.ErrPermission) ||
+		errors.Is(err, fs.ErrInvalid)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryingFileLookup(t *testing.T) {
+	transientErr := errors.New("connection reset")
+
+	testCases := map[string]struct {
+		errs      []error
+		attempts  int
+		wantCalls int
+		wantErr   error
+	}{
+		"success": {
+			attempts:  3,
+			wantCalls: 1,
+		},
+		"success after transient errors": {
+			errs:      []error{transientErr, transientErr},
+			attempts:  3,
+			wantCalls: 3,
+		},
+		"attempts exhausted": {
+			errs:      []error{transientErr, transientErr, transientErr},
+			attempts:  3,
+			wantCalls: 3,
+			wantErr:   transientErr,
+		},
+		"single attempt": {
+			errs:      []error{transientErr},
+			attempts:  1,
+			wantCalls: 1,
+			wantErr:   transientErr,
+		},
+		"not exist is not retried": {
+			errs:      []error{fmt.Errorf("reading version file: %w", fs.ErrNotExist)},
+			attempts:  3,
+			wantCalls: 1,
+			wantErr:   fs.ErrNotExist,
+		},
+		"permission denied is not retried": {
+			errs:      []error{&fs.PathError{Op: "open", Path: "version.txt", Err: fs.ErrPermission}},
+			attempts:  3,
+			wantCalls: 1,
+			wantErr:   fs.ErrPermission,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var calls int
+			lookup := RetryingFileLookup(func(name string) ([]byte, error) {
+				calls++
+				if calls <= len(tc.errs) {
+					return nil, tc.errs[calls-1]
+				}
+				return []byte(name), nil
+			}, tc.attempts, time.Millisecond)
+
+			data, err := lookup("version.txt")
+			assert.Equal(tc.wantCalls, calls)
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal("version.txt", string(data))
+		})
+	}
+}
+
+func TestConfigRenderVersionFromGlob(t *testing.T) {
+	testCases := map[string]struct {
+		files       map[string]string
+		pattern     string
+		wantVersion string
+		wantErr     string
+	}{
+		"single match": {
+			files:       map[string]string{"build/x86_64/version.txt": "v1.2.3\n"},
+			pattern:     "build/*/version.txt",
+			wantVersion: "1.2.3",
+		},
+		"literal path": {
+			files:       map[string]string{"build/x86_64/version.txt": "1.2.3"},
+			pattern:     "build/x86_64/version.txt",
+			wantVersion: "1.2.3",
+		},
+		"literal path with metacharacters": {
+			files: map[string]string{
+				"build/[x86_64]/version.txt": "1.2.3",
+				"build/x/version.txt":        "1.2.4",
+			},
+			pattern:     "build/[x86_64]/version.txt",
+			wantVersion: "1.2.3",
+		},
+		"no match": {
+			files:   map[string]string{"build/x86_64/other.txt": "1.2.3"},
+			pattern: "build/*/version.txt",
+			wantErr: "matches no files",
+		},
+		"multiple matches": {
+			files: map[string]string{
+				"build/x86_64/version.txt":  "1.2.3",
+				"build/aarch64/version.txt": "1.2.4",
+			},
+			pattern: "build/*/version.txt",
+			wantErr: "matches 2 files, expected exactly one",
+		},
+		"malformed pattern": {
+			pattern: "build/[/version.txt",
+			wantErr: "syntax error in pattern",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			dir := t.TempDir()
+			for name, content := range tc.files {
+				path := filepath.Join(dir, name)
+				assert.NoError(os.MkdirAll(filepath.Dir(path), 0o755))
+				assert.NoError(os.WriteFile(path, []byte(content), 0o644))
+			}
+			config := fullConfig()
+			assert.NoError(config.Merge(Config{
+				Name:             "test",
+				ImageVersionFile: filepath.Join(dir, tc.pattern),
+			}))
+			err := config.Render(os.ReadFile)
+			if tc.wantErr != "" {
+				assert.ErrorContains(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantVersion, config.ImageVersion)
+		})
+	}
+}
+
+func TestConfigRenderVersionWithGlob(t *testing.T) {
+	assert := assert.New(t)
+	lookup := stubFileLookup{"build/x86_64/version.txt": []byte("1.2.3")}
+	glob := func(pattern string) ([]string, error) {
+		assert.Equal("build/*/version.txt", pattern)
+		return []string{"build/x86_64/version.txt"}, nil
+	}
+	config := fullConfig()
+	assert.NoError(config.Merge(Config{
+		Name:             "test",
+		ImageVersionFile: "build/*/version.txt",
+	}))
+
+	assert.NoError(config.Render(lookup.Lookup, WithGlob(glob)))
+	assert.Equal("1.2.3", config.ImageVersion)
+}
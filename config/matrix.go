@@ -0,0 +1,69 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// matrixSeparator joins the dimension values of a matrix variant to its name.
+const matrixSeparator = "_"
+
+// ExpandMatrix returns a config file with the base config and one variant for every combination
+// of the values of the matrix dimensions, e.g. regions × architectures × environments.
+// The dimension values of a variant are available to templates as {{.Vars.<dimension>}}.
+//
+// Variant names join the values with "_" in the alphabetical order of the dimension names,
+// e.g. "arm64_prod_us-east-1" for the dimensions arch, env and region.
+// An error is returned if the matrix is empty, a dimension has no values or two combinations have the same name.
+func ExpandMatrix(base Config, matrix map[string][]string) (ConfigFile, error) {
+	if len(matrix) == 0 {
+		return ConfigFile{}, errors.New("matrix has no dimensions")
+	}
+	dimensions := make([]string, 0, len(matrix))
+	for dimension := range matrix {
+		dimensions = append(dimensions, dimension)
+	}
+	slices.Sort(dimensions)
+	for _, dimension := range dimensions {
+		if len(matrix[dimension]) == 0 {
+			return ConfigFile{}, fmt.Errorf("matrix dimension %q has no values", dimension)
+		}
+		if slices.Contains(matrix[dimension], "") {
+			return ConfigFile{}, fmt.Errorf("matrix dimension %q has an empty value", dimension)
+		}
+	}
+
+	conf := ConfigFile{Base: base.Clone()}
+	combinations := []map[string]string{{}}
+	for _, dimension := range dimensions {
+		expanded := make([]map[string]string, 0, len(combinations)*len(matrix[dimension]))
+		for _, combination := range combinations {
+			for _, value := range matrix[dimension] {
+				vars := maps.Clone(combination)
+				vars[dimension] = value
+				expanded = append(expanded, vars)
+			}
+		}
+		combinations = expanded
+	}
+	for _, vars := range combinations {
+		values := make([]string, 0, len(dimensions))
+		for _, dimension := range dimensions {
+			values = append(values, vars[dimension])
+		}
+		name := strings.Join(values, matrixSeparator)
+		if err := conf.AddVariant(name, Config{Vars: vars}); err != nil {
+			return ConfigFile{}, fmt.Errorf("expanding matrix: %w", err)
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	testCases := map[string]struct {
+		matrix    map[string][]string
+		wantNames []string
+		wantVars  map[string]string
+		wantErr   bool
+	}{
+		"single dimension": {
+			matrix:    map[string][]string{"env": {"prod", "dev"}},
+			wantNames: []string{"dev", "prod"},
+		},
+		"multiple dimensions": {
+			matrix: map[string][]string{
+				"region": {"us-east-1", "eu-west-1"},
+				"arch":   {"arm64", "x86_64"},
+				"env":    {"prod"},
+			},
+			wantNames: []string{
+				"arm64_prod_eu-west-1",
+				"arm64_prod_us-east-1",
+				"x86_64_prod_eu-west-1",
+				"x86_64_prod_us-east-1",
+			},
+		},
+		"empty matrix": {
+			matrix:  map[string][]string{},
+			wantErr: true,
+		},
+		"dimension without values": {
+			matrix:  map[string][]string{"arch": {"arm64"}, "env": {}},
+			wantErr: true,
+		},
+		"empty value": {
+			matrix:  map[string][]string{"env": {"prod", ""}},
+			wantErr: true,
+		},
+		"duplicate value": {
+			matrix:  map[string][]string{"env": {"prod", "prod"}},
+			wantErr: true,
+		},
+		"colliding names": {
+			matrix:  map[string][]string{"a": {"x_y", "x"}, "b": {"z", "y_z"}},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf, err := ExpandMatrix(Config{Name: "base"}, tc.matrix)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal("base", conf.Base.Name)
+			names, err := conf.orderedVariantNames()
+			assert.NoError(err)
+			assert.Equal(tc.wantNames, names)
+			for _, variant := range conf.Variants {
+				assert.Len(variant.Vars, len(tc.matrix))
+			}
+		})
+	}
+}
+
+func TestExpandMatrixRender(t *testing.T) {
+	assert := assert.New(t)
+	base := fullConfig()
+	assert.NoError(base.Merge(Config{
+		Name:         "name",
+		ImageVersion: "0.0.1",
+		Vars:         map[string]string{"team": "os", "env": "default"},
+		GCP: GCPConfig{
+			ImageName: "{{.Vars.team}}-{{.Vars.arch}}-{{.Vars.env}}",
+		},
+	}))
+
+	conf, err := ExpandMatrix(base, map[string][]string{
+		"arch": {"arm64", "x86-64"},
+		"env":  {"prod"},
+	})
+	assert.NoError(err)
+
+	rendered, err := conf.RenderedVariant(stubFileLookup{}.Lookup, "arm64_prod")
+	assert.NoError(err)
+	assert.Equal("os-arm64-prod", rendered.GCP.ImageName)
+	assert.Equal(map[string]string{"team": "os", "env": "prod", "arch": "arm64"}, rendered.Vars)
+
+	rendered, err = conf.RenderedVariant(stubFileLookup{}.Lookup, "x86-64_prod")
+	assert.NoError(err)
+	assert.Equal("os-x86-64-prod", rendered.GCP.ImageName)
+
+	// The variants don't share the vars of the base config.
+	assert.Equal(map[string]string{"team": "os", "env": "default"}, conf.Base.Vars)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Normalize rewrites the config file into a canonical form, e.g. before encoding it
+// with a format-on-save tool, so equivalent config files produce minimal diffs.
+//
+// Strings are trimmed, slices are sorted, empty slices and maps become nil
+// and unset options drop their stored value. Variant names and the variant order are kept,
+// as they are referenced from outside the config and the order determines the order variants are processed in.
+// Normalize is idempotent.
+func (c *ConfigFile) Normalize() {
+	c.Base.normalize()
+	for name, variant := range c.Variants {
+		variant.normalize()
+		c.Variants[name] = variant
+	}
+	if len(c.Variants) == 0 {
+		c.Variants = nil
+	}
+	if len(c.VariantOrder) == 0 {
+		c.VariantOrder = nil
+	}
+}
+
+// normalize rewrites the config into the canonical form described in ConfigFile.Normalize.
+// Slices and maps are replaced instead of modified, as they may be shared with other configs.
+func (c *Config) normalize() {
+	normalizeValue(reflect.ValueOf(c).Elem())
+}
+
+// normalizeValue normalizes the settable value v in place.
+// Fields that aren't part of the config file format are skipped.
+func normalizeValue(v reflect.Value) {
+	if v.Type().Implements(optionType) {
+		if !v.FieldByName("Valid").Bool() {
+			v.FieldByName("Val").SetZero()
+			return
+		}
+		normalizeValue(v.FieldByName("Val"))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			if !field.IsExported() || field.Tag.Get("toml") == "-" {
+				continue
+			}
+			normalizeValue(v.Field(i))
+		}
+	case reflect.String:
+		v.SetString(strings.TrimSpace(v.String()))
+	case reflect.Slice:
+		if v.Len() == 0 {
+			v.SetZero()
+			return
+		}
+		elems := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(elems, v)
+		keys := make([]string, elems.Len())
+		for i := range elems.Len() {
+			normalizeValue(elems.Index(i))
+			keys[i] = sortKey(elems.Index(i))
+		}
+		sort.Sort(&sortableSlice{keys: keys, swap: reflect.Swapper(elems.Interface())})
+		v.Set(elems)
+	case reflect.Map:
+		if v.Len() == 0 {
+			v.SetZero()
+			return
+		}
+		entries := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			val := reflect.New(v.Type().Elem()).Elem()
+			val.Set(iter.Value())
+			normalizeValue(val)
+			entries.SetMapIndex(iter.Key(), val)
+		}
+		v.Set(entries)
+	}
+}
+
+// sortKey returns the key slice elements are sorted by.
+// Strings are sorted by their value, all other elements by their canonical encoding.
+func sortKey(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return v.String()
+	}
+	// Canonical values only consist of maps, slices and basic types, which can always be encoded.
+	data, err := json.Marshal(canonicalValue(v))
+	if err != nil {
+		panic("config: encoding canonical config: " + err.Error())
+	}
+	return string(data)
+}
+
+// sortableSlice sorts a slice by precomputed keys.
+type sortableSlice struct {
+	keys []string
+	swap func(i, j int)
+}
+
+func (s *sortableSlice) Len() int           { return len(s.keys) }
+func (s *sortableSlice) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s *sortableSlice) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.swap(i, j)
+}
@@ -0,0 +1,66 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFileNormalize(t *testing.T) {
+	assert := assert.New(t)
+	unsorted := []string{"us-east-1", " eu-west-1"}
+	file := ConfigFile{
+		Base: Config{
+			Provider: " aws ",
+			Name:     "my-image\n",
+			AWS: AWSConfig{
+				ReplicationRegions: unsorted,
+				BlobTags:           map[string]string{"team": " os "},
+				Publish:            Option[bool]{Val: true},
+			},
+			Azure: AzureConfig{
+				TargetRegions: []AzureTargetRegion{{Name: "westeurope", ReplicaCount: 2}, {Name: "eastus", ReplicaCount: 1}},
+				Features:      map[string]string{},
+			},
+			GCP: GCPConfig{
+				GuestOSFeatures: []string{},
+			},
+			Warnings: []string{" kept "},
+		},
+		Variants: map[string]Config{
+			"sev": {AWS: AWSConfig{AMIName: " {{.Name}}-sev "}, OpenStack: OpenStackConfig{Tags: []string{"b", "a"}}},
+		},
+		VariantOrder: []string{"tdx", "sev"},
+	}
+
+	file.Normalize()
+	assert.Equal("aws", file.Base.Provider)
+	assert.Equal("my-image", file.Base.Name)
+	assert.Equal([]string{"eu-west-1", "us-east-1"}, file.Base.AWS.ReplicationRegions)
+	assert.Equal(map[string]string{"team": "os"}, file.Base.AWS.BlobTags)
+	assert.Equal(None[bool](), file.Base.AWS.Publish)
+	assert.Equal([]AzureTargetRegion{{Name: "eastus", ReplicaCount: 1}, {Name: "westeurope", ReplicaCount: 2}}, file.Base.Azure.TargetRegions)
+	assert.Nil(file.Base.Azure.Features)
+	assert.Nil(file.Base.GCP.GuestOSFeatures)
+	assert.Equal([]string{" kept "}, file.Base.Warnings)
+	assert.Equal("{{.Name}}-sev", file.Variants["sev"].AWS.AMIName)
+	assert.Equal([]string{"a", "b"}, file.Variants["sev"].OpenStack.Tags)
+	assert.Equal([]string{"tdx", "sev"}, file.VariantOrder)
+	// Slices shared with other configs aren't modified.
+	assert.Equal([]string{"us-east-1", " eu-west-1"}, unsorted)
+
+	// Normalizing is idempotent.
+	once := ConfigFile{Base: file.Base.Clone(), Variants: map[string]Config{}, VariantOrder: slices.Clone(file.VariantOrder)}
+	for name, variant := range file.Variants {
+		once.Variants[name] = variant.Clone()
+	}
+	file.Normalize()
+	assert.Equal(once, file)
+}
@@ -10,11 +10,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
 
+	"dario.cat/mergo"
 	"github.com/BurntSushi/toml"
 )
 
+// ErrInvalidOptionType is returned if a value can't be decoded into an option of the given type.
+var ErrInvalidOptionType = errors.New("invalid type")
+
 type Option[T any] struct {
 	Val   T
 	Valid bool
@@ -99,7 +104,7 @@ func (o *Option[T]) UnmarshalTOML(v any) error {
 	}
 
 	o.Valid = false
-	return errors.New("invalid type")
+	return fmt.Errorf("%w: cannot use %T as %T", ErrInvalidOptionType, v, o.Val)
 }
 
 func (o Option[T]) MarshalTOML() ([]byte, error) {
@@ -136,6 +141,21 @@ func (t OptionTransformer) Transformer(typ reflect.Type) func(dst, src reflect.V
 	}
 }
 
+// transformerChain uses the transformer of the first entry that handles a type.
+type transformerChain []mergo.Transformers
+
+func (c transformerChain) Transformer(typ reflect.Type) func(dst, src reflect.Value) error {
+	for _, t := range c {
+		if t == nil {
+			continue
+		}
+		if fn := t.Transformer(typ); fn != nil {
+			return fn
+		}
+	}
+	return nil
+}
+
 var (
 	_ toml.Unmarshaler = (*Option[int])(nil)
 	_ toml.Marshaler   = Option[int]{}
@@ -121,6 +121,13 @@ func TestTOML(t *testing.T) {
 	}, conf)
 }
 
+func TestTOMLInvalidType(t *testing.T) {
+	assert := assert.New(t)
+	var opt Option[bool]
+	assert.ErrorIs(opt.UnmarshalTOML("yes"), ErrInvalidOptionType)
+	assert.False(opt.IsSome())
+}
+
 func TestTransformer(t *testing.T) {
 	assert := assert.New(t)
 
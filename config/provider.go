@@ -0,0 +1,113 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrUnknownProvider is returned if the provider of a config is not supported.
+	ErrUnknownProvider = errors.New("unknown provider")
+	// ErrNoProviderConfig is returned for custom providers, which don't have a provider specific config section.
+	ErrNoProviderConfig = errors.New("provider has no provider specific config")
+)
+
+// Provider is a cloud provider images can be uploaded to.
+type Provider string
+
+const (
+	ProviderAWS       Provider = "aws"
+	ProviderAzure     Provider = "azure"
+	ProviderGCP       Provider = "gcp"
+	ProviderOpenStack Provider = "openstack"
+	ProviderScaleway  Provider = "scaleway"
+)
+
+var (
+	customProvidersMux sync.RWMutex
+	customProviders    []Provider
+)
+
+// Providers returns all supported providers, including registered custom providers.
+func Providers() []Provider {
+	return append(builtinProviders(), CustomProviders()...)
+}
+
+// CustomProviders returns the providers added with RegisterProvider.
+func CustomProviders() []Provider {
+	customProvidersMux.RLock()
+	defer customProvidersMux.RUnlock()
+	return slices.Clone(customProviders)
+}
+
+// RegisterProvider adds a custom provider to the supported providers and returns it.
+// The name is normalized like in ParseProvider. Registering a built-in or an
+// already registered provider has no effect.
+// Custom providers don't have a provider specific config section.
+func RegisterProvider(name string) Provider {
+	provider := normalizeProvider(name)
+	customProvidersMux.Lock()
+	defer customProvidersMux.Unlock()
+	if slices.Contains(builtinProviders(), provider) || slices.Contains(customProviders, provider) {
+		return provider
+	}
+	customProviders = append(customProviders, provider)
+	return provider
+}
+
+// ParseProvider returns the provider with the given name.
+// The name is matched case-insensitively and surrounding whitespace is ignored.
+func ParseProvider(name string) (Provider, error) {
+	normalized := normalizeProvider(name)
+	for _, provider := range Providers() {
+		if normalized == provider {
+			return provider, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownProvider, name)
+}
+
+// ResolveProvider returns the typed provider of the config.
+func (c *Config) ResolveProvider() (Provider, error) {
+	return ParseProvider(c.Provider)
+}
+
+// ProviderConfig returns the provider specific config section of the config's provider,
+// e.g. an AWSConfig for provider aws.
+func (c *Config) ProviderConfig() (any, error) {
+	provider, err := c.ResolveProvider()
+	if err != nil {
+		return nil, err
+	}
+	switch provider {
+	case ProviderAWS:
+		return c.AWS, nil
+	case ProviderAzure:
+		return c.Azure, nil
+	case ProviderGCP:
+		return c.GCP, nil
+	case ProviderOpenStack:
+		return c.OpenStack, nil
+	case ProviderScaleway:
+		return c.Scaleway, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrNoProviderConfig, provider)
+	}
+}
+
+func builtinProviders() []Provider {
+	return []Provider{ProviderAWS, ProviderAzure, ProviderGCP, ProviderOpenStack, ProviderScaleway}
+}
+
+func normalizeProvider(name string) Provider {
+	return Provider(strings.ToLower(strings.TrimSpace(name)))
+}
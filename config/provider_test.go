@@ -0,0 +1,112 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveProvider(t *testing.T) {
+	testCases := map[string]struct {
+		provider string
+		want     Provider
+		wantErr  bool
+	}{
+		"aws":           {provider: "aws", want: ProviderAWS},
+		"azure":         {provider: "azure", want: ProviderAzure},
+		"gcp":           {provider: "gcp", want: ProviderGCP},
+		"openstack":     {provider: "openstack", want: ProviderOpenStack},
+		"scaleway":      {provider: "scaleway", want: ProviderScaleway},
+		"upper case":    {provider: "AWS", want: ProviderAWS},
+		"mixed case":    {provider: "OpenStack", want: ProviderOpenStack},
+		"whitespace":    {provider: " gcp\n", want: ProviderGCP},
+		"empty":         {provider: "", wantErr: true},
+		"unknown":       {provider: "foo", wantErr: true},
+		"inner spacing": {provider: "open stack", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			config := Config{Provider: tc.provider}
+			got, err := config.ResolveProvider()
+			if tc.wantErr {
+				assert.ErrorIs(err, ErrUnknownProvider)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
+
+func TestConfigProviderConfig(t *testing.T) {
+	config := fullConfig()
+	RegisterProvider("provider-config-test")
+	testCases := map[string]struct {
+		provider string
+		want     any
+		wantErr  error
+	}{
+		"aws":             {provider: "aws", want: config.AWS},
+		"azure":           {provider: "azure", want: config.Azure},
+		"gcp":             {provider: "GCP", want: config.GCP},
+		"openstack":       {provider: "openstack", want: config.OpenStack},
+		"scaleway":        {provider: "scaleway", want: config.Scaleway},
+		"unknown":         {provider: "foo", wantErr: ErrUnknownProvider},
+		"custom provider": {provider: "provider-config-test", wantErr: ErrNoProviderConfig},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			config.Provider = tc.provider
+			got, err := config.ProviderConfig()
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
+
+func TestRegisterProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(ProviderAWS, RegisterProvider("AWS"))
+	assert.NotContains(CustomProviders(), ProviderAWS)
+
+	provider := RegisterProvider(" Test-Cloud ")
+	assert.Equal(Provider("test-cloud"), provider)
+	RegisterProvider("test-cloud")
+	assert.Equal(1, countProvider(CustomProviders(), provider))
+	assert.Contains(Providers(), provider)
+
+	parsed, err := ParseProvider("TEST-CLOUD")
+	assert.NoError(err)
+	assert.Equal(provider, parsed)
+
+	cfg := validConfig()
+	cfg.Provider = "test-cloud"
+	v := Validator{}
+	assert.NoError(v.Validate(context.Background(), cfg))
+}
+
+func countProvider(providers []Provider, provider Provider) int {
+	var count int
+	for _, p := range providers {
+		if p == provider {
+			count++
+		}
+	}
+	return count
+}
@@ -11,28 +11,51 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"reflect"
+	"slices"
+	"strings"
 
 	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
 )
 
 //go:embed validation.rego
 var validationPolicy string
 
+// ErrInvalidConfig is returned for every policy violation found when validating a config.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// ValidationHook validates a rendered variant in addition to the built-in validation,
+// e.g. to enforce naming conventions. The name is empty for configs without variants.
+type ValidationHook func(name string, cfg Config) error
+
 type Validator struct{}
 
 func (v *Validator) Validate(ctx context.Context, config Config) error {
+	violations, err := v.violations(ctx, config)
+	if err != nil {
+		return err
+	}
+	return errors.Join(violations...)
+}
+
+// violations returns an error wrapping ErrInvalidConfig for every policy violation of the config.
+func (v *Validator) violations(ctx context.Context, config Config) ([]error, error) {
 	opts := []func(*rego.Rego){
 		rego.Query("data.config.deny"),
 		rego.Module("validation.rego", validationPolicy),
 		rego.Input(config),
+		rego.Store(inmem.NewFromObject(map[string]any{
+			"custom_providers": CustomProviders(),
+		})),
 	}
 	r := rego.New(opts...)
 	res, err := r.Eval(ctx)
 	if err != nil {
-		return fmt.Errorf("evaluating policy: %w", err)
+		return nil, fmt.Errorf("evaluating policy: %w", err)
 	}
 
-	var resErr error
+	var violations []error
 	for _, result := range res {
 		for _, expression := range result.Expressions {
 			var expressionValues []any
@@ -44,11 +67,118 @@ func (v *Validator) Validate(ctx context.Context, config Config) error {
 				switch val := v.(type) {
 				// Policies that only return a single string (e.g. deny[msg])
 				case string:
-					resErr = errors.Join(resErr, errors.New(val))
+					violations = append(violations, fmt.Errorf("%w: %s", ErrInvalidConfig, val))
 				}
 			}
 		}
 	}
 
-	return resErr
+	return violations, nil
+}
+
+// ValidateAll validates a config that may be incomplete and not rendered yet, e.g. while it is edited,
+// and returns all problems found instead of stopping at the first one.
+// Every template field is rendered on its own, so all template errors are reported.
+// Fields that fail to render are treated as empty by the remaining checks.
+// No files are read: a version from the imageVersionFile, the version auto and a missing image digest
+// are replaced by placeholders. Use Render to validate the complete config before uploading.
+func (c *Config) ValidateAll() []error {
+	_, errs := c.validateAll()
+	return errs
+}
+
+// validateAll returns the config rendered as far as possible together with all problems found.
+func (c *Config) validateAll() (Config, []error) {
+	out := c.Clone()
+	if out.ImageVersionFile != "" || out.ImageVersion == AutoVersion {
+		out.ImageVersion = autoVersionPlaceholder
+	}
+	if out.ImageDigest == "" {
+		out.ImageDigest = strings.Repeat("0", 64)
+	}
+
+	out.normalizeRegions()
+
+	var errs []error
+	o := newRenderOptions(nil)
+	for _, section := range []any{&out, &out.AWS, &out.Azure, &out.GCP, &out.OpenStack, &out.Scaleway, &out.Manifest} {
+		errs = append(errs, out.renderTemplatesAll(section, o)...)
+	}
+
+	v := Validator{}
+	violations, err := v.violations(context.TODO(), out)
+	if err != nil {
+		return out, append(errs, err)
+	}
+	return out, append(errs, violations...)
+}
+
+// renderTemplatesAll renders the template fields like renderTemplates, but continues after errors.
+// Fields that fail to render are cleared.
+func (c *Config) renderTemplatesAll(configStruct any, o renderOptions) []error {
+	var errs []error
+	val := reflect.ValueOf(configStruct).Elem()
+	for i := range val.NumField() {
+		typeField := val.Type().Field(i)
+		field := val.Field(i)
+		if err := c.renderFieldTemplate(typeField.Name, field, typeField.Tag, o); err != nil {
+			errs = append(errs, err)
+			if field.CanSet() {
+				field.SetZero()
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateAll validates the base config or all variants like Config.ValidateAll,
+// including the variant order and the validation hooks, and returns all problems found.
+// Problems of variants are prefixed with the variant name.
+func (c *ConfigFile) ValidateAll() []error {
+	var errs []error
+	names := []string{""}
+	if len(c.Variants) > 0 {
+		var err error
+		names, err = c.orderedVariantNames()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("validating variant order: %w", err))
+			names = make([]string, 0, len(c.Variants))
+			for name := range c.Variants {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+		}
+	}
+
+	for _, name := range names {
+		var variantErrs []error
+		merged, err := c.mergedVariant(name)
+		if err != nil {
+			variantErrs = append(variantErrs, err)
+		} else {
+			rendered, renderErrs := merged.validateAll()
+			variantErrs = append(variantErrs, renderErrs...)
+			if err := runValidationHooks(c.ValidationHooks, name, rendered); err != nil {
+				variantErrs = append(variantErrs, err)
+			}
+		}
+		for _, err := range variantErrs {
+			if name != "" {
+				err = fmt.Errorf("config for variant %s: %w", name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// runValidationHooks runs all hooks on the rendered variant and joins their errors.
+func runValidationHooks(hooks []ValidationHook, name string, cfg Config) error {
+	var errs error
+	for _, hook := range hooks {
+		if err := hook(name, cfg); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%w: %w", ErrInvalidConfig, err))
+		}
+	}
+	return errs
 }
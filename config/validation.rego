@@ -4,6 +4,7 @@ import future.keywords.in
 
 deny[msg] {
     not input.Provider in valid_csps
+    not input.Provider in data.custom_providers
 
     msg = sprintf("cloud provider %q unknown", [input.Provider])
 }
@@ -14,12 +15,26 @@ deny[msg] {
     msg = sprintf("image version %q must be in format <MAJOR>.<MINOR>.<PATCH>", [input.ImageVersion])
 }
 
+deny[msg] {
+    input.ImageVersionFileKey != ""
+    input.ImageVersionFile == ""
+
+    msg = "field imageVersionFileKey requires imageVersionFile"
+}
+
 deny[msg] {
     input.Name == ""
 
     msg = "required field name empty"
 }
 
+deny[msg] {
+    input.TTL != ""
+    not valid_positive_duration(input.TTL)
+
+    msg = sprintf("field ttl %q must be a positive number of days (e.g. 30d) or a duration (e.g. 720h)", [input.TTL])
+}
+
 deny[msg] {
     input.Provider == "aws"
     some "" in input.AWS.ReplicationRegions
@@ -27,6 +42,27 @@ deny[msg] {
     msg = "member of list replicationRegions empty for provider aws"
 }
 
+# Region names like us-east-1 or us-gov-west-1. The format is checked loosely,
+# so new regions are accepted without updating uplosi.
+aws_region_pattern := `^[a-z]{2}(-[a-z]+)+-[0-9]+$`
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.Region != ""
+    not regex.match(aws_region_pattern, input.AWS.Region)
+
+    msg = sprintf("region %q is not a valid AWS region name like us-east-1 for provider aws", [input.AWS.Region])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    some region in input.AWS.ReplicationRegions
+    not region in {"", "*"}
+    not regex.match(aws_region_pattern, region)
+
+    msg = sprintf("replication region %q is not a valid AWS region name like us-east-1 for provider aws", [region])
+}
+
 deny[msg] {
     input.Provider == "aws"
     input.AWS.AMIName != ""
@@ -43,6 +79,13 @@ deny[msg] {
     msg = sprintf("ami name %q should only contain letters, numbers, '(', ')', '.', '-', '/' and '_'", [input.AWS.AMIName])
 }
 
+deny[msg] {
+    input.Provider == "aws"
+    count(input.AWS.AMIDescription) > 255
+
+    msg = sprintf("field amiDescription must be at most 255 characters for provider aws, got %d", [count(input.AWS.AMIDescription)])
+}
+
 # https://docs.aws.amazon.com/AmazonS3/latest/userguide/bucketnamingrules.html - 1
 deny[msg] {
     input.Provider == "aws"
@@ -146,6 +189,235 @@ deny[msg] {
     msg = sprintf("%q is not a valid bucket location constraint", [ input.AWS.BucketLocationConstraint ] )
 }
 
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.SnapshotID == ""
+    some fieldName, fieldValue in {
+        "bucket": input.AWS.Bucket,
+        "blobName": input.AWS.BlobName,
+    }
+    fieldValue == ""
+
+    msg = sprintf("required field %q empty for provider aws", [fieldName])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.StorageClass != ""
+    allowed := ["STANDARD", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING"]
+    not input.AWS.StorageClass in allowed
+
+    msg = sprintf("storage class %q must be one of %s for provider aws", [input.AWS.StorageClass, allowed])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.BlobACL != ""
+    allowed := ["private", "public-read", "authenticated-read", "bucket-owner-read", "bucket-owner-full-control"]
+    not input.AWS.BlobACL in allowed
+
+    msg = sprintf("field blobACL %q must be one of %s for provider aws", [input.AWS.BlobACL, allowed])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.TPMSupport != ""
+    allowed := ["v2.0", "none"]
+    not input.AWS.TPMSupport in allowed
+
+    msg = sprintf("field tpmSupport %q must be one of %s for provider aws", [input.AWS.TPMSupport, allowed])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.IMDSSupport != ""
+    allowed := ["v2.0"]
+    not input.AWS.IMDSSupport in allowed
+
+    msg = sprintf("field imdsSupport %q must be one of %s for provider aws", [input.AWS.IMDSSupport, allowed])
+}
+
+# https://docs.aws.amazon.com/ebs/latest/userguide/ebs-volume-types.html
+# Throughput optimized and cold HDD volumes can't be used as root volumes.
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.VolumeType != ""
+    allowed := ["gp2", "gp3", "io1", "io2", "standard"]
+    not input.AWS.VolumeType in allowed
+
+    msg = sprintf("field volumeType %q must be one of %s for provider aws", [input.AWS.VolumeType, allowed])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.IOPS != 0
+    not input.AWS.VolumeType in ["gp3", "io1", "io2"]
+
+    msg = sprintf("field iops is only supported for volume types gp3, io1 and io2 for provider aws, got volume type %q", [input.AWS.VolumeType])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.VolumeType in ["io1", "io2"]
+    input.AWS.IOPS == 0
+
+    msg = sprintf("field iops is required for volume type %s for provider aws", [input.AWS.VolumeType])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.IOPS < 0
+
+    msg = sprintf("field iops must be positive for provider aws, got %d", [input.AWS.IOPS])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.Throughput != 0
+    input.AWS.VolumeType != "gp3"
+
+    msg = sprintf("field throughput is only supported for volume type gp3 for provider aws, got volume type %q", [input.AWS.VolumeType])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.Throughput != 0
+    not int_in_range(input.AWS.Throughput, 125, 1000)
+
+    msg = sprintf("field throughput must be between 125 and 1000 MiB/s for provider aws, got %d", [input.AWS.Throughput])
+}
+
+# https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/device_naming.html
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.RootDeviceName != ""
+    not regex.match(`^/dev/(sd[a-z][0-9]*|xvd[a-z]{1,2}|nvme[0-9]+n[0-9]+)$`, input.AWS.RootDeviceName)
+
+    msg = sprintf("field rootDeviceName %q must be a device path like /dev/xvda or /dev/sda1 for provider aws", [input.AWS.RootDeviceName])
+}
+
+# https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-tagging.html
+deny[msg] {
+    input.Provider == "aws"
+    count(object.get(input.AWS, "BlobTags", {})) > 10
+
+    msg = sprintf("field blobTags must have at most 10 tags for provider aws, got %d", [count(input.AWS.BlobTags)])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    some key, _ in object.get(input.AWS, "BlobTags", {})
+    not length_in_range(key, 1, 128)
+
+    msg = sprintf("blob tag key %q must be between 1 and 128 characters for provider aws", [key])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    some key, value in object.get(input.AWS, "BlobTags", {})
+    count(value) > 256
+
+    msg = sprintf("blob tag %q value must be at most 256 characters for provider aws, got %d", [key, count(value)])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    some key, value in object.get(input.AWS, "BlobTags", {})
+    some s in [key, value]
+    not regex.match(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`, s)
+
+    msg = sprintf("blob tag %q should only contain letters, numbers, spaces and the characters _ . : / = + - @ for provider aws", [key])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    some key, _ in object.get(input.AWS, "BlobTags", {})
+    startswith(lower(key), "aws:")
+
+    msg = sprintf("blob tag key %q must not use the reserved prefix aws: for provider aws", [key])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.DeprecateAt != ""
+    input.AWS.DeprecateAfter != ""
+
+    msg = "fields deprecateAt and deprecateAfter are mutually exclusive for provider aws"
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.DeprecateAt != ""
+    not time.parse_rfc3339_ns(input.AWS.DeprecateAt)
+
+    msg = sprintf("field deprecateAt %q must be an RFC 3339 timestamp for provider aws", [input.AWS.DeprecateAt])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.DeprecateAt != ""
+    time.parse_rfc3339_ns(input.AWS.DeprecateAt) <= time.now_ns()
+
+    msg = sprintf("field deprecateAt %q must be in the future for provider aws", [input.AWS.DeprecateAt])
+}
+
+deny[msg] {
+    input.Provider == "azure"
+    input.Azure.EndOfLifeDate != ""
+    not time.parse_rfc3339_ns(input.Azure.EndOfLifeDate)
+    not valid_positive_duration(input.Azure.EndOfLifeDate)
+
+    msg = sprintf("field endOfLifeDate %q must be an RFC 3339 timestamp, a positive number of days (e.g. 365d) or a duration (e.g. 8760h) for provider azure", [input.Azure.EndOfLifeDate])
+}
+
+deny[msg] {
+    input.Provider == "azure"
+    input.Azure.EndOfLifeDate != ""
+    time.parse_rfc3339_ns(input.Azure.EndOfLifeDate) <= time.now_ns()
+
+    msg = sprintf("field endOfLifeDate %q must be in the future for provider azure", [input.Azure.EndOfLifeDate])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.DeprecateAfter != ""
+    not valid_positive_duration(input.AWS.DeprecateAfter)
+
+    msg = sprintf("field deprecateAfter %q must be a positive number of days (e.g. 90d) or a duration (e.g. 2160h) for provider aws", [input.AWS.DeprecateAfter])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.SnapshotID != ""
+    not regex.match(`^snap-[0-9a-f]+$`, input.AWS.SnapshotID)
+
+    msg = sprintf("field snapshotID %q must be an EBS snapshot ID (snap-...) for provider aws", [input.AWS.SnapshotID])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    input.AWS.SnapshotID != ""
+    input.AWS.Bucket != ""
+
+    msg = "fields snapshotID and bucket are mutually exclusive for provider aws, as no image is uploaded when using an existing snapshot"
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    some arn in input.AWS.OrganizationARNs
+    not regex.match(`^arn:aws[a-z-]*:organizations::\d{12}:organization/o-[a-z0-9]{10,32}$`, arn)
+
+    msg = sprintf("organization ARN %q must be like arn:aws:organizations::123456789012:organization/o-exampleorgid for provider aws", [arn])
+}
+
+deny[msg] {
+    input.Provider == "aws"
+    some arn in input.AWS.OrganizationalUnitARNs
+    not regex.match(`^arn:aws[a-z-]*:organizations::\d{12}:ou/o-[a-z0-9]{10,32}/ou-[a-z0-9]{4,32}-[a-z0-9]{8,32}$`, arn)
+
+    msg = sprintf("organizational unit ARN %q must be like arn:aws:organizations::123456789012:ou/o-exampleorgid/ou-examplerootid-exampleouid for provider aws", [arn])
+}
+
 deny[msg] {
     input.Provider == "aws"
     not is_boolean(input.AWS.Publish)
@@ -210,8 +482,11 @@ deny[msg] {
     msg = "field sharingNamePrefix is required for sharing profile community and provider azure"
 }
 
+# Only community galleries have a public name, so the prefix is ignored for other sharing profiles,
+# e.g. if it is inherited from a base config sharing the image with the community.
 deny[msg] {
     input.Provider == "azure"
+    input.Azure.SharingProfile == "community"
     input.Azure.SharingNamePrefix != ""
     not length_in_range(input.Azure.SharingNamePrefix, 5, 16)
 
@@ -220,6 +495,7 @@ deny[msg] {
 
 deny[msg] {
     input.Provider == "azure"
+    input.Azure.SharingProfile == "community"
     input.Azure.SharingNamePrefix != ""
     not regex.match(`^[a-zA-Z0-9]*$`, input.Azure.SharingNamePrefix)
 
@@ -266,29 +542,176 @@ deny[msg] {
     msg = sprintf("field diskName must be between 1 and 80 characters for provider azure, got %d", [count(input.Azure.DiskName)])
 }
 
+deny[msg] {
+    input.Provider == "azure"
+    some region in input.Azure.TargetRegions
+    region.Name == ""
+
+    msg = "member of list targetRegions has empty name for provider azure"
+}
+
+deny[msg] {
+    input.Provider == "azure"
+    some region in input.Azure.TargetRegions
+    region.ReplicaCount < 1
+
+    msg = sprintf("replica count of target region %q must be positive for provider azure, got %d", [region.Name, region.ReplicaCount])
+}
+
+deny[msg] {
+    input.Provider == "azure"
+    some region in input.Azure.TargetRegions
+    region.StorageAccountType != ""
+    allowed := ["Standard_LRS", "Standard_ZRS", "Premium_LRS"]
+    not region.StorageAccountType in allowed
+
+    msg = sprintf("storage account type %q of target region %q must be one of %s for provider azure", [region.StorageAccountType, region.Name, allowed])
+}
+
+deny[msg] {
+    input.Provider == "azure"
+    plan := {
+        "planName": input.Azure.PlanName,
+        "planPublisher": input.Azure.PlanPublisher,
+        "planProduct": input.Azure.PlanProduct,
+    }
+    some setField, setValue in plan
+    setValue != ""
+    some fieldName, fieldValue in plan
+    fieldValue == ""
+
+    msg = sprintf("field %s is required if %s is set for provider azure", [fieldName, setField])
+}
+
+# Features of image definitions that can be set in addition to the SecurityType,
+# which is derived from the attestation variant.
+azure_image_features := {
+    "DiskControllerTypes": ["SCSI", "NVMe", "SCSI, NVMe"],
+    "IsAcceleratedNetworkSupported": ["True", "False"],
+    "IsHibernateSupported": ["True", "False"],
+}
+
+deny[msg] {
+    input.Provider == "azure"
+    some name, _ in object.get(input.Azure, "Features", {})
+    not azure_image_features[name]
+    allowed := sort([known | some known, _ in azure_image_features])
+
+    msg = sprintf("image feature %q must be one of %s for provider azure", [name, allowed])
+}
+
+deny[msg] {
+    input.Provider == "azure"
+    some name, value in object.get(input.Azure, "Features", {})
+    allowed := azure_image_features[name]
+    not value in allowed
+
+    msg = sprintf("value %q of image feature %s must be one of %s for provider azure", [value, name, allowed])
+}
+
+deny[msg] {
+    input.Provider == "azure"
+    input.Azure.OSDiskSizeGB < 0
+
+    msg = sprintf("field osDiskSizeGB must not be negative for provider azure, got %d", [input.Azure.OSDiskSizeGB])
+}
+
 deny[msg] {
     input.Provider == "gcp"
-    input.GCP.Project != ""
-    not regex.match(`^[a-z0-9\-]*$`, input.GCP.Project)
+    some key, _ in object.get(input.GCP, "BlobTags", {})
+    key == ""
 
-    msg = sprintf("project name %q must contain only lowercase letters, digits and hyphens for provider gcp", [input.GCP.Project])
+    msg = "blob tag keys must not be empty for provider gcp"
 }
 
 deny[msg] {
     input.Provider == "gcp"
-    input.GCP.Project != ""
-    not begins_with(input.GCP.Project, lowercase_letters)
-    not ends_with(input.GCP.Project, lowercase_letters | digits)
+    input.GCP.State != ""
+    allowed := ["ACTIVE", "DEPRECATED"]
+    not input.GCP.State in allowed
 
-    msg = sprintf("project name %q must begin with a letter and end with a letter or number", [input.GCP.Project])
+    msg = sprintf("field state %q must be one of %s for provider gcp", [input.GCP.State, allowed])
 }
 
 deny[msg] {
     input.Provider == "gcp"
-    input.GCP.Project != ""
-    not length_in_range(input.GCP.Project, 6, 30)
+    input.GCP.State == "DEPRECATED"
+    input.GCP.DeprecateOldInFamily == true
 
-    msg = sprintf("field project must be between 6 and 30 characters for provider gcp, got %d", [count(input.GCP.Project)])
+    msg = "field deprecateOldInFamily can't be used with state DEPRECATED for provider gcp"
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    count(input.GCP.Description) > 2048
+
+    msg = sprintf("field description must be at most 2048 characters for provider gcp, got %d", [count(input.GCP.Description)])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    input.GCP.DeprecateOldInFamily == true
+    input.GCP.ImageFamily == ""
+
+    msg = "field deprecateOldInFamily requires imageFamily to be set for provider gcp"
+}
+
+# https://cloud.google.com/storage/quotas#objects
+deny[msg] {
+    input.Provider == "gcp"
+    tags := object.get(input.GCP, "BlobTags", {})
+    size := sum([n | some key, value in tags; n := count(key) + count(value)])
+    size > 8192
+
+    msg = sprintf("field blobTags must be at most 8 KiB in total for provider gcp, got %d bytes", [size])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    input.GCP.OSDiskSizeGB < 0
+
+    msg = sprintf("field osDiskSizeGB must not be negative for provider gcp, got %d", [input.GCP.OSDiskSizeGB])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    input.GCP.BlobName != ""
+    not endswith(input.GCP.BlobName, ".tar.gz")
+
+    msg = sprintf("field blobName %q must end with .tar.gz for provider gcp", [input.GCP.BlobName])
+}
+
+# The image is created in project, the bucket is created in sourceProject.
+gcp_projects := {
+    "project": input.GCP.Project,
+    "sourceProject": input.GCP.SourceProject,
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    some field, project in gcp_projects
+    project != ""
+    not regex.match(`^[a-z0-9\-]*$`, project)
+
+    msg = sprintf("%s name %q must contain only lowercase letters, digits and hyphens for provider gcp", [field, project])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    some field, project in gcp_projects
+    project != ""
+    not rfc1035_bounds(project)
+
+    msg = sprintf("%s name %q must begin with a letter and end with a letter or number", [field, project])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    some field, project in gcp_projects
+    project != ""
+    not length_in_range(project, 6, 30)
+
+    msg = sprintf("field %s must be between 6 and 30 characters for provider gcp, got %d", [field, count(project)])
 }
 
 deny[msg] {
@@ -296,16 +719,50 @@ deny[msg] {
     input.GCP.ImageName != ""
     not regex.match(`^[a-z0-9\-]*$`, input.GCP.ImageName)
 
-    msg = sprintf("image name %q must contain only alphanumerics, underscores, hyphens, and periods for provider gcp", [input.GCP.ImageName])
+    msg = sprintf("field imageName %q must contain only lowercase letters, digits and hyphens for provider gcp", [input.GCP.ImageName])
 }
 
 deny[msg] {
     input.Provider == "gcp"
     input.GCP.ImageName != ""
-    not begins_with(input.GCP.ImageName, lowercase_letters)
-    not ends_with(input.GCP.ImageName, lowercase_letters | digits)
+    not rfc1035_bounds(input.GCP.ImageName)
+
+    msg = sprintf("field imageName %q must begin with a letter and end with a letter or number", [input.GCP.ImageName])
+}
+
+# Regions like europe-west3, multi-regions like eu and dual-regions like nam4.
+gcp_location_pattern := `^[a-z]+[0-9]*(-[a-z]+[0-9]+)?$`
+
+deny[msg] {
+    input.Provider == "gcp"
+    input.GCP.Location != ""
+    not regex.match(gcp_location_pattern, input.GCP.Location)
+
+    msg = sprintf("location %q is not a valid GCP location like europe-west3 for provider gcp", [input.GCP.Location])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    some location in input.GCP.ReplicationLocations
+    not regex.match(gcp_location_pattern, location)
 
-    msg = sprintf("image name %q must begin with a letter and end with a letter or number", [input.GCP.ImageName])
+    msg = sprintf("replication location %q is not a valid GCP location like europe-west3 for provider gcp", [location])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    count(input.GCP.ReplicationLocations) != count({location | some location in input.GCP.ReplicationLocations})
+
+    msg = "field replicationLocations must not contain duplicates for provider gcp"
+}
+
+# Replicas are named <imageName>-<location>.
+deny[msg] {
+    input.Provider == "gcp"
+    some location in input.GCP.ReplicationLocations
+    count(input.GCP.ImageName) + 1 + count(location) > 63
+
+    msg = sprintf("image name %q of replication location %s must be at most 63 characters for provider gcp", [sprintf("%s-%s", [input.GCP.ImageName, location]), location])
 }
 
 deny[msg] {
@@ -321,16 +778,15 @@ deny[msg] {
     input.GCP.ImageFamily != ""
     not regex.match(`^[a-z0-9\-]*$`, input.GCP.ImageFamily)
 
-    msg = sprintf("image family %q must contain only alphanumerics, underscores, hyphens, and periods for provider gcp", [input.GCP.ImageFamily])
+    msg = sprintf("field imageFamily %q must contain only lowercase letters, digits and hyphens for provider gcp", [input.GCP.ImageFamily])
 }
 
 deny[msg] {
     input.Provider == "gcp"
     input.GCP.ImageFamily != ""
-    not begins_with(input.GCP.ImageFamily, lowercase_letters)
-    not ends_with(input.GCP.ImageFamily, lowercase_letters | digits)
+    not rfc1035_bounds(input.GCP.ImageFamily)
 
-    msg = sprintf("image family %q must begin with a letter and end with a letter or number", [input.GCP.ImageFamily])
+    msg = sprintf("field imageFamily %q must begin with a letter and end with a letter or number", [input.GCP.ImageFamily])
 }
 
 deny[msg] {
@@ -365,6 +821,76 @@ deny[msg] {
     msg = sprintf("field bucket must be between 1 and 63 characters for provider gcp, got %d", [count(input.GCP.Bucket)])
 }
 
+deny[msg] {
+    input.Provider == "gcp"
+    some feature in input.GCP.GuestOSFeatures
+    allowed := [
+        "GVNIC",
+        "IDPF",
+        "MULTI_IP_SUBNET",
+        "SECURE_BOOT",
+        "SEV_CAPABLE",
+        "SEV_LIVE_MIGRATABLE",
+        "SEV_LIVE_MIGRATABLE_V2",
+        "SEV_SNP_CAPABLE",
+        "UEFI_COMPATIBLE",
+        "VIRTIO_SCSI_MULTIQUEUE",
+        "WINDOWS",
+    ]
+    not feature in allowed
+
+    msg = sprintf("guest os feature %q must be one of %s for provider gcp", [feature, allowed])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    some "" in input.GCP.Licenses
+
+    msg = "member of list licenses empty for provider gcp"
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    some license in input.GCP.Licenses
+    license != ""
+    not regex.match(`^(https://(www|compute)\.googleapis\.com/compute/(v1|beta|alpha)/)?projects/[a-z0-9.:-]+/global/licenses/[a-z]([-a-z0-9]*[a-z0-9])?$`, license)
+
+    msg = sprintf("license %q must be a license URL like projects/my-project/global/licenses/my-license for provider gcp", [license])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    input.GCP.Sharing != ""
+    allowed := ["private", "allAuthenticatedUsers", "allUsers"]
+    not input.GCP.Sharing in allowed
+
+    msg = sprintf("field sharing %q must be one of %s for provider gcp", [input.GCP.Sharing, allowed])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    input.GCP.BlobACL != ""
+    allowed := ["private", "projectPrivate", "publicRead", "authenticatedRead", "bucketOwnerRead", "bucketOwnerFullControl"]
+    not input.GCP.BlobACL in allowed
+
+    msg = sprintf("field blobACL %q must be one of %s for provider gcp", [input.GCP.BlobACL, allowed])
+}
+
+deny[msg] {
+    input.Provider == "gcp"
+    input.GCP.Sharing == "allUsers"
+    not input.GCP.ConfirmAllUsers == true
+
+    msg = "sharing allUsers makes the image available to anonymous users and requires confirmAllUsers to be set for provider gcp"
+}
+
+deny[msg] {
+    input.Provider == "openstack"
+    count(input.OpenStack.ImageName) > 255
+
+    msg = sprintf("field imageName must be at most 255 characters for provider openstack, got %d", [count(input.OpenStack.ImageName)])
+}
+
 deny[msg] {
     input.Provider == "openstack"
     input.OpenStack.Visibility != ""
@@ -374,6 +900,63 @@ deny[msg] {
     msg = sprintf("field visibility must be one of %s for provider openstack", allowed)
 }
 
+# https://www.scaleway.com/en/docs/compute/instances/concepts/#availability-zone
+deny[msg] {
+    input.Provider == "scaleway"
+    input.Scaleway.Zone != ""
+    not regex.match(`^[a-z]{2}-[a-z]{3}-[0-9]$`, input.Scaleway.Zone)
+
+    msg = sprintf("zone %q must be a zone like fr-par-1 for provider scaleway", [input.Scaleway.Zone])
+}
+
+deny[msg] {
+    input.Provider == "scaleway"
+    input.Scaleway.ProjectID != ""
+    not regex.match(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`, input.Scaleway.ProjectID)
+
+    msg = sprintf("project id %q must be a valid uuid for provider scaleway", [input.Scaleway.ProjectID])
+}
+
+deny[msg] {
+    input.Provider == "scaleway"
+    input.Scaleway.Bucket != ""
+    not regex.match(`^[a-z0-9][a-z0-9.\-]{1,61}[a-z0-9]$`, input.Scaleway.Bucket)
+
+    msg = sprintf("bucket name %q must be 3 to 63 lowercase letters, numbers, dots or hyphens, starting and ending with a letter or number for provider scaleway", [input.Scaleway.Bucket])
+}
+
+deny[msg] {
+    input.Provider == "scaleway"
+    input.Scaleway.ObjectName != ""
+    not endswith(input.Scaleway.ObjectName, ".qcow2")
+
+    msg = sprintf("field objectName %q must end with .qcow2 for provider scaleway, as the image is uploaded in QCOW2 format", [input.Scaleway.ObjectName])
+}
+
+deny[msg] {
+    input.Provider == "scaleway"
+    count(input.Scaleway.ImageName) > 255
+
+    msg = sprintf("field imageName must be at most 255 characters for provider scaleway, got %d", [count(input.Scaleway.ImageName)])
+}
+
+deny[msg] {
+    input.Provider == "scaleway"
+    input.Scaleway.Arch != ""
+    allowed := ["x86_64", "arm64"]
+    not input.Scaleway.Arch in allowed
+
+    msg = sprintf("field arch %q must be one of %s for provider scaleway", [input.Scaleway.Arch, allowed])
+}
+
+# Manifests are written to the bucket the image is uploaded through, which azure and openstack don't use.
+deny[msg] {
+    input.Manifest.Key != ""
+    input.Provider in ["azure", "openstack"]
+
+    msg = sprintf("field manifest.key must not be set for provider %s, as it doesn't upload through a bucket", [input.Provider])
+}
+
 deny[msg] {
     some provider in valid_csps
     input.Provider == provider
@@ -383,11 +966,23 @@ deny[msg] {
     msg = sprintf("required field %q empty for provider %s", [fieldName, input.Provider])
 }
 
+valid_positive_duration(s) {
+    regex.match(`^[1-9][0-9]*d$`, s)
+}
+
+valid_positive_duration(s) {
+    time.parse_duration_ns(s) > 0
+}
+
 length_in_range(s, min_len, max_len) = in_range {
     length := count(s)
     in_range := all([min_len <= length, length <= max_len])
 }
 
+int_in_range(n, min_val, max_val) = in_range {
+    in_range := all([min_val <= n, n <= max_val])
+}
+
 begins_with(s, charset) = begin {
     begin := substring(s, 0, 1) in charset
 }
@@ -403,15 +998,19 @@ begin_and_end_with(s, charset) = begin_and_end {
     ])
 }
 
-valid_csps := [ "aws", "azure", "gcp", "openstack" ]
+# Names in GCP must comply with RFC 1035: start with a lowercase letter and end with a lowercase letter or digit.
+rfc1035_bounds(s) {
+    begins_with(s, lowercase_letters)
+    ends_with(s, lowercase_letters | digits)
+}
+
+valid_csps := [ "aws", "azure", "gcp", "openstack", "scaleway" ]
 
 required_fields := {
     "aws": {
         "region": input.AWS.Region,
         "replicationRegions": input.AWS.ReplicationRegions,
         "amiName": input.AWS.AMIName,
-        "bucket": input.AWS.Bucket,
-        "blobName": input.AWS.BlobName,
         "snapshotName": input.AWS.SnapshotName,
     },
     "azure": {
@@ -441,6 +1040,14 @@ required_fields := {
         "cloud": input.OpenStack.Cloud,
         "imageName": input.OpenStack.ImageName,
     },
+    "scaleway": {
+        "zone": input.Scaleway.Zone,
+        "projectID": input.Scaleway.ProjectID,
+        "bucket": input.Scaleway.Bucket,
+        "objectName": input.Scaleway.ObjectName,
+        "imageName": input.Scaleway.ImageName,
+        "arch": input.Scaleway.Arch,
+    },
 }
 
 lowercase_letters := {
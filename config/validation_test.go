@@ -8,6 +8,7 @@ package config
 
 import (
 	"context"
+	"errors"
 	"strings"
 	"testing"
 
@@ -39,6 +40,19 @@ func TestValidate(t *testing.T) {
 			base:      validConfig(),
 			overrides: Config{Provider: "gcp"},
 		},
+		"valid Scaleway config": {
+			base:      validConfig(),
+			overrides: Config{Provider: "scaleway"},
+		},
+		"manifest key with AWS": {
+			base:      validConfig(),
+			overrides: Config{Provider: "aws", Manifest: ManifestConfig{Key: "manifests/image.json"}},
+		},
+		"manifest key with Azure": {
+			base:      validConfig(),
+			overrides: Config{Provider: "azure", Manifest: ManifestConfig{Key: "manifests/image.json"}},
+			wantErr:   true,
+		},
 		"unknown provider": {
 			base:      validConfig(),
 			overrides: Config{Provider: "foo"},
@@ -75,242 +89,1295 @@ func TestValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
-		"wrong length AWS amiName": {
+		"wrong length AWS amiName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					AMIName: strings.Repeat("a", 129),
+				},
+			},
+			wantErr: true,
+		},
+		"invalid AWS amiName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					AMIName: "invalid<ami_name",
+				},
+			},
+			wantErr: true,
+		},
+		"too long AWS amiDescription": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					AMIDescription: strings.Repeat("a", 256),
+				},
+			},
+			wantErr: true,
+		},
+		"missing AWS blobName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+			},
+			mutation: func(c *Config) {
+				c.AWS.BlobName = ""
+			},
+			wantErr: true,
+		},
+		"AWS snapshotID without bucket": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					SnapshotID: "snap-0123456789abcdef0",
+				},
+			},
+			mutation: func(c *Config) {
+				c.AWS.Bucket = ""
+				c.AWS.BlobName = ""
+			},
+		},
+		"AWS snapshotID with bucket": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					SnapshotID: "snap-0123456789abcdef0",
+				},
+			},
+			wantErr: true,
+		},
+		"invalid AWS snapshotID": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					SnapshotID: "ami-0123456789abcdef0",
+				},
+			},
+			mutation: func(c *Config) {
+				c.AWS.Bucket = ""
+			},
+			wantErr: true,
+		},
+		"missing AWS bucket": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+			},
+			mutation: func(c *Config) {
+				c.AWS.Bucket = ""
+			},
+			wantErr: true,
+		},
+		"valid AWS storageClass": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					StorageClass: "ONEZONE_IA",
+				},
+			},
+		},
+		"invalid AWS storageClass": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					StorageClass: "GLACIER",
+				},
+			},
+			wantErr: true,
+		},
+		"valid AWS blobACL": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					BlobACL: "public-read",
+				},
+			},
+		},
+		"invalid AWS blobACL": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					BlobACL: "publicRead",
+				},
+			},
+			wantErr: true,
+		},
+		"valid AWS GovCloud region": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.Region = "us-gov-west-1"
+				c.AWS.ReplicationRegions = []string{"us-gov-east-1"}
+			},
+		},
+		"AWS replication to all regions": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.ReplicationRegions = []string{"*"}
+			},
+		},
+		"invalid AWS region": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.Region = "useast1"
+			},
+			wantErr: true,
+		},
+		"unnormalized AWS region": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.Region = "US-East-1"
+			},
+			wantErr: true,
+		},
+		"invalid AWS replication region": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.ReplicationRegions = []string{"us-west-1", "eu_west_1"}
+			},
+			wantErr: true,
+		},
+		"valid AWS organization ARNs": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.OrganizationARNs = []string{"arn:aws:organizations::123456789012:organization/o-a1b2c3d4e5"}
+				c.AWS.OrganizationalUnitARNs = []string{"arn:aws-us-gov:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cd34ef56"}
+			},
+		},
+		"invalid AWS organization ARN": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.OrganizationARNs = []string{"o-a1b2c3d4e5"}
+			},
+			wantErr: true,
+		},
+		"AWS organizational unit ARN as organization ARN": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.OrganizationARNs = []string{"arn:aws:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cd34ef56"}
+			},
+			wantErr: true,
+		},
+		"invalid AWS organizational unit ARN": {
+			base: validConfig(),
+			mutation: func(c *Config) {
+				c.AWS.OrganizationalUnitARNs = []string{"arn:aws:organizations::123456789012:ou/ou-ab12-cd34ef56"}
+			},
+			wantErr: true,
+		},
+		"valid AWS tpmSupport": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					TPMSupport: "none",
+				},
+			},
+		},
+		"invalid AWS tpmSupport": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					TPMSupport: "v1.2",
+				},
+			},
+			wantErr: true,
+		},
+		"valid AWS imdsSupport": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					IMDSSupport: "v2.0",
+				},
+			},
+		},
+		"invalid AWS imdsSupport": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					IMDSSupport: "v1.0",
+				},
+			},
+			wantErr: true,
+		},
+		"valid AWS gp3 volume": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					VolumeType: "gp3",
+					IOPS:       6000,
+					Throughput: 500,
+				},
+			},
+		},
+		"valid AWS io2 volume": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					VolumeType: "io2",
+					IOPS:       10000,
+				},
+			},
+		},
+		"invalid AWS volumeType": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					VolumeType: "st1",
+				},
+			},
+			wantErr: true,
+		},
+		"AWS iops with gp2 volume": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					VolumeType: "gp2",
+					IOPS:       3000,
+				},
+			},
+			wantErr: true,
+		},
+		"AWS iops without volumeType": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					IOPS: 3000,
+				},
+			},
+			wantErr: true,
+		},
+		"missing AWS iops for io1 volume": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					VolumeType: "io1",
+				},
+			},
+			wantErr: true,
+		},
+		"AWS throughput with io2 volume": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					VolumeType: "io2",
+					IOPS:       10000,
+					Throughput: 500,
+				},
+			},
+			wantErr: true,
+		},
+		"AWS throughput out of range": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					VolumeType: "gp3",
+					Throughput: 2000,
+				},
+			},
+			wantErr: true,
+		},
+		"valid AWS rootDeviceName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					RootDeviceName: "/dev/sda1",
+				},
+			},
+		},
+		"invalid AWS rootDeviceName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					RootDeviceName: "sda1",
+				},
+			},
+			wantErr: true,
+		},
+		"valid AWS deprecateAt": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					DeprecateAt: "2100-01-01T00:00:00Z",
+				},
+			},
+		},
+		"AWS deprecateAt in the past": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					DeprecateAt: "2000-01-01T00:00:00Z",
+				},
+			},
+			wantErr: true,
+		},
+		"invalid AWS deprecateAt": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					DeprecateAt: "tomorrow",
+				},
+			},
+			wantErr: true,
+		},
+		"valid Azure endOfLifeDate timestamp": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					EndOfLifeDate: "2100-01-01T00:00:00Z",
+				},
+			},
+		},
+		"valid Azure endOfLifeDate duration": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					EndOfLifeDate: "365d",
+				},
+			},
+		},
+		"Azure endOfLifeDate in the past": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					EndOfLifeDate: "2000-01-01T00:00:00Z",
+				},
+			},
+			wantErr: true,
+		},
+		"invalid Azure endOfLifeDate": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					EndOfLifeDate: "next year",
+				},
+			},
+			wantErr: true,
+		},
+		"imageVersionFileKey without imageVersionFile": {
+			base: validConfig(),
+			overrides: Config{
+				ImageVersionFileKey: "version",
+			},
+			wantErr: true,
+		},
+		"valid ttl": {
+			base: validConfig(),
+			overrides: Config{
+				TTL: "30d",
+			},
+		},
+		"invalid ttl": {
+			base: validConfig(),
+			overrides: Config{
+				TTL: "-720h",
+			},
+			wantErr: true,
+		},
+		"valid AWS deprecateAfter in days": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					DeprecateAfter: "90d",
+				},
+			},
+		},
+		"valid AWS deprecateAfter duration": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					DeprecateAfter: "2160h",
+				},
+			},
+		},
+		"invalid AWS deprecateAfter": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					DeprecateAfter: "0d",
+				},
+			},
+			wantErr: true,
+		},
+		"AWS deprecateAt and deprecateAfter": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					DeprecateAt:    "2100-01-01T00:00:00Z",
+					DeprecateAfter: "90d",
+				},
+			},
+			wantErr: true,
+		},
+		"valid AWS blobTags": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					BlobTags: map[string]string{"cost-center": "os images", "path": "a/b:c=d+e@f"},
+				},
+			},
+		},
+		"too many AWS blobTags": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					BlobTags: map[string]string{
+						"1": "", "2": "", "3": "", "4": "", "5": "", "6": "",
+						"7": "", "8": "", "9": "", "10": "", "11": "",
+					},
+				},
+			},
+			wantErr: true,
+		},
+		"AWS blobTags key too long": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					BlobTags: map[string]string{strings.Repeat("a", 129): "value"},
+				},
+			},
+			wantErr: true,
+		},
+		"AWS blobTags value too long": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					BlobTags: map[string]string{"key": strings.Repeat("a", 257)},
+				},
+			},
+			wantErr: true,
+		},
+		"AWS blobTags invalid characters": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					BlobTags: map[string]string{"key": "value?"},
+				},
+			},
+			wantErr: true,
+		},
+		"AWS blobTags reserved prefix": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+				AWS: AWSConfig{
+					BlobTags: map[string]string{"aws:key": "value"},
+				},
+			},
+			wantErr: true,
+		},
+		"missing AWS snapshotName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+			},
+			mutation: func(c *Config) {
+				c.AWS.SnapshotName = ""
+			},
+			wantErr: true,
+		},
+		"uninitialized AWS Publish setting": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "aws",
+			},
+			mutation: func(c *Config) {
+				c.AWS.Publish = None[bool]()
+			},
+			wantErr: true,
+		},
+		"missing Azure subscriptionID": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.SubscriptionID = ""
+			},
+			wantErr: true,
+		},
+		"invalid Azure subscriptionID": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure:    AzureConfig{SubscriptionID: "invalid"},
+			},
+			wantErr: true,
+		},
+		"missing Azure location": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.Location = ""
+			},
+			wantErr: true,
+		},
+		"missing Azure resourceGroup": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.ResourceGroup = ""
+			},
+			wantErr: true,
+		},
+		"missing Azure attestationVariant": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.AttestationVariant = ""
+			},
+			wantErr: true,
+		},
+		"invalid Azure attestationVariant": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure:    AzureConfig{AttestationVariant: "invalid"},
+			},
+			wantErr: true,
+		},
+		"missing Azure sharedImageGallery": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.SharedImageGallery = ""
+			},
+			wantErr: true,
+		},
+		"missing Azure sharingProfile": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.SharedImageGallery = ""
+			},
+			wantErr: true,
+		},
+		"invalid Azure sharingProfile": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure:    AzureConfig{SharingProfile: "invalid"},
+			},
+			wantErr: true,
+		},
+		"missing Azure sharingNamePrefix with sharingProfile community": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					SharingProfile: "community",
+				},
+			},
+			mutation: func(c *Config) {
+				c.Azure.SharingNamePrefix = ""
+			},
+			wantErr: true,
+		},
+		"missing Azure sharingNamePrefix with sharingProfile private": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					SharingProfile: "private",
+				},
+			},
+			mutation: func(c *Config) {
+				c.Azure.SharingNamePrefix = ""
+			},
+		},
+		"Azure sharingNamePrefix is ignored with sharingProfile private": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					SharingProfile: "private",
+				},
+			},
+		},
+		"invalid Azure sharingNamePrefix is ignored with sharingProfile groups": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					SharingProfile:    "groups",
+					SharingNamePrefix: "not-alphanumeric",
+				},
+			},
+		},
+		"missing Azure imageDefinitionName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.ImageDefinitionName = ""
+			},
+			wantErr: true,
+		},
+		"missing Azure diskName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.DiskName = ""
+			},
+			wantErr: true,
+		},
+		"valid Azure targetRegions": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					TargetRegions: []AzureTargetRegion{
+						{Name: "westeurope", ReplicaCount: 2, StorageAccountType: "Standard_ZRS"},
+						{Name: "eastus", ReplicaCount: 1},
+					},
+				},
+			},
+		},
+		"non-positive Azure targetRegions replicaCount": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					TargetRegions: []AzureTargetRegion{
+						{Name: "westeurope", ReplicaCount: 0},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		"missing Azure targetRegions name": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					TargetRegions: []AzureTargetRegion{
+						{ReplicaCount: 1},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		"invalid Azure targetRegions storageAccountType": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					TargetRegions: []AzureTargetRegion{
+						{Name: "westeurope", ReplicaCount: 1, StorageAccountType: "invalid"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		"valid Azure purchase plan": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					PlanName:      "plan",
+					PlanPublisher: "publisher",
+					PlanProduct:   "product",
+				},
+			},
+		},
+		"partial Azure purchase plan": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					PlanName: "plan",
+				},
+			},
+			wantErr: true,
+		},
+		"negative Azure osDiskSizeGB": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+			},
+			mutation: func(c *Config) {
+				c.Azure.OSDiskSizeGB = -1
+			},
+			wantErr: true,
+		},
+		"valid Azure features": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					Features: map[string]string{
+						"IsAcceleratedNetworkSupported": "True",
+						"DiskControllerTypes":           "SCSI, NVMe",
+					},
+				},
+			},
+		},
+		"unknown Azure feature": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					Features: map[string]string{"SerialConsole": "True"},
+				},
+			},
+			wantErr: true,
+		},
+		"Azure security type feature": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					Features: map[string]string{"SecurityType": "TrustedLaunch"},
+				},
+			},
+			wantErr: true,
+		},
+		"invalid Azure feature value": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "azure",
+				Azure: AzureConfig{
+					Features: map[string]string{"IsHibernateSupported": "yes"},
+				},
+			},
+			wantErr: true,
+		},
+		"valid GCP blobTags": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					BlobTags: map[string]string{"cost-center": "os images"},
+				},
+			},
+		},
+		"empty GCP blobTags key": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					BlobTags: map[string]string{"": "value"},
+				},
+			},
+			wantErr: true,
+		},
+		"too large GCP blobTags": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					BlobTags: map[string]string{"key": strings.Repeat("a", 8190)},
+				},
+			},
+			wantErr: true,
+		},
+		"missing Scaleway zone": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.Zone = ""
+			},
+			wantErr: true,
+		},
+		"invalid Scaleway zone": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.Zone = "fr-par"
+			},
+			wantErr: true,
+		},
+		"missing Scaleway projectID": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.ProjectID = ""
+			},
+			wantErr: true,
+		},
+		"invalid Scaleway projectID": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.ProjectID = "my-project"
+			},
+			wantErr: true,
+		},
+		"missing Scaleway bucket": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.Bucket = ""
+			},
+			wantErr: true,
+		},
+		"invalid Scaleway bucket": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.Bucket = "My_Bucket"
+			},
+			wantErr: true,
+		},
+		"Scaleway objectName without qcow2 suffix": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.ObjectName = "my-object.raw"
+			},
+			wantErr: true,
+		},
+		"missing Scaleway imageName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.ImageName = ""
+			},
+			wantErr: true,
+		},
+		"too long Scaleway imageName": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.ImageName = strings.Repeat("a", 256)
+			},
+			wantErr: true,
+		},
+		"invalid Scaleway arch": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "scaleway",
+			},
+			mutation: func(c *Config) {
+				c.Scaleway.Arch = "riscv64"
+			},
+			wantErr: true,
+		},
+		"GCP deprecateOldInFamily": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					DeprecateOldInFamily: Some(true),
+				},
+			},
+		},
+		"GCP deprecateOldInFamily without imageFamily": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					DeprecateOldInFamily: Some(true),
+				},
+			},
+			mutation: func(c *Config) {
+				c.GCP.ImageFamily = ""
+			},
+			wantErr: true,
+		},
+		"GCP deprecated state": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					Description: "my image",
+					State:       "DEPRECATED",
+				},
+			},
+		},
+		"GCP invalid state": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					State: "OBSOLETE",
+				},
+			},
+			wantErr: true,
+		},
+		"GCP deprecated state with deprecateOldInFamily": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "aws",
-				AWS: AWSConfig{
-					AMIName: strings.Repeat("a", 129),
+				Provider: "gcp",
+				GCP: GCPConfig{
+					State:                "DEPRECATED",
+					DeprecateOldInFamily: Some(true),
 				},
 			},
 			wantErr: true,
 		},
-		"invalid AWS amiName": {
+		"GCP description too long": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "aws",
-				AWS: AWSConfig{
-					AMIName: "invalid<ami_name",
+				Provider: "gcp",
+				GCP: GCPConfig{
+					Description: strings.Repeat("a", 2049),
 				},
 			},
 			wantErr: true,
 		},
-		"missing AWS blobName": {
+		"missing GCP project": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "aws",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.AWS.BlobName = ""
+				c.GCP.Project = ""
 			},
 			wantErr: true,
 		},
-		"missing AWS snapshotName": {
+		"invalid GCP project": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "aws",
+				Provider: "gcp",
+				GCP: GCPConfig{
+					Project: "-invalid project name",
+				},
+			},
+			wantErr: true,
+		},
+		"valid GCP sourceProject": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.AWS.SnapshotName = ""
+				c.GCP.SourceProject = "my-sandbox-project"
 			},
-			wantErr: true,
 		},
-		"uninitialized AWS Publish setting": {
+		"invalid GCP sourceProject": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "aws",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.AWS.Publish = None[bool]()
+				c.GCP.SourceProject = "Sandbox_Project"
 			},
 			wantErr: true,
 		},
-		"missing Azure subscriptionID": {
+		"too short GCP sourceProject": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.Azure.SubscriptionID = ""
+				c.GCP.SourceProject = "sand"
 			},
 			wantErr: true,
 		},
-		"invalid Azure subscriptionID": {
+		"valid GCP replicationLocations": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
-				Azure:    AzureConfig{SubscriptionID: "invalid"},
+				Provider: "gcp",
+			},
+			mutation: func(c *Config) {
+				c.GCP.Location = "eu"
+				c.GCP.ReplicationLocations = []string{"europe-west3", "us", "nam4"}
 			},
-			wantErr: true,
 		},
-		"missing Azure location": {
+		"invalid GCP location": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.Azure.Location = ""
+				c.GCP.Location = "europe west3"
 			},
 			wantErr: true,
 		},
-		"missing Azure resourceGroup": {
+		"invalid GCP replicationLocations": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.Azure.ResourceGroup = ""
+				c.GCP.ReplicationLocations = []string{"europe-west3", "europe_west4"}
 			},
 			wantErr: true,
 		},
-		"missing Azure attestationVariant": {
+		"duplicate GCP replicationLocations": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.Azure.AttestationVariant = ""
+				c.GCP.ReplicationLocations = []string{"europe-west3", "europe-west3"}
 			},
 			wantErr: true,
 		},
-		"invalid Azure attestationVariant": {
+		"too long GCP replica image name": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
-				Azure:    AzureConfig{AttestationVariant: "invalid"},
+				Provider: "gcp",
+			},
+			mutation: func(c *Config) {
+				c.GCP.ImageName = "a" + strings.Repeat("b", 50)
+				c.GCP.ReplicationLocations = []string{"northamerica-northeast1"}
 			},
 			wantErr: true,
 		},
-		"missing Azure sharedImageGallery": {
+		"missing GCP location": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.Azure.SharedImageGallery = ""
+				c.GCP.Location = ""
 			},
 			wantErr: true,
 		},
-		"missing Azure sharingProfile": {
+		"missing GCP imageName": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.Azure.SharedImageGallery = ""
+				c.GCP.ImageName = ""
 			},
 			wantErr: true,
 		},
-		"invalid Azure sharingProfile": {
+		"too long GCP imageName": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
-				Azure:    AzureConfig{SharingProfile: "invalid"},
+				Provider: "gcp",
+				GCP: GCPConfig{
+					ImageName: strings.Repeat("a", 64),
+				},
 			},
 			wantErr: true,
 		},
-		"missing Azure sharingNamePrefix with sharingProfile community": {
+		"GCP imageName ending with hyphen": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
-				Azure: AzureConfig{
-					SharingProfile: "community",
+				Provider: "gcp",
+				GCP: GCPConfig{
+					ImageName: "my-image-",
 				},
 			},
-			mutation: func(c *Config) {
-				c.Azure.SharingNamePrefix = ""
-			},
 			wantErr: true,
 		},
-		"missing Azure sharingNamePrefix with sharingProfile private": {
+		"GCP imageName starting with digit": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
-				Azure: AzureConfig{
-					SharingProfile: "private",
+				Provider: "gcp",
+				GCP: GCPConfig{
+					ImageName: "1-my-image",
 				},
 			},
-			mutation: func(c *Config) {
-				c.Azure.SharingNamePrefix = ""
+			wantErr: true,
+		},
+		"uppercase GCP imageFamily": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					ImageFamily: "My-family",
+				},
 			},
+			wantErr: true,
 		},
-		"missing Azure imageDefinitionName": {
+		"missing GCP imageFamily": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.Azure.ImageDefinitionName = ""
+				c.GCP.ImageFamily = ""
 			},
 			wantErr: true,
 		},
-		"missing Azure diskName": {
+		"missing GCP bucket": {
 			base: validConfig(),
 			overrides: Config{
-				Provider: "azure",
+				Provider: "gcp",
 			},
 			mutation: func(c *Config) {
-				c.Azure.DiskName = ""
+				c.GCP.Bucket = ""
 			},
 			wantErr: true,
 		},
-		"missing GCP project": {
+		"valid GCP guestOSFeatures": {
 			base: validConfig(),
 			overrides: Config{
 				Provider: "gcp",
+				GCP: GCPConfig{
+					GuestOSFeatures: []string{"UEFI_COMPATIBLE", "GVNIC"},
+				},
 			},
-			mutation: func(c *Config) {
-				c.GCP.Project = ""
+		},
+		"invalid GCP guestOSFeatures": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					GuestOSFeatures: []string{"UEFI_COMPATIBLE", "UEFI"},
+				},
 			},
 			wantErr: true,
 		},
-		"invalid GCP project": {
+		"valid GCP licenses": {
 			base: validConfig(),
 			overrides: Config{
 				Provider: "gcp",
 				GCP: GCPConfig{
-					Project: "-invalid project name",
+					Licenses: []string{"projects/my-project/global/licenses/my-license"},
+				},
+			},
+		},
+		"empty GCP license": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					Licenses: []string{""},
 				},
 			},
 			wantErr: true,
 		},
-		"missing GCP location": {
+		"valid GCP license URL": {
 			base: validConfig(),
 			overrides: Config{
 				Provider: "gcp",
+				GCP: GCPConfig{
+					Licenses: []string{"https://www.googleapis.com/compute/v1/projects/my-project/global/licenses/my-license"},
+				},
 			},
-			mutation: func(c *Config) {
-				c.GCP.Location = ""
+		},
+		"invalid GCP license": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					Licenses: []string{"my-license"},
+				},
 			},
 			wantErr: true,
 		},
-		"missing GCP imageName": {
+		"valid GCP blobACL": {
 			base: validConfig(),
 			overrides: Config{
 				Provider: "gcp",
+				GCP: GCPConfig{
+					BlobACL: "publicRead",
+				},
 			},
-			mutation: func(c *Config) {
-				c.GCP.ImageName = ""
+		},
+		"invalid GCP blobACL": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					BlobACL: "public-read",
+				},
 			},
 			wantErr: true,
 		},
-		"missing GCP imageFamily": {
+		"valid GCP sharing": {
 			base: validConfig(),
 			overrides: Config{
 				Provider: "gcp",
+				GCP: GCPConfig{
+					Sharing: "private",
+				},
 			},
-			mutation: func(c *Config) {
-				c.GCP.ImageFamily = ""
+		},
+		"invalid GCP sharing": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					Sharing: "public",
+				},
 			},
 			wantErr: true,
 		},
-		"missing GCP bucket": {
+		"GCP sharing with all users": {
 			base: validConfig(),
 			overrides: Config{
 				Provider: "gcp",
+				GCP: GCPConfig{
+					Sharing:         "allUsers",
+					ConfirmAllUsers: Some(true),
+				},
 			},
-			mutation: func(c *Config) {
-				c.GCP.Bucket = ""
+		},
+		"unconfirmed GCP sharing with all users": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					Sharing: "allUsers",
+				},
 			},
 			wantErr: true,
 		},
@@ -324,6 +1391,35 @@ func TestValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		"valid GCP osDiskSizeGB": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					OSDiskSizeGB: 30,
+				},
+			},
+		},
+		"negative GCP osDiskSizeGB": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+			},
+			mutation: func(c *Config) {
+				c.GCP.OSDiskSizeGB = -1
+			},
+			wantErr: true,
+		},
+		"GCP blobName without tar.gz extension": {
+			base: validConfig(),
+			overrides: Config{
+				Provider: "gcp",
+				GCP: GCPConfig{
+					BlobName: "image.raw",
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for name, tc := range testCases {
@@ -346,7 +1442,7 @@ func TestValidate(t *testing.T) {
 				t.Log(err)
 			}
 			if tc.wantErr {
-				assert.Error(err)
+				assert.ErrorIs(err, ErrInvalidConfig)
 				return
 			}
 			assert.NoError(err)
@@ -354,6 +1450,123 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestConfigValidateAll(t *testing.T) {
+	testCases := map[string]struct {
+		mutation func(*Config)
+		wantErrs []string
+	}{
+		"valid config": {},
+		"unrendered config with placeholders": {
+			mutation: func(c *Config) {
+				c.ImageVersion = ""
+				c.ImageVersionFile = "version.txt"
+				c.AWS.AMIName = "{{.Name}}-{{.Version}}-{{sha256short}}"
+			},
+		},
+		"auto version": {
+			mutation: func(c *Config) {
+				c.ImageVersion = AutoVersion
+			},
+		},
+		"all problems": {
+			mutation: func(c *Config) {
+				c.Provider = "unknown"
+				c.ImageVersion = "1.2"
+				c.Name = ""
+				c.AWS.AMIName = "{{.Unknown}}"
+				c.GCP.ImageName = "{{.Name"
+			},
+			wantErrs: []string{
+				`cloud provider "unknown" unknown`,
+				`image version "1.2" must be in format`,
+				"required field name empty",
+				"field AMIName",
+				"field ImageName",
+			},
+		},
+		"naming limit after failed template": {
+			mutation: func(c *Config) {
+				c.AWS.AMIName = "{{.Unknown}}"
+				c.AWS.Bucket = "b"
+			},
+			wantErrs: []string{
+				"field AMIName",
+				// The field is treated as empty after the template error.
+				`required field "amiName" empty`,
+				"field bucket must be between 3 and 63 characters",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			cfg := validConfig()
+			if tc.mutation != nil {
+				tc.mutation(&cfg)
+			}
+			unmodified := cfg.Clone()
+
+			errs := cfg.ValidateAll()
+			assert.Len(errs, len(tc.wantErrs), "%v", errs)
+			for _, want := range tc.wantErrs {
+				assert.True(containsError(errs, want), "missing error %q in %v", want, errs)
+			}
+			assert.Equal(unmodified, cfg)
+		})
+	}
+}
+
+func TestConfigFileValidateAll(t *testing.T) {
+	assert := assert.New(t)
+	base := validConfig()
+	conf := ConfigFile{
+		Base:         base,
+		VariantOrder: []string{"a", "missing"},
+		Variants: map[string]Config{
+			"a": {ImageVersion: "1.2", GCP: GCPConfig{ImageName: "{{"}},
+			"b": {AWS: AWSConfig{Bucket: "b"}},
+		},
+		ValidationHooks: []ValidationHook{
+			func(name string, _ Config) error {
+				if name == "b" {
+					return errors.New("variant b is not allowed")
+				}
+				return nil
+			},
+		},
+	}
+
+	errs := conf.ValidateAll()
+	assert.Len(errs, 5, "%v", errs)
+	for _, want := range []string{
+		`variant "missing" in variant order does not exist`,
+		"config for variant a: field ImageName",
+		`config for variant a: invalid config: image version "1.2" must be in format`,
+		"config for variant b: invalid config: field bucket must be between 3 and 63 characters",
+		"config for variant b: invalid config: variant b is not allowed",
+	} {
+		assert.True(containsError(errs, want), "missing error %q in %v", want, errs)
+	}
+	for _, err := range errs[2:] {
+		assert.ErrorIs(err, ErrInvalidConfig)
+	}
+
+	conf.VariantOrder = nil
+	conf.Variants = nil
+	conf.ValidationHooks = nil
+	assert.Empty(conf.ValidateAll())
+}
+
+func containsError(errs []error, substr string) bool {
+	for _, err := range errs {
+		if strings.Contains(err.Error(), substr) {
+			return true
+		}
+	}
+	return false
+}
+
 func validConfig() Config {
 	return Config{
 		Provider:     "aws",
@@ -389,7 +1602,15 @@ func validConfig() Config {
 			ImageName:   "my-image",
 			ImageFamily: "my-family",
 			Bucket:      "my-bucket",
-			BlobName:    "my-blob",
+			BlobName:    "my-blob.tar.gz",
+		},
+		Scaleway: ScalewayConfig{
+			Zone:       "fr-par-1",
+			ProjectID:  "00000000-0000-0000-0000-000000000000",
+			Bucket:     "my-bucket",
+			ObjectName: "my-object.qcow2",
+			ImageName:  "my-image",
+			Arch:       "x86_64",
 		},
 	}
 }
@@ -0,0 +1,142 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/semver"
+	"gopkg.in/yaml.v3"
+)
+
+// AutoVersion is an image version that is resolved to the next patch version
+// after the highest version of the existing images.
+const AutoVersion = "auto"
+
+// autoVersionPlaceholder is used as image version while rendering a variant to list its existing images.
+const autoVersionPlaceholder = "0.0.0"
+
+var imageVersionPattern = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// shortVersionPattern matches versions with missing minor or patch components.
+var shortVersionPattern = regexp.MustCompile(`^\d+(\.\d+)?$`)
+
+// versionFromKey returns the semantic version at the key path of a JSON or YAML document.
+// The key path consists of keys separated by dots, optionally prefixed with "$.", e.g. "version" or "$.build.version".
+func versionFromKey(data []byte, key string) (string, error) {
+	// JSON documents are valid YAML documents.
+	var value any
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return "", fmt.Errorf("parsing file: %w", err)
+	}
+	for _, name := range strings.Split(strings.TrimPrefix(key, "$."), ".") {
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("key %q not found", key)
+		}
+		if value, ok = fields[name]; !ok {
+			return "", fmt.Errorf("key %q not found", key)
+		}
+	}
+	version, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("value of key %q is not a string, quote the version", key)
+	}
+	version = strings.TrimSpace(version)
+	if !semver.IsValid("v" + strings.TrimPrefix(version, "v")) {
+		return "", fmt.Errorf("value %q of key %q is not a semantic version", version, key)
+	}
+	return version, nil
+}
+
+// NextPatchVersion returns the highest of the existing versions with its patch version incremented.
+// Existing versions not in the format <major>.<minor>.<patch> are ignored.
+// Without any existing versions, the first patch version 0.0.1 is returned.
+func NextPatchVersion(existing []string) (string, error) {
+	highest := autoVersionPlaceholder
+	for _, version := range existing {
+		if !imageVersionPattern.MatchString(version) {
+			continue
+		}
+		if semver.Compare("v"+version, "v"+highest) > 0 {
+			highest = version
+		}
+	}
+
+	parts := strings.Split(highest, ".")
+	patch, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("parsing patch version of %q: %w", highest, err)
+	}
+	return fmt.Sprintf("%s.%s.%d", parts[0], parts[1], patch+1), nil
+}
+
+// ResolveAutoVersions replaces the image version AutoVersion of the base config and all variants
+// with the next patch version after the versions returned by listVersions.
+// listVersions is called with the rendered config of each variant using the version auto.
+// Variants reading their version from a file are left unchanged, as are variants not matching the filters,
+// so listVersions is only called for the variants that are uploaded.
+func (c *ConfigFile) ResolveAutoVersions(fileLookup fileLookupFn, listVersions func(cfg Config) ([]string, error), filters ...variantFilter) error {
+	names, err := c.orderedVariantNames(filters...)
+	if err != nil {
+		return err
+	}
+	if len(c.Variants) == 0 {
+		names = []string{""}
+	}
+
+	for _, name := range names {
+		var merged Config
+		if err := merged.Merge(c.Base); err != nil {
+			return err
+		}
+		if err := merged.Merge(c.Variants[name]); err != nil {
+			return err
+		}
+		if merged.ImageVersion != AutoVersion || merged.ImageVersionFile != "" {
+			continue
+		}
+
+		// The existing images are described by the rendered config,
+		// so render it with a valid version first.
+		c.setVariantVersion(name, autoVersionPlaceholder)
+		cfg, err := c.RenderedVariant(fileLookup, name)
+		if err != nil {
+			return fmt.Errorf("config for variant %s: %w", name, err)
+		}
+		existing, err := listVersions(cfg)
+		if err != nil {
+			return fmt.Errorf("listing image versions of variant %s: %w", name, err)
+		}
+		version, err := NextPatchVersion(existing)
+		if err != nil {
+			return fmt.Errorf("resolving image version of variant %s: %w", name, err)
+		}
+		if !imageVersionPattern.MatchString(version) {
+			return fmt.Errorf("resolved image version %q of variant %s is invalid", version, name)
+		}
+		if slices.Contains(existing, version) {
+			return fmt.Errorf("resolved image version %q of variant %s already exists", version, name)
+		}
+		c.setVariantVersion(name, version)
+	}
+	return nil
+}
+
+func (c *ConfigFile) setVariantVersion(name, version string) {
+	if name == "" {
+		c.Base.ImageVersion = version
+		return
+	}
+	variant := c.Variants[name]
+	variant.ImageVersion = version
+	c.Variants[name] = variant
+}
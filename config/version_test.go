@@ -0,0 +1,118 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextPatchVersion(t *testing.T) {
+	testCases := map[string]struct {
+		existing []string
+		want     string
+	}{
+		"no versions": {
+			want: "0.0.1",
+		},
+		"single version": {
+			existing: []string{"1.2.3"},
+			want:     "1.2.4",
+		},
+		"highest semver, not lexical order": {
+			existing: []string{"1.9.0", "1.10.2", "1.2.30"},
+			want:     "1.10.3",
+		},
+		"invalid versions are ignored": {
+			existing: []string{"latest", "2.0", "v3.0.0", "1.0.0"},
+			want:     "1.0.1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			got, err := NextPatchVersion(tc.existing)
+			assert.NoError(err)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
+
+func TestConfigFileResolveAutoVersions(t *testing.T) {
+	newConfigFile := func() ConfigFile {
+		return ConfigFile{
+			Base: Config{
+				Provider:     "aws",
+				ImageVersion: AutoVersion,
+				AWS: AWSConfig{
+					Region:             "us-east-1",
+					ReplicationRegions: []string{"us-west-1"},
+					Bucket:             "my-bucket",
+				},
+			},
+			Variants: map[string]Config{
+				"a":     {Name: "image-a"},
+				"b":     {Name: "image-b"},
+				"fixed": {Name: "image-fixed", ImageVersion: "2.0.0"},
+			},
+		}
+	}
+	existing := map[string][]string{
+		"image-a": {"1.0.0", "1.0.1"},
+	}
+
+	testCases := map[string]struct {
+		filters      []variantFilter
+		listErr      error
+		wantListed   []string
+		wantVersions map[string]string
+		wantErr      bool
+	}{
+		"versions resolved": {
+			wantListed:   []string{"image-a", "image-b"},
+			wantVersions: map[string]string{"a": "1.0.2", "b": "0.0.1", "fixed": "2.0.0"},
+		},
+		"filtered variants are skipped": {
+			filters:      []variantFilter{FilterSkipCompleted([]string{"b"})},
+			wantListed:   []string{"image-a"},
+			wantVersions: map[string]string{"a": "1.0.2", "fixed": "2.0.0"},
+		},
+		"listing fails": {
+			listErr: errors.New("failed"),
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			conf := newConfigFile()
+			var listed []string
+
+			err := conf.ResolveAutoVersions(stubFileLookup{}.Lookup, func(cfg Config) ([]string, error) {
+				listed = append(listed, cfg.Name)
+				// The config is rendered before listing.
+				assert.Equal(cfg.Name+"-0.0.0", cfg.AWS.AMIName)
+				return existing[cfg.Name], tc.listErr
+			}, tc.filters...)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantListed, listed)
+			for variant, version := range tc.wantVersions {
+				cfg, err := conf.RenderedVariant(stubFileLookup{}.Lookup, variant)
+				assert.NoError(err)
+				assert.Equal(version, cfg.ImageVersion)
+			}
+		})
+	}
+}
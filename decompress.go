@@ -0,0 +1,89 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// newDecompressingReader detects gzip and zstd compressed data by its magic bytes
+// and returns a reader yielding the decompressed data together with the name of the
+// detected format. Uncompressed data is passed through unchanged and the format is empty.
+func newDecompressingReader(r io.Reader) (io.ReadCloser, string, error) {
+	bufR := bufio.NewReader(r)
+	header, err := bufR.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", fmt.Errorf("reading header: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gzipR, err := gzip.NewReader(bufR)
+		if err != nil {
+			return nil, "", fmt.Errorf("creating gzip reader: %w", err)
+		}
+		return gzipR, "gzip", nil
+	case bytes.HasPrefix(header, zstdMagic):
+		zstdR, err := zstd.NewReader(bufR)
+		if err != nil {
+			return nil, "", fmt.Errorf("creating zstd reader: %w", err)
+		}
+		return zstdR.IOReadCloser(), "zstd", nil
+	default:
+		return io.NopCloser(bufR), "", nil
+	}
+}
+
+// decompressImage writes a decompressed copy of the image to tmpDir if the image is
+// gzip or zstd compressed and returns its path. Uncompressed images are used in place.
+// Providers need to know the size of the raw image and seek in it, so compressed
+// images are buffered on disk instead of being streamed to the provider.
+func decompressImage(imagePath, tmpDir string, logger *slog.Logger) (string, error) {
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("opening image: %w", err)
+	}
+	defer image.Close()
+
+	decompressed, format, err := newDecompressingReader(image)
+	if err != nil {
+		return "", err
+	}
+	defer decompressed.Close()
+	if format == "" {
+		return imagePath, nil
+	}
+
+	logger.Info("Decompressing image", "format", format)
+	rawImagePath := filepath.Join(tmpDir, "image.raw")
+	rawImage, err := os.Create(rawImagePath)
+	if err != nil {
+		return "", fmt.Errorf("creating decompressed image: %w", err)
+	}
+	if _, err := io.Copy(rawImage, decompressed); err != nil {
+		return "", errors.Join(fmt.Errorf("decompressing image: %w", err), rawImage.Close())
+	}
+	// Errors of delayed writes are only reported when closing the file.
+	if err := rawImage.Close(); err != nil {
+		return "", fmt.Errorf("closing decompressed image: %w", err)
+	}
+	return rawImagePath, nil
+}
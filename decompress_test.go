@@ -0,0 +1,66 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDecompressingReader(t *testing.T) {
+	raw := bytes.Repeat([]byte("uplosi"), 1000)
+
+	gzipData := new(bytes.Buffer)
+	gzipW := gzip.NewWriter(gzipData)
+	_, err := gzipW.Write(raw)
+	assert.NoError(t, err)
+	assert.NoError(t, gzipW.Close())
+
+	zstdData := new(bytes.Buffer)
+	zstdW, err := zstd.NewWriter(zstdData)
+	assert.NoError(t, err)
+	_, err = zstdW.Write(raw)
+	assert.NoError(t, err)
+	assert.NoError(t, zstdW.Close())
+
+	testCases := map[string]struct {
+		data       []byte
+		wantFormat string
+	}{
+		"uncompressed": {data: raw},
+		"gzip":         {data: gzipData.Bytes(), wantFormat: "gzip"},
+		"zstd":         {data: zstdData.Bytes(), wantFormat: "zstd"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			r, format, err := newDecompressingReader(bytes.NewReader(tc.data))
+			assert.NoError(err)
+			defer r.Close()
+			assert.Equal(tc.wantFormat, format)
+			got, err := io.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(raw, got)
+		})
+	}
+
+	t.Run("short input", func(t *testing.T) {
+		assert := assert.New(t)
+		r, format, err := newDecompressingReader(bytes.NewReader([]byte{0x01}))
+		assert.NoError(err)
+		assert.Empty(format)
+		got, err := io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal([]byte{0x01}, got)
+	})
+}
@@ -0,0 +1,30 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// imageDigest returns the hex encoded sha256 digest of the image at imagePath.
+func imageDigest(imagePath string) (string, error) {
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("opening image: %w", err)
+	}
+	defer image.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, image); err != nil {
+		return "", fmt.Errorf("hashing image: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
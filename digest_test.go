@@ -0,0 +1,29 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	imagePath := filepath.Join(t.TempDir(), "image.raw")
+	assert.NoError(os.WriteFile(imagePath, []byte("hello world"), 0o644))
+
+	digest, err := imageDigest(imagePath)
+	assert.NoError(err)
+	assert.Equal("b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", digest)
+
+	_, err = imageDigest(filepath.Join(t.TempDir(), "missing.raw"))
+	assert.Error(err)
+}
@@ -20,16 +20,95 @@ type imagesAPI interface {
 	Get(ctx context.Context, req *computepb.GetImageRequest, opts ...gaxv2.CallOption,
 	) (*computepb.Image, error)
 	Insert(ctx context.Context, req *computepb.InsertImageRequest, opts ...gaxv2.CallOption,
-	) (*compute.Operation, error)
+	) (operation, error)
 	SetIamPolicy(ctx context.Context, req *computepb.SetIamPolicyImageRequest, opts ...gaxv2.CallOption,
 	) (*computepb.Policy, error)
 	Delete(ctx context.Context, req *computepb.DeleteImageRequest, opts ...gaxv2.CallOption,
-	) (*compute.Operation, error)
+	) (operation, error)
+	List(ctx context.Context, req *computepb.ListImagesRequest, opts ...gaxv2.CallOption,
+	) imageIterator
+	Deprecate(ctx context.Context, req *computepb.DeprecateImageRequest, opts ...gaxv2.CallOption,
+	) (operation, error)
 	io.Closer
 }
 
+// operation is a long-running operation of the Compute API.
+type operation interface {
+	Wait(ctx context.Context, opts ...gaxv2.CallOption) error
+}
+
+// imageIterator returns listed images until it returns iterator.Done.
+type imageIterator interface {
+	Next() (*computepb.Image, error)
+}
+
 type bucketAPI interface {
 	Attrs(ctx context.Context) (attrs *storage.BucketAttrs, err error)
 	Create(ctx context.Context, projectID string, attrs *storage.BucketAttrs) (err error)
-	Object(name string) *storage.ObjectHandle
+	Object(name string) objectAPI
+}
+
+type objectAPI interface {
+	Attrs(ctx context.Context) (attrs *storage.ObjectAttrs, err error)
+	Delete(ctx context.Context) error
+	// NewWriter creates the object with the given metadata and predefined ACL once the writer is closed.
+	NewWriter(ctx context.Context, metadata map[string]string, predefinedACL string) objectWriter
+	// NewReader reads the object as stored, without decompressing it.
+	NewReader(ctx context.Context) (io.ReadCloser, error)
+}
+
+type objectWriter interface {
+	io.WriteCloser
+	// Attrs returns the attributes of the written object after Close succeeded.
+	Attrs() *storage.ObjectAttrs
+}
+
+// imagesClient adapts the Compute API client to imagesAPI.
+type imagesClient struct {
+	*compute.ImagesClient
+}
+
+func (c imagesClient) Insert(ctx context.Context, req *computepb.InsertImageRequest, opts ...gaxv2.CallOption,
+) (operation, error) {
+	return c.ImagesClient.Insert(ctx, req, opts...)
+}
+
+func (c imagesClient) Delete(ctx context.Context, req *computepb.DeleteImageRequest, opts ...gaxv2.CallOption,
+) (operation, error) {
+	return c.ImagesClient.Delete(ctx, req, opts...)
+}
+
+func (c imagesClient) List(ctx context.Context, req *computepb.ListImagesRequest, opts ...gaxv2.CallOption,
+) imageIterator {
+	return c.ImagesClient.List(ctx, req, opts...)
+}
+
+func (c imagesClient) Deprecate(ctx context.Context, req *computepb.DeprecateImageRequest, opts ...gaxv2.CallOption,
+) (operation, error) {
+	return c.ImagesClient.Deprecate(ctx, req, opts...)
+}
+
+// bucketHandle adapts a Cloud Storage bucket to bucketAPI.
+type bucketHandle struct {
+	*storage.BucketHandle
+}
+
+func (b bucketHandle) Object(name string) objectAPI {
+	return objectHandle{b.BucketHandle.Object(name)}
+}
+
+// objectHandle adapts a Cloud Storage object to objectAPI.
+type objectHandle struct {
+	*storage.ObjectHandle
+}
+
+func (o objectHandle) NewWriter(ctx context.Context, metadata map[string]string, predefinedACL string) objectWriter {
+	writer := o.ObjectHandle.NewWriter(ctx)
+	writer.Metadata = metadata
+	writer.PredefinedACL = predefinedACL
+	return writer
+}
+
+func (o objectHandle) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return o.ObjectHandle.ReadCompressed(true).NewReader(ctx)
 }
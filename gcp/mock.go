@@ -0,0 +1,294 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package gcp
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"cloud.google.com/go/storage"
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	gaxv2 "github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// useMock replaces the API clients with in-memory fakes that record their calls in rec.
+func (u *Uploader) useMock(rec *provider.Recorder) {
+	cloud := &mockCloud{
+		rec:     rec,
+		images:  make(map[string]*computepb.Image),
+		buckets: make(map[string]*storage.BucketAttrs),
+		objects: make(map[string]*storage.ObjectAttrs),
+	}
+	u.image = func(context.Context) (imagesAPI, error) {
+		return &mockImages{cloud: cloud}, nil
+	}
+	u.bucket = func(context.Context) (bucketAPI, error) {
+		return &mockBucket{cloud: cloud, name: u.config.GCP.Bucket}, nil
+	}
+}
+
+// Mocked reports whether the uploader uses fake API clients, see provider.WithMock.
+func (u *Uploader) Mocked() bool {
+	return u.opts.Mock != nil
+}
+
+// mockCloud is the state shared by the fake API clients of an uploader.
+// Uploaded objects are hashed, but their content isn't kept.
+type mockCloud struct {
+	rec *provider.Recorder
+
+	mux sync.Mutex
+	// images are the created images, keyed by project and name.
+	images map[string]*computepb.Image
+	// buckets are the created buckets, keyed by name.
+	buckets map[string]*storage.BucketAttrs
+	// objects are the written objects, keyed by bucket and name.
+	objects map[string]*storage.ObjectAttrs
+}
+
+// record records the call and locks the state until the returned function is called.
+func (c *mockCloud) record(operation string, input any) func() {
+	c.rec.Record(string(config.ProviderGCP), operation, input)
+	c.mux.Lock()
+	return c.mux.Unlock
+}
+
+// mockNotFound returns the error of the Compute API for missing resources.
+func mockNotFound(resource string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("the resource %s was not found", resource)}
+}
+
+// mockImages is the fake Compute API for images.
+type mockImages struct {
+	cloud *mockCloud
+}
+
+func (m *mockImages) Get(_ context.Context, req *computepb.GetImageRequest, _ ...gaxv2.CallOption,
+) (*computepb.Image, error) {
+	defer m.cloud.record("compute.Images.Get", req)()
+	image, ok := m.cloud.images[path.Join(req.GetProject(), req.GetImage())]
+	if !ok {
+		return nil, mockNotFound(mockImageSelfLink(req.GetProject(), req.GetImage()))
+	}
+	return image, nil
+}
+
+func (m *mockImages) Insert(_ context.Context, req *computepb.InsertImageRequest, _ ...gaxv2.CallOption,
+) (operation, error) {
+	defer m.cloud.record("compute.Images.Insert", req)()
+	image := &computepb.Image{
+		Name:             req.GetImageResource().Name,
+		Family:           req.GetImageResource().Family,
+		Description:      req.GetImageResource().Description,
+		Labels:           req.GetImageResource().GetLabels(),
+		StorageLocations: req.GetImageResource().GetStorageLocations(),
+		SelfLink:         toPtr(mockImageSelfLink(req.GetProject(), req.GetImageResource().GetName())),
+	}
+	m.cloud.images[path.Join(req.GetProject(), image.GetName())] = image
+	return mockOperation{}, nil
+}
+
+func (m *mockImages) SetIamPolicy(_ context.Context, req *computepb.SetIamPolicyImageRequest, _ ...gaxv2.CallOption,
+) (*computepb.Policy, error) {
+	defer m.cloud.record("compute.Images.SetIamPolicy", req)()
+	if _, ok := m.cloud.images[path.Join(req.GetProject(), req.GetResource())]; !ok {
+		return nil, mockNotFound(mockImageSelfLink(req.GetProject(), req.GetResource()))
+	}
+	return req.GetGlobalSetPolicyRequestResource().GetPolicy(), nil
+}
+
+func (m *mockImages) Delete(_ context.Context, req *computepb.DeleteImageRequest, _ ...gaxv2.CallOption,
+) (operation, error) {
+	defer m.cloud.record("compute.Images.Delete", req)()
+	delete(m.cloud.images, path.Join(req.GetProject(), req.GetImage()))
+	return mockOperation{}, nil
+}
+
+func (m *mockImages) List(_ context.Context, req *computepb.ListImagesRequest, _ ...gaxv2.CallOption,
+) imageIterator {
+	defer m.cloud.record("compute.Images.List", req)()
+	var family string
+	if req.Filter != nil {
+		// The uploader only filters by family.
+		if _, err := fmt.Sscanf(req.GetFilter(), "family = %q", &family); err != nil {
+			return &mockImageIterator{err: fmt.Errorf("unsupported filter %q", req.GetFilter())}
+		}
+	}
+	it := &mockImageIterator{}
+	for key, image := range m.cloud.images {
+		if path.Dir(key) != req.GetProject() || (req.Filter != nil && image.GetFamily() != family) {
+			continue
+		}
+		it.images = append(it.images, image)
+	}
+	sort.Slice(it.images, func(i, j int) bool { return it.images[i].GetName() < it.images[j].GetName() })
+	return it
+}
+
+func (m *mockImages) Deprecate(_ context.Context, req *computepb.DeprecateImageRequest, _ ...gaxv2.CallOption,
+) (operation, error) {
+	defer m.cloud.record("compute.Images.Deprecate", req)()
+	image, ok := m.cloud.images[path.Join(req.GetProject(), req.GetImage())]
+	if !ok {
+		return nil, mockNotFound(mockImageSelfLink(req.GetProject(), req.GetImage()))
+	}
+	image.Deprecated = req.GetDeprecationStatusResource()
+	return mockOperation{}, nil
+}
+
+func (m *mockImages) Close() error {
+	return nil
+}
+
+func mockImageSelfLink(project, image string) string {
+	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/global/images/%s", project, image)
+}
+
+// mockOperation is an operation of the fake Compute API, which is done immediately.
+type mockOperation struct{}
+
+func (mockOperation) Wait(context.Context, ...gaxv2.CallOption) error {
+	return nil
+}
+
+type mockImageIterator struct {
+	images []*computepb.Image
+	err    error
+}
+
+func (it *mockImageIterator) Next() (*computepb.Image, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.images) == 0 {
+		return nil, iterator.Done
+	}
+	image := it.images[0]
+	it.images = it.images[1:]
+	return image, nil
+}
+
+// mockBucket is the fake Cloud Storage API for a bucket.
+type mockBucket struct {
+	cloud *mockCloud
+	name  string
+}
+
+func (m *mockBucket) Attrs(context.Context) (*storage.BucketAttrs, error) {
+	defer m.cloud.record("storage.Bucket.Attrs", m.name)()
+	attrs, ok := m.cloud.buckets[m.name]
+	if !ok {
+		return nil, storage.ErrBucketNotExist
+	}
+	return attrs, nil
+}
+
+func (m *mockBucket) Create(_ context.Context, projectID string, attrs *storage.BucketAttrs) error {
+	defer m.cloud.record("storage.Bucket.Create", attrs)()
+	created := *attrs
+	created.Name = m.name
+	m.cloud.buckets[m.name] = &created
+	return nil
+}
+
+func (m *mockBucket) Object(name string) objectAPI {
+	return &mockObject{cloud: m.cloud, bucket: m.name, name: name}
+}
+
+type mockObject struct {
+	cloud  *mockCloud
+	bucket string
+	name   string
+}
+
+func (m *mockObject) Attrs(context.Context) (*storage.ObjectAttrs, error) {
+	defer m.cloud.record("storage.Object.Attrs", path.Join(m.bucket, m.name))()
+	attrs, ok := m.cloud.objects[path.Join(m.bucket, m.name)]
+	if !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	return attrs, nil
+}
+
+func (m *mockObject) Delete(context.Context) error {
+	defer m.cloud.record("storage.Object.Delete", path.Join(m.bucket, m.name))()
+	if _, ok := m.cloud.objects[path.Join(m.bucket, m.name)]; !ok {
+		return storage.ErrObjectNotExist
+	}
+	delete(m.cloud.objects, path.Join(m.bucket, m.name))
+	return nil
+}
+
+func (m *mockObject) NewWriter(_ context.Context, metadata map[string]string, predefinedACL string) objectWriter {
+	return &mockObjectWriter{
+		object: m,
+		attrs: storage.ObjectAttrs{
+			Bucket:        m.bucket,
+			Name:          m.name,
+			Metadata:      metadata,
+			PredefinedACL: predefinedACL,
+		},
+		crc32c: crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		md5:    md5.New(),
+	}
+}
+
+func (m *mockObject) NewReader(context.Context) (io.ReadCloser, error) {
+	defer m.cloud.record("storage.Object.NewReader", path.Join(m.bucket, m.name))()
+	if _, ok := m.cloud.objects[path.Join(m.bucket, m.name)]; !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	return nil, fmt.Errorf("reading objects in mock mode: %w", errors.ErrUnsupported)
+}
+
+// mockObjectWriter hashes the written data like GCS and creates the object when it is closed.
+type mockObjectWriter struct {
+	object *mockObject
+	attrs  storage.ObjectAttrs
+	crc32c hash.Hash32
+	md5    hash.Hash
+	closed bool
+}
+
+func (w *mockObjectWriter) Write(p []byte) (int, error) {
+	w.crc32c.Write(p)
+	w.md5.Write(p)
+	w.attrs.Size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *mockObjectWriter) Close() error {
+	defer w.object.cloud.record("storage.Object.Write", &w.attrs)()
+	if _, ok := w.object.cloud.buckets[w.attrs.Bucket]; !ok {
+		return storage.ErrBucketNotExist
+	}
+	w.attrs.CRC32C = w.crc32c.Sum32()
+	w.attrs.MD5 = w.md5.Sum(nil)
+	w.object.cloud.objects[path.Join(w.attrs.Bucket, w.attrs.Name)] = &w.attrs
+	w.closed = true
+	return nil
+}
+
+func (w *mockObjectWriter) Attrs() *storage.ObjectAttrs {
+	if !w.closed {
+		return nil
+	}
+	return &w.attrs
+}
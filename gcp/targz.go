@@ -0,0 +1,240 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package gcp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+// tarImageName is the name of the raw disk inside the archive, as required by GCP.
+const tarImageName = "disk.raw"
+
+const (
+	// tarBlockSize is the size of tar headers and the alignment of entry data.
+	tarBlockSize = 512
+	// sparseBlockSize is the granularity in which zeros are detected in sparse archives.
+	sparseBlockSize = 4096
+	// sparseHeaderEntries is the number of sparse map entries in the oldgnu header.
+	sparseHeaderEntries = 4
+	// sparseExtEntries is the number of sparse map entries in an extension header.
+	sparseExtEntries = 21
+)
+
+// writeTarGz writes the raw image as the only entry of a gzip compressed tar archive.
+// GCP images need to be packed as tar (with the oldgnu format) and compressed with gzip.
+// See https://cloud.google.com/compute/docs/import/import-existing-image#requirements_for_the_image_file
+// for details.
+// If sparse is set, blocks that only contain zeros are not stored in the archive.
+func writeTarGz(rawImage io.ReadSeeker, out io.Writer, sparse bool) error {
+	gzipW := gzip.NewWriter(out)
+	if err := writeTar(rawImage, gzipW, sparse); err != nil {
+		return err
+	}
+	return gzipW.Close()
+}
+
+// writeTar writes the uncompressed tar archive of writeTarGz.
+func writeTar(rawImage io.ReadSeeker, out io.Writer, sparse bool) error {
+	rawImageSize, err := rawImage.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := rawImage.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if sparse {
+		return writeSparseTar(rawImage, rawImageSize, out)
+	}
+
+	tarW := tar.NewWriter(out)
+	if err := tarW.WriteHeader(&tar.Header{
+		Name:   tarImageName,
+		Size:   rawImageSize,
+		Mode:   0o644,
+		Format: tar.FormatGNU,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tarW, rawImage); err != nil {
+		return err
+	}
+	return tarW.Close()
+}
+
+// readTarGz returns the raw image of a gzip compressed tar archive, as written by writeTarGz
+// or by an image export. Holes of sparse archives are read as zeros.
+// The image is spooled to a temporary file, which the returned cleanup function removes.
+func readTarGz(in io.Reader) (provider.Request, func() error, error) {
+	gzipR, err := gzip.NewReader(in)
+	if err != nil {
+		return provider.Request{}, nil, fmt.Errorf("reading gzip header: %w", err)
+	}
+	tarR := tar.NewReader(gzipR)
+	for {
+		header, err := tarR.Next()
+		if errors.Is(err, io.EOF) {
+			return provider.Request{}, nil, fmt.Errorf("archive contains no %s", tarImageName)
+		}
+		if err != nil {
+			return provider.Request{}, nil, fmt.Errorf("reading archive: %w", err)
+		}
+		if header.Name == tarImageName {
+			return provider.NewStreamRequest(tarR)
+		}
+	}
+}
+
+// dataRegion is a region of the image that contains data.
+type dataRegion struct {
+	offset, length int64
+}
+
+// findDataRegions scans the image for blocks that contain data.
+// Adjacent blocks are merged into a single region.
+func findDataRegions(rawImage io.Reader, size int64) ([]dataRegion, error) {
+	var regions []dataRegion
+	buf := make([]byte, sparseBlockSize)
+	for offset := int64(0); offset < size; offset += sparseBlockSize {
+		block := buf[:min(sparseBlockSize, size-offset)]
+		if _, err := io.ReadFull(rawImage, block); err != nil {
+			return nil, fmt.Errorf("reading image at offset %d: %w", offset, err)
+		}
+		if isZero(block) {
+			continue
+		}
+		if last := len(regions) - 1; last >= 0 && regions[last].offset+regions[last].length == offset {
+			regions[last].length += int64(len(block))
+			continue
+		}
+		regions = append(regions, dataRegion{offset: offset, length: int64(len(block))})
+	}
+	return regions, nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSparseTar writes the image as oldgnu sparse entry, like `tar --format=oldgnu -S`.
+// The archive/tar package can read, but not write sparse entries, so the headers are built here.
+func writeSparseTar(rawImage io.ReadSeeker, size int64, out io.Writer) error {
+	regions, err := findDataRegions(rawImage, size)
+	if err != nil {
+		return err
+	}
+	// GNU tar marks a trailing hole with an empty region at the end of the file.
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length < size {
+		regions = append(regions, dataRegion{offset: size})
+	}
+	var dataSize int64
+	for _, region := range regions {
+		dataSize += region.length
+	}
+
+	if _, err := out.Write(sparseHeader(size, dataSize, regions)); err != nil {
+		return err
+	}
+	for rest := regions[min(len(regions), sparseHeaderEntries):]; len(rest) > 0; rest = rest[min(len(rest), sparseExtEntries):] {
+		if _, err := out.Write(sparseExtHeader(rest)); err != nil {
+			return err
+		}
+	}
+
+	for _, region := range regions {
+		if region.length == 0 {
+			continue
+		}
+		if _, err := rawImage.Seek(region.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(out, rawImage, region.length); err != nil {
+			return fmt.Errorf("copying image at offset %d: %w", region.offset, err)
+		}
+	}
+	padding := (tarBlockSize - dataSize%tarBlockSize) % tarBlockSize
+	// The archive ends with two zero blocks.
+	_, err = out.Write(make([]byte, padding+2*tarBlockSize))
+	return err
+}
+
+// sparseHeader builds the oldgnu header of a sparse entry
+// with the first sparseHeaderEntries regions of the sparse map.
+func sparseHeader(size, dataSize int64, regions []dataRegion) []byte {
+	block := make([]byte, tarBlockSize)
+	copy(block[0:100], tarImageName)
+	formatNumeric(block[100:108], 0o644)     // mode
+	formatNumeric(block[108:116], 0)         // uid
+	formatNumeric(block[116:124], 0)         // gid
+	formatNumeric(block[124:136], dataSize)  // size of the stored data
+	formatNumeric(block[136:148], 0)         // mtime
+	block[156] = tar.TypeGNUSparse           // typeflag
+	copy(block[257:265], "ustar  \x00")      // oldgnu magic and version
+	formatSparseMap(block[386:482], regions) // sparse map
+	if len(regions) > sparseHeaderEntries {
+		block[482] = 1 // isextended
+	}
+	formatNumeric(block[483:495], size) // realsize
+
+	// The checksum is computed with the checksum field set to spaces.
+	copy(block[148:156], bytes.Repeat([]byte{' '}, 8))
+	var chksum int64
+	for _, b := range block {
+		chksum += int64(b)
+	}
+	formatNumeric(block[148:155], chksum)
+	block[155] = ' '
+	return block
+}
+
+// sparseExtHeader builds an extension header with the first sparseExtEntries regions.
+func sparseExtHeader(regions []dataRegion) []byte {
+	block := make([]byte, tarBlockSize)
+	formatSparseMap(block[:sparseExtEntries*24], regions)
+	if len(regions) > sparseExtEntries {
+		block[sparseExtEntries*24] = 1 // isextended
+	}
+	return block
+}
+
+// formatSparseMap writes as many regions as fit into the sparse map.
+// Each entry consists of a 12 byte offset and a 12 byte length.
+func formatSparseMap(b []byte, regions []dataRegion) {
+	for i := 0; i < len(b)/24 && i < len(regions); i++ {
+		formatNumeric(b[i*24:i*24+12], regions[i].offset)
+		formatNumeric(b[i*24+12:i*24+24], regions[i].length)
+	}
+}
+
+// formatNumeric writes n into the header field as NUL terminated octal number.
+// Numbers too large for octal use the GNU base-256 encoding.
+func formatNumeric(b []byte, n int64) {
+	octal := strconv.FormatInt(n, 8)
+	if len(octal) < len(b) {
+		copy(b, bytes.Repeat([]byte{'0'}, len(b)-1-len(octal)))
+		copy(b[len(b)-1-len(octal):], octal)
+		b[len(b)-1] = 0
+		return
+	}
+	for i := len(b) - 1; i > 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	b[0] = 0x80
+}
@@ -0,0 +1,254 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package gcp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTarGz(t *testing.T) {
+	assert := assert.New(t)
+	image := bytes.Repeat([]byte{0xaa, 0xbb, 0xcc}, 1000)
+	rawImage := bytes.NewReader(image)
+	// The whole image is written, regardless of the current offset.
+	_, err := rawImage.Seek(100, io.SeekStart)
+	assert.NoError(err)
+
+	var out bytes.Buffer
+	assert.NoError(writeTarGz(rawImage, &out, false))
+
+	gzipR, err := gzip.NewReader(&out)
+	assert.NoError(err)
+	tarR := tar.NewReader(gzipR)
+
+	header, err := tarR.Next()
+	assert.NoError(err)
+	assert.Equal("disk.raw", header.Name)
+	assert.Equal(int64(len(image)), header.Size)
+	assert.Equal(tar.FormatGNU, header.Format)
+	content, err := io.ReadAll(tarR)
+	assert.NoError(err)
+	assert.Equal(image, content)
+
+	_, err = tarR.Next()
+	assert.ErrorIs(err, io.EOF)
+}
+
+func TestWriteTarGzSparse(t *testing.T) {
+	testCases := map[string]struct {
+		size int64
+		// data maps blocks of sparseBlockSize to the byte they are filled with.
+		data map[int64]byte
+	}{
+		"empty image": {},
+		"only zeros": {
+			size: 16 * sparseBlockSize,
+		},
+		"only data": {
+			size: 3 * sparseBlockSize,
+			data: map[int64]byte{0: 0x01, 1: 0x02, 2: 0x03},
+		},
+		"trailing hole": {
+			size: 8 * sparseBlockSize,
+			data: map[int64]byte{0: 0xaa, 3: 0xbb},
+		},
+		"partial last block": {
+			size: 4*sparseBlockSize + 100,
+			data: map[int64]byte{1: 0xaa, 4: 0xbb},
+		},
+		"extension headers": {
+			size: 100 * sparseBlockSize,
+			data: everyOtherBlock(100, 0xcc),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			image := &sparseImage{size: tc.size, data: tc.data}
+
+			out := &countingWriter{}
+			assert.NoError(writeTar(image, out, true))
+			// Only the data blocks, the headers and the end of archive are written.
+			dataSize := int64(0)
+			for block := range tc.data {
+				dataSize += min(sparseBlockSize, tc.size-block*sparseBlockSize)
+			}
+			assert.Zero(out.n % tarBlockSize)
+			assert.GreaterOrEqual(out.n, dataSize)
+			assert.Less(out.n, dataSize+int64(len(tc.data)/sparseExtEntries+5)*tarBlockSize)
+
+			var archive bytes.Buffer
+			_, err := image.Seek(0, io.SeekStart)
+			assert.NoError(err)
+			assert.NoError(writeTarGz(image, &archive, true))
+			gzipR, err := gzip.NewReader(&archive)
+			assert.NoError(err)
+			tarR := tar.NewReader(gzipR)
+
+			header, err := tarR.Next()
+			assert.NoError(err)
+			assert.Equal("disk.raw", header.Name)
+			assert.Equal(tc.size, header.Size)
+			assert.Equal(tar.FormatGNU, header.Format)
+			assert.Equal(byte(tar.TypeGNUSparse), header.Typeflag)
+
+			// The content reads back as the original image.
+			got := make([]byte, sparseBlockSize)
+			want := make([]byte, sparseBlockSize)
+			for offset := int64(0); offset < tc.size; offset += sparseBlockSize {
+				n, err := io.ReadFull(tarR, got[:min(sparseBlockSize, tc.size-offset)])
+				assert.NoError(err)
+				_, err = image.ReadAt(want[:n], offset)
+				assert.NoError(err)
+				if !bytes.Equal(want[:n], got[:n]) {
+					t.Fatalf("content differs at offset %d", offset)
+				}
+			}
+			_, err = tarR.Read(got)
+			assert.ErrorIs(err, io.EOF)
+
+			_, err = tarR.Next()
+			assert.ErrorIs(err, io.EOF)
+		})
+	}
+}
+
+func TestReadTarGz(t *testing.T) {
+	image := make([]byte, 8*sparseBlockSize)
+	copy(image[sparseBlockSize:], bytes.Repeat([]byte{0xaa}, sparseBlockSize))
+	copy(image[5*sparseBlockSize:], bytes.Repeat([]byte{0xbb}, 100))
+
+	archive := func(sparse bool) []byte {
+		var out bytes.Buffer
+		assert.NoError(t, writeTarGz(bytes.NewReader(image), &out, sparse))
+		return out.Bytes()
+	}
+	var otherEntry bytes.Buffer
+	gzipW := gzip.NewWriter(&otherEntry)
+	tarW := tar.NewWriter(gzipW)
+	assert.NoError(t, tarW.WriteHeader(&tar.Header{Name: "other.raw", Size: 1, Mode: 0o644}))
+	_, err := tarW.Write([]byte{1})
+	assert.NoError(t, err)
+	assert.NoError(t, tarW.Close())
+	assert.NoError(t, gzipW.Close())
+
+	testCases := map[string]struct {
+		archive []byte
+		wantErr bool
+	}{
+		"archive":          {archive: archive(false)},
+		"sparse archive":   {archive: archive(true)},
+		"no disk.raw":      {archive: otherEntry.Bytes(), wantErr: true},
+		"not gzip archive": {archive: image, wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			req, cleanup, err := readTarGz(bytes.NewReader(tc.archive))
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			defer func() { assert.NoError(cleanup()) }()
+			assert.Equal(int64(len(image)), req.Size)
+			got, err := io.ReadAll(req.Image)
+			assert.NoError(err)
+			assert.True(bytes.Equal(image, got))
+		})
+	}
+}
+
+func TestFormatNumeric(t *testing.T) {
+	testCases := map[string]struct {
+		n    int64
+		want []byte
+	}{
+		"zero":      {n: 0, want: []byte("00000000000\x00")},
+		"octal":     {n: 0o644, want: []byte("00000000644\x00")},
+		"max octal": {n: 1<<33 - 1, want: []byte("77777777777\x00")},
+		"base-256":  {n: 1 << 33, want: []byte{0x80, 0, 0, 0, 0, 0, 0, 0x02, 0, 0, 0, 0}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b := make([]byte, 12)
+			formatNumeric(b, tc.n)
+			assert.Equal(t, tc.want, b)
+		})
+	}
+}
+
+func everyOtherBlock(blocks int64, b byte) map[int64]byte {
+	data := make(map[int64]byte)
+	for block := int64(0); block < blocks; block += 2 {
+		data[block] = b
+	}
+	return data
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// sparseImage is an image of zeros with some blocks filled with a byte.
+type sparseImage struct {
+	size int64
+	data map[int64]byte
+	pos  int64
+}
+
+func (s *sparseImage) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *sparseImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), s.size-off))
+	for i := 0; i < n; {
+		block := (off + int64(i)) / sparseBlockSize
+		end := min(n, int((block+1)*sparseBlockSize-off))
+		clear(p[i:end])
+		if b := s.data[block]; b != 0 {
+			copy(p[i:end], bytes.Repeat([]byte{b}, end-i))
+		}
+		i = end
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *sparseImage) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		s.pos = offset
+	case io.SeekCurrent:
+		s.pos += offset
+	case io.SeekEnd:
+		s.pos = s.size + offset
+	}
+	return s.pos, nil
+}
@@ -7,19 +7,39 @@ SPDX-License-Identifier: Apache-2.0
 package gcp
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	compute "cloud.google.com/go/compute/apiv1"
 	"cloud.google.com/go/compute/apiv1/computepb"
 	"cloud.google.com/go/storage"
 	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// versionLabel identifies the image version, so existing versions can be listed.
+	versionLabel = "uplosi-version"
 )
 
 // Uploader can upload and remove os images on GCP.
@@ -29,29 +49,140 @@ type Uploader struct {
 	image  func(context.Context) (imagesAPI, error)
 	bucket func(context.Context) (bucketAPI, error)
 
-	log *log.Logger
+	httpClient *http.Client
+	confirm    config.ConfirmFunc
+	log        *slog.Logger
+	steps      provider.StepTimer
+	checksums  map[string]string
+	opts       provider.Options
+	// expiresAt is the expiry time of the current upload, or zero if the config has no TTL.
+	expiresAt time.Time
+}
+
+// Option configures an Uploader.
+type Option func(*Uploader)
+
+// WithLogger sets the structured logger used by the uploader.
+// By default, log output is discarded.
+func WithLogger(log *slog.Logger) Option {
+	return func(u *Uploader) {
+		u.log = log.With("provider", "gcp")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to communicate with the GCP APIs,
+// e.g. to use a proxy or custom CA certificates.
+// Requests are authenticated on top of the client's transport.
+// By default, the SDK's default client is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(u *Uploader) {
+		u.httpClient = client
+	}
+}
+
+// WithProviderOptions sets the options shared by all providers, like provider.WithMetrics or provider.WithClock.
+func WithProviderOptions(opts ...provider.Option) Option {
+	return func(u *Uploader) {
+		u.opts.Apply(opts...)
+	}
+}
+
+// WithConfirm sets a callback that approves overwriting existing images
+// and publishing images before these actions are performed.
+// Declining to overwrite aborts the upload with config.ErrNotConfirmed.
+// By default, all actions are performed without confirmation.
+func WithConfirm(confirm config.ConfirmFunc) Option {
+	return func(u *Uploader) {
+		u.confirm = confirm
+	}
 }
 
 // NewUploader creates a new config.
-func NewUploader(config config.Config, log *log.Logger) (*Uploader, error) {
-	return &Uploader{
+func NewUploader(config config.Config, opts ...Option) (*Uploader, error) {
+	u := &Uploader{
 		config: config,
-		image: func(ctx context.Context) (imagesAPI, error) {
-			return compute.NewImagesRESTClient(ctx)
-		},
-		bucket: func(ctx context.Context) (bucketAPI, error) {
-			storage, err := storage.NewClient(ctx)
-			if err != nil {
-				return nil, err
-			}
-			return storage.Bucket(config.GCP.Bucket), nil
-		},
-		log: log,
-	}, nil
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts:   provider.NewOptions(),
+	}
+	u.image = func(ctx context.Context) (imagesAPI, error) {
+		clientOpts, err := u.clientOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client, err := compute.NewImagesRESTClient(ctx, clientOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return imagesClient{client}, nil
+	}
+	u.bucket = func(ctx context.Context) (bucketAPI, error) {
+		clientOpts, err := u.clientOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		storage, err := storage.NewClient(ctx, clientOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return bucketHandle{storage.Bucket(config.GCP.Bucket)}, nil
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+	if u.opts.Mock != nil {
+		u.useMock(u.opts.Mock)
+	}
+	return u, nil
+}
+
+// clientOptions returns the options shared by all GCP clients.
+// A custom HTTP client replaces the default authentication of the SDK,
+// so the credentials are added by wrapping its transport.
+func (u *Uploader) clientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	if u.httpClient == nil {
+		return nil, nil
+	}
+	base := u.httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// Also use the client to fetch access tokens.
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, u.httpClient)
+	transport, err := htransport.NewTransport(ctx, base, option.WithScopes(cloudPlatformScope))
+	if err != nil {
+		return nil, fmt.Errorf("creating authenticated transport: %w", err)
+	}
+	client := *u.httpClient
+	client.Transport = transport
+	return []option.ClientOption{option.WithHTTPClient(&client)}, nil
 }
 
 // Upload uploads an OS image to GCP.
-func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, _ int64) (ref []string, retErr error) {
+func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, size int64) (ref []string, retErr error) {
+	u.steps = provider.NewStepTimer(string(config.ProviderGCP), u.opts, u.log)
+	u.checksums = nil
+	size, err := provider.ImageSize(image, size)
+	defer func() { provider.RecordUpload(u.opts.Metrics, string(config.ProviderGCP), size, retErr) }()
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	image, err = provider.EnforceSize(image, size)
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := provider.RequireRaw(image); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := provider.CheckOSDiskSize(u.config.GCP.OSDiskSizeGB, size); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	u.expiresAt, err = u.config.ExpiresAt(u.opts.Clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := u.checkProjectAccess(ctx); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
 	// Ensure new image can be uploaded by deleting existing resources with the same name.
 	if err := u.ensureImageDeleted(ctx); err != nil {
 		return nil, fmt.Errorf("pre-cleaning: ensuring no image using the same name exists: %w", err)
@@ -64,124 +195,579 @@ func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, _ int64) (re
 	if err := u.ensureBucket(ctx); err != nil {
 		return nil, fmt.Errorf("ensuring bucket exists: %w", err)
 	}
+	if err := u.checkBlobACL(ctx); err != nil {
+		return nil, fmt.Errorf("checking blob acl: %w", err)
+	}
 
-	// Upload tar.gz encoded raw image to GCS.
+	// Upload raw image to GCS, packed as tar.gz on the fly.
+	stepDone := u.steps.Start("upload")
 	if err := u.uploadBlob(ctx, image); err != nil {
 		return nil, fmt.Errorf("uploading image to GCS: %w", err)
 	}
+	stepDone()
 	defer func(retErr *error) {
 		if err := u.ensureBlobDeleted(ctx); err != nil {
 			*retErr = errors.Join(*retErr, fmt.Errorf("post-cleaning: deleting temporary blob from GCS: %w", err))
 		}
 	}(&retErr)
 
-	imageRef, err := u.createImage(ctx)
+	return u.finishImage(ctx, blobURL(u.config.GCP.Bucket, u.config.GCP.BlobName))
+}
+
+// sourceProject returns the project of the bucket the image is uploaded to.
+// It defaults to the project of the image.
+func (u *Uploader) sourceProject() string {
+	if u.config.GCP.SourceProject != "" {
+		return u.config.GCP.SourceProject
+	}
+	return u.config.GCP.Project
+}
+
+// Preflight checks that a token can be obtained with the application default credentials,
+// that images can be listed in the image project and the bucket can be accessed in the source project,
+// and that the bucket allows the blob ACL, if it already exists.
+func (u *Uploader) Preflight(ctx context.Context) error {
+	if err := u.checkCredentials(ctx); err != nil {
+		return err
+	}
+	if err := u.checkAccess(ctx); err != nil {
+		return preflightError(err)
+	}
+	if err := u.checkBlobACL(ctx); err != nil {
+		return preflightError(fmt.Errorf("checking blob acl for bucket %s: %w", u.config.GCP.Bucket, err))
+	}
+	return nil
+}
+
+// checkCredentials checks that a token can be obtained with the application default credentials.
+// The fake API clients of mock mode don't need credentials.
+func (u *Uploader) checkCredentials(ctx context.Context) error {
+	if u.Mocked() {
+		return nil
+	}
+	tokenCtx := ctx
+	if u.httpClient != nil {
+		tokenCtx = context.WithValue(ctx, oauth2.HTTPClient, u.httpClient)
+	}
+	creds, err := google.FindDefaultCredentials(tokenCtx, cloudPlatformScope)
+	if err != nil {
+		return fmt.Errorf("finding credentials: %w: log in with \"gcloud auth application-default login\" or set GOOGLE_APPLICATION_CREDENTIALS: %w",
+			provider.ErrPermissionDenied, err)
+	}
+	if _, err := creds.TokenSource.Token(); err != nil {
+		return fmt.Errorf("obtaining token: %w: credentials are invalid or expired, log in again: %w", provider.ErrPermissionDenied, err)
+	}
+	return nil
+}
+
+// preflightError marks errors caused by missing permissions with provider.ErrPermissionDenied
+// and adds a hint on how to fix them.
+func preflightError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden) {
+		return fmt.Errorf("%w: grant the Compute Storage Admin and Storage Admin roles on the projects: %w", provider.ErrPermissionDenied, err)
+	}
+	return err
+}
+
+// checkProjectAccess checks that images can be listed in the image project
+// and the bucket can be accessed in the source project before anything is uploaded,
+// if the image is published from a different project than it is uploaded to.
+func (u *Uploader) checkProjectAccess(ctx context.Context) error {
+	if u.sourceProject() == u.config.GCP.Project {
+		return nil
+	}
+	return u.checkAccess(ctx)
+}
+
+// checkAccess checks that images can be listed in the image project
+// and the bucket can be accessed in the source project.
+func (u *Uploader) checkAccess(ctx context.Context) error {
+	imageC, err := u.image(ctx)
+	if err != nil {
+		return err
+	}
+	it := imageC.List(ctx, &computepb.ListImagesRequest{
+		Project:    u.config.GCP.Project,
+		MaxResults: toPtr(uint32(1)),
+	})
+	if _, err := it.Next(); err != nil && !errors.Is(err, iterator.Done) {
+		return fmt.Errorf("accessing images of project %s: %w", u.config.GCP.Project, err)
+	}
+	if _, err := u.bucketExists(ctx); err != nil {
+		return fmt.Errorf("accessing bucket %s of source project %s: %w", u.config.GCP.Bucket, u.sourceProject(), err)
+	}
+	return nil
+}
+
+// CanImportURL reports whether the image can be imported from the URL.
+// Images are imported from Cloud Storage URLs of the form gs://bucket/object
+// or https://storage.googleapis.com/bucket/object.
+func (u *Uploader) CanImportURL(src *url.URL) bool {
+	_, err := gcsSourceURL(src)
+	return err == nil
+}
+
+// ImportURL creates the image from an image archive in Cloud Storage, without uploading it first.
+// Like the archives uploaded by Upload, it must be a gzip compressed tar archive containing the raw image as disk.raw.
+func (u *Uploader) ImportURL(ctx context.Context, src *url.URL) (ref []string, retErr error) {
+	u.steps = provider.NewStepTimer(string(config.ProviderGCP), u.opts, u.log)
+	u.checksums = nil
+	defer func() { provider.RecordUpload(u.opts.Metrics, string(config.ProviderGCP), 0, retErr) }()
+	source, err := gcsSourceURL(src)
+	if err != nil {
+		return nil, err
+	}
+	u.expiresAt, err = u.config.ExpiresAt(u.opts.Clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := u.ensureImageDeleted(ctx); err != nil {
+		return nil, fmt.Errorf("pre-cleaning: ensuring no image using the same name exists: %w", err)
+	}
+	return u.finishImage(ctx, source)
+}
+
+// finishImage creates the image from the archive at the source URL
+// and deprecates older images in its family, if enabled.
+func (u *Uploader) finishImage(ctx context.Context, source string) ([]string, error) {
+	stepDone := u.steps.Start("create")
+	imageRef, err := u.createImage(ctx, source)
 	if err != nil {
 		return nil, fmt.Errorf("creating image: %w", err)
 	}
+	stepDone()
+
+	if u.config.GCP.DeprecateOldInFamily.UnwrapOr(false) {
+		stepDone = u.steps.Start("deprecate")
+		if err := u.deprecateOldImages(ctx); err != nil {
+			return nil, fmt.Errorf("deprecating old images in family %s: %w", u.config.GCP.ImageFamily, err)
+		}
+		stepDone()
+	}
+
+	refs := []string{imageRef}
+	for _, name := range u.imageNames()[1:] {
+		refs = append(refs, u.imageRef(name))
+	}
+	return refs, nil
+}
+
+// StepDurations returns how long each step of the last upload took, keyed by step name.
+func (u *Uploader) StepDurations() map[string]time.Duration {
+	return u.steps.Durations()
+}
 
-	return []string{imageRef}, nil
+// Checksums returns the checksums of the archive uploaded by the last upload, keyed by algorithm.
+// It is empty if the image was imported from a URL.
+func (u *Uploader) Checksums() map[string]string {
+	return maps.Clone(u.checksums)
 }
 
-func (u *Uploader) createImage(ctx context.Context) (string, error) {
+// WriteObject writes the data to the object with the given key in the configured bucket.
+func (u *Uploader) WriteObject(ctx context.Context, key string, data []byte) error {
+	bucketC, err := u.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	writer := bucketC.Object(key).NewWriter(ctx, nil, "")
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func (u *Uploader) createImage(ctx context.Context, source string) (string, error) {
 	imageName := u.config.GCP.ImageName
 	imageC, err := u.image(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	u.log.Printf("Creating image %s", imageName)
-	blobURL := blobURL(u.config.GCP.Bucket, u.config.GCP.BlobName)
-	req := computepb.InsertImageRequest{
-		ImageResource: &computepb.Image{
-			Name: &imageName,
-			RawDisk: &computepb.RawDisk{
-				ContainerType: toPtr("TAR"),
-				Source:        &blobURL,
-			},
-			Family:       &u.config.GCP.ImageFamily,
-			Architecture: toPtr("X86_64"),
-			GuestOsFeatures: []*computepb.GuestOsFeature{
-				{Type: toPtr("GVNIC")},
-				{Type: toPtr("SEV_CAPABLE")},
-				{Type: toPtr("SEV_SNP_CAPABLE")},
-				{Type: toPtr("VIRTIO_SCSI_MULTIQUEUE")},
-				{Type: toPtr("UEFI_COMPATIBLE")},
-			},
-			// TODO(malt3): enable secure boot support
-			// ShieldedInstanceInitialState: nil,
-		},
-		Project: u.config.GCP.Project,
-	}
-	op, err := imageC.Insert(ctx, &req)
+	u.log.Info("Creating image", "image", imageName, "project", u.config.GCP.Project)
+	req := u.insertImageRequest(source)
+	op, err := imageC.Insert(ctx, req)
 	if err != nil {
 		return "", fmt.Errorf("creating image: %w", err)
 	}
 	if err := op.Wait(ctx); err != nil {
 		return "", fmt.Errorf("waiting for image to be created: %w", err)
 	}
+	if err := u.replicateImage(ctx, imageC); err != nil {
+		return "", fmt.Errorf("replicating image: %w", err)
+	}
+	// Images can only be created active, so the initial state is set afterwards.
+	if u.config.GCP.State == computepb.DeprecationStatus_DEPRECATED.String() {
+		for _, name := range u.imageNames() {
+			u.log.Info("Deprecating new image", "image", name)
+			op, err := imageC.Deprecate(ctx, u.deprecateImageRequest(name, ""))
+			if err != nil {
+				return "", fmt.Errorf("deprecating image %s: %w", name, err)
+			}
+			if err := op.Wait(ctx); err != nil {
+				return "", fmt.Errorf("waiting for image %s to be deprecated: %w", name, err)
+			}
+		}
+	}
+	publish, err := u.confirmPublish()
+	if err != nil {
+		return "", err
+	}
+	if publish {
+		for _, name := range u.imageNames() {
+			if err := u.publishImage(ctx, imageC, name); err != nil {
+				return "", err
+			}
+		}
+	}
+	image, err := imageC.Get(ctx, &computepb.GetImageRequest{
+		Image:   imageName,
+		Project: u.config.GCP.Project,
+	})
+	if err != nil {
+		return "", fmt.Errorf("created image doesn't exist: %w", err)
+	}
+	return strings.TrimPrefix(image.GetSelfLink(), "https://www.googleapis.com/compute/v1/"), nil
+}
+
+// replicateImage copies the image to every replication location concurrently.
+func (u *Uploader) replicateImage(ctx context.Context, imageC imagesAPI) error {
+	errs := make([]error, len(u.config.GCP.ReplicationLocations))
+	var wg sync.WaitGroup
+	for i, location := range u.config.GCP.ReplicationLocations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := replicaImageName(u.config.GCP.ImageName, location)
+			u.log.Info("Replicating image", "image", name, "location", location)
+			op, err := imageC.Insert(ctx, u.replicaImageRequest(location))
+			if err != nil {
+				errs[i] = fmt.Errorf("creating image %s: %w", name, err)
+				return
+			}
+			if err := op.Wait(ctx); err != nil {
+				errs[i] = fmt.Errorf("waiting for image %s to be created: %w", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// replicaImageName returns the name of the copy of the image stored in the replication location.
+// Image names are unique within a project, so the location is appended.
+func replicaImageName(imageName, location string) string {
+	return imageName + "-" + location
+}
+
+// imageNames returns the names of the image and all its replicas.
+func (u *Uploader) imageNames() []string {
+	names := []string{u.config.GCP.ImageName}
+	for _, location := range u.config.GCP.ReplicationLocations {
+		names = append(names, replicaImageName(u.config.GCP.ImageName, location))
+	}
+	return names
+}
+
+// imageRef returns the reference of an image in the project, as returned by Upload.
+func (u *Uploader) imageRef(name string) string {
+	return path.Join("projects", u.config.GCP.Project, "global/images", name)
+}
+
+// confirmPublish reports whether the image should be shared according to the sharing setting.
+// Declining to publish keeps the image private.
+func (u *Uploader) confirmPublish() (bool, error) {
+	if u.config.GCP.Sharing == config.GCPSharingPrivate {
+		return false, nil
+	}
+	ok, err := u.confirm.ConfirmPublish(u.config)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		u.log.Warn("Publishing was declined, the image stays private", "image", u.config.GCP.ImageName)
+	}
+	return ok, nil
+}
+
+// publishImage allows the users of the sharing setting to use the image.
+func (u *Uploader) publishImage(ctx context.Context, imageC imagesAPI, name string) error {
+	// Images were always shared with all authenticated users before sharing could be configured.
+	member := config.GCPSharingAllAuthenticatedUsers
+	if u.config.GCP.Sharing == config.GCPSharingAllUsers {
+		member = config.GCPSharingAllUsers
+	}
 	policy := &computepb.Policy{
 		Bindings: []*computepb.Binding{
 			{
 				Role:    toPtr("roles/compute.imageUser"),
-				Members: []string{"allAuthenticatedUsers"},
+				Members: []string{member},
 			},
 		},
 	}
-	if _, err = imageC.SetIamPolicy(ctx, &computepb.SetIamPolicyImageRequest{
-		Resource: imageName,
+	if _, err := imageC.SetIamPolicy(ctx, &computepb.SetIamPolicyImageRequest{
+		Resource: name,
 		Project:  u.config.GCP.Project,
 		GlobalSetPolicyRequestResource: &computepb.GlobalSetPolicyRequest{
 			Policy: policy,
 		},
 	}); err != nil {
-		return "", fmt.Errorf("setting iam policy: %w", err)
+		return fmt.Errorf("setting iam policy of image %s: %w", name, err)
 	}
-	image, err := imageC.Get(ctx, &computepb.GetImageRequest{
-		Image:   imageName,
+	return nil
+}
+
+// insertImageRequest returns the request for creating the image from the archive at the source URL.
+func (u *Uploader) insertImageRequest(source string) *computepb.InsertImageRequest {
+	guestOSFeatures := make([]*computepb.GuestOsFeature, 0, len(u.config.GCP.GuestOSFeatures))
+	for _, feature := range u.config.GCP.GuestOSFeatures {
+		guestOSFeatures = append(guestOSFeatures, &computepb.GuestOsFeature{Type: toPtr(feature)})
+	}
+	req := &computepb.InsertImageRequest{
+		ImageResource: &computepb.Image{
+			Name: toPtr(u.config.GCP.ImageName),
+			RawDisk: &computepb.RawDisk{
+				ContainerType: toPtr("TAR"),
+				Source:        &source,
+			},
+			Family:          toPtr(u.config.GCP.ImageFamily),
+			Description:     toPtr(u.config.GCP.Description),
+			Architecture:    toPtr("X86_64"),
+			GuestOsFeatures: guestOSFeatures,
+			Licenses:        u.config.GCP.Licenses,
+			Labels:          map[string]string{versionLabel: versionLabelValue(u.config.ImageVersion)},
+			// TODO(malt3): enable secure boot support
+			// ShieldedInstanceInitialState: nil,
+		},
 		Project: u.config.GCP.Project,
+	}
+	if !u.expiresAt.IsZero() {
+		req.ImageResource.Labels[config.ExpiryTag] = expiryLabelValue(u.expiresAt)
+	}
+	if u.config.GCP.OSDiskSizeGB > 0 {
+		req.ImageResource.DiskSizeGb = toPtr(int64(u.config.GCP.OSDiskSizeGB))
+	}
+	return req
+}
+
+// replicaImageRequest returns the request for copying the image to the replication location.
+// Replicas aren't part of the image family, so the family only resolves to the primary image
+// and replicas aren't deprecated together with older images.
+func (u *Uploader) replicaImageRequest(location string) *computepb.InsertImageRequest {
+	req := u.insertImageRequest("")
+	req.ImageResource.Name = toPtr(replicaImageName(u.config.GCP.ImageName, location))
+	req.ImageResource.RawDisk = nil
+	req.ImageResource.Family = nil
+	req.ImageResource.SourceImage = toPtr(u.imageRef(u.config.GCP.ImageName))
+	req.ImageResource.StorageLocations = []string{location}
+	return req
+}
+
+// ImageVersions returns the versions of the images in the config's image family.
+// Only images labeled by uplosi are considered.
+func (u *Uploader) ImageVersions(ctx context.Context) ([]string, error) {
+	imageC, err := u.image(ctx)
+	if err != nil {
+		return nil, err
+	}
+	it := imageC.List(ctx, &computepb.ListImagesRequest{
+		Project: u.config.GCP.Project,
+		Filter:  toPtr(fmt.Sprintf("family = %q", u.config.GCP.ImageFamily)),
 	})
+	var versions []string
+	for {
+		image, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return versions, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing images: %w", err)
+		}
+		if value, ok := image.GetLabels()[versionLabel]; ok {
+			versions = append(versions, versionFromLabelValue(value))
+		}
+	}
+}
+
+// deprecateOldImages marks all other images of the family as deprecated, with the new image as replacement.
+func (u *Uploader) deprecateOldImages(ctx context.Context) error {
+	imageC, err := u.image(ctx)
 	if err != nil {
-		return "", fmt.Errorf("created image doesn't exist: %w", err)
+		return err
 	}
-	return strings.TrimPrefix(image.GetSelfLink(), "https://www.googleapis.com/compute/v1/"), nil
+	newImage, err := imageC.Get(ctx, &computepb.GetImageRequest{
+		Image:   u.config.GCP.ImageName,
+		Project: u.config.GCP.Project,
+	})
+	if err != nil {
+		return fmt.Errorf("getting new image: %w", err)
+	}
+
+	it := imageC.List(ctx, &computepb.ListImagesRequest{
+		Project: u.config.GCP.Project,
+		Filter:  toPtr(fmt.Sprintf("family = %q", u.config.GCP.ImageFamily)),
+	})
+	var images []*computepb.Image
+	for {
+		image, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("listing images: %w", err)
+		}
+		images = append(images, image)
+	}
+
+	for _, image := range imagesToDeprecate(images, newImage.GetName()) {
+		u.log.Info("Deprecating image", "image", image, "replacement", newImage.GetName())
+		op, err := imageC.Deprecate(ctx, u.deprecateImageRequest(image, newImage.GetSelfLink()))
+		if err != nil {
+			return fmt.Errorf("deprecating image %s: %w", image, err)
+		}
+		if err := op.Wait(ctx); err != nil {
+			return fmt.Errorf("waiting for image %s to be deprecated: %w", image, err)
+		}
+	}
+	return nil
 }
 
-func (u *Uploader) uploadBlob(ctx context.Context, img io.Reader) error {
+// imagesToDeprecate returns the names of all images except the new one that aren't deprecated yet.
+func imagesToDeprecate(images []*computepb.Image, newImage string) []string {
+	var names []string
+	for _, image := range images {
+		if image.GetName() == newImage {
+			continue
+		}
+		if image.GetDeprecated().GetState() != "" && image.GetDeprecated().GetState() != computepb.DeprecationStatus_ACTIVE.String() {
+			continue
+		}
+		names = append(names, image.GetName())
+	}
+	return names
+}
+
+// deprecateImageRequest returns the request for deprecating the image.
+// The replacement is optional.
+func (u *Uploader) deprecateImageRequest(image, replacement string) *computepb.DeprecateImageRequest {
+	req := &computepb.DeprecateImageRequest{
+		Project: u.config.GCP.Project,
+		Image:   image,
+		DeprecationStatusResource: &computepb.DeprecationStatus{
+			State: toPtr(computepb.DeprecationStatus_DEPRECATED.String()),
+		},
+	}
+	if replacement != "" {
+		req.DeprecationStatusResource.Replacement = toPtr(replacement)
+	}
+	return req
+}
+
+func (u *Uploader) uploadBlob(ctx context.Context, img io.ReadSeeker) error {
 	blobName := u.config.GCP.BlobName
 	bucketC, err := u.bucket(ctx)
 	if err != nil {
 		return err
 	}
-	u.log.Printf("Uploading os image as temporary blob %s", blobName)
+	u.log.Info("Uploading os image as temporary blob", "bucket", u.config.GCP.Bucket, "blob", blobName)
 
-	writer := bucketC.Object(blobName).NewWriter(ctx)
-	_, err = io.Copy(writer, img)
-	if err != nil {
+	// Stream the archive instead of writing it to disk first.
+	sparse := u.config.GCP.SkipZeroBlocks.UnwrapOr(true)
+	tarGz, tarGzW := io.Pipe()
+	go func() {
+		tarGzW.CloseWithError(writeTarGz(img, tarGzW, sparse))
+	}()
+
+	// The archive is hashed while it is uploaded, and compared with the checksums computed by GCS.
+	sums := provider.NewChecksummer(provider.ChecksumCRC32C, provider.ChecksumMD5)
+	writer := bucketC.Object(blobName).NewWriter(ctx, u.config.GCP.BlobTags, u.config.GCP.BlobACL)
+	if _, err := io.Copy(io.MultiWriter(writer, sums), tarGz); err != nil {
+		// Unblock the archive writer.
+		tarGz.CloseWithError(err)
 		return err
 	}
-	return writer.Close()
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := verifyBlobChecksums(writer.Attrs(), sums); err != nil {
+		return err
+	}
+	u.checksums = sums.Sums()
+	return nil
 }
 
+// Download returns the raw image exported to the blob of the config,
+// which can be passed to the uploader of another provider to mirror an image.
+// The Compute API can't export images itself, so the image must be exported to the bucket first, e.g. with
+// `gcloud compute images export --image <imageName> --destination-uri gs://<bucket>/<blobName>`.
+// The disk is streamed out of the exported archive and spooled to a temporary file,
+// which the returned cleanup function removes.
+func (u *Uploader) Download(ctx context.Context) (provider.Request, func() error, error) {
+	bucketC, err := u.bucket(ctx)
+	if err != nil {
+		return provider.Request{}, nil, err
+	}
+	blobName := u.config.GCP.BlobName
+	u.log.Info("Downloading exported image", "image", u.config.GCP.ImageName, "bucket", u.config.GCP.Bucket, "blob", blobName)
+	// The archive is read as stored, even if GCS would decompress it because of its content encoding.
+	reader, err := bucketC.Object(blobName).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return provider.Request{}, nil, fmt.Errorf("exported image %s not found: export image %s to it first",
+			blobURL(u.config.GCP.Bucket, blobName), u.config.GCP.ImageName)
+	}
+	if err != nil {
+		return provider.Request{}, nil, fmt.Errorf("reading exported image: %w", err)
+	}
+	defer reader.Close()
+	req, cleanup, err := readTarGz(reader)
+	if err != nil {
+		return provider.Request{}, nil, fmt.Errorf("extracting exported image: %w", err)
+	}
+	return req, cleanup, nil
+}
+
+// verifyBlobChecksums compares the checksums GCS computed for the uploaded object with the local ones.
+// The MD5 is only compared if GCS reports one, which it doesn't for composite objects.
+func verifyBlobChecksums(attrs *storage.ObjectAttrs, sums *provider.Checksummer) error {
+	if attrs == nil {
+		return nil
+	}
+	if want := binary.BigEndian.Uint32(sums.Sum(provider.ChecksumCRC32C)); attrs.CRC32C != want {
+		return fmt.Errorf("checksum mismatch: GCS reported crc32c %08x, uploaded data has %08x", attrs.CRC32C, want)
+	}
+	if want := sums.Sum(provider.ChecksumMD5); len(attrs.MD5) > 0 && !bytes.Equal(attrs.MD5, want) {
+		return fmt.Errorf("checksum mismatch: GCS reported md5 %x, uploaded data has %x", attrs.MD5, want)
+	}
+	return nil
+}
+
+// ensureImageDeleted deletes the image and its replicas if they exist.
 func (u *Uploader) ensureImageDeleted(ctx context.Context) error {
 	imageC, err := u.image(ctx)
 	if err != nil {
 		return err
 	}
-	imageName := u.config.GCP.ImageName
-	if err != nil {
-		return fmt.Errorf("inferring image name: %w", err)
+	for _, name := range u.imageNames() {
+		if err := u.ensureNamedImageDeleted(ctx, imageC, name); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	_, err = imageC.Get(ctx, &computepb.GetImageRequest{
+func (u *Uploader) ensureNamedImageDeleted(ctx context.Context, imageC imagesAPI, imageName string) error {
+	_, err := imageC.Get(ctx, &computepb.GetImageRequest{
 		Image:   imageName,
 		Project: u.config.GCP.Project,
 	})
 	if err != nil {
-		u.log.Printf("Image %s doesn't exist. Nothing to clean up.", imageName)
+		u.log.Debug("Image doesn't exist. Nothing to clean up.", "image", imageName)
 		return nil
 	}
-	u.log.Printf("Deleting image %s", imageName)
+	if err := u.confirm.ConfirmOverwrite(u.config, imageName); err != nil {
+		return err
+	}
+	u.log.Info("Deleting image", "image", imageName)
 	op, err := imageC.Delete(ctx, &computepb.DeleteImageRequest{
 		Image:   imageName,
 		Project: u.config.GCP.Project,
@@ -204,19 +790,19 @@ func (u *Uploader) ensureBlobDeleted(ctx context.Context) error {
 		return err
 	}
 	if !bucketExists {
-		u.log.Printf("Bucket %s doesn't exist. Nothing to clean up.", u.config.GCP.Bucket)
+		u.log.Debug("Bucket doesn't exist. Nothing to clean up.", "bucket", u.config.GCP.Bucket)
 		return nil
 	}
 
 	_, err = bucketC.Object(blobName).Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
-		u.log.Printf("Blob %s doesn't exist. Nothing to clean up.", blobName)
+		u.log.Debug("Blob doesn't exist. Nothing to clean up.", "bucket", u.config.GCP.Bucket, "blob", blobName)
 		return nil
 	}
 	if err != nil {
 		return err
 	}
-	u.log.Printf("Deleting blob %s", blobName)
+	u.log.Info("Deleting blob", "bucket", u.config.GCP.Bucket, "blob", blobName)
 	return bucketC.Object(blobName).Delete(ctx)
 }
 
@@ -231,14 +817,64 @@ func (u *Uploader) ensureBucket(ctx context.Context) error {
 		return err
 	}
 	if bucketExists {
-		u.log.Printf("Bucket %s exists", bucket)
+		u.log.Debug("Bucket exists", "bucket", bucket)
 		return nil
 	}
-	u.log.Printf("Creating bucket %s", bucket)
-	return bucketC.Create(ctx, u.config.GCP.Project, &storage.BucketAttrs{
-		PublicAccessPrevention: storage.PublicAccessPreventionEnforced,
-		Location:               u.config.GCP.Location,
-	})
+	u.log.Info("Creating bucket", "bucket", bucket, "location", u.config.GCP.Location, "project", u.sourceProject())
+	return bucketC.Create(ctx, u.sourceProject(), newBucketAttrs(u.config.GCP))
+}
+
+// newBucketAttrs returns the attributes of a bucket created by uplosi.
+// Public access prevention is enforced, unless the blob ACL is public.
+func newBucketAttrs(cfg config.GCPConfig) *storage.BucketAttrs {
+	prevention := storage.PublicAccessPreventionEnforced
+	if isPublicACL(cfg.BlobACL) {
+		prevention = storage.PublicAccessPreventionInherited
+	}
+	return &storage.BucketAttrs{
+		PublicAccessPrevention: prevention,
+		Location:               cfg.Location,
+	}
+}
+
+// checkBlobACL fails if the bucket doesn't allow storing the blob with the blob ACL.
+// A missing bucket passes, as it is created with attributes allowing the blob ACL.
+func (u *Uploader) checkBlobACL(ctx context.Context) error {
+	if u.config.GCP.BlobACL == "" {
+		return nil
+	}
+	bucketC, err := u.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	attrs, err := bucketC.Attrs(ctx)
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting attributes of bucket %s: %w", u.config.GCP.Bucket, err)
+	}
+	return bucketAllowsACL(attrs, u.config.GCP.BlobACL)
+}
+
+// bucketAllowsACL returns an error if a bucket with the attributes rejects objects with the predefined ACL.
+// Buckets with uniform bucket-level access reject all object ACLs,
+// buckets with enforced public access prevention reject public ACLs.
+func bucketAllowsACL(attrs *storage.BucketAttrs, acl string) error {
+	if attrs.UniformBucketLevelAccess.Enabled {
+		return fmt.Errorf("blob acl %s requested, but bucket %s uses uniform bucket-level access: "+
+			"disable uniform bucket-level access or remove blobACL", acl, attrs.Name)
+	}
+	if isPublicACL(acl) && attrs.PublicAccessPrevention == storage.PublicAccessPreventionEnforced {
+		return fmt.Errorf("blob acl %s requested, but bucket %s enforces public access prevention: "+
+			"allow public access for the bucket or remove blobACL", acl, attrs.Name)
+	}
+	return nil
+}
+
+// isPublicACL reports whether the predefined ACL grants access to users outside of the project.
+func isPublicACL(acl string) bool {
+	return acl == "publicRead" || acl == "authenticatedRead"
 }
 
 func (u *Uploader) bucketExists(ctx context.Context) (bool, error) {
@@ -257,6 +893,23 @@ func (u *Uploader) bucketExists(ctx context.Context) (bool, error) {
 	return false, err
 }
 
+// gcsSourceURL returns the URL of a Cloud Storage object as expected by the images API.
+func gcsSourceURL(src *url.URL) (string, error) {
+	var bucket, object string
+	switch {
+	case src.Scheme == "gs":
+		bucket, object = src.Host, strings.TrimPrefix(src.Path, "/")
+	case src.Scheme == "https" && src.Host == "storage.googleapis.com":
+		bucket, object, _ = strings.Cut(strings.TrimPrefix(src.Path, "/"), "/")
+	default:
+		return "", fmt.Errorf("importing image from %s is not supported, only Cloud Storage URLs are", src.Redacted())
+	}
+	if bucket == "" || object == "" {
+		return "", fmt.Errorf("storage URL %s must contain bucket and object", src.Redacted())
+	}
+	return blobURL(bucket, object), nil
+}
+
 func blobURL(bucketName, blobName string) string {
 	return (&url.URL{
 		Scheme: "https",
@@ -268,3 +921,18 @@ func blobURL(bucketName, blobName string) string {
 func toPtr[T any](v T) *T {
 	return &v
 }
+
+// versionLabelValue encodes the version as label value, which must not contain dots.
+func versionLabelValue(version string) string {
+	return strings.ReplaceAll(version, ".", "-")
+}
+
+// expiryLabelValue encodes the expiry time as label value, which must be lowercase and not contain colons,
+// e.g. 2025-01-01t00-00-00z.
+func expiryLabelValue(expiresAt time.Time) string {
+	return strings.ToLower(strings.ReplaceAll(expiresAt.UTC().Format(time.RFC3339), ":", "-"))
+}
+
+func versionFromLabelValue(value string) string {
+	return strings.ReplaceAll(value, "-", ".")
+}
@@ -0,0 +1,454 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"cloud.google.com/go/storage"
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	gaxv2 "github.com/googleapis/gax-go/v2"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+)
+
+func TestBucketAllowsACL(t *testing.T) {
+	testCases := map[string]struct {
+		attrs   storage.BucketAttrs
+		acl     string
+		wantErr bool
+	}{
+		"public acl": {
+			acl: "publicRead",
+		},
+		"private acl with public access prevention": {
+			attrs: storage.BucketAttrs{PublicAccessPrevention: storage.PublicAccessPreventionEnforced},
+			acl:   "projectPrivate",
+		},
+		"public acl with public access prevention": {
+			attrs:   storage.BucketAttrs{PublicAccessPrevention: storage.PublicAccessPreventionEnforced},
+			acl:     "publicRead",
+			wantErr: true,
+		},
+		"uniform bucket-level access": {
+			attrs:   storage.BucketAttrs{UniformBucketLevelAccess: storage.UniformBucketLevelAccess{Enabled: true}},
+			acl:     "private",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := bucketAllowsACL(&tc.attrs, tc.acl)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestNewBucketAttrs(t *testing.T) {
+	testCases := map[string]struct {
+		acl            string
+		wantPrevention storage.PublicAccessPrevention
+	}{
+		"no acl": {
+			wantPrevention: storage.PublicAccessPreventionEnforced,
+		},
+		"private acl": {
+			acl:            "projectPrivate",
+			wantPrevention: storage.PublicAccessPreventionEnforced,
+		},
+		"public acl": {
+			acl:            "publicRead",
+			wantPrevention: storage.PublicAccessPreventionInherited,
+		},
+		"authenticated acl": {
+			acl:            "authenticatedRead",
+			wantPrevention: storage.PublicAccessPreventionInherited,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			attrs := newBucketAttrs(config.GCPConfig{Location: "europe-west3", BlobACL: tc.acl})
+			assert.Equal(tc.wantPrevention, attrs.PublicAccessPrevention)
+			assert.Equal("europe-west3", attrs.Location)
+			// Buckets created by uplosi accept the blob ACL.
+			assert.NoError(bucketAllowsACL(attrs, tc.acl))
+		})
+	}
+}
+
+func TestInsertImageRequest(t *testing.T) {
+	assert := assert.New(t)
+	u := &Uploader{
+		config: config.Config{
+			ImageVersion: "1.2.3",
+			GCP: config.GCPConfig{
+				Project:         "my-project",
+				ImageName:       "my-image",
+				ImageFamily:     "my-family",
+				Description:     "My image 1.2.3",
+				Bucket:          "my-bucket",
+				BlobName:        "my-blob.tar.gz",
+				GuestOSFeatures: []string{"UEFI_COMPATIBLE", "GVNIC"},
+				Licenses:        []string{"projects/my-project/global/licenses/my-license"},
+				OSDiskSizeGB:    30,
+			},
+		},
+	}
+
+	req := u.insertImageRequest(blobURL("my-bucket", "my-blob.tar.gz"))
+	assert.Equal("my-project", req.GetProject())
+	image := req.GetImageResource()
+	assert.Equal("my-image", image.GetName())
+	assert.Equal("my-family", image.GetFamily())
+	assert.Equal("My image 1.2.3", image.GetDescription())
+	assert.Equal("https://storage.googleapis.com/my-bucket/my-blob.tar.gz", image.GetRawDisk().GetSource())
+	var features []string
+	for _, feature := range image.GetGuestOsFeatures() {
+		features = append(features, feature.GetType())
+	}
+	assert.Equal([]string{"UEFI_COMPATIBLE", "GVNIC"}, features)
+	assert.Equal([]string{"projects/my-project/global/licenses/my-license"}, image.GetLicenses())
+	assert.Equal(int64(30), image.GetDiskSizeGb())
+	assert.Equal("1-2-3", image.GetLabels()[versionLabel])
+	assert.Equal("1.2.3", versionFromLabelValue(image.GetLabels()[versionLabel]))
+
+	assert.NotContains(image.GetLabels(), config.ExpiryTag)
+
+	u.config.GCP.OSDiskSizeGB = 0
+	assert.Nil(u.insertImageRequest("").GetImageResource().DiskSizeGb)
+
+	u.expiresAt = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal("2025-01-02t03-04-05z", u.insertImageRequest("").GetImageResource().GetLabels()[config.ExpiryTag])
+}
+
+func TestReplicaImageRequest(t *testing.T) {
+	assert := assert.New(t)
+	u := &Uploader{
+		config: config.Config{
+			ImageVersion: "1.2.3",
+			GCP: config.GCPConfig{
+				Project:              "my-project",
+				ImageName:            "my-image",
+				ImageFamily:          "my-family",
+				ReplicationLocations: []string{"europe-west3", "us"},
+				GuestOSFeatures:      []string{"UEFI_COMPATIBLE"},
+			},
+		},
+	}
+
+	req := u.replicaImageRequest("europe-west3")
+	assert.Equal("my-project", req.GetProject())
+	image := req.GetImageResource()
+	assert.Equal("my-image-europe-west3", image.GetName())
+	assert.Equal("projects/my-project/global/images/my-image", image.GetSourceImage())
+	assert.Equal([]string{"europe-west3"}, image.GetStorageLocations())
+	assert.Nil(image.GetRawDisk())
+	assert.Empty(image.GetFamily())
+	assert.Len(image.GetGuestOsFeatures(), 1)
+	assert.Equal("1-2-3", image.GetLabels()[versionLabel])
+
+	assert.Equal([]string{"my-image", "my-image-europe-west3", "my-image-us"}, u.imageNames())
+	assert.Equal("projects/my-project/global/images/my-image-us", u.imageRef("my-image-us"))
+}
+
+func TestGCSSourceURL(t *testing.T) {
+	testCases := map[string]struct {
+		src     string
+		want    string
+		wantErr bool
+	}{
+		"gs URL": {
+			src:  "gs://my-bucket/images/my-image.tar.gz",
+			want: "https://storage.googleapis.com/my-bucket/images/my-image.tar.gz",
+		},
+		"https URL": {
+			src:  "https://storage.googleapis.com/my-bucket/my-image.tar.gz",
+			want: "https://storage.googleapis.com/my-bucket/my-image.tar.gz",
+		},
+		"missing object": {
+			src:     "gs://my-bucket/",
+			wantErr: true,
+		},
+		"missing object in https URL": {
+			src:     "https://storage.googleapis.com/my-bucket",
+			wantErr: true,
+		},
+		"other host": {
+			src:     "https://example.com/my-bucket/my-image.tar.gz",
+			wantErr: true,
+		},
+		"s3 URL": {
+			src:     "s3://my-bucket/my-image.tar.gz",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			src, err := url.Parse(tc.src)
+			assert.NoError(err)
+
+			got, err := gcsSourceURL(src)
+			u := &Uploader{}
+			assert.Equal(!tc.wantErr, u.CanImportURL(src))
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
+
+func TestSourceProject(t *testing.T) {
+	testCases := map[string]struct {
+		sourceProject string
+		want          string
+	}{
+		"defaults to image project": {
+			want: "image-project",
+		},
+		"separate source project": {
+			sourceProject: "sandbox-project",
+			want:          "sandbox-project",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			u, err := NewUploader(config.Config{
+				GCP: config.GCPConfig{Project: "image-project", SourceProject: tc.sourceProject},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, u.sourceProject())
+		})
+	}
+}
+
+func TestImagesToDeprecate(t *testing.T) {
+	assert := assert.New(t)
+	images := []*computepb.Image{
+		{Name: toPtr("image-3")},
+		{Name: toPtr("image-2")},
+		{Name: toPtr("image-1"), Deprecated: &computepb.DeprecationStatus{State: toPtr("DEPRECATED")}},
+		{Name: toPtr("image-0"), Deprecated: &computepb.DeprecationStatus{State: toPtr("ACTIVE")}},
+	}
+
+	assert.Equal([]string{"image-2", "image-0"}, imagesToDeprecate(images, "image-3"))
+	assert.Empty(imagesToDeprecate(nil, "image-3"))
+}
+
+func TestDeprecateImageRequest(t *testing.T) {
+	assert := assert.New(t)
+	u := &Uploader{config: config.Config{GCP: config.GCPConfig{Project: "my-project"}}}
+
+	req := u.deprecateImageRequest("image-2", "https://www.googleapis.com/compute/v1/projects/my-project/global/images/image-3")
+	assert.Equal("my-project", req.GetProject())
+	assert.Equal("image-2", req.GetImage())
+	assert.Equal("DEPRECATED", req.GetDeprecationStatusResource().GetState())
+	assert.Equal("https://www.googleapis.com/compute/v1/projects/my-project/global/images/image-3",
+		req.GetDeprecationStatusResource().GetReplacement())
+
+	// New images are deprecated without replacement.
+	req = u.deprecateImageRequest("image-3", "")
+	assert.Equal("DEPRECATED", req.GetDeprecationStatusResource().GetState())
+	assert.Nil(req.GetDeprecationStatusResource().Replacement)
+}
+
+func TestVerifyBlobChecksums(t *testing.T) {
+	md5Sum := []byte{0x5e, 0xb6, 0x3b, 0xbb, 0xe0, 0x1e, 0xee, 0xd0, 0x93, 0xcb, 0x22, 0xbb, 0x8f, 0x5a, 0xcd, 0xc3}
+	testCases := map[string]struct {
+		attrs   *storage.ObjectAttrs
+		wantErr bool
+	}{
+		"matching checksums": {attrs: &storage.ObjectAttrs{CRC32C: 0xc99465aa, MD5: md5Sum}},
+		"composite object":   {attrs: &storage.ObjectAttrs{CRC32C: 0xc99465aa}},
+		"crc32c mismatch": {
+			attrs:   &storage.ObjectAttrs{CRC32C: 1, MD5: md5Sum},
+			wantErr: true,
+		},
+		"md5 mismatch": {
+			attrs:   &storage.ObjectAttrs{CRC32C: 0xc99465aa, MD5: make([]byte, 16)},
+			wantErr: true,
+		},
+		"no attributes": {},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			sums := provider.NewChecksummer(provider.ChecksumCRC32C, provider.ChecksumMD5)
+			_, _ = sums.Write([]byte("hello world"))
+			err := verifyBlobChecksums(tc.attrs, sums)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestPreflightError(t *testing.T) {
+	testCases := map[string]struct {
+		err           error
+		wantForbidden bool
+	}{
+		"no error": {},
+		"forbidden": {
+			err:           fmt.Errorf("accessing images of project p: %w", &googleapi.Error{Code: http.StatusForbidden}),
+			wantForbidden: true,
+		},
+		"unauthorized": {
+			err:           &googleapi.Error{Code: http.StatusUnauthorized},
+			wantForbidden: true,
+		},
+		"not found": {
+			err: &googleapi.Error{Code: http.StatusNotFound},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			err := preflightError(tc.err)
+			if tc.err == nil {
+				assert.NoError(err)
+				return
+			}
+			assert.ErrorIs(err, tc.err)
+			assert.Equal(tc.wantForbidden, errors.Is(err, provider.ErrPermissionDenied))
+		})
+	}
+}
+
+func TestPublishImage(t *testing.T) {
+	testCases := map[string]struct {
+		sharing     string
+		wantPublish bool
+		wantMember  string
+	}{
+		"default": {
+			wantPublish: true,
+			wantMember:  "allAuthenticatedUsers",
+		},
+		"all authenticated users": {
+			sharing:     config.GCPSharingAllAuthenticatedUsers,
+			wantPublish: true,
+			wantMember:  "allAuthenticatedUsers",
+		},
+		"all users": {
+			sharing:     config.GCPSharingAllUsers,
+			wantPublish: true,
+			wantMember:  "allUsers",
+		},
+		"private": {
+			sharing: config.GCPSharingPrivate,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u := &Uploader{
+				config: config.Config{GCP: config.GCPConfig{Project: "my-project", ImageName: "my-image", Sharing: tc.sharing}},
+				log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			publish, err := u.confirmPublish()
+			assert.NoError(err)
+			assert.Equal(tc.wantPublish, publish)
+			if !publish {
+				return
+			}
+
+			images := &stubImages{}
+			assert.NoError(u.publishImage(context.Background(), images, "my-image"))
+			assert.Equal("my-image", images.policyReq.GetResource())
+			bindings := images.policyReq.GetGlobalSetPolicyRequestResource().GetPolicy().GetBindings()
+			assert.Len(bindings, 1)
+			assert.Equal("roles/compute.imageUser", bindings[0].GetRole())
+			assert.Equal([]string{tc.wantMember}, bindings[0].GetMembers())
+		})
+	}
+}
+
+type stubImages struct {
+	imagesAPI
+	policyReq *computepb.SetIamPolicyImageRequest
+}
+
+func (s *stubImages) SetIamPolicy(_ context.Context, req *computepb.SetIamPolicyImageRequest, _ ...gaxv2.CallOption) (*computepb.Policy, error) {
+	s.policyReq = req
+	return req.GetGlobalSetPolicyRequestResource().GetPolicy(), nil
+}
+
+func TestUploadMock(t *testing.T) {
+	assert := assert.New(t)
+	conf := config.Config{
+		Provider:     "gcp",
+		Name:         "my-image",
+		ImageVersion: "1.0.0",
+		GCP: config.GCPConfig{
+			Project:              "my-project",
+			Location:             "europe-west3",
+			ReplicationLocations: []string{"us-east1"},
+			Bucket:               "my-bucket",
+		},
+	}
+	assert.NoError(conf.SetDefaults())
+	assert.NoError(conf.Render(func(string) ([]byte, error) { return nil, nil }))
+	rec := &provider.Recorder{}
+	u, err := NewUploader(conf, WithProviderOptions(provider.WithMock(rec)))
+	assert.NoError(err)
+	assert.True(u.Mocked())
+	assert.NoError(u.Preflight(context.Background()))
+
+	image := bytes.Repeat([]byte{0xaa}, 4096)
+	refs, err := u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+	assert.NoError(err)
+	assert.Equal([]string{
+		"projects/my-project/global/images/my-image-1-0-0",
+		"projects/my-project/global/images/my-image-1-0-0-us-east1",
+	}, refs)
+	assert.Len(u.Checksums(), 2)
+	versions, err := u.ImageVersions(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"1.0.0"}, versions)
+	ops := mockOperations(rec.Calls())
+	assert.Contains(ops, "storage.Bucket.Create")
+	assert.Contains(ops, "storage.Object.Write")
+	assert.Contains(ops, "storage.Object.Delete")
+	assert.Contains(ops, "compute.Images.Insert")
+	assert.Contains(ops, "compute.Images.SetIamPolicy")
+}
+
+func mockOperations(calls []provider.Call) []string {
+	ops := make([]string, 0, len(calls))
+	for _, call := range calls {
+		ops = append(ops, call.Operation)
+	}
+	return ops
+}
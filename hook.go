@@ -0,0 +1,50 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// uploadResult describes the resources created by uploading a single variant.
+type uploadResult struct {
+	Variant  string
+	Provider string
+	Refs     []string
+	// StepDurations holds how long each step of the upload took, keyed by step name.
+	StepDurations map[string]time.Duration
+	// Checksums holds the hex encoded checksums of the uploaded data, keyed by algorithm.
+	// It is empty if the provider doesn't compute checksums.
+	Checksums map[string]string
+}
+
+// postUploadHook is called after each successful variant upload.
+type postUploadHook func(ctx context.Context, result uploadResult) error
+
+// commandHook returns a post-upload hook that executes the given command.
+// The references of the uploaded image are passed as arguments, the variant
+// name and provider via the UPLOSI_VARIANT and UPLOSI_PROVIDER environment variables.
+func commandHook(command string, stdout, stderr io.Writer) postUploadHook {
+	return func(ctx context.Context, result uploadResult) error {
+		cmd := exec.CommandContext(ctx, command, result.Refs...)
+		cmd.Env = append(os.Environ(),
+			"UPLOSI_VARIANT="+result.Variant,
+			"UPLOSI_PROVIDER="+result.Provider,
+		)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("running %s: %w", command, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,36 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandHook(t *testing.T) {
+	assert := assert.New(t)
+
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	assert.NoError(os.WriteFile(script, []byte("#!/bin/sh\necho \"$UPLOSI_PROVIDER $UPLOSI_VARIANT $*\"\n"), 0o755))
+
+	stdout := new(bytes.Buffer)
+	hook := commandHook(script, stdout, stdout)
+	assert.NoError(hook(context.Background(), uploadResult{
+		Variant:  "foo",
+		Provider: "aws",
+		Refs:     []string{"ref-a", "ref-b"},
+	}))
+	assert.Equal("aws foo ref-a ref-b\n", stdout.String())
+
+	hook = commandHook(filepath.Join(t.TempDir(), "does-not-exist"), stdout, stdout)
+	assert.Error(hook(context.Background(), uploadResult{}))
+}
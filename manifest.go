@@ -0,0 +1,102 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+// manifestFormatVersion is the version of the manifest format.
+// It is only increased on incompatible changes, new fields may be added without increasing it.
+const manifestFormatVersion = 1
+
+// manifest describes an uploaded image for artifact catalogs.
+// The JSON encoding is documented in the README and must stay stable.
+type manifest struct {
+	FormatVersion int    `json:"formatVersion"`
+	Variant       string `json:"variant"`
+	Provider      string `json:"provider"`
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	// ImageDigest is the hex encoded sha256 digest of the image,
+	// or empty if the image was imported from a URL.
+	ImageDigest string    `json:"imageDigest"`
+	Refs        []string  `json:"refs"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+	// Checksums are the hex encoded checksums of the data sent to the provider, keyed by algorithm.
+	// They are omitted if the provider doesn't compute checksums.
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+// newManifest assembles the manifest of an upload from its result and the rendered config.
+func newManifest(result uploadResult, cfg config.Config, uploadedAt time.Time) manifest {
+	refs := result.Refs
+	if refs == nil {
+		refs = []string{}
+	}
+	return manifest{
+		FormatVersion: manifestFormatVersion,
+		Variant:       result.Variant,
+		Provider:      result.Provider,
+		Name:          cfg.Name,
+		Version:       cfg.ImageVersion,
+		ImageDigest:   cfg.ImageDigest,
+		Refs:          refs,
+		UploadedAt:    uploadedAt.UTC(),
+		Checksums:     result.Checksums,
+	}
+}
+
+// encodeManifest returns the manifest as indented JSON.
+func encodeManifest(m manifest) ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding manifest: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// writeManifest writes the manifest as indented JSON to the path, creating missing parent directories.
+// An existing file is overwritten.
+func writeManifest(path string, m manifest) error {
+	data, err := encodeManifest(m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("writing file: %w", err)
+	}
+	return nil
+}
+
+// writeManifestObject writes the manifest as indented JSON to the object with the key in the bucket of the uploader.
+// An existing object is overwritten.
+func writeManifestObject(ctx context.Context, upload provider.Uploader, key string, m manifest) error {
+	writer, ok := upload.(provider.ObjectWriter)
+	if !ok {
+		return fmt.Errorf("provider %s can't write objects to a bucket", m.Provider)
+	}
+	data, err := encodeManifest(m)
+	if err != nil {
+		return err
+	}
+	if err := writer.WriteObject(ctx, key, data); err != nil {
+		return fmt.Errorf("writing object %q: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteManifest(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "manifests", "image.json")
+	uploadedAt := time.Date(2024, 5, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	result := uploadResult{
+		Variant:  "aws-sev",
+		Provider: "aws",
+		Refs:     []string{"arn:aws:ec2:eu-central-1::image/ami-1"},
+	}
+	cfg := config.Config{
+		Name:         "my-image",
+		ImageVersion: "1.2.3",
+		ImageDigest:  "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+	}
+
+	assert.NoError(writeManifest(path, newManifest(result, cfg, uploadedAt)))
+	data, err := os.ReadFile(path)
+	assert.NoError(err)
+	// The format is stable, changes need to be backwards compatible.
+	assert.Equal(`{
+  "formatVersion": 1,
+  "variant": "aws-sev",
+  "provider": "aws",
+  "name": "my-image",
+  "version": "1.2.3",
+  "imageDigest": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+  "refs": [
+    "arn:aws:ec2:eu-central-1::image/ami-1"
+  ],
+  "uploadedAt": "2024-05-01T10:30:00Z"
+}
+`, string(data))
+
+	// Existing manifests are overwritten, missing refs are encoded as empty list.
+	assert.NoError(writeManifest(path, newManifest(uploadResult{Provider: "gcp"}, config.Config{}, uploadedAt)))
+	data, err = os.ReadFile(path)
+	assert.NoError(err)
+	assert.Contains(string(data), `"refs": [],`)
+	assert.Contains(string(data), `"provider": "gcp",`)
+	assert.NotContains(string(data), "checksums")
+
+	// Checksums are added if the provider computed them.
+	result.Checksums = map[string]string{"crc32c": "c99465aa", "sha256": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"}
+	assert.NoError(writeManifest(path, newManifest(result, cfg, uploadedAt)))
+	data, err = os.ReadFile(path)
+	assert.NoError(err)
+	assert.Contains(string(data), `"uploadedAt": "2024-05-01T10:30:00Z",
+  "checksums": {
+    "crc32c": "c99465aa",
+    "sha256": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+  }
+}`)
+}
+
+func TestWriteManifestObject(t *testing.T) {
+	assert := assert.New(t)
+	m := newManifest(uploadResult{Provider: "aws"}, config.Config{Name: "my-image"}, time.Unix(0, 0))
+	want, err := encodeManifest(m)
+	assert.NoError(err)
+
+	upload := &objectUploader{objects: map[string][]byte{}}
+	assert.NoError(writeManifestObject(context.Background(), upload, "manifests/image.json", m))
+	assert.Equal(want, upload.objects["manifests/image.json"])
+
+	upload.err = errors.New("failed")
+	assert.ErrorContains(writeManifestObject(context.Background(), upload, "manifests/image.json", m), "manifests/image.json")
+
+	// Uploaders without a bucket can't write the manifest.
+	assert.Error(writeManifestObject(context.Background(), plainUploader{}, "manifests/image.json", m))
+}
+
+// plainUploader is an uploader without optional features.
+type plainUploader struct{}
+
+func (plainUploader) Upload(context.Context, io.ReadSeeker, int64) ([]string, error) {
+	return nil, nil
+}
+
+func (plainUploader) StepDurations() map[string]time.Duration {
+	return nil
+}
+
+// objectUploader records the objects written to its bucket.
+type objectUploader struct {
+	plainUploader
+	objects map[string][]byte
+	err     error
+}
+
+func (u *objectUploader) WriteObject(_ context.Context, key string, data []byte) error {
+	if u.err != nil {
+		return u.err
+	}
+	u.objects[key] = data
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package openstack
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/imagedata"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+)
+
+type imagesAPI interface {
+	Create(opts images.CreateOpts) (*images.Image, error)
+	Upload(id string, data io.Reader) error
+	Download(id string) (io.ReadCloser, error)
+	List(opts images.ListOpts) ([]images.Image, error)
+	Delete(id string) error
+}
+
+// imagesClient adapts a client of the image service to imagesAPI.
+type imagesClient struct {
+	client *gophercloud.ServiceClient
+}
+
+func (c imagesClient) Create(opts images.CreateOpts) (*images.Image, error) {
+	return images.Create(c.client, opts).Extract()
+}
+
+func (c imagesClient) Upload(id string, data io.Reader) error {
+	return imagedata.Upload(c.client, id, data).ExtractErr()
+}
+
+func (c imagesClient) Download(id string) (io.ReadCloser, error) {
+	return imagedata.Download(c.client, id).Extract()
+}
+
+func (c imagesClient) List(opts images.ListOpts) ([]images.Image, error) {
+	page, err := images.List(c.client, opts).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	imgs, err := images.ExtractImages(page)
+	if err != nil {
+		return nil, fmt.Errorf("extracting images: %w", err)
+	}
+	return imgs, nil
+}
+
+func (c imagesClient) Delete(id string) error {
+	return images.Delete(c.client, id).ExtractErr()
+}
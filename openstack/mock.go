@@ -0,0 +1,137 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package openstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+)
+
+// useMock replaces the API clients with in-memory fakes that record their calls in rec.
+func (u *Uploader) useMock(rec *provider.Recorder) {
+	fake := &mockImages{rec: rec, images: make(map[string]images.Image)}
+	u.image = func(context.Context) (imagesAPI, error) {
+		return fake, nil
+	}
+}
+
+// Mocked reports whether the uploader uses fake API clients, see provider.WithMock.
+func (u *Uploader) Mocked() bool {
+	return u.opts.Mock != nil
+}
+
+// mockImages is the fake image service of a project.
+// Uploaded image data is counted, but not kept.
+type mockImages struct {
+	rec *provider.Recorder
+
+	mux    sync.Mutex
+	nextID int
+	// images are the created images, keyed by ID.
+	images map[string]images.Image
+}
+
+// record records the call and locks the state until the returned function is called.
+func (m *mockImages) record(operation string, input any) func() {
+	m.rec.Record(string(config.ProviderOpenStack), operation, input)
+	m.mux.Lock()
+	return m.mux.Unlock
+}
+
+// mockNotFound returns the error of the image service for missing images.
+func mockNotFound(id string) error {
+	return gophercloud.ErrDefault404{ErrUnexpectedResponseCode: gophercloud.ErrUnexpectedResponseCode{
+		Expected: []int{200},
+		Actual:   404,
+		Body:     []byte(fmt.Sprintf("no image found with ID %s", id)),
+	}}
+}
+
+func (m *mockImages) Create(opts images.CreateOpts) (*images.Image, error) {
+	defer m.record("images.Create", opts)()
+	m.nextID++
+	image := images.Image{
+		ID:               fmt.Sprintf("00000000-0000-0000-0000-%012x", m.nextID),
+		Name:             opts.Name,
+		Status:           images.ImageStatusQueued,
+		Tags:             opts.Tags,
+		ContainerFormat:  opts.ContainerFormat,
+		DiskFormat:       opts.DiskFormat,
+		MinDiskGigabytes: opts.MinDisk,
+		MinRAMMegabytes:  opts.MinRAM,
+	}
+	if opts.Visibility != nil {
+		image.Visibility = *opts.Visibility
+	}
+	if opts.Protected != nil {
+		image.Protected = *opts.Protected
+	}
+	if opts.Hidden != nil {
+		image.Hidden = *opts.Hidden
+	}
+	m.images[image.ID] = image
+	return &image, nil
+}
+
+func (m *mockImages) Upload(id string, data io.Reader) error {
+	// Drain the image outside of the lock, like the image service reads the request body.
+	size, err := io.Copy(io.Discard, data)
+	if err != nil {
+		return fmt.Errorf("reading image data: %w", err)
+	}
+	defer m.record("imagedata.Upload", id)()
+	image, ok := m.images[id]
+	if !ok {
+		return mockNotFound(id)
+	}
+	image.SizeBytes = size
+	image.Status = images.ImageStatusActive
+	m.images[id] = image
+	return nil
+}
+
+func (m *mockImages) Download(id string) (io.ReadCloser, error) {
+	defer m.record("imagedata.Download", id)()
+	if _, ok := m.images[id]; !ok {
+		return nil, mockNotFound(id)
+	}
+	return nil, fmt.Errorf("downloading image data in mock mode: %w", errors.ErrUnsupported)
+}
+
+func (m *mockImages) List(opts images.ListOpts) ([]images.Image, error) {
+	defer m.record("images.List", opts)()
+	var imgs []images.Image
+	for _, image := range m.images {
+		if opts.Name != "" && image.Name != opts.Name {
+			continue
+		}
+		imgs = append(imgs, image)
+	}
+	sort.Slice(imgs, func(i, j int) bool { return imgs[i].ID < imgs[j].ID })
+	if opts.Limit > 0 && len(imgs) > opts.Limit {
+		imgs = imgs[:opts.Limit]
+	}
+	return imgs, nil
+}
+
+func (m *mockImages) Delete(id string) error {
+	defer m.record("images.Delete", id)()
+	if _, ok := m.images[id]; !ok {
+		return mockNotFound(id)
+	}
+	delete(m.images, id)
+	return nil
+}
@@ -11,11 +11,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"time"
 
 	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
 	"github.com/gophercloud/gophercloud"
-	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/imagedata"
 	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
 	"github.com/gophercloud/utils/openstack/clientconfig"
 )
@@ -25,52 +28,155 @@ const microversion = "2.42"
 type Uploader struct {
 	config config.Config
 
-	image func(context.Context) (*gophercloud.ServiceClient, error)
+	image func(context.Context) (imagesAPI, error)
 
-	log *log.Logger
+	httpClient *http.Client
+	confirm    config.ConfirmFunc
+	log        *slog.Logger
+	steps      provider.StepTimer
+	opts       provider.Options
+	// expiresAt is the expiry time of the current upload, or zero if the config has no TTL.
+	expiresAt time.Time
 }
 
-func NewUploader(config config.Config, log *log.Logger) (*Uploader, error) {
-	clientOpts := &clientconfig.ClientOpts{
-		Cloud: config.OpenStack.Cloud,
+// Option configures an Uploader.
+type Option func(*Uploader)
+
+// WithLogger sets the structured logger used by the uploader.
+// By default, log output is discarded.
+func WithLogger(log *slog.Logger) Option {
+	return func(u *Uploader) {
+		u.log = log.With("provider", "openstack")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to communicate with the OpenStack APIs,
+// e.g. to use a proxy or custom CA certificates.
+// By default, a client using the TLS settings of the cloud configuration is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(u *Uploader) {
+		u.httpClient = client
 	}
+}
 
-	return &Uploader{
+// WithProviderOptions sets the options shared by all providers, like provider.WithMetrics or provider.WithClock.
+func WithProviderOptions(opts ...provider.Option) Option {
+	return func(u *Uploader) {
+		u.opts.Apply(opts...)
+	}
+}
+
+// WithConfirm sets a callback that approves overwriting existing images
+// and publishing images with public or community visibility before these actions are performed.
+// Declining to overwrite aborts the upload with config.ErrNotConfirmed,
+// declining to publish creates the image with private visibility.
+// By default, all actions are performed without confirmation.
+func WithConfirm(confirm config.ConfirmFunc) Option {
+	return func(u *Uploader) {
+		u.confirm = confirm
+	}
+}
+
+func NewUploader(config config.Config, opts ...Option) (*Uploader, error) {
+	u := &Uploader{
 		config: config,
-		image: func(ctx context.Context) (*gophercloud.ServiceClient, error) {
-			imageClient, err := clientconfig.NewServiceClient("image", clientOpts)
-			if err != nil {
-				return nil, err
-			}
-			imageClient.Microversion = microversion
-			return imageClient, nil
-		},
-		log: log,
-	}, nil
-}
-
-func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, _ int64) (refs []string, retErr error) {
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts:   provider.NewOptions(),
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	clientOpts := &clientconfig.ClientOpts{
+		Cloud:      config.OpenStack.Cloud,
+		HTTPClient: u.httpClient,
+	}
+	u.image = func(ctx context.Context) (imagesAPI, error) {
+		imageClient, err := clientconfig.NewServiceClient("image", clientOpts)
+		if err != nil {
+			return nil, err
+		}
+		imageClient.Microversion = microversion
+		// Requests of the client are canceled with the context.
+		imageClient.Context = ctx
+		return imagesClient{imageClient}, nil
+	}
+	if u.opts.Mock != nil {
+		u.useMock(u.opts.Mock)
+	}
+	return u, nil
+}
+
+func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, size int64) (refs []string, retErr error) {
+	u.steps = provider.NewStepTimer(string(config.ProviderOpenStack), u.opts, u.log)
+	// Images are streamed to Glance, so the size is only needed for metrics. An unknown size isn't recorded.
+	size, _ = provider.ImageSize(image, size)
+	defer func() { provider.RecordUpload(u.opts.Metrics, string(config.ProviderOpenStack), size, retErr) }()
+	image, err := provider.EnforceSize(image, size)
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	// Glance accepts raw and QCOW2 images, QCOW2 images are uploaded as they are.
+	disk, err := provider.InspectImage(image, size)
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := checkMinDisk(u.config.OpenStack.MinDiskGB, disk.VirtualSize); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	u.expiresAt, err = u.config.ExpiresAt(u.opts.Clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
 	if err := u.ensureImageDeleted(ctx); err != nil {
 		return nil, fmt.Errorf("pre-cleaning: ensuring no image using the same name exists: %w", err)
 	}
-	imageID, err := u.createImage(ctx, image)
+	stepDone := u.steps.Start("upload")
+	imageID, err := u.createImage(ctx, image, disk.Format)
 	if err != nil {
 		return nil, fmt.Errorf("creating image: %w", err)
 	}
+	stepDone()
 	return []string{imageID}, nil
 }
 
-func (u *Uploader) createImage(ctx context.Context, image io.ReadSeeker) (string, error) {
+// StepDurations returns how long each step of the last upload took, keyed by step name.
+func (u *Uploader) StepDurations() map[string]time.Duration {
+	return u.steps.Durations()
+}
+
+// visibility returns the visibility of the new image, which defaults to public.
+// Public and community images are published, which needs to be confirmed. Declining to publish keeps the image private.
+func (u *Uploader) visibility() (images.ImageVisibility, error) {
 	visibility := images.ImageVisibility(u.config.OpenStack.Visibility)
 	if visibility == images.ImageVisibility("") {
 		visibility = images.ImageVisibilityPublic
 	}
+	if visibility != images.ImageVisibilityPublic && visibility != images.ImageVisibilityCommunity {
+		return visibility, nil
+	}
+	ok, err := u.confirm.ConfirmPublish(u.config)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		u.log.Warn("Publishing was declined, the image stays private", "image", u.config.OpenStack.ImageName)
+		return images.ImageVisibilityPrivate, nil
+	}
+	return visibility, nil
+}
+
+func (u *Uploader) createImage(ctx context.Context, image io.ReadSeeker, diskFormat string) (string, error) {
+	visibility, err := u.visibility()
+	if err != nil {
+		return "", err
+	}
 	protected := u.config.OpenStack.Protected.UnwrapOr(false)
 	hidden := u.config.OpenStack.Hidden.UnwrapOr(false)
 	createOpts := images.CreateOpts{
 		Name:            u.config.OpenStack.ImageName,
 		ContainerFormat: "bare",
-		DiskFormat:      "raw",
+		DiskFormat:      diskFormat,
 		Visibility:      &visibility,
 		Hidden:          &hidden,
 		Tags:            u.config.OpenStack.Tags,
@@ -79,50 +185,144 @@ func (u *Uploader) createImage(ctx context.Context, image io.ReadSeeker) (string
 		MinRAM:          u.config.OpenStack.MinRamMB,
 		Properties:      u.config.OpenStack.Properties,
 	}
+	if !u.expiresAt.IsZero() {
+		// The properties are shared with the config, so they are copied before adding the expiry.
+		createOpts.Properties = maps.Clone(u.config.OpenStack.Properties)
+		if createOpts.Properties == nil {
+			createOpts.Properties = make(map[string]string)
+		}
+		createOpts.Properties[config.ExpiryTag] = u.expiresAt.Format(time.RFC3339)
+	}
 
 	imageClient, err := u.image(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	u.log.Printf("Creating image %q", u.config.OpenStack.ImageName)
+	u.log.Info("Creating image", "image", u.config.OpenStack.ImageName, "diskFormat", diskFormat)
 
-	newImage, err := images.Create(imageClient, createOpts).Extract()
+	newImage, err := imageClient.Create(createOpts)
 	if err != nil {
 		return "", fmt.Errorf("creating image: %w", err)
 	}
 
-	if err := imagedata.Upload(imageClient, newImage.ID, image).ExtractErr(); err != nil {
+	if err := imageClient.Upload(newImage.ID, image); err != nil {
 		return "", fmt.Errorf("uploading image data: %w", err)
 	}
 
 	return newImage.ID, nil
 }
 
+// Preflight authenticates to the cloud and looks up the image by name,
+// which verifies that the credentials are valid and the image service of the project is accessible.
+func (u *Uploader) Preflight(ctx context.Context) error {
+	imageClient, err := u.image(ctx)
+	if err != nil {
+		return preflightError(fmt.Errorf("authenticating to cloud %s, check its entry in clouds.yaml or the OS_* environment variables: %w",
+			u.config.OpenStack.Cloud, err))
+	}
+	if _, err := u.findImage(imageClient); err != nil {
+		return preflightError(err)
+	}
+	return nil
+}
+
+// preflightError marks errors caused by invalid credentials or missing permissions
+// with provider.ErrPermissionDenied and adds a hint on how to fix them.
+func preflightError(err error) error {
+	var unauthorized gophercloud.ErrDefault401
+	var forbidden gophercloud.ErrDefault403
+	switch {
+	case errors.As(err, &unauthorized):
+		return fmt.Errorf("%w: credentials are invalid or expired: %w", provider.ErrPermissionDenied, err)
+	case errors.As(err, &forbidden):
+		return fmt.Errorf("%w: the user needs a role with access to the image service of the project: %w", provider.ErrPermissionDenied, err)
+	}
+	return err
+}
+
 func (u *Uploader) ensureImageDeleted(ctx context.Context) error {
 	imageClient, err := u.image(ctx)
 	if err != nil {
 		return err
 	}
 
+	img, err := u.findImage(imageClient)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return nil
+	}
+	if err := u.confirm.ConfirmOverwrite(u.config, u.config.OpenStack.ImageName); err != nil {
+		return err
+	}
+	u.log.Info("Deleting existing image", "image", u.config.OpenStack.ImageName, "id", img.ID)
+	return imageClient.Delete(img.ID)
+}
+
+// Download returns the raw image named by the config,
+// which can be passed to the uploader of another provider to mirror an image.
+// The image is spooled to a temporary file, which the returned cleanup function removes.
+func (u *Uploader) Download(ctx context.Context) (provider.Request, func() error, error) {
+	imageClient, err := u.image(ctx)
+	if err != nil {
+		return provider.Request{}, nil, err
+	}
+	img, err := u.findImage(imageClient)
+	if err != nil {
+		return provider.Request{}, nil, err
+	}
+	if img == nil {
+		return provider.Request{}, nil, fmt.Errorf("image %q not found", u.config.OpenStack.ImageName)
+	}
+	if img.DiskFormat != "raw" {
+		return provider.Request{}, nil, fmt.Errorf("image %q has disk format %q, only raw images can be downloaded", u.config.OpenStack.ImageName, img.DiskFormat)
+	}
+
+	u.log.Info("Downloading image", "image", u.config.OpenStack.ImageName, "id", img.ID)
+	data, err := imageClient.Download(img.ID)
+	if err != nil {
+		return provider.Request{}, nil, fmt.Errorf("downloading image data: %w", err)
+	}
+	defer data.Close()
+	req, cleanup, err := provider.NewStreamRequest(data)
+	if err != nil {
+		return provider.Request{}, nil, fmt.Errorf("downloading image data: %w", err)
+	}
+	return req, cleanup, nil
+}
+
+// findImage returns the image named by the config or nil if it doesn't exist.
+func (u *Uploader) findImage(imageClient imagesAPI) (*images.Image, error) {
 	listOpts := images.ListOpts{
 		Name:  u.config.OpenStack.ImageName,
 		Limit: 1,
 	}
-	page, err := images.List(imageClient, listOpts).AllPages()
+	imgs, err := imageClient.List(listOpts)
 	if err != nil {
-		return fmt.Errorf("listing images: %w", err)
-	}
-	imgs, err := images.ExtractImages(page)
-	if err != nil {
-		return fmt.Errorf("extracting images: %w", err)
+		return nil, fmt.Errorf("listing images: %w", err)
 	}
 	if len(imgs) == 0 {
-		return nil
+		return nil, nil
 	}
 	if len(imgs) != 1 {
-		return errors.New("multiple images with the same name found")
+		return nil, errors.New("multiple images with the same name found")
+	}
+	return &imgs[0], nil
+}
+
+// checkMinDisk returns an error if the configured minimum disk size is smaller
+// than the virtual size of the image rounded up to full GiB.
+// A minimum disk size of 0 or an unknown virtual size are not checked.
+func checkMinDisk(minDiskGB int, virtualSize int64) error {
+	if minDiskGB == 0 || virtualSize <= 0 {
+		return nil
+	}
+	const gib = 1 << 30
+	virtualSizeGB := (virtualSize + gib - 1) / gib
+	if int64(minDiskGB) < virtualSizeGB {
+		return fmt.Errorf("minDiskGB %d is smaller than the virtual size of the image of %d GB", minDiskGB, virtualSizeGB)
 	}
-	u.log.Printf("Deleting existing image %q (%s)", u.config.OpenStack.ImageName, imgs[0].ID)
-	return images.Delete(imageClient, imgs[0].ID).ExtractErr()
+	return nil
 }
@@ -0,0 +1,184 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package openstack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload(t *testing.T) {
+	data := bytes.Repeat([]byte("uplosi"), 1000)
+
+	testCases := map[string]struct {
+		images   []map[string]string
+		cancel   bool
+		wantData []byte
+		wantErr  bool
+	}{
+		"raw image": {
+			images:   []map[string]string{{"id": "image-id", "name": "my-image", "disk_format": "raw"}},
+			wantData: data,
+		},
+		"image not found": {
+			images:  []map[string]string{},
+			wantErr: true,
+		},
+		"qcow2 image": {
+			images:  []map[string]string{{"id": "image-id", "name": "my-image", "disk_format": "qcow2"}},
+			wantErr: true,
+		},
+		"canceled context": {
+			images:  []map[string]string{{"id": "image-id", "name": "my-image", "disk_format": "raw"}},
+			cancel:  true,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /v2/images", func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal("my-image", r.URL.Query().Get("name"))
+				w.Header().Set("Content-Type", "application/json")
+				assert.NoError(json.NewEncoder(w).Encode(map[string]any{"images": tc.images}))
+			})
+			mux.HandleFunc("GET /v2/images/image-id/file", func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				_, _ = w.Write(data)
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				cancel()
+			}
+			u := &Uploader{
+				config: config.Config{OpenStack: config.OpenStackConfig{ImageName: "my-image"}},
+				log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+				image: func(ctx context.Context) (imagesAPI, error) {
+					return imagesClient{&gophercloud.ServiceClient{
+						ProviderClient: &gophercloud.ProviderClient{HTTPClient: *server.Client(), Context: ctx},
+						Endpoint:       server.URL + "/v2/",
+					}}, nil
+				},
+			}
+
+			req, cleanup, err := u.Download(ctx)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			defer func() { assert.NoError(cleanup()) }()
+			assert.Equal(int64(len(tc.wantData)), req.Size)
+			got, err := io.ReadAll(req.Image)
+			assert.NoError(err)
+			assert.Equal(tc.wantData, got)
+		})
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	testCases := map[string]struct {
+		visibility     string
+		confirm        config.ConfirmFunc
+		wantVisibility images.ImageVisibility
+	}{
+		"default is public": {
+			wantVisibility: images.ImageVisibilityPublic,
+		},
+		"private": {
+			visibility:     "private",
+			confirm:        func(string, config.Config) (bool, error) { return false, nil },
+			wantVisibility: images.ImageVisibilityPrivate,
+		},
+		"public confirmed": {
+			visibility:     "public",
+			confirm:        func(string, config.Config) (bool, error) { return true, nil },
+			wantVisibility: images.ImageVisibilityPublic,
+		},
+		"public declined": {
+			visibility:     "public",
+			confirm:        func(string, config.Config) (bool, error) { return false, nil },
+			wantVisibility: images.ImageVisibilityPrivate,
+		},
+		"community declined": {
+			visibility:     "community",
+			confirm:        func(string, config.Config) (bool, error) { return false, nil },
+			wantVisibility: images.ImageVisibilityPrivate,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			u := &Uploader{
+				config:  config.Config{OpenStack: config.OpenStackConfig{Visibility: tc.visibility}},
+				confirm: tc.confirm,
+				log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			visibility, err := u.visibility()
+			assert.NoError(err)
+			assert.Equal(tc.wantVisibility, visibility)
+		})
+	}
+}
+
+func TestUploadMock(t *testing.T) {
+	assert := assert.New(t)
+	conf := config.Config{
+		Provider:     "openstack",
+		Name:         "my-image",
+		ImageVersion: "1.0.0",
+		OpenStack: config.OpenStackConfig{
+			Cloud:      "my-cloud",
+			Visibility: "private",
+		},
+	}
+	assert.NoError(conf.SetDefaults())
+	assert.NoError(conf.Render(func(string) ([]byte, error) { return nil, nil }))
+	rec := &provider.Recorder{}
+	u, err := NewUploader(conf, WithProviderOptions(provider.WithMock(rec)))
+	assert.NoError(err)
+	assert.True(u.Mocked())
+	assert.NoError(u.Preflight(context.Background()))
+
+	image := bytes.Repeat([]byte{0xaa}, 4096)
+	refs, err := u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+	assert.NoError(err)
+	assert.Len(refs, 1)
+	// Uploading again replaces the existing image.
+	newRefs, err := u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+	assert.NoError(err)
+	assert.NotEqual(refs, newRefs)
+
+	var ops []string
+	for _, call := range rec.Calls() {
+		ops = append(ops, call.Operation)
+	}
+	assert.Equal([]string{
+		"images.List",
+		"images.List", "images.Create", "imagedata.Upload",
+		"images.List", "images.Delete", "images.Create", "imagedata.Upload",
+	}, ops)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Names of the checksum algorithms supported by Checksummer.
+const (
+	// ChecksumCRC32C is the CRC-32 with the Castagnoli polynomial, as used by S3 and Cloud Storage.
+	ChecksumCRC32C = "crc32c"
+	// ChecksumMD5 is the MD5 digest, as used by Cloud Storage and Azure Storage.
+	ChecksumMD5 = "md5"
+	// ChecksumSHA256 is the SHA-256 digest.
+	ChecksumSHA256 = "sha256"
+)
+
+// ChecksumReporter is implemented by uploaders that compute checksums of the data they upload.
+type ChecksumReporter interface {
+	// Checksums returns the hex encoded checksums of the data uploaded by the last upload, keyed by algorithm.
+	// The data is the blob sent to the provider, which may differ from the image, e.g. if it was compressed.
+	Checksums() map[string]string
+}
+
+// Checksummer computes several checksums of a stream in a single pass.
+// Data is written to it, e.g. with io.TeeReader or io.MultiWriter, while it is uploaded.
+type Checksummer struct {
+	hashes map[string]hash.Hash
+	w      io.Writer
+}
+
+// NewChecksummer returns a Checksummer computing the given algorithms.
+// It panics if an algorithm is unknown.
+func NewChecksummer(algorithms ...string) *Checksummer {
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		if _, ok := hashes[algorithm]; ok {
+			continue
+		}
+		var h hash.Hash
+		switch algorithm {
+		case ChecksumCRC32C:
+			h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		case ChecksumMD5:
+			h = md5.New()
+		case ChecksumSHA256:
+			h = sha256.New()
+		default:
+			panic("provider: unknown checksum algorithm " + algorithm)
+		}
+		hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+	return &Checksummer{hashes: hashes, w: io.MultiWriter(writers...)}
+}
+
+// Write adds p to all checksums. It never returns an error.
+func (c *Checksummer) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Sum returns the checksum of the data written so far, or nil if the algorithm isn't computed.
+func (c *Checksummer) Sum(algorithm string) []byte {
+	h, ok := c.hashes[algorithm]
+	if !ok {
+		return nil
+	}
+	return h.Sum(nil)
+}
+
+// Sums returns the hex encoded checksums of the data written so far, keyed by algorithm.
+func (c *Checksummer) Sums() map[string]string {
+	sums := make(map[string]string, len(c.hashes))
+	for algorithm, h := range c.hashes {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
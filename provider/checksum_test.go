@@ -0,0 +1,38 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksummer(t *testing.T) {
+	assert := assert.New(t)
+	sums := NewChecksummer(ChecksumCRC32C, ChecksumMD5, ChecksumSHA256, ChecksumMD5)
+
+	// Data is hashed while it is read.
+	n, err := io.Copy(io.Discard, io.TeeReader(strings.NewReader("hello world"), sums))
+	assert.NoError(err)
+	assert.EqualValues(11, n)
+
+	assert.Equal(map[string]string{
+		ChecksumCRC32C: "c99465aa",
+		ChecksumMD5:    "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		ChecksumSHA256: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+	}, sums.Sums())
+	assert.Equal([]byte{0xc9, 0x94, 0x65, 0xaa}, sums.Sum(ChecksumCRC32C))
+
+	only := NewChecksummer(ChecksumMD5)
+	assert.Nil(only.Sum(ChecksumCRC32C))
+	assert.Len(only.Sums(), 1)
+
+	assert.Panics(func() { NewChecksummer("crc64") })
+}
@@ -0,0 +1,48 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"context"
+	"time"
+)
+
+// Clock provides the time to uploaders, e.g. for timestamps, polling and timeouts.
+// Tests can use a fake clock to make time-based behavior deterministic.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Since returns the time elapsed since t.
+	Since(t time.Time) time.Duration
+	// Sleep waits for the duration d. It returns the context's error if the context is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// RealClock is the Clock of the system, used by uploaders by default.
+type RealClock struct{}
+
+// Now returns the current time.
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// Since returns the time elapsed since t.
+func (RealClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// Sleep waits for the duration d. It returns the context's error if the context is done first.
+func (RealClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
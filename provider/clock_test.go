@@ -0,0 +1,27 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealClockSleep(t *testing.T) {
+	assert := assert.New(t)
+	clock := RealClock{}
+	start := clock.Now()
+	assert.NoError(clock.Sleep(context.Background(), time.Millisecond))
+	assert.GreaterOrEqual(clock.Since(start), time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(clock.Sleep(ctx, time.Hour), context.Canceled)
+}
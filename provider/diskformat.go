@@ -0,0 +1,83 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Disk formats detected by InspectImage.
+const (
+	DiskFormatRaw   = "raw"
+	DiskFormatQCOW2 = "qcow2"
+)
+
+// QCOW2Magic is the magic number at the start of QCOW2 images ("QFI\xfb").
+const QCOW2Magic = 0x514649fb
+
+// ErrUnsupportedFormat is returned by uploaders if the image is in a disk format they can't upload.
+var ErrUnsupportedFormat = errors.New("unsupported disk format")
+
+// DiskInfo describes the disk stored in an image file.
+type DiskInfo struct {
+	// Format is the disk format of the image, DiskFormatRaw or DiskFormatQCOW2.
+	Format string
+	// Size is the number of bytes to upload, or 0 if it is unknown.
+	Size int64
+	// VirtualSize is the capacity of the disk, which import APIs declare as disk size.
+	// It equals Size for raw images, but may be larger for images in other formats, e.g. sparse QCOW2 images.
+	VirtualSize int64
+}
+
+// InspectImage detects the disk format of the image from its header, and the virtual size of the disk.
+// size is the number of bytes to upload, as passed to Uploader.Upload; a size of 0 (or less) means it is unknown.
+// The image is rewound to its current position afterwards.
+// Images without a known header are treated as raw. It fails if the virtual size is smaller than the size.
+func InspectImage(image io.ReadSeeker, size int64) (DiskInfo, error) {
+	info := DiskInfo{Format: DiskFormatRaw, Size: max(size, 0), VirtualSize: max(size, 0)}
+	pos, err := image.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return DiskInfo{}, fmt.Errorf("reading image header: %w", err)
+	}
+	// The QCOW2 header starts with the magic, version, backing file offset and size, and cluster bits,
+	// followed by the virtual size at offset 24.
+	header := make([]byte, 32)
+	n, err := io.ReadFull(image, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return DiskInfo{}, fmt.Errorf("reading image header: %w", err)
+	}
+	if _, err := image.Seek(pos, io.SeekStart); err != nil {
+		return DiskInfo{}, fmt.Errorf("rewinding image: %w", err)
+	}
+	if n < len(header) || binary.BigEndian.Uint32(header[0:4]) != QCOW2Magic {
+		return info, nil
+	}
+
+	info.Format = DiskFormatQCOW2
+	info.VirtualSize = int64(binary.BigEndian.Uint64(header[24:32]))
+	if info.VirtualSize < info.Size {
+		return DiskInfo{}, fmt.Errorf("virtual size %d of %s image is smaller than its size %d", info.VirtualSize, info.Format, info.Size)
+	}
+	return info, nil
+}
+
+// RequireRaw returns ErrUnsupportedFormat if the image isn't a raw image.
+// It is used by uploaders that convert the raw image themselves, or whose import API only accepts raw images.
+// The image is rewound to its current position afterwards.
+func RequireRaw(image io.ReadSeeker) error {
+	info, err := InspectImage(image, 0)
+	if err != nil {
+		return err
+	}
+	if info.Format != DiskFormatRaw {
+		return fmt.Errorf("%w: image is %s, convert it to a raw image first", ErrUnsupportedFormat, info.Format)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectImage(t *testing.T) {
+	qcow2 := func(virtualSize uint64, length int) []byte {
+		data := make([]byte, length)
+		binary.BigEndian.PutUint32(data[0:4], QCOW2Magic)
+		binary.BigEndian.PutUint32(data[4:8], 3)
+		binary.BigEndian.PutUint64(data[24:32], virtualSize)
+		return data
+	}
+
+	testCases := map[string]struct {
+		data    []byte
+		size    int64
+		want    DiskInfo
+		wantErr bool
+	}{
+		"raw image": {
+			data: bytes.Repeat([]byte{0xaa}, 4096),
+			size: 4096,
+			want: DiskInfo{Format: DiskFormatRaw, Size: 4096, VirtualSize: 4096},
+		},
+		"short raw image": {
+			data: []byte{1, 2, 3},
+			size: 3,
+			want: DiskInfo{Format: DiskFormatRaw, Size: 3, VirtualSize: 3},
+		},
+		"qcow2 image": {
+			data: qcow2(1<<30, 512),
+			size: 512,
+			want: DiskInfo{Format: DiskFormatQCOW2, Size: 512, VirtualSize: 1 << 30},
+		},
+		"qcow2 image with unknown size": {
+			data: qcow2(1<<30, 512),
+			want: DiskInfo{Format: DiskFormatQCOW2, VirtualSize: 1 << 30},
+		},
+		"qcow2 virtual size smaller than size": {
+			data:    qcow2(256, 512),
+			size:    512,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			image := bytes.NewReader(tc.data)
+			info, err := InspectImage(image, tc.size)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, info)
+			// The image is rewound.
+			pos, err := image.Seek(0, io.SeekCurrent)
+			assert.NoError(err)
+			assert.Zero(pos)
+		})
+	}
+}
+
+func TestRequireRaw(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(RequireRaw(bytes.NewReader(make([]byte, 1024))))
+
+	qcow2 := make([]byte, 1024)
+	binary.BigEndian.PutUint32(qcow2, QCOW2Magic)
+	assert.ErrorIs(RequireRaw(bytes.NewReader(qcow2)), ErrUnsupportedFormat)
+}
@@ -0,0 +1,41 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import "time"
+
+// Metrics receives operational metrics of the uploaders, e.g. to export them to Prometheus.
+// Callers adapt it to their metrics library. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// IncUpload counts a finished upload or import of an image.
+	IncUpload(provider string, success bool)
+	// ObserveUploadBytes records the size of a successfully uploaded image.
+	ObserveUploadBytes(provider string, bytes int64)
+	// ObserveDuration records how long a step of an upload took, with the step names of Uploader.StepDurations.
+	ObserveDuration(provider, step string, d time.Duration)
+}
+
+// NopMetrics discards all metrics. It is used by uploaders that weren't given metrics.
+type NopMetrics struct{}
+
+// IncUpload does nothing.
+func (NopMetrics) IncUpload(string, bool) {}
+
+// ObserveUploadBytes does nothing.
+func (NopMetrics) ObserveUploadBytes(string, int64) {}
+
+// ObserveDuration does nothing.
+func (NopMetrics) ObserveDuration(string, string, time.Duration) {}
+
+// RecordUpload reports a finished upload of size bytes with the result err to the metrics.
+// Bytes are only recorded for successful uploads of a known size, so imported images pass a size of 0.
+func RecordUpload(m Metrics, provider string, size int64, err error) {
+	m.IncUpload(provider, err == nil)
+	if err == nil && size > 0 {
+		m.ObserveUploadBytes(provider, size)
+	}
+}
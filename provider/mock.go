@@ -0,0 +1,57 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"slices"
+	"sync"
+)
+
+// Call is a call of a cloud API made by an uploader in mock mode.
+type Call struct {
+	// Provider is the name of the provider that made the call.
+	Provider string
+	// Operation is the API operation, prefixed with the API, e.g. "ec2.RegisterImage".
+	Operation string
+	// Input is the request of the call as passed to the fake client.
+	Input any
+}
+
+// Recorder records the calls of uploaders in mock mode. It is safe for concurrent use.
+type Recorder struct {
+	mux   sync.Mutex
+	calls []Call
+}
+
+// Record appends a call to the recorded calls.
+func (r *Recorder) Record(provider, operation string, input any) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.calls = append(r.calls, Call{Provider: provider, Operation: operation, Input: input})
+}
+
+// Calls returns the recorded calls in the order they were made.
+func (r *Recorder) Calls() []Call {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return slices.Clone(r.calls)
+}
+
+// Mocker is implemented by uploaders that support mock mode.
+type Mocker interface {
+	// Mocked reports whether the uploader uses fake API clients instead of the cloud APIs.
+	Mocked() bool
+}
+
+// WithMock makes the built-in uploaders use in-memory fakes of the cloud APIs, which record their calls in rec.
+// Uploads run through the same code as real uploads, but nothing is created in the cloud and no credentials are needed.
+// New fails for providers that don't support mock mode, so custom providers never upload in mock mode by accident.
+func WithMock(rec *Recorder) Option {
+	return func(o *Options) {
+		o.Mock = rec
+	}
+}
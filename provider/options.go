@@ -0,0 +1,59 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+// Options are the options shared by all built-in uploaders.
+// They are passed to the uploaders by New, or by the WithProviderOptions option of a provider's NewUploader.
+type Options struct {
+	// Metrics receives the operational metrics of uploads.
+	Metrics Metrics
+	// Clock is used for timestamps, polling and timeouts.
+	Clock Clock
+	// Mock records the calls of the fake API clients used in mock mode.
+	// If nil, the cloud APIs are used.
+	Mock *Recorder
+}
+
+// Option sets one of the Options.
+type Option func(*Options)
+
+// WithMetrics sets the metrics that uploads, uploaded bytes and step durations are reported to.
+// By default, metrics are discarded.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *Options) {
+		if metrics != nil {
+			o.Metrics = metrics
+		}
+	}
+}
+
+// WithClock sets the clock used for timestamps, polling and timeouts, e.g. a fake clock in tests.
+// By default, the system clock is used.
+func WithClock(clock Clock) Option {
+	return func(o *Options) {
+		if clock != nil {
+			o.Clock = clock
+		}
+	}
+}
+
+// NewOptions returns the default options, modified by opts.
+func NewOptions(opts ...Option) Options {
+	o := Options{
+		Metrics: NopMetrics{},
+		Clock:   RealClock{},
+	}
+	o.Apply(opts...)
+	return o
+}
+
+// Apply modifies the options with opts.
+func (o *Options) Apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	defaults := NewOptions()
+	assert.Equal(NopMetrics{}, defaults.Metrics)
+	assert.Equal(RealClock{}, defaults.Clock)
+
+	metrics := &countingMetrics{}
+	clock := &stubClock{}
+	opts := NewOptions(WithMetrics(metrics), WithClock(clock))
+	assert.Same(metrics, opts.Metrics)
+	assert.Same(clock, opts.Clock)
+
+	// Unset options keep their default.
+	opts = NewOptions(WithMetrics(nil), WithClock(nil))
+	assert.Equal(NopMetrics{}, opts.Metrics)
+	assert.Equal(RealClock{}, opts.Clock)
+}
+
+// countingMetrics counts the observed durations.
+type countingMetrics struct {
+	NopMetrics
+	durations int
+}
+
+func (m *countingMetrics) ObserveDuration(string, string, time.Duration) {
+	m.durations++
+}
+
+// stubClock is a Clock distinguishable from RealClock.
+type stubClock struct {
+	RealClock
+}
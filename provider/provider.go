@@ -0,0 +1,215 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package provider implements a registry of image upload providers.
+//
+// The built-in providers register themselves when their package is imported.
+// Additional providers can be plugged in by calling Register, usually from an init function.
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/edgelesssys/uplosi/config"
+)
+
+// Prepper converts an image into the format expected by a provider.
+type Prepper interface {
+	Prepare(ctx context.Context, imagePath, tmpDir string) (string, error)
+}
+
+// ErrUnknownSize is returned if the size of an image is neither given nor can be determined.
+var ErrUnknownSize = errors.New("image size unknown")
+
+// Uploader uploads a prepared image to a provider.
+type Uploader interface {
+	// Upload uploads the image. Callers that don't know the size of the image pass a size of 0 (or less),
+	// providers that need it determine it with ImageSize.
+	Upload(ctx context.Context, image io.ReadSeeker, size int64) (refs []string, retErr error)
+	// StepDurations returns how long each step of the last upload took, keyed by step name.
+	StepDurations() map[string]time.Duration
+}
+
+// VersionLister is implemented by uploaders that can list the versions of existing images.
+// It is required to resolve the image version config.AutoVersion.
+type VersionLister interface {
+	ImageVersions(ctx context.Context) ([]string, error)
+}
+
+// URLImporter is implemented by uploaders that can import an image directly from a URL,
+// so the image doesn't need to be downloaded and uploaded again by uplosi.
+type URLImporter interface {
+	// CanImportURL reports whether the image at the URL can be imported directly.
+	CanImportURL(src *url.URL) bool
+	// ImportURL creates the image from the URL, like Upload does for local images.
+	// The image at the URL must already be in the format expected by the provider,
+	// as the Prepper of the provider isn't run on imported images.
+	ImportURL(ctx context.Context, src *url.URL) (refs []string, retErr error)
+}
+
+// ObjectWriter is implemented by uploaders that upload images through a bucket,
+// and can write other objects to it, e.g. the manifest of an upload.
+type ObjectWriter interface {
+	// WriteObject writes the data to the object with the given key in the bucket of the config.
+	// An existing object is overwritten.
+	WriteObject(ctx context.Context, key string, data []byte) error
+}
+
+// Preflighter is implemented by uploaders that can check credentials and permissions before an upload.
+type Preflighter interface {
+	// Preflight makes cheap authenticated calls to verify that the credentials are valid
+	// and the configured account, subscription or project is reachable, without creating anything.
+	// Missing credentials or permissions are reported as ErrPermissionDenied.
+	Preflight(ctx context.Context) error
+}
+
+// Downloader is implemented by uploaders that can download existing images,
+// e.g. to mirror an image to another provider.
+type Downloader interface {
+	// Download returns the raw image named by the config as a Request for the Uploader of another provider.
+	// The image is spooled to a temporary file, see NewStreamRequest.
+	// The returned cleanup function removes it and must be called once the upload finished.
+	Download(ctx context.Context) (Request, func() error, error)
+}
+
+// ErrPermissionDenied is returned by preflight checks if the credentials are missing or invalid,
+// or lack permissions needed for the upload.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// ImageSize returns the given size if it is known (greater than 0).
+// Otherwise the size of the remaining image is determined by seeking to its end,
+// and the image is rewound to its current position afterwards.
+func ImageSize(image io.Seeker, size int64) (int64, error) {
+	if size > 0 {
+		return size, nil
+	}
+	pos, err := image.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrUnknownSize, err)
+	}
+	end, err := image.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrUnknownSize, err)
+	}
+	if _, err := image.Seek(pos, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("rewinding image: %w", err)
+	}
+	if end-pos <= 0 {
+		return 0, fmt.Errorf("%w: image is empty", ErrUnknownSize)
+	}
+	return end - pos, nil
+}
+
+// CheckOSDiskSize returns an error if the configured OS disk size is smaller
+// than the image size rounded up to full GiB. A size of 0 keeps the image size.
+func CheckOSDiskSize(sizeGB int, imageSize int64) error {
+	if sizeGB == 0 {
+		return nil
+	}
+	const gib = 1 << 30
+	minSizeGB := (imageSize + gib - 1) / gib
+	if int64(sizeGB) < minSizeGB {
+		return fmt.Errorf("osDiskSizeGB %d is smaller than the image size of %d GB", sizeGB, minSizeGB)
+	}
+	return nil
+}
+
+// Factory creates the prepper and uploader for a rendered config.
+// The options are those passed to New, custom providers may ignore them.
+type Factory func(cfg config.Config, logger *slog.Logger, opts ...Option) (Prepper, Uploader, error)
+
+var (
+	factoriesMux sync.RWMutex
+	factories    = make(map[config.Provider]Factory)
+)
+
+// Register makes a provider available under the given name.
+// Names that aren't built-in providers are added to the providers accepted by config validation.
+// If Register is called twice with the same name or if factory is nil, it panics.
+func Register(name string, factory Factory) {
+	if factory == nil {
+		panic("provider: Register factory is nil")
+	}
+	provider := config.RegisterProvider(name)
+
+	factoriesMux.Lock()
+	defer factoriesMux.Unlock()
+	if _, ok := factories[provider]; ok {
+		panic("provider: Register called twice for provider " + string(provider))
+	}
+	factories[provider] = factory
+}
+
+// New creates the prepper and uploader for the provider selected by the config.
+// The options are passed to the factory of the provider.
+func New(cfg config.Config, logger *slog.Logger, opts ...Option) (Prepper, Uploader, error) {
+	provider, err := cfg.ResolveProvider()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	factoriesMux.RLock()
+	factory, ok := factories[provider]
+	factoriesMux.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q has no registered uploader", config.ErrUnknownProvider, cfg.Provider)
+	}
+
+	prepper, uploader, err := factory(cfg, logger, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating %s uploader: %w", provider, err)
+	}
+	if NewOptions(opts...).Mock != nil {
+		if mocker, ok := uploader.(Mocker); !ok || !mocker.Mocked() {
+			return nil, nil, fmt.Errorf("creating %s uploader: mock mode: %w", provider, errors.ErrUnsupported)
+		}
+	}
+	return prepper, uploader, nil
+}
+
+// Preflight creates the uploader for the config with the options and runs its preflight check.
+// Providers whose uploader doesn't implement Preflighter pass without checks.
+func Preflight(ctx context.Context, cfg config.Config, logger *slog.Logger, opts ...Option) error {
+	_, uploader, err := New(cfg, logger, opts...)
+	if err != nil {
+		return err
+	}
+	preflighter, ok := uploader.(Preflighter)
+	if !ok {
+		logger.Debug("Provider has no preflight check", "provider", cfg.Provider)
+		return nil
+	}
+	if err := preflighter.Preflight(ctx); err != nil {
+		return fmt.Errorf("preflight check for %s: %w", cfg.Provider, err)
+	}
+	return nil
+}
+
+// Download creates the uploader for the config and downloads the image named by it,
+// so it can be uploaded to another provider.
+// Providers whose uploader doesn't implement Downloader fail with errors.ErrUnsupported.
+func Download(ctx context.Context, cfg config.Config, logger *slog.Logger) (Request, func() error, error) {
+	_, uploader, err := New(cfg, logger)
+	if err != nil {
+		return Request{}, nil, err
+	}
+	downloader, ok := uploader.(Downloader)
+	if !ok {
+		return Request{}, nil, fmt.Errorf("downloading from %s: %w", cfg.Provider, errors.ErrUnsupported)
+	}
+	req, cleanup, err := downloader.Download(ctx)
+	if err != nil {
+		return Request{}, nil, fmt.Errorf("downloading from %s: %w", cfg.Provider, err)
+	}
+	return req, cleanup, nil
+}
@@ -0,0 +1,418 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	Register("stub-cloud", func(config.Config, *slog.Logger, ...Option) (Prepper, Uploader, error) {
+		return &stubPrepper{}, &stubUploader{}, nil
+	})
+	Register("failing-cloud", func(config.Config, *slog.Logger, ...Option) (Prepper, Uploader, error) {
+		return nil, nil, errors.New("failed")
+	})
+	config.RegisterProvider("unregistered-cloud")
+
+	testCases := map[string]struct {
+		provider    string
+		wantErr     bool
+		wantUnknown bool
+	}{
+		"registered provider": {
+			provider: "stub-cloud",
+		},
+		"case insensitive": {
+			provider: "Stub-Cloud",
+		},
+		"failing factory": {
+			provider: "failing-cloud",
+			wantErr:  true,
+		},
+		"unknown provider": {
+			provider:    "foo",
+			wantErr:     true,
+			wantUnknown: true,
+		},
+		"provider without factory": {
+			provider:    "unregistered-cloud",
+			wantErr:     true,
+			wantUnknown: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			prepper, uploader, err := New(config.Config{Provider: tc.provider}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if tc.wantErr {
+				assert.Error(err)
+				if tc.wantUnknown {
+					assert.ErrorIs(err, config.ErrUnknownProvider)
+				}
+				return
+			}
+			assert.NoError(err)
+			assert.IsType(&stubPrepper{}, prepper)
+			assert.IsType(&stubUploader{}, uploader)
+		})
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	assert := assert.New(t)
+	factory := func(config.Config, *slog.Logger, ...Option) (Prepper, Uploader, error) {
+		return &stubPrepper{}, &stubUploader{}, nil
+	}
+
+	Register("twice-cloud", factory)
+	assert.Panics(func() { Register("Twice-Cloud", factory) })
+	assert.Panics(func() { Register("nil-cloud", nil) })
+}
+
+func TestImageSize(t *testing.T) {
+	testCases := map[string]struct {
+		image   io.Seeker
+		offset  int64
+		size    int64
+		want    int64
+		wantErr bool
+	}{
+		"known size": {
+			image: strings.NewReader("image"),
+			size:  42,
+			want:  42,
+		},
+		"unknown size": {
+			image: strings.NewReader("image"),
+			want:  5,
+		},
+		"negative size": {
+			image: strings.NewReader("image"),
+			size:  -1,
+			want:  5,
+		},
+		"partially read image": {
+			image:  strings.NewReader("image"),
+			offset: 2,
+			want:   3,
+		},
+		"empty image": {
+			image:   strings.NewReader(""),
+			wantErr: true,
+		},
+		"not seekable": {
+			image:   failingSeeker{},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			if tc.offset > 0 {
+				_, err := tc.image.Seek(tc.offset, io.SeekStart)
+				assert.NoError(err)
+			}
+
+			size, err := ImageSize(tc.image, tc.size)
+			if tc.wantErr {
+				assert.ErrorIs(err, ErrUnknownSize)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, size)
+
+			// The image is read from the same position afterwards.
+			pos, err := tc.image.Seek(0, io.SeekCurrent)
+			assert.NoError(err)
+			assert.Equal(tc.offset, pos)
+		})
+	}
+}
+
+func TestCheckOSDiskSize(t *testing.T) {
+	const gib = 1 << 30
+	testCases := map[string]struct {
+		sizeGB    int
+		imageSize int64
+		wantErr   bool
+	}{
+		"unset": {
+			imageSize: 3 * gib,
+		},
+		"larger than image": {
+			sizeGB:    30,
+			imageSize: 2 * gib,
+		},
+		"equal to image": {
+			sizeGB:    2,
+			imageSize: 2 * gib,
+		},
+		"partial GiB is rounded up": {
+			sizeGB:    2,
+			imageSize: 2*gib + 1,
+			wantErr:   true,
+		},
+		"smaller than image": {
+			sizeGB:    1,
+			imageSize: 2 * gib,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			err := CheckOSDiskSize(tc.sizeGB, tc.imageSize)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestRecordUpload(t *testing.T) {
+	testCases := map[string]struct {
+		size        int64
+		err         error
+		wantUploads []string
+		wantBytes   []int64
+	}{
+		"successful upload": {
+			size:        1024,
+			wantUploads: []string{"stub-cloud:true"},
+			wantBytes:   []int64{1024},
+		},
+		"failed upload": {
+			size:        1024,
+			err:         errors.New("failed"),
+			wantUploads: []string{"stub-cloud:false"},
+		},
+		"import": {
+			wantUploads: []string{"stub-cloud:true"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			metrics := &recordingMetrics{}
+			RecordUpload(metrics, "stub-cloud", tc.size, tc.err)
+			assert.Equal(tc.wantUploads, metrics.uploads)
+			assert.Equal(tc.wantBytes, metrics.bytes)
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	Register("plain-cloud", func(config.Config, *slog.Logger, ...Option) (Prepper, Uploader, error) {
+		return &stubPrepper{}, &stubUploader{}, nil
+	})
+	Register("preflight-cloud", func(cfg config.Config, _ *slog.Logger, _ ...Option) (Prepper, Uploader, error) {
+		return &stubPrepper{}, &preflightUploader{err: cfg.Vars["preflightErr"]}, nil
+	})
+
+	testCases := map[string]struct {
+		cfg           config.Config
+		wantErr       bool
+		wantForbidden bool
+	}{
+		"without preflight check": {
+			cfg: config.Config{Provider: "plain-cloud"},
+		},
+		"preflight check passes": {
+			cfg: config.Config{Provider: "preflight-cloud"},
+		},
+		"permission denied": {
+			cfg:           config.Config{Provider: "preflight-cloud", Vars: map[string]string{"preflightErr": "forbidden"}},
+			wantErr:       true,
+			wantForbidden: true,
+		},
+		"unknown provider": {
+			cfg:     config.Config{Provider: "foo"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			err := Preflight(context.Background(), tc.cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if tc.wantErr {
+				assert.Error(err)
+				if tc.wantForbidden {
+					assert.ErrorIs(err, ErrPermissionDenied)
+					assert.ErrorContains(err, "preflight-cloud")
+				}
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestNewMock(t *testing.T) {
+	Register("mock-cloud", func(_ config.Config, _ *slog.Logger, opts ...Option) (Prepper, Uploader, error) {
+		return &stubPrepper{}, &mockUploader{mocked: NewOptions(opts...).Mock != nil}, nil
+	})
+	Register("unmocked-cloud", func(config.Config, *slog.Logger, ...Option) (Prepper, Uploader, error) {
+		return &stubPrepper{}, &stubUploader{}, nil
+	})
+
+	testCases := map[string]struct {
+		provider        string
+		wantUnsupported bool
+	}{
+		"provider with mock mode": {
+			provider: "mock-cloud",
+		},
+		"provider without mock mode": {
+			provider:        "unmocked-cloud",
+			wantUnsupported: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			_, _, err := New(config.Config{Provider: tc.provider}, slog.New(slog.NewTextHandler(io.Discard, nil)), WithMock(&Recorder{}))
+			if tc.wantUnsupported {
+				assert.ErrorIs(err, errors.ErrUnsupported)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestDownload(t *testing.T) {
+	Register("download-cloud", func(config.Config, *slog.Logger, ...Option) (Prepper, Uploader, error) {
+		return &stubPrepper{}, &downloadUploader{}, nil
+	})
+	Register("upload-only-cloud", func(config.Config, *slog.Logger, ...Option) (Prepper, Uploader, error) {
+		return &stubPrepper{}, &stubUploader{}, nil
+	})
+
+	testCases := map[string]struct {
+		cfg             config.Config
+		wantErr         bool
+		wantUnsupported bool
+	}{
+		"download": {
+			cfg: config.Config{Provider: "download-cloud"},
+		},
+		"without download": {
+			cfg:             config.Config{Provider: "upload-only-cloud"},
+			wantErr:         true,
+			wantUnsupported: true,
+		},
+		"unknown provider": {
+			cfg:     config.Config{Provider: "foo"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			req, cleanup, err := Download(context.Background(), tc.cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if tc.wantErr {
+				assert.Error(err)
+				if tc.wantUnsupported {
+					assert.ErrorIs(err, errors.ErrUnsupported)
+				}
+				return
+			}
+			assert.NoError(err)
+			defer func() { assert.NoError(cleanup()) }()
+			data, err := io.ReadAll(req.Image)
+			assert.NoError(err)
+			assert.Equal("image", string(data))
+			assert.Equal(int64(5), req.Size)
+		})
+	}
+}
+
+type recordingMetrics struct {
+	NopMetrics
+	uploads []string
+	bytes   []int64
+}
+
+func (m *recordingMetrics) IncUpload(provider string, success bool) {
+	m.uploads = append(m.uploads, fmt.Sprintf("%s:%t", provider, success))
+}
+
+func (m *recordingMetrics) ObserveUploadBytes(_ string, bytes int64) {
+	m.bytes = append(m.bytes, bytes)
+}
+
+type failingSeeker struct{}
+
+func (failingSeeker) Seek(int64, int) (int64, error) {
+	return 0, errors.New("illegal seek")
+}
+
+type stubPrepper struct{}
+
+func (p *stubPrepper) Prepare(_ context.Context, imagePath, _ string) (string, error) {
+	return imagePath, nil
+}
+
+type stubUploader struct{}
+
+func (u *stubUploader) Upload(context.Context, io.ReadSeeker, int64) ([]string, error) {
+	return nil, nil
+}
+
+func (u *stubUploader) StepDurations() map[string]time.Duration {
+	return nil
+}
+
+type preflightUploader struct {
+	stubUploader
+	err string
+}
+
+func (u *preflightUploader) Preflight(context.Context) error {
+	if u.err != "" {
+		return fmt.Errorf("%w: %s", ErrPermissionDenied, u.err)
+	}
+	return nil
+}
+
+type mockUploader struct {
+	stubUploader
+	mocked bool
+}
+
+func (u *mockUploader) Mocked() bool {
+	return u.mocked
+}
+
+type downloadUploader struct {
+	stubUploader
+}
+
+func (u *downloadUploader) Download(context.Context) (Request, func() error, error) {
+	return NewStreamRequest(strings.NewReader("image"))
+}
@@ -0,0 +1,75 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrSizeMismatch is returned if an image doesn't have the size declared for it, e.g. because the caller passed a stale size.
+var ErrSizeMismatch = errors.New("image size mismatch")
+
+// EnforceSize wraps the image, so reading it fails with ErrSizeMismatch if it yields fewer or more bytes
+// than the declared size, counted from its current position.
+// As a cheaper precheck, the remaining size of the image is determined by seeking to its end,
+// so stale sizes are reported before anything is uploaded. Images that can't seek are only checked while reading.
+// An unknown size (0 or less) isn't enforced and the image is returned unchanged.
+func EnforceSize(image io.ReadSeeker, size int64) (io.ReadSeeker, error) {
+	if size <= 0 {
+		return image, nil
+	}
+	start, err := image.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &sizeEnforcer{image: image, end: size, size: size}, nil
+	}
+	if end, err := image.Seek(0, io.SeekEnd); err == nil {
+		if _, err := image.Seek(start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("rewinding image: %w", err)
+		}
+		if end-start != size {
+			return nil, fmt.Errorf("%w: image has %d bytes, but its size is declared as %d bytes", ErrSizeMismatch, end-start, size)
+		}
+	}
+	return &sizeEnforcer{image: image, pos: start, end: start + size, size: size}, nil
+}
+
+// sizeEnforcer checks that the image ends exactly at the end of the declared size.
+type sizeEnforcer struct {
+	image io.ReadSeeker
+	// pos is the current position in the image.
+	pos int64
+	// end is the position the image must end at.
+	end int64
+	// size is the declared size of the image.
+	size int64
+}
+
+// Read reads from the image. Bytes beyond the declared size aren't returned.
+func (s *sizeEnforcer) Read(p []byte) (int, error) {
+	n, err := s.image.Read(p)
+	s.pos += int64(n)
+	if s.pos > s.end {
+		n -= int(min(s.pos-s.end, int64(n)))
+		return n, fmt.Errorf("%w: image has more than the declared %d bytes", ErrSizeMismatch, s.size)
+	}
+	if errors.Is(err, io.EOF) && s.pos < s.end {
+		return n, fmt.Errorf("%w: image ended %d bytes before its declared size of %d bytes", ErrSizeMismatch, s.end-s.pos, s.size)
+	}
+	return n, err
+}
+
+// Seek seeks in the image, like its Seek method.
+func (s *sizeEnforcer) Seek(offset int64, whence int) (int64, error) {
+	pos, err := s.image.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	s.pos = pos
+	return pos, nil
+}
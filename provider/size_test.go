@@ -0,0 +1,119 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforceSize(t *testing.T) {
+	testCases := map[string]struct {
+		image       io.ReadSeeker
+		offset      int64
+		size        int64
+		want        string
+		wantInitErr bool
+		wantReadErr bool
+	}{
+		"exact size": {
+			image: strings.NewReader("image"),
+			size:  5,
+			want:  "image",
+		},
+		"partially read image": {
+			image:  strings.NewReader("image"),
+			offset: 2,
+			size:   3,
+			want:   "age",
+		},
+		"unknown size": {
+			image: strings.NewReader("image"),
+			want:  "image",
+		},
+		"undersized image": {
+			image:       strings.NewReader("image"),
+			size:        6,
+			wantInitErr: true,
+		},
+		"oversized image": {
+			image:       strings.NewReader("image"),
+			size:        4,
+			wantInitErr: true,
+		},
+		"exact size without seeking": {
+			image: unseekableReader{strings.NewReader("image")},
+			size:  5,
+			want:  "image",
+		},
+		"undersized image without seeking": {
+			image:       unseekableReader{strings.NewReader("image")},
+			size:        6,
+			want:        "image",
+			wantReadErr: true,
+		},
+		"oversized image without seeking": {
+			image:       unseekableReader{strings.NewReader("image")},
+			size:        4,
+			want:        "imag",
+			wantReadErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			if tc.offset > 0 {
+				_, err := tc.image.Seek(tc.offset, io.SeekStart)
+				assert.NoError(err)
+			}
+
+			image, err := EnforceSize(tc.image, tc.size)
+			if tc.wantInitErr {
+				assert.ErrorIs(err, ErrSizeMismatch)
+				return
+			}
+			assert.NoError(err)
+			got, err := io.ReadAll(image)
+			if tc.wantReadErr {
+				assert.ErrorIs(err, ErrSizeMismatch)
+			} else {
+				assert.NoError(err)
+			}
+			assert.Equal(tc.want, string(got))
+		})
+	}
+}
+
+func TestEnforceSizeSeek(t *testing.T) {
+	assert := assert.New(t)
+	image, err := EnforceSize(strings.NewReader("image"), 5)
+	assert.NoError(err)
+
+	// Reading the header and rewinding doesn't count towards the size.
+	header := make([]byte, 2)
+	_, err = io.ReadFull(image, header)
+	assert.NoError(err)
+	_, err = image.Seek(0, io.SeekStart)
+	assert.NoError(err)
+	got, err := io.ReadAll(image)
+	assert.NoError(err)
+	assert.Equal("image", string(got))
+}
+
+// unseekableReader is an image that fails to seek, like a pipe.
+type unseekableReader struct {
+	io.Reader
+}
+
+func (unseekableReader) Seek(int64, int) (int64, error) {
+	return 0, errors.New("illegal seek")
+}
@@ -0,0 +1,56 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"log/slog"
+	"maps"
+	"time"
+)
+
+// StepTimer measures how long the steps of an upload take, as returned by Uploader.StepDurations.
+// Durations of repeated steps are summed up. Finished steps are logged and reported to the metrics of the options.
+// The zero value uses the system clock and neither logs nor reports steps.
+type StepTimer struct {
+	provider  string
+	opts      Options
+	log       *slog.Logger
+	durations map[string]time.Duration
+}
+
+// NewStepTimer returns a StepTimer for uploads of the provider, using the clock and metrics of the options.
+func NewStepTimer(provider string, opts Options, log *slog.Logger) StepTimer {
+	return StepTimer{provider: provider, opts: opts, log: log}
+}
+
+// Start starts timing the step. Calling the returned function records the duration.
+func (t *StepTimer) Start(step string) func() {
+	clock := t.opts.Clock
+	if clock == nil {
+		clock = RealClock{}
+	}
+	start := clock.Now()
+	return func() {
+		duration := clock.Since(start)
+		if t.durations == nil {
+			t.durations = make(map[string]time.Duration)
+		}
+		t.durations[step] += duration
+		if t.log != nil {
+			t.log.Debug("Step finished", "step", step, "duration", duration)
+		}
+		if t.opts.Metrics != nil {
+			t.opts.Metrics.ObserveDuration(t.provider, step, duration)
+		}
+	}
+}
+
+// Durations returns how long each step took, keyed by step name.
+// The returned map is a copy and can be modified by the caller.
+func (t *StepTimer) Durations() map[string]time.Duration {
+	return maps.Clone(t.durations)
+}
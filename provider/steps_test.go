@@ -0,0 +1,65 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepTimer(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeStepClock{now: time.Unix(0, 0)}
+	metrics := &stepMetrics{}
+	timer := NewStepTimer("test", NewOptions(WithClock(clock), WithMetrics(metrics)), nil)
+	assert.Empty(timer.Durations())
+
+	done := timer.Start("upload")
+	clock.now = clock.now.Add(2 * time.Second)
+	done()
+	done = timer.Start("upload")
+	clock.now = clock.now.Add(time.Second)
+	done()
+	timer.Start("publish")()
+
+	durations := timer.Durations()
+	assert.Equal(map[string]time.Duration{"upload": 3 * time.Second, "publish": 0}, durations)
+	assert.Equal([]string{"test/upload", "test/upload", "test/publish"}, metrics.steps)
+
+	// The returned map is a copy.
+	delete(durations, "upload")
+	assert.Len(timer.Durations(), 2)
+}
+
+func TestStepTimerZeroValue(t *testing.T) {
+	assert := assert.New(t)
+	var timer StepTimer
+	assert.NotPanics(func() { timer.Start("upload")() })
+	assert.Contains(timer.Durations(), "upload")
+}
+
+// fakeStepClock returns a fixed time, which the test advances.
+type fakeStepClock struct {
+	RealClock
+	now time.Time
+}
+
+func (c *fakeStepClock) Now() time.Time { return c.now }
+
+func (c *fakeStepClock) Since(t time.Time) time.Duration { return c.now.Sub(t) }
+
+// stepMetrics records the steps observed.
+type stepMetrics struct {
+	NopMetrics
+	steps []string
+}
+
+func (m *stepMetrics) ObserveDuration(provider, step string, _ time.Duration) {
+	m.steps = append(m.steps, provider+"/"+step)
+}
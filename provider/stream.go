@@ -0,0 +1,54 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Request is an image to upload, holding the arguments of Uploader.Upload.
+type Request struct {
+	// Image is the image, positioned at its start.
+	Image io.ReadSeekCloser
+	// Size is the number of bytes to upload.
+	Size int64
+}
+
+// NewStreamRequest returns a Request for an image read from r, e.g. from stdin.
+// Uploaders need to seek in the image and know its size, so non-seekable images are spooled
+// to a temporary file first. The image is copied in chunks, so it doesn't need to fit into memory.
+// Seekable images, e.g. files redirected to stdin, are used in place.
+//
+// The returned cleanup function closes and removes the temporary file. It must be called
+// once the upload finished. Images used in place are left to the caller to close.
+func NewStreamRequest(r io.Reader) (Request, func() error, error) {
+	if image, ok := r.(io.ReadSeekCloser); ok {
+		// Pipes implement io.Seeker as well, but fail when seeking.
+		if size, err := ImageSize(image, 0); err == nil {
+			return Request{Image: image, Size: size}, func() error { return nil }, nil
+		}
+	}
+
+	spool, err := os.CreateTemp("", "uplosi-stream-")
+	if err != nil {
+		return Request{}, nil, fmt.Errorf("creating temporary file: %w", err)
+	}
+	cleanup := func() error {
+		return errors.Join(spool.Close(), os.Remove(spool.Name()))
+	}
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return Request{}, nil, errors.Join(fmt.Errorf("spooling image: %w", err), cleanup())
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return Request{}, nil, errors.Join(fmt.Errorf("rewinding image: %w", err), cleanup())
+	}
+	return Request{Image: spool, Size: size}, cleanup, nil
+}
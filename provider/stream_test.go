@@ -0,0 +1,63 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package provider
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStreamRequest(t *testing.T) {
+	assert := assert.New(t)
+	data := bytes.Repeat([]byte("uplosi"), 100_000)
+
+	// Non-seekable streams are spooled to a temporary file.
+	req, cleanup, err := NewStreamRequest(io.MultiReader(bytes.NewReader(data)))
+	assert.NoError(err)
+	assert.Equal(int64(len(data)), req.Size)
+	got, err := io.ReadAll(req.Image)
+	assert.NoError(err)
+	assert.Equal(data, got)
+	spool, ok := req.Image.(*os.File)
+	assert.True(ok)
+	assert.NoError(cleanup())
+	_, err = os.Stat(spool.Name())
+	assert.ErrorIs(err, os.ErrNotExist)
+
+	// Seekable files are used in place.
+	path := filepath.Join(t.TempDir(), "image.raw")
+	assert.NoError(os.WriteFile(path, data, 0o644))
+	file, err := os.Open(path)
+	assert.NoError(err)
+	defer file.Close()
+	req, cleanup, err = NewStreamRequest(file)
+	assert.NoError(err)
+	assert.Same(file, req.Image)
+	assert.Equal(int64(len(data)), req.Size)
+	assert.NoError(cleanup())
+	_, err = os.Stat(path)
+	assert.NoError(err)
+
+	// Read errors are returned.
+	readErr := errors.New("broken pipe")
+	_, _, err = NewStreamRequest(io.MultiReader(bytes.NewReader(data), &failingReader{err: readErr}))
+	assert.ErrorIs(err, readErr)
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
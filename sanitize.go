@@ -0,0 +1,54 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import "regexp"
+
+const redacted = "[REDACTED]"
+
+// secretPatterns match sensitive parts of error messages returned by the cloud SDKs.
+// The first capture group is kept, the rest of the match is redacted.
+var secretPatterns = []*regexp.Regexp{
+	// Signatures and credentials in Azure SAS URLs and presigned S3 and GCS URLs.
+	regexp.MustCompile(`(?i)([?&](?:sig|signature|x-amz-signature|x-amz-credential|x-amz-security-token|x-goog-signature|x-goog-credential|access_token|token)=)[^&\s"'<>]+`),
+	// AWS access key IDs.
+	regexp.MustCompile(`()\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`),
+	// Bearer tokens in authorization headers.
+	regexp.MustCompile(`(?i)(bearer\s+)[a-z0-9\-._~+/]+=*`),
+}
+
+// sanitizedError redacts secrets from the message of the wrapped error.
+// The wrapped error is still available to errors.Is and errors.As.
+type sanitizedError struct {
+	err error
+	msg string
+}
+
+func (e *sanitizedError) Error() string {
+	return e.msg
+}
+
+func (e *sanitizedError) Unwrap() error {
+	return e.err
+}
+
+// sanitizeError redacts known secrets, like SAS tokens, presigned URL parameters and access keys,
+// from the error message. It should be applied to errors returned by providers before they are logged.
+func sanitizeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	sanitized := msg
+	for _, pattern := range secretPatterns {
+		sanitized = pattern.ReplaceAllString(sanitized, "${1}"+redacted)
+	}
+	if sanitized == msg {
+		return err
+	}
+	return &sanitizedError{err: err, msg: sanitized}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"context"
+
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type s3API interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options),
+	) (*s3.HeadBucketOutput, error)
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options),
+	) (*s3.CreateBucketOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options),
+	) (*s3.HeadObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options),
+	) (*s3.DeleteObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options),
+	) (*s3.PutObjectOutput, error)
+}
+
+type s3UploaderAPI interface {
+	Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3manager.Uploader),
+	) (*s3manager.UploadOutput, error)
+}
+
+type instanceAPI interface {
+	ListImages(ctx context.Context, name string) ([]instanceImage, error)
+	CreateImage(ctx context.Context, req createImageRequest) (instanceImage, error)
+	DeleteImage(ctx context.Context, id string) error
+	ListSnapshots(ctx context.Context, name string) ([]instanceSnapshot, error)
+	GetSnapshot(ctx context.Context, id string) (instanceSnapshot, error)
+	CreateSnapshot(ctx context.Context, req importSnapshotRequest) (instanceSnapshot, error)
+	DeleteSnapshot(ctx context.Context, id string) error
+}
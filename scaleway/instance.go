@@ -0,0 +1,217 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const defaultAPIURL = "https://api.scaleway.com"
+
+// Snapshot states of the Instance API.
+const (
+	snapshotStateAvailable   = "available"
+	snapshotStateError       = "error"
+	snapshotStateInvalidData = "invalid_data"
+)
+
+// instanceImage is an image of the Scaleway Instance API.
+type instanceImage struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	RootVolume struct {
+		ID string `json:"id"`
+	} `json:"root_volume"`
+}
+
+// instanceSnapshot is a snapshot of the Scaleway Instance API.
+type instanceSnapshot struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+type createImageRequest struct {
+	Name       string   `json:"name"`
+	RootVolume string   `json:"root_volume"`
+	Arch       string   `json:"arch"`
+	Project    string   `json:"project"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// importSnapshotRequest creates a snapshot from a QCOW2 object in Object Storage.
+type importSnapshotRequest struct {
+	Name       string `json:"name"`
+	Project    string `json:"project"`
+	VolumeType string `json:"volume_type"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+}
+
+// apiError is returned by the Scaleway APIs for unsuccessful requests.
+type apiError struct {
+	StatusCode int    `json:"-"`
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status %d: %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// instanceClient is a client of the Instance API in a zone, authenticated with the secret key.
+type instanceClient struct {
+	apiURL     string
+	zone       string
+	project    string
+	secretKey  string
+	httpClient *http.Client
+}
+
+// ListImages returns the images of the project with exactly the given name.
+func (c *instanceClient) ListImages(ctx context.Context, name string) ([]instanceImage, error) {
+	var resp struct {
+		Images []instanceImage `json:"images"`
+	}
+	query := url.Values{"name": {name}, "project": {c.project}}
+	if err := c.do(ctx, http.MethodGet, "/images", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	// The name filter of the API also matches partially.
+	var images []instanceImage
+	for _, image := range resp.Images {
+		if image.Name == name {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// CreateImage creates an image from a snapshot.
+func (c *instanceClient) CreateImage(ctx context.Context, req createImageRequest) (instanceImage, error) {
+	var resp struct {
+		Image instanceImage `json:"image"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/images", nil, req, &resp); err != nil {
+		return instanceImage{}, err
+	}
+	return resp.Image, nil
+}
+
+// DeleteImage deletes an image, but not its snapshot.
+func (c *instanceClient) DeleteImage(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/images/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// ListSnapshots returns the snapshots of the project with exactly the given name.
+func (c *instanceClient) ListSnapshots(ctx context.Context, name string) ([]instanceSnapshot, error) {
+	var resp struct {
+		Snapshots []instanceSnapshot `json:"snapshots"`
+	}
+	query := url.Values{"name": {name}, "project": {c.project}}
+	if err := c.do(ctx, http.MethodGet, "/snapshots", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	var snapshots []instanceSnapshot
+	for _, snapshot := range resp.Snapshots {
+		if snapshot.Name == name {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// GetSnapshot returns a snapshot by ID.
+func (c *instanceClient) GetSnapshot(ctx context.Context, id string) (instanceSnapshot, error) {
+	var resp struct {
+		Snapshot instanceSnapshot `json:"snapshot"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/snapshots/"+url.PathEscape(id), nil, nil, &resp); err != nil {
+		return instanceSnapshot{}, err
+	}
+	return resp.Snapshot, nil
+}
+
+// CreateSnapshot imports a snapshot from Object Storage.
+func (c *instanceClient) CreateSnapshot(ctx context.Context, req importSnapshotRequest) (instanceSnapshot, error) {
+	var resp struct {
+		Snapshot instanceSnapshot `json:"snapshot"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/snapshots", nil, req, &resp); err != nil {
+		return instanceSnapshot{}, err
+	}
+	return resp.Snapshot, nil
+}
+
+// DeleteSnapshot deletes a snapshot by ID.
+func (c *instanceClient) DeleteSnapshot(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/snapshots/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// do sends a request to the Instance API of the zone.
+// The request body is encoded as JSON and the response body is decoded into out, if not nil.
+func (c *instanceClient) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	endpoint, err := url.JoinPath(c.apiURL, "instance/v1/zones", c.zone, path)
+	if err != nil {
+		return fmt.Errorf("building request url: %w", err)
+	}
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encoding request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("X-Auth-Token", c.secretKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &apiError{StatusCode: resp.StatusCode}
+		// The error body is optional, so decoding errors are ignored.
+		_ = json.NewDecoder(resp.Body).Decode(apiErr)
+		return fmt.Errorf("%s %s: %w", method, path, apiErr)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding response of %s %s: %w", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+// useMock replaces the API clients with in-memory fakes that record their calls in rec.
+func (u *Uploader) useMock(rec *provider.Recorder) {
+	cloud := &mockCloud{
+		rec:       rec,
+		images:    make(map[string]instanceImage),
+		snapshots: make(map[string]instanceSnapshot),
+		buckets:   make(map[string]bool),
+		objects:   make(map[string]bool),
+	}
+	u.s3 = func(context.Context) (s3API, error) {
+		return &mockS3{cloud: cloud}, nil
+	}
+	u.s3uploader = func(context.Context) (s3UploaderAPI, error) {
+		return &mockS3{cloud: cloud}, nil
+	}
+	u.instance = func(context.Context) (instanceAPI, error) {
+		return &mockInstance{cloud: cloud}, nil
+	}
+}
+
+// Mocked reports whether the uploader uses fake API clients, see provider.WithMock.
+func (u *Uploader) Mocked() bool {
+	return u.opts.Mock != nil
+}
+
+// mockCloud is the state shared by the fake API clients of an uploader.
+// Uploaded objects are read, but their content isn't kept.
+type mockCloud struct {
+	rec *provider.Recorder
+
+	mux    sync.Mutex
+	nextID int
+	// images are the created images, keyed by ID.
+	images map[string]instanceImage
+	// snapshots are the imported snapshots, keyed by ID.
+	snapshots map[string]instanceSnapshot
+	// buckets holds the names of the created buckets.
+	buckets map[string]bool
+	// objects holds the bucket and key of uploaded objects, separated by a slash.
+	objects map[string]bool
+}
+
+// record records the call and locks the state until the returned function is called.
+func (c *mockCloud) record(operation string, input any) func() {
+	c.rec.Record(string(config.ProviderScaleway), operation, input)
+	c.mux.Lock()
+	return c.mux.Unlock
+}
+
+func (c *mockCloud) newID() string {
+	c.nextID++
+	return fmt.Sprintf("00000000-0000-0000-0000-%012x", c.nextID)
+}
+
+// mockNotFound returns the error of the Instance API for missing resources.
+func mockNotFound(resource, id string) error {
+	return &apiError{
+		StatusCode: http.StatusNotFound,
+		Type:       "unknown_resource",
+		Message:    fmt.Sprintf("%s %s not found", resource, id),
+	}
+}
+
+// mockInstance is the fake Instance API of the zone.
+type mockInstance struct {
+	cloud *mockCloud
+}
+
+func (m *mockInstance) ListImages(_ context.Context, name string) ([]instanceImage, error) {
+	defer m.cloud.record("instance.ListImages", name)()
+	var images []instanceImage
+	for _, image := range m.cloud.images {
+		if image.Name == name {
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
+}
+
+func (m *mockInstance) CreateImage(_ context.Context, req createImageRequest) (instanceImage, error) {
+	defer m.cloud.record("instance.CreateImage", req)()
+	if _, ok := m.cloud.snapshots[req.RootVolume]; !ok {
+		return instanceImage{}, mockNotFound("snapshot", req.RootVolume)
+	}
+	image := instanceImage{ID: m.cloud.newID(), Name: req.Name}
+	image.RootVolume.ID = req.RootVolume
+	m.cloud.images[image.ID] = image
+	return image, nil
+}
+
+func (m *mockInstance) DeleteImage(_ context.Context, id string) error {
+	defer m.cloud.record("instance.DeleteImage", id)()
+	if _, ok := m.cloud.images[id]; !ok {
+		return mockNotFound("image", id)
+	}
+	delete(m.cloud.images, id)
+	return nil
+}
+
+func (m *mockInstance) ListSnapshots(_ context.Context, name string) ([]instanceSnapshot, error) {
+	defer m.cloud.record("instance.ListSnapshots", name)()
+	var snapshots []instanceSnapshot
+	for _, snapshot := range m.cloud.snapshots {
+		if snapshot.Name == name {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots, nil
+}
+
+func (m *mockInstance) GetSnapshot(_ context.Context, id string) (instanceSnapshot, error) {
+	defer m.cloud.record("instance.GetSnapshot", id)()
+	snapshot, ok := m.cloud.snapshots[id]
+	if !ok {
+		return instanceSnapshot{}, mockNotFound("snapshot", id)
+	}
+	return snapshot, nil
+}
+
+// CreateSnapshot imports the object, which is available immediately.
+func (m *mockInstance) CreateSnapshot(_ context.Context, req importSnapshotRequest) (instanceSnapshot, error) {
+	defer m.cloud.record("instance.CreateSnapshot", req)()
+	if !m.cloud.objects[req.Bucket+"/"+req.Key] {
+		return instanceSnapshot{}, mockNotFound("object", req.Bucket+"/"+req.Key)
+	}
+	snapshot := instanceSnapshot{ID: m.cloud.newID(), Name: req.Name, State: snapshotStateAvailable}
+	m.cloud.snapshots[snapshot.ID] = snapshot
+	return snapshot, nil
+}
+
+func (m *mockInstance) DeleteSnapshot(_ context.Context, id string) error {
+	defer m.cloud.record("instance.DeleteSnapshot", id)()
+	if _, ok := m.cloud.snapshots[id]; !ok {
+		return mockNotFound("snapshot", id)
+	}
+	delete(m.cloud.snapshots, id)
+	return nil
+}
+
+// mockS3 is the fake Object Storage API of the region.
+type mockS3 struct {
+	cloud *mockCloud
+}
+
+func (m *mockS3) HeadBucket(_ context.Context, params *s3.HeadBucketInput, _ ...func(*s3.Options),
+) (*s3.HeadBucketOutput, error) {
+	defer m.cloud.record("s3.HeadBucket", params)()
+	if !m.cloud.buckets[aws.ToString(params.Bucket)] {
+		return nil, &s3types.NotFound{}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *mockS3) CreateBucket(_ context.Context, params *s3.CreateBucketInput, _ ...func(*s3.Options),
+) (*s3.CreateBucketOutput, error) {
+	defer m.cloud.record("s3.CreateBucket", params)()
+	m.cloud.buckets[aws.ToString(params.Bucket)] = true
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (m *mockS3) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...func(*s3.Options),
+) (*s3.HeadObjectOutput, error) {
+	defer m.cloud.record("s3.HeadObject", params)()
+	if !m.cloud.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)] {
+		return nil, &s3types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func (m *mockS3) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options),
+) (*s3.DeleteObjectOutput, error) {
+	defer m.cloud.record("s3.DeleteObject", params)()
+	delete(m.cloud.objects, aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options),
+) (*s3.PutObjectOutput, error) {
+	if err := m.put(params); err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3) Upload(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3manager.Uploader),
+) (*s3manager.UploadOutput, error) {
+	if err := m.put(input); err != nil {
+		return nil, err
+	}
+	return &s3manager.UploadOutput{Key: input.Key}, nil
+}
+
+// put drains the body outside of the lock and creates the object in an existing bucket.
+func (m *mockS3) put(input *s3.PutObjectInput) error {
+	if _, err := io.Copy(io.Discard, input.Body); err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	defer m.cloud.record("s3.PutObject", input)()
+	if !m.cloud.buckets[aws.ToString(input.Bucket)] {
+		return &s3types.NoSuchBucket{}
+	}
+	m.cloud.objects[aws.ToString(input.Bucket)+"/"+aws.ToString(input.Key)] = true
+	return nil
+}
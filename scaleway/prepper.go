@@ -0,0 +1,18 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"context"
+)
+
+type Prepper struct{}
+
+func (p *Prepper) Prepare(_ context.Context, imagePath, _ string) (string, error) {
+	// The image is converted to QCOW2 while uploading.
+	return imagePath, nil
+}
@@ -0,0 +1,254 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+// Scaleway only imports snapshots in QCOW2 format, so raw images are converted while uploading.
+// The converted image is a QCOW2 version 2 file without backing file, compression or snapshots.
+// Clusters only containing zeros are not allocated.
+//
+// The file is laid out as follows, every part starting at a cluster boundary:
+// header, refcount table, refcount blocks, L1 table, L2 tables, data clusters.
+const (
+	qcow2Version       = 2
+	qcow2ClusterBits   = 16
+	qcow2ClusterSize   = 1 << qcow2ClusterBits
+	qcow2HeaderSize    = 72
+	qcow2L2Entries     = qcow2ClusterSize / 8
+	qcow2RefcountBytes = 2 // refcount_order 4 is fixed for version 2
+	qcow2BlockEntries  = qcow2ClusterSize / qcow2RefcountBytes
+	qcow2OffsetCopied  = 1 << 63 // QCOW_OFLAG_COPIED, set as all clusters have a refcount of 1
+)
+
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+// qcow2Layout describes where the parts of a QCOW2 file are located, in clusters.
+type qcow2Layout struct {
+	size int64
+	// allocated reports for every guest cluster whether it contains data.
+	allocated []bool
+
+	refcountTableClusters int64
+	refcountBlocks        int64
+	l1Clusters            int64
+	// l2Tables maps L1 indices of allocated L2 tables to their host cluster.
+	l2Tables map[int64]int64
+	// dataClusters is the number of allocated guest clusters.
+	dataClusters  int64
+	totalClusters int64
+}
+
+// writeQCOW2 converts the raw image of the given size read from src to QCOW2 and writes it to dst.
+// src is read twice, first to find the clusters containing data, then to copy them.
+func writeQCOW2(dst io.Writer, src io.ReadSeeker, size int64) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking image: %w", err)
+	}
+	allocated, err := allocatedClusters(src, size)
+	if err != nil {
+		return fmt.Errorf("scanning image: %w", err)
+	}
+	layout := newQCOW2Layout(size, allocated)
+	if err := layout.writeMetadata(dst); err != nil {
+		return fmt.Errorf("writing qcow2 metadata: %w", err)
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking image: %w", err)
+	}
+	cluster := make([]byte, qcow2ClusterSize)
+	for _, isAllocated := range allocated {
+		clear(cluster)
+		if _, err := io.ReadFull(src, cluster); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("reading image: %w", err)
+		}
+		if !isAllocated {
+			continue
+		}
+		if _, err := dst.Write(cluster); err != nil {
+			return fmt.Errorf("writing qcow2 data: %w", err)
+		}
+	}
+	return nil
+}
+
+// allocatedClusters reads the image and reports for every cluster whether it contains non-zero bytes.
+func allocatedClusters(src io.Reader, size int64) ([]bool, error) {
+	numClusters := divCeil(size, qcow2ClusterSize)
+	allocated := make([]bool, numClusters)
+	cluster := make([]byte, qcow2ClusterSize)
+	zeros := make([]byte, qcow2ClusterSize)
+	for i := range allocated {
+		n, err := io.ReadFull(src, cluster)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		allocated[i] = !bytes.Equal(cluster[:n], zeros[:n])
+	}
+	return allocated, nil
+}
+
+func newQCOW2Layout(size int64, allocated []bool) qcow2Layout {
+	l := qcow2Layout{
+		size:      size,
+		allocated: allocated,
+		l2Tables:  make(map[int64]int64),
+	}
+	numL2Tables := divCeil(int64(len(allocated)), qcow2L2Entries)
+	l.l1Clusters = max(1, divCeil(numL2Tables*8, qcow2ClusterSize))
+	for i, isAllocated := range allocated {
+		if !isAllocated {
+			continue
+		}
+		l.dataClusters++
+		l.l2Tables[int64(i)/qcow2L2Entries] = 0
+	}
+
+	// The refcount structures need to cover themselves, so grow them until they fit.
+	l.refcountTableClusters, l.refcountBlocks = 1, 1
+	for {
+		l.totalClusters = 1 + l.refcountTableClusters + l.refcountBlocks + l.l1Clusters + int64(len(l.l2Tables)) + l.dataClusters
+		blocks := divCeil(l.totalClusters, qcow2BlockEntries)
+		tableClusters := divCeil(blocks*8, qcow2ClusterSize)
+		if blocks <= l.refcountBlocks && tableClusters <= l.refcountTableClusters {
+			break
+		}
+		l.refcountBlocks = max(l.refcountBlocks, blocks)
+		l.refcountTableClusters = max(l.refcountTableClusters, tableClusters)
+	}
+
+	// L2 tables are stored in the order of their L1 index.
+	next := l.l2TablesStart()
+	for i := int64(0); i < numL2Tables; i++ {
+		if _, ok := l.l2Tables[i]; ok {
+			l.l2Tables[i] = next
+			next++
+		}
+	}
+	return l
+}
+
+// refcountTableStart returns the first cluster of the refcount table, which follows the header.
+// The other parts follow each other in the order of the layout.
+func (l qcow2Layout) refcountTableStart() int64 {
+	return 1
+}
+
+func (l qcow2Layout) refcountBlocksStart() int64 {
+	return l.refcountTableStart() + l.refcountTableClusters
+}
+
+func (l qcow2Layout) l1Start() int64 {
+	return l.refcountBlocksStart() + l.refcountBlocks
+}
+
+func (l qcow2Layout) l2TablesStart() int64 {
+	return l.l1Start() + l.l1Clusters
+}
+
+func (l qcow2Layout) dataStart() int64 {
+	return l.l2TablesStart() + int64(len(l.l2Tables))
+}
+
+// writeMetadata writes everything but the data clusters.
+func (l qcow2Layout) writeMetadata(dst io.Writer) error {
+	header := qcow2Header{
+		Magic:                 provider.QCOW2Magic,
+		Version:               qcow2Version,
+		ClusterBits:           qcow2ClusterBits,
+		Size:                  uint64(l.size),
+		L1Size:                uint32(divCeil(int64(len(l.allocated)), qcow2L2Entries)),
+		L1TableOffset:         uint64(l.l1Start() * qcow2ClusterSize),
+		RefcountTableOffset:   uint64(l.refcountTableStart() * qcow2ClusterSize),
+		RefcountTableClusters: uint32(l.refcountTableClusters),
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, qcow2ClusterSize))
+	if err := binary.Write(buf, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if err := writeCluster(dst, buf.Bytes()); err != nil {
+		return err
+	}
+
+	// refcount table
+	table := make([]byte, l.refcountTableClusters*qcow2ClusterSize)
+	for i := int64(0); i < l.refcountBlocks; i++ {
+		binary.BigEndian.PutUint64(table[i*8:], uint64((l.refcountBlocksStart()+i)*qcow2ClusterSize))
+	}
+	if _, err := dst.Write(table); err != nil {
+		return err
+	}
+
+	// refcount blocks, every cluster of the file is used exactly once
+	blocks := make([]byte, l.refcountBlocks*qcow2ClusterSize)
+	for i := int64(0); i < l.totalClusters; i++ {
+		binary.BigEndian.PutUint16(blocks[i*qcow2RefcountBytes:], 1)
+	}
+	if _, err := dst.Write(blocks); err != nil {
+		return err
+	}
+
+	// L1 table
+	l1 := make([]byte, l.l1Clusters*qcow2ClusterSize)
+	for index, cluster := range l.l2Tables {
+		binary.BigEndian.PutUint64(l1[index*8:], uint64(cluster*qcow2ClusterSize)|qcow2OffsetCopied)
+	}
+	if _, err := dst.Write(l1); err != nil {
+		return err
+	}
+
+	// L2 tables, data clusters are stored in guest order
+	l2 := make([]byte, len(l.l2Tables)*qcow2ClusterSize)
+	next := l.dataStart()
+	for i, isAllocated := range l.allocated {
+		if !isAllocated {
+			continue
+		}
+		l1Index := int64(i) / qcow2L2Entries
+		tableOffset := (l.l2Tables[l1Index] - l.l2TablesStart()) * qcow2ClusterSize
+		entryOffset := tableOffset + int64(i)%qcow2L2Entries*8
+		binary.BigEndian.PutUint64(l2[entryOffset:], uint64(next*qcow2ClusterSize)|qcow2OffsetCopied)
+		next++
+	}
+	_, err := dst.Write(l2)
+	return err
+}
+
+// writeCluster writes data padded to a full cluster.
+func writeCluster(dst io.Writer, data []byte) error {
+	cluster := make([]byte, qcow2ClusterSize)
+	copy(cluster, data)
+	_, err := dst.Write(cluster)
+	return err
+}
+
+func divCeil(a, b int64) int64 {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,153 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/edgelesssys/uplosi/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteQCOW2(t *testing.T) {
+	testCases := map[string]struct {
+		size int64
+		// data maps guest clusters to the byte they are filled with.
+		data map[int64]byte
+	}{
+		"empty image": {
+			size: 0,
+		},
+		"only zeros": {
+			size: 4 * qcow2ClusterSize,
+		},
+		"partial last cluster": {
+			size: 3*qcow2ClusterSize + 512,
+			data: map[int64]byte{0: 0xaa, 2: 0xbb, 3: 0xcc},
+		},
+		"multiple L2 tables": {
+			size: (qcow2L2Entries + 1) * qcow2ClusterSize,
+			data: map[int64]byte{1: 0x01, qcow2L2Entries: 0x02},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			src := &sparseImage{size: tc.size, data: tc.data}
+
+			var dst bytes.Buffer
+			assert.NoError(writeQCOW2(&dst, src, tc.size))
+			out := dst.Bytes()
+			assert.Zero(len(out) % qcow2ClusterSize)
+
+			var header qcow2Header
+			assert.NoError(binary.Read(bytes.NewReader(out), binary.BigEndian, &header))
+			assert.Equal(uint32(provider.QCOW2Magic), header.Magic)
+			assert.Equal(uint32(qcow2Version), header.Version)
+			assert.Equal(uint64(tc.size), header.Size)
+			assert.Equal(qcow2HeaderSize, binary.Size(header))
+
+			// The converted image is recognized by the shared format detection.
+			info, err := provider.InspectImage(bytes.NewReader(out), 0)
+			assert.NoError(err)
+			assert.Equal(provider.DiskFormatQCOW2, info.Format)
+			assert.Equal(tc.size, info.VirtualSize)
+
+			// Every cluster of the file is referenced once.
+			refcountTable := out[header.RefcountTableOffset:]
+			for cluster := int64(0); cluster < int64(len(out))/qcow2ClusterSize; cluster++ {
+				block := binary.BigEndian.Uint64(refcountTable[cluster/qcow2BlockEntries*8:])
+				refcount := binary.BigEndian.Uint16(out[block+uint64(cluster%qcow2BlockEntries*qcow2RefcountBytes):])
+				assert.Equal(uint16(1), refcount, "refcount of cluster %d", cluster)
+			}
+
+			// Guest clusters read back as the original data.
+			allocated := 0
+			for cluster := int64(0); cluster < divCeil(tc.size, qcow2ClusterSize); cluster++ {
+				want := make([]byte, qcow2ClusterSize)
+				if _, err := src.ReadAt(want, cluster*qcow2ClusterSize); err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+				got := readQCOW2Cluster(out, header, cluster)
+				if got == nil {
+					assert.Equal(make([]byte, qcow2ClusterSize), want, "cluster %d", cluster)
+					continue
+				}
+				allocated++
+				assert.Equal(want, got, "cluster %d", cluster)
+			}
+			assert.Equal(len(tc.data), allocated)
+		})
+	}
+}
+
+// readQCOW2Cluster returns the data of a guest cluster or nil if the cluster is unallocated.
+func readQCOW2Cluster(file []byte, header qcow2Header, cluster int64) []byte {
+	const offsetMask = 0x00fffffffffffe00
+	l1Index := cluster / qcow2L2Entries
+	if l1Index >= int64(header.L1Size) {
+		return nil
+	}
+	l2Offset := binary.BigEndian.Uint64(file[header.L1TableOffset+uint64(l1Index*8):]) & offsetMask
+	if l2Offset == 0 {
+		return nil
+	}
+	dataOffset := binary.BigEndian.Uint64(file[l2Offset+uint64(cluster%qcow2L2Entries*8):]) & offsetMask
+	if dataOffset == 0 {
+		return nil
+	}
+	return file[dataOffset : dataOffset+qcow2ClusterSize]
+}
+
+// sparseImage is an image of zeros with some clusters filled with a byte.
+type sparseImage struct {
+	size int64
+	data map[int64]byte
+	pos  int64
+}
+
+func (s *sparseImage) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *sparseImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), s.size-off))
+	for i := 0; i < n; {
+		cluster := (off + int64(i)) / qcow2ClusterSize
+		end := min(n, int((cluster+1)*qcow2ClusterSize-off))
+		clear(p[i:end])
+		if b := s.data[cluster]; b != 0 {
+			copy(p[i:end], bytes.Repeat([]byte{b}, end-i))
+		}
+		i = end
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *sparseImage) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		s.pos = offset
+	case io.SeekCurrent:
+		s.pos += offset
+	case io.SeekEnd:
+		s.pos = s.size + offset
+	}
+	return s.pos, nil
+}
@@ -0,0 +1,26 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"log/slog"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+func init() {
+	provider.Register(string(config.ProviderScaleway), newProvider)
+}
+
+func newProvider(cfg config.Config, logger *slog.Logger, opts ...provider.Option) (provider.Prepper, provider.Uploader, error) {
+	uploader, err := NewUploader(cfg, WithLogger(logger), WithProviderOptions(opts...))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Prepper{}, uploader, nil
+}
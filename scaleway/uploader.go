@@ -0,0 +1,465 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+const (
+	waitInterval = 15 * time.Second // 15 seconds
+	maxWait      = 30 * time.Minute // 30 minutes
+
+	// accessKeyEnv and secretKeyEnv are the environment variables
+	// the Scaleway API credentials are read from.
+	accessKeyEnv = "SCW_ACCESS_KEY"
+	secretKeyEnv = "SCW_SECRET_KEY"
+
+	// snapshotVolumeType can be used with both local and block volumes.
+	snapshotVolumeType = "unified"
+)
+
+// Uploader can upload and remove os images on Scaleway.
+type Uploader struct {
+	config config.Config
+
+	apiURL    string
+	accessKey string
+	secretKey string
+
+	// s3, s3uploader and instance create the API clients, so mock mode can replace them with fakes.
+	s3         func(ctx context.Context) (s3API, error)
+	s3uploader func(ctx context.Context) (s3UploaderAPI, error)
+	instance   func(ctx context.Context) (instanceAPI, error)
+
+	httpClient *http.Client
+	confirm    config.ConfirmFunc
+	log        *slog.Logger
+	steps      provider.StepTimer
+	opts       provider.Options
+	// expiresAt is the expiry time of the current upload, or zero if the config has no TTL.
+	expiresAt time.Time
+}
+
+// Option configures an Uploader.
+type Option func(*Uploader)
+
+// WithLogger sets the structured logger used by the uploader.
+// By default, log output is discarded.
+func WithLogger(log *slog.Logger) Option {
+	return func(u *Uploader) {
+		u.log = log.With("provider", "scaleway")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to communicate with the Scaleway APIs,
+// e.g. to use a proxy or custom CA certificates.
+// By default, http.DefaultClient is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(u *Uploader) {
+		u.httpClient = client
+	}
+}
+
+// WithProviderOptions sets the options shared by all providers, like provider.WithMetrics or provider.WithClock.
+func WithProviderOptions(opts ...provider.Option) Option {
+	return func(u *Uploader) {
+		u.opts.Apply(opts...)
+	}
+}
+
+// WithConfirm sets a callback that approves overwriting existing images
+// before they are deleted.
+// Declining to overwrite aborts the upload with config.ErrNotConfirmed.
+// By default, all actions are performed without confirmation.
+func WithConfirm(confirm config.ConfirmFunc) Option {
+	return func(u *Uploader) {
+		u.confirm = confirm
+	}
+}
+
+// NewUploader creates a new Scaleway uploader.
+// The API credentials are read from the SCW_ACCESS_KEY and SCW_SECRET_KEY environment variables.
+func NewUploader(config config.Config, opts ...Option) (*Uploader, error) {
+	u := &Uploader{
+		config:     config,
+		apiURL:     defaultAPIURL,
+		accessKey:  os.Getenv(accessKeyEnv),
+		secretKey:  os.Getenv(secretKeyEnv),
+		httpClient: http.DefaultClient,
+		log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts:       provider.NewOptions(),
+	}
+	u.s3 = func(context.Context) (s3API, error) {
+		return u.newS3(), nil
+	}
+	u.s3uploader = func(context.Context) (s3UploaderAPI, error) {
+		return s3manager.NewUploader(u.newS3()), nil
+	}
+	u.instance = func(context.Context) (instanceAPI, error) {
+		return &instanceClient{
+			apiURL:     u.apiURL,
+			zone:       u.config.Scaleway.Zone,
+			project:    u.config.Scaleway.ProjectID,
+			secretKey:  u.secretKey,
+			httpClient: u.httpClient,
+		}, nil
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+	if u.opts.Mock != nil {
+		u.useMock(u.opts.Mock)
+	}
+	return u, nil
+}
+
+// Upload converts the image to QCOW2, uploads it to Object Storage, imports it as snapshot
+// and creates an image from the snapshot. The reference of the image is returned as <zone>/<image ID>.
+func (u *Uploader) Upload(ctx context.Context, image io.ReadSeeker, size int64) (refs []string, retErr error) {
+	u.steps = provider.NewStepTimer(string(config.ProviderScaleway), u.opts, u.log)
+	size, err := provider.ImageSize(image, size)
+	defer func() { provider.RecordUpload(u.opts.Metrics, string(config.ProviderScaleway), size, retErr) }()
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	image, err = provider.EnforceSize(image, size)
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := provider.RequireRaw(image); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	if err := u.checkKeys(); err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	u.expiresAt, err = u.config.ExpiresAt(u.opts.Clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("pre-flight: %w", err)
+	}
+	u.log.Info("Uploading image", "project", u.config.Scaleway.ProjectID, "zone", u.config.Scaleway.Zone)
+
+	if err := u.ensureImageDeleted(ctx); err != nil {
+		return nil, fmt.Errorf("pre-cleaning: ensuring no image using the same name exists: %w", err)
+	}
+	snapshotID, err := u.uploadSnapshot(ctx, image, size)
+	if err != nil {
+		return nil, err
+	}
+
+	stepDone := u.steps.Start("create")
+	instanceC, err := u.instance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u.log.Info("Creating image", "image", u.config.Scaleway.ImageName, "snapshot", snapshotID)
+	img, err := instanceC.CreateImage(ctx, u.imageRequest(snapshotID))
+	if err != nil {
+		return nil, fmt.Errorf("creating image: %w", err)
+	}
+	stepDone()
+	return []string{u.config.Scaleway.Zone + "/" + img.ID}, nil
+}
+
+// imageRequest returns the request for creating the image from the snapshot.
+func (u *Uploader) imageRequest(snapshotID string) createImageRequest {
+	req := createImageRequest{
+		Name:       u.config.Scaleway.ImageName,
+		RootVolume: snapshotID,
+		Arch:       u.config.Scaleway.Arch,
+		Project:    u.config.Scaleway.ProjectID,
+	}
+	if !u.expiresAt.IsZero() {
+		req.Tags = []string{config.ExpiryTag + "=" + u.expiresAt.Format(time.RFC3339)}
+	}
+	return req
+}
+
+// Preflight checks that the API keys are set and lists the images of the project in the zone,
+// which verifies that the keys are valid and have access to the project.
+func (u *Uploader) Preflight(ctx context.Context) error {
+	if err := u.checkKeys(); err != nil {
+		return fmt.Errorf("%w: %w", provider.ErrPermissionDenied, err)
+	}
+	instanceC, err := u.instance(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := instanceC.ListImages(ctx, u.config.Scaleway.ImageName); err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden) {
+			return fmt.Errorf("%w: the API key needs the InstancesFullAccess and ObjectStorageFullAccess permissions for project %s: %w",
+				provider.ErrPermissionDenied, u.config.Scaleway.ProjectID, err)
+		}
+		return fmt.Errorf("listing images: %w", err)
+	}
+	return nil
+}
+
+// checkKeys fails if the API keys aren't set. The fake API clients of mock mode don't need keys.
+func (u *Uploader) checkKeys() error {
+	if u.Mocked() {
+		return nil
+	}
+	if u.accessKey == "" || u.secretKey == "" {
+		return fmt.Errorf("%s and %s must be set", accessKeyEnv, secretKeyEnv)
+	}
+	return nil
+}
+
+// StepDurations returns how long each step of the last upload took, keyed by step name.
+func (u *Uploader) StepDurations() map[string]time.Duration {
+	return u.steps.Durations()
+}
+
+// WriteObject writes the data to the object with the given key in the configured bucket.
+func (u *Uploader) WriteObject(ctx context.Context, key string, data []byte) error {
+	s3C, err := u.s3(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s3C.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &u.config.Scaleway.Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// uploadSnapshot uploads the image to a temporary object in Object Storage and imports it as snapshot.
+func (u *Uploader) uploadSnapshot(ctx context.Context, image io.ReadSeeker, size int64) (snapshotID string, retErr error) {
+	if err := u.ensureSnapshotDeleted(ctx); err != nil {
+		return "", fmt.Errorf("pre-cleaning: ensuring no snapshot using the same name exists: %w", err)
+	}
+	s3C, err := u.s3(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := u.ensureObjectDeleted(ctx, s3C); err != nil {
+		return "", fmt.Errorf("pre-cleaning: ensuring no object using the same name exists: %w", err)
+	}
+
+	// Ensure bucket exists.
+	// While the object is only created temporarily, the bucket is persistent.
+	if err := u.ensureBucket(ctx, s3C); err != nil {
+		return "", fmt.Errorf("ensuring bucket exists: %w", err)
+	}
+
+	stepDone := u.steps.Start("upload")
+	if err := u.uploadObject(ctx, image, size); err != nil {
+		return "", fmt.Errorf("uploading image to object storage: %w", err)
+	}
+	stepDone()
+	defer func(retErr *error) {
+		if err := u.ensureObjectDeleted(ctx, s3C); err != nil {
+			*retErr = errors.Join(*retErr, fmt.Errorf("post-cleaning: deleting temporary object: %w", err))
+		}
+	}(&retErr)
+
+	stepDone = u.steps.Start("import")
+	snapshotID, err = u.importSnapshot(ctx)
+	if err != nil {
+		return "", fmt.Errorf("importing snapshot: %w", err)
+	}
+	stepDone()
+	return snapshotID, nil
+}
+
+func (u *Uploader) ensureBucket(ctx context.Context, s3C s3API) error {
+	bucket := u.config.Scaleway.Bucket
+	_, err := s3C.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &bucket})
+	if err == nil {
+		u.log.Debug("Bucket exists", "bucket", bucket)
+		return nil
+	}
+	var notFound *s3types.NotFound
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("checking if bucket exists: %w", err)
+	}
+	u.log.Info("Creating bucket", "bucket", bucket)
+	if _, err := s3C.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: &bucket}); err != nil {
+		return fmt.Errorf("creating bucket: %w", err)
+	}
+	return nil
+}
+
+func (u *Uploader) uploadObject(ctx context.Context, image io.ReadSeeker, size int64) error {
+	uploader, err := u.s3uploader(ctx)
+	if err != nil {
+		return err
+	}
+	objectName := u.config.Scaleway.ObjectName
+	u.log.Info("Uploading os image as temporary QCOW2 object", "bucket", u.config.Scaleway.Bucket, "object", objectName)
+
+	// Stream the converted image instead of writing it to disk first.
+	qcow2, qcow2W := io.Pipe()
+	go func() {
+		qcow2W.CloseWithError(writeQCOW2(qcow2W, image, size))
+	}()
+
+	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: &u.config.Scaleway.Bucket,
+		Key:    &objectName,
+		Body:   qcow2,
+	})
+	if err != nil {
+		// Unblock the converter.
+		qcow2.CloseWithError(err)
+	}
+	return err
+}
+
+func (u *Uploader) ensureObjectDeleted(ctx context.Context, s3C s3API) error {
+	bucket := u.config.Scaleway.Bucket
+	objectName := u.config.Scaleway.ObjectName
+	_, err := s3C.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &objectName,
+	})
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		u.log.Debug("Object does not exist. Nothing to clean up.", "bucket", bucket, "object", objectName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking if object exists: %w", err)
+	}
+	u.log.Info("Deleting temporary object", "bucket", bucket, "object", objectName)
+	_, err = s3C.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &objectName,
+	})
+	return err
+}
+
+func (u *Uploader) importSnapshot(ctx context.Context) (string, error) {
+	instanceC, err := u.instance(ctx)
+	if err != nil {
+		return "", err
+	}
+	u.log.Info("Importing snapshot", "snapshot", u.config.Scaleway.ImageName)
+	snapshot, err := instanceC.CreateSnapshot(ctx, importSnapshotRequest{
+		Name:       u.config.Scaleway.ImageName,
+		Project:    u.config.Scaleway.ProjectID,
+		VolumeType: snapshotVolumeType,
+		Bucket:     u.config.Scaleway.Bucket,
+		Key:        u.config.Scaleway.ObjectName,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := u.waitForSnapshot(ctx, instanceC, snapshot.ID, waitInterval); err != nil {
+		return "", fmt.Errorf("waiting for snapshot %s: %w", snapshot.ID, err)
+	}
+	return snapshot.ID, nil
+}
+
+// waitForSnapshot polls the snapshot until it is available.
+func (u *Uploader) waitForSnapshot(ctx context.Context, instanceC instanceAPI, id string, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	for {
+		snapshot, err := instanceC.GetSnapshot(ctx, id)
+		if err != nil {
+			return err
+		}
+		switch snapshot.State {
+		case snapshotStateAvailable:
+			return nil
+		case snapshotStateError, snapshotStateInvalidData:
+			return fmt.Errorf("snapshot is in state %s", snapshot.State)
+		}
+		u.log.Debug("Waiting for snapshot", "snapshot", id, "state", snapshot.State)
+		if err := u.opts.Clock.Sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+func (u *Uploader) ensureSnapshotDeleted(ctx context.Context) error {
+	instanceC, err := u.instance(ctx)
+	if err != nil {
+		return err
+	}
+	snapshots, err := instanceC.ListSnapshots(ctx, u.config.Scaleway.ImageName)
+	if err != nil {
+		return fmt.Errorf("listing snapshots: %w", err)
+	}
+	for _, snapshot := range snapshots {
+		u.log.Info("Deleting snapshot", "snapshot", snapshot.ID, "zone", u.config.Scaleway.Zone)
+		if err := instanceC.DeleteSnapshot(ctx, snapshot.ID); err != nil && !isNotFound(err) {
+			return fmt.Errorf("deleting snapshot %s: %w", snapshot.ID, err)
+		}
+	}
+	return nil
+}
+
+// ensureImageDeleted deletes existing images of the same name and their snapshots.
+func (u *Uploader) ensureImageDeleted(ctx context.Context) error {
+	instanceC, err := u.instance(ctx)
+	if err != nil {
+		return err
+	}
+	images, err := instanceC.ListImages(ctx, u.config.Scaleway.ImageName)
+	if err != nil {
+		return fmt.Errorf("listing images: %w", err)
+	}
+	for _, image := range images {
+		if err := u.confirm.ConfirmOverwrite(u.config, image.ID); err != nil {
+			return err
+		}
+		u.log.Info("Deleting existing image", "image", u.config.Scaleway.ImageName, "id", image.ID)
+		if err := instanceC.DeleteImage(ctx, image.ID); err != nil {
+			return fmt.Errorf("deleting image %s: %w", image.ID, err)
+		}
+		if image.RootVolume.ID == "" {
+			continue
+		}
+		u.log.Info("Deleting snapshot of existing image", "snapshot", image.RootVolume.ID)
+		if err := instanceC.DeleteSnapshot(ctx, image.RootVolume.ID); err != nil && !isNotFound(err) {
+			return fmt.Errorf("deleting snapshot %s: %w", image.RootVolume.ID, err)
+		}
+	}
+	return nil
+}
+
+// newS3 returns a client for the S3 compatible Object Storage in the region of the configured zone.
+func (u *Uploader) newS3() *s3.Client {
+	region := objectStorageRegion(u.config.Scaleway.Zone)
+	return s3.New(s3.Options{
+		Region:       region,
+		BaseEndpoint: aws.String(fmt.Sprintf("https://s3.%s.scw.cloud", region)),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: u.accessKey, SecretAccessKey: u.secretKey}, nil
+		}),
+		HTTPClient: u.httpClient,
+	})
+}
+
+// objectStorageRegion returns the region of a zone, e.g. "fr-par" for "fr-par-1".
+func objectStorageRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i >= 0 {
+		return zone[:i]
+	}
+	return zone
+}
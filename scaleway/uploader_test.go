@@ -0,0 +1,287 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package scaleway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+const zonePath = "/instance/v1/zones/fr-par-1"
+
+func TestEnsureImageDeleted(t *testing.T) {
+	testCases := map[string]struct {
+		confirm     config.ConfirmFunc
+		wantDeleted []string
+		wantErr     error
+	}{
+		"deletes image and snapshot": {
+			wantDeleted: []string{"/images/image-1", "/snapshots/snap-1"},
+		},
+		"overwrite declined": {
+			confirm: func(string, config.Config) (bool, error) { return false, nil },
+			wantErr: config.ErrNotConfirmed,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var deleted []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal("secret", r.Header.Get("X-Auth-Token"))
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == zonePath+"/images":
+					assert.Equal("my-image", r.URL.Query().Get("name"))
+					assert.Equal("project", r.URL.Query().Get("project"))
+					writeJSON(w, map[string]any{"images": []map[string]any{
+						{"id": "image-1", "name": "my-image", "root_volume": map[string]any{"id": "snap-1"}},
+						{"id": "image-2", "name": "my-image-2"},
+					}})
+				case r.Method == http.MethodDelete:
+					deleted = append(deleted, r.URL.Path[len(zonePath):])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer server.Close()
+
+			u := newTestUploader(t, server, WithConfirm(tc.confirm))
+			err := u.ensureImageDeleted(context.Background())
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				assert.Empty(deleted)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantDeleted, deleted)
+		})
+	}
+}
+
+func TestImportSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == zonePath+"/snapshots":
+			var req importSnapshotRequest
+			assert.NoError(json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(importSnapshotRequest{
+				Name:       "my-image",
+				Project:    "project",
+				VolumeType: "unified",
+				Bucket:     "my-bucket",
+				Key:        "my-image.qcow2",
+			}, req)
+			writeJSON(w, map[string]any{"snapshot": map[string]any{"id": "snap-1", "state": "importing"}})
+		case r.Method == http.MethodGet && r.URL.Path == zonePath+"/snapshots/snap-1":
+			writeJSON(w, map[string]any{"snapshot": map[string]any{"id": "snap-1", "state": "available"}})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	u := newTestUploader(t, server)
+	snapshotID, err := u.importSnapshot(context.Background())
+	assert.NoError(err)
+	assert.Equal("snap-1", snapshotID)
+}
+
+func TestWaitForSnapshot(t *testing.T) {
+	testCases := map[string]struct {
+		states  []string
+		wantErr bool
+	}{
+		"available after importing": {
+			states: []string{"importing", "importing", "available"},
+		},
+		"import failed": {
+			states:  []string{"importing", "invalid_data"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var calls int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				state := tc.states[min(calls, len(tc.states)-1)]
+				calls++
+				writeJSON(w, map[string]any{"snapshot": map[string]any{"id": "snap-1", "state": state}})
+			}))
+			defer server.Close()
+
+			u := newTestUploader(t, server)
+			instanceC, err := u.instance(context.Background())
+			assert.NoError(err)
+			err = u.waitForSnapshot(context.Background(), instanceC, "snap-1", time.Millisecond)
+			assert.Equal(len(tc.states), calls)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]any{"type": "not_found", "message": "resource is not found"})
+	}))
+	defer server.Close()
+
+	u := newTestUploader(t, server)
+	instanceC, err := u.instance(context.Background())
+	assert.NoError(err)
+	err = instanceC.DeleteSnapshot(context.Background(), "snap-1")
+	assert.True(isNotFound(err))
+	assert.ErrorContains(err, "resource is not found")
+}
+
+func TestPreflight(t *testing.T) {
+	testCases := map[string]struct {
+		accessKey     string
+		status        int
+		wantErr       bool
+		wantForbidden bool
+	}{
+		"valid keys": {
+			accessKey: "access",
+			status:    http.StatusOK,
+		},
+		"missing keys": {
+			wantErr:       true,
+			wantForbidden: true,
+		},
+		"invalid keys": {
+			accessKey:     "access",
+			status:        http.StatusUnauthorized,
+			wantErr:       true,
+			wantForbidden: true,
+		},
+		"server error": {
+			accessKey: "access",
+			status:    http.StatusInternalServerError,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				assert.Equal(zonePath+"/images", r.URL.Path)
+				w.WriteHeader(tc.status)
+				writeJSON(w, map[string]any{"images": []map[string]any{}})
+			}))
+			defer server.Close()
+
+			u := newTestUploader(t, server)
+			u.accessKey = tc.accessKey
+			err := u.Preflight(context.Background())
+			if tc.wantErr {
+				assert.Error(err)
+				assert.Equal(tc.wantForbidden, errors.Is(err, provider.ErrPermissionDenied))
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(1, requests)
+		})
+	}
+}
+
+func TestUploadMock(t *testing.T) {
+	assert := assert.New(t)
+	conf := config.Config{
+		Provider:     "scaleway",
+		Name:         "my-image",
+		ImageVersion: "1.0.0",
+		Scaleway: config.ScalewayConfig{
+			Zone:      "fr-par-1",
+			ProjectID: "11111111-2222-3333-4444-555555555555",
+			Bucket:    "my-bucket",
+		},
+	}
+	assert.NoError(conf.SetDefaults())
+	assert.NoError(conf.Render(func(string) ([]byte, error) { return nil, nil }))
+	rec := &provider.Recorder{}
+	u, err := NewUploader(conf, WithProviderOptions(provider.WithMock(rec)))
+	assert.NoError(err)
+	assert.True(u.Mocked())
+	// No API keys are needed in mock mode.
+	u.accessKey, u.secretKey = "", ""
+	assert.NoError(u.Preflight(context.Background()))
+
+	image := bytes.Repeat([]byte{0xaa}, 1<<20)
+	refs, err := u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+	assert.NoError(err)
+	assert.Len(refs, 1)
+	// Uploading again replaces the existing image and its snapshot.
+	_, err = u.Upload(context.Background(), bytes.NewReader(image), int64(len(image)))
+	assert.NoError(err)
+
+	var ops []string
+	for _, call := range rec.Calls() {
+		ops = append(ops, call.Operation)
+	}
+	assert.Contains(ops, "s3.CreateBucket")
+	assert.Contains(ops, "s3.PutObject")
+	assert.Contains(ops, "s3.DeleteObject")
+	assert.Contains(ops, "instance.CreateSnapshot")
+	assert.Contains(ops, "instance.CreateImage")
+	assert.Contains(ops, "instance.DeleteImage")
+	assert.Contains(ops, "instance.DeleteSnapshot")
+}
+
+func TestObjectStorageRegion(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("fr-par", objectStorageRegion("fr-par-1"))
+	assert.Equal("nl-ams", objectStorageRegion("nl-ams-3"))
+}
+
+func newTestUploader(t *testing.T, server *httptest.Server, opts ...Option) *Uploader {
+	t.Helper()
+	u, err := NewUploader(config.Config{
+		Scaleway: config.ScalewayConfig{
+			Zone:       "fr-par-1",
+			ProjectID:  "project",
+			Bucket:     "my-bucket",
+			ObjectName: "my-image.qcow2",
+			ImageName:  "my-image",
+			Arch:       "x86_64",
+		},
+	}, append(opts, WithHTTPClient(server.Client()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.apiURL = server.URL
+	u.secretKey = "secret"
+	return u
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
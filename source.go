@@ -0,0 +1,161 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+)
+
+// urlSchemes are the schemes of image arguments that are treated as URLs.
+// Providers may import images from these URLs directly,
+// otherwise images are downloaded if the scheme is http or https.
+var urlSchemes = []string{"http", "https", "s3", "gs"}
+
+// stdinArg is the image argument that reads the image from stdin.
+const stdinArg = "-"
+
+// imageSource is the image passed to the upload command, either a local file or a URL.
+type imageSource struct {
+	// path is the local path of the decompressed image.
+	// For URLs, it is empty until the image is downloaded.
+	path string
+	// url is the URL of the image, or nil for local files.
+	url *url.URL
+	// digest is the hex encoded sha256 digest of the decompressed image.
+	// It is empty until the image is hashed, which happens while downloading for URLs.
+	digest string
+
+	tmpDir     string
+	httpClient *http.Client
+	logger     *slog.Logger
+}
+
+// newImageSource interprets the image argument of the upload command.
+// Arguments starting with one of the urlSchemes are URLs, everything else is a local path.
+func newImageSource(arg, tmpDir string, logger *slog.Logger) *imageSource {
+	source := &imageSource{
+		tmpDir:     tmpDir,
+		httpClient: http.DefaultClient,
+		logger:     logger,
+	}
+	if imageURL, err := url.Parse(arg); err == nil {
+		for _, scheme := range urlSchemes {
+			if imageURL.Scheme == scheme {
+				source.url = imageURL
+				return source
+			}
+		}
+	}
+	source.path = arg
+	return source
+}
+
+// localPath returns the path of the decompressed image.
+// Images given by URL are downloaded on first use, later calls reuse the download.
+func (s *imageSource) localPath(ctx context.Context) (string, error) {
+	if s.path != "" {
+		return s.path, nil
+	}
+	if s.url.Scheme != "http" && s.url.Scheme != "https" {
+		return "", fmt.Errorf("downloading images from %s URLs is not supported", s.url.Scheme)
+	}
+
+	s.logger.Info("Downloading image", "host", s.url.Host, "path", s.url.Path)
+	downloadPath := filepath.Join(s.tmpDir, "image.raw")
+	digest, err := s.download(ctx, downloadPath)
+	if err != nil {
+		return "", fmt.Errorf("downloading image: %w", err)
+	}
+	s.path = downloadPath
+	s.digest = digest
+	return s.path, nil
+}
+
+// imageDigest returns the hex encoded sha256 digest of the decompressed image.
+// Images given by URL are downloaded to compute it, so it is only available for http and https URLs.
+// The digest is computed on first use, later calls reuse it.
+func (s *imageSource) imageDigest(ctx context.Context) (string, error) {
+	if s.digest != "" {
+		return s.digest, nil
+	}
+	if s.url != nil && s.url.Scheme != "http" && s.url.Scheme != "https" {
+		return "", fmt.Errorf("%w: images from %s URLs aren't read by uplosi", config.ErrImageDigestUnavailable, s.url.Scheme)
+	}
+	imagePath, err := s.localPath(ctx)
+	if err != nil {
+		return "", err
+	}
+	if s.digest == "" {
+		s.digest, err = imageDigest(imagePath)
+		if err != nil {
+			return "", fmt.Errorf("computing image digest: %w", err)
+		}
+	}
+	return s.digest, nil
+}
+
+// download writes the decompressed image to dst and returns its digest,
+// which is computed while downloading.
+func (s *imageSource) download(ctx context.Context, dst string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", sanitizeError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	decompressed, format, err := newDecompressingReader(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	defer decompressed.Close()
+	if format != "" {
+		s.logger.Info("Decompressing image", "format", format)
+	}
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return "", fmt.Errorf("creating file: %w", err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), decompressed); err != nil {
+		return "", errors.Join(fmt.Errorf("writing file: %w", err), file.Close())
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("closing file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// requestPath returns the path of the file holding the image of the request,
+// like the temporary file images read from stdin are spooled to.
+func requestPath(req provider.Request) (string, error) {
+	file, ok := req.Image.(*os.File)
+	if !ok {
+		return "", errors.New("image is not read from a file")
+	}
+	return file.Name(), nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/edgelesssys/uplosi/config"
+	"github.com/edgelesssys/uplosi/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewImageSource(t *testing.T) {
+	testCases := map[string]struct {
+		arg     string
+		wantURL bool
+	}{
+		"relative path":     {arg: "image.raw"},
+		"absolute path":     {arg: "/tmp/image.raw"},
+		"path with colon":   {arg: "images/a:b.raw"},
+		"https URL":         {arg: "https://example.com/image.raw", wantURL: true},
+		"http URL":          {arg: "http://example.com/image.raw", wantURL: true},
+		"s3 URL":            {arg: "s3://bucket/image.raw", wantURL: true},
+		"gs URL":            {arg: "gs://bucket/image.tar.gz", wantURL: true},
+		"unsupported URL":   {arg: "ftp://example.com/image.raw"},
+		"file with scheme":  {arg: "file:///tmp/image.raw"},
+		"windows like path": {arg: `C:\images\image.raw`},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			source := newImageSource(tc.arg, t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if tc.wantURL {
+				assert.Equal(tc.arg, source.url.String())
+				assert.Empty(source.path)
+				return
+			}
+			assert.Nil(source.url)
+			assert.Equal(tc.arg, source.path)
+		})
+	}
+}
+
+func TestImageSourceLocalPath(t *testing.T) {
+	raw := bytes.Repeat([]byte("uplosi"), 1000)
+	gzipData := new(bytes.Buffer)
+	gzipW := gzip.NewWriter(gzipData)
+	_, err := gzipW.Write(raw)
+	assert.NoError(t, err)
+	assert.NoError(t, gzipW.Close())
+	rawDigest := sha256.Sum256(raw)
+	wantDigest := hex.EncodeToString(rawDigest[:])
+
+	testCases := map[string]struct {
+		path    string
+		status  int
+		body    []byte
+		wantErr bool
+	}{
+		"raw image": {
+			path:   "/image.raw",
+			status: http.StatusOK,
+			body:   raw,
+		},
+		"compressed image": {
+			path:   "/image.raw.gz",
+			status: http.StatusOK,
+			body:   gzipData.Bytes(),
+		},
+		"not found": {
+			path:    "/missing.raw",
+			status:  http.StatusNotFound,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				assert.Equal(tc.path, r.URL.Path)
+				w.WriteHeader(tc.status)
+				_, _ = w.Write(tc.body)
+			}))
+			defer server.Close()
+
+			source := newImageSource(server.URL+tc.path, t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+			source.httpClient = server.Client()
+
+			imagePath, err := source.localPath(context.Background())
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			got, err := os.ReadFile(imagePath)
+			assert.NoError(err)
+			assert.Equal(raw, got)
+
+			// The download is reused.
+			again, err := source.localPath(context.Background())
+			assert.NoError(err)
+			assert.Equal(imagePath, again)
+
+			// The digest is computed while downloading.
+			digest, err := source.imageDigest(context.Background())
+			assert.NoError(err)
+			assert.Equal(wantDigest, digest)
+			assert.Equal(1, requests)
+		})
+	}
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		source := newImageSource("s3://bucket/image.raw", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+		_, err := source.localPath(context.Background())
+		assert.Error(t, err)
+		_, err = source.imageDigest(context.Background())
+		assert.ErrorIs(t, err, config.ErrImageDigestUnavailable)
+	})
+
+	t.Run("local file", func(t *testing.T) {
+		assert := assert.New(t)
+		imagePath := filepath.Join(t.TempDir(), "image.raw")
+		assert.NoError(os.WriteFile(imagePath, raw, 0o644))
+		source := newImageSource(imagePath, t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+		digest, err := source.imageDigest(context.Background())
+		assert.NoError(err)
+		assert.Equal(wantDigest, digest)
+
+		// The digest is reused without reading the image again.
+		assert.NoError(os.Remove(imagePath))
+		digest, err = source.imageDigest(context.Background())
+		assert.NoError(err)
+		assert.Equal(wantDigest, digest)
+	})
+}
+
+func TestRequestPath(t *testing.T) {
+	assert := assert.New(t)
+	raw := bytes.Repeat([]byte("uplosi"), 1000)
+
+	req, cleanup, err := provider.NewStreamRequest(io.MultiReader(bytes.NewReader(raw)))
+	assert.NoError(err)
+	path, err := requestPath(req)
+	assert.NoError(err)
+	got, err := os.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal(raw, got)
+	assert.NoError(cleanup())
+
+	_, err = requestPath(provider.Request{Image: nopSeekCloser{bytes.NewReader(raw)}})
+	assert.Error(err)
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
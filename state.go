@@ -0,0 +1,46 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readCompletedVariants returns the variant names recorded in the state file.
+// A missing state file means no variant was completed yet.
+func readCompletedVariants(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+	var completed []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			completed = append(completed, name)
+		}
+	}
+	return completed, nil
+}
+
+// markVariantCompleted records the variant name in the state file.
+func markVariantCompleted(path, name string) error {
+	stateFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer stateFile.Close()
+	if _, err := stateFile.WriteString(name + "\n"); err != nil {
+		return fmt.Errorf("writing file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompletedVariants(t *testing.T) {
+	assert := assert.New(t)
+	stateFile := filepath.Join(t.TempDir(), "state")
+
+	completed, err := readCompletedVariants(stateFile)
+	assert.NoError(err)
+	assert.Empty(completed)
+
+	assert.NoError(markVariantCompleted(stateFile, "a"))
+	assert.NoError(markVariantCompleted(stateFile, "b"))
+
+	completed, err = readCompletedVariants(stateFile)
+	assert.NoError(err)
+	assert.Equal([]string{"a", "b"}, completed)
+
+	_, err = readCompletedVariants(t.TempDir())
+	assert.Error(err)
+}
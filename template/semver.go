@@ -0,0 +1,67 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package template
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semverMajor returns the major component of a version, e.g. "1" for "1.2.3".
+func semverMajor(version string) (string, error) {
+	major, _, _, err := parseSemver(version)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(major), nil
+}
+
+// semverMajorMinor returns the major and minor components of a version, e.g. "1.2" for "1.2.3".
+func semverMajorMinor(version string) (string, error) {
+	major, minor, _, err := parseSemver(version)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.%d", major, minor), nil
+}
+
+// semverBump increments the given component ("major", "minor" or "patch") of a version
+// and resets all lower components, e.g. "1.3.0" for component "minor" and version "1.2.3".
+func semverBump(component, version string) (string, error) {
+	major, minor, patch, err := parseSemver(version)
+	if err != nil {
+		return "", err
+	}
+	switch component {
+	case "major":
+		major, minor, patch = major+1, 0, 0
+	case "minor":
+		minor, patch = minor+1, 0
+	case "patch":
+		patch++
+	default:
+		return "", fmt.Errorf("unknown version component %q, must be one of major, minor, patch", component)
+	}
+	return fmt.Sprintf("%d.%d.%d", major, minor, patch), nil
+}
+
+func parseSemver(version string) (major, minor, patch int, err error) {
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("version %q must be in format <MAJOR>.<MINOR>.<PATCH>", version)
+	}
+	nums := make([]int, 0, len(parts))
+	for _, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 {
+			return 0, 0, 0, fmt.Errorf("version %q must be in format <MAJOR>.<MINOR>.<PATCH>", version)
+		}
+		nums = append(nums, num)
+	}
+	return nums[0], nums[1], nums[2], nil
+}
@@ -6,10 +6,91 @@ SPDX-License-Identifier: Apache-2.0
 
 package template
 
-import "strings"
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
 
 func DefaultFuncMap() map[string]any {
 	return map[string]any{
-		"replaceAll": strings.ReplaceAll,
+		"replaceAll":   strings.ReplaceAll,
+		"replaceRegex": replaceRegex,
+		"default":      defaultValue,
+		"empty":        empty,
+		"padLeft":      padLeft,
+		"padRight":     padRight,
+
+		"semverMajor":      semverMajor,
+		"semverMajorMinor": semverMajorMinor,
+		"semverBump":       semverBump,
+	}
+}
+
+// replaceRegex replaces all matches of the regular expression pattern in s with repl.
+// Inside repl, $1 and ${name} refer to capture groups, as in regexp.Regexp.ReplaceAllString.
+func replaceRegex(s, pattern, repl string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("compiling regular expression: %w", err)
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// padLeft pads the value on the left with the pad character until it is width characters long.
+// Values that are already at least width characters long are returned unchanged.
+// It is meant to be used in pipelines, e.g. {{.VersionMajor | padLeft 3 "0"}}.
+func padLeft(width int, pad string, value any) (string, error) {
+	padding, s, err := padValue(width, pad, value)
+	if err != nil {
+		return "", err
+	}
+	return padding + s, nil
+}
+
+// padRight pads the value on the right with the pad character until it is width characters long,
+// like padLeft.
+func padRight(width int, pad string, value any) (string, error) {
+	padding, s, err := padValue(width, pad, value)
+	if err != nil {
+		return "", err
+	}
+	return s + padding, nil
+}
+
+// padValue formats the value as string and returns the padding needed to reach width characters.
+func padValue(width int, pad string, value any) (string, string, error) {
+	if utf8.RuneCountInString(pad) != 1 {
+		return "", "", fmt.Errorf("pad must be a single character, got %q", pad)
+	}
+	s := fmt.Sprint(value)
+	return strings.Repeat(pad, max(0, width-utf8.RuneCountInString(s))), s, nil
+}
+
+// defaultValue returns def if given is empty or missing, otherwise given.
+// It is meant to be used in pipelines, e.g. {{.Name | default "foo"}}.
+func defaultValue(def any, given ...any) any {
+	if len(given) == 0 || empty(given[0]) {
+		return def
+	}
+	return given[0]
+}
+
+// empty reports whether the given value is nil or the zero value of its type.
+// Slices, maps and arrays are empty if their length is zero.
+func empty(given any) bool {
+	if given == nil {
+		return true
+	}
+	val := reflect.ValueOf(given)
+	switch val.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+		return val.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return val.IsNil()
+	default:
+		return val.IsZero()
 	}
 }
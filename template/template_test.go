@@ -0,0 +1,246 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package template
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefault(t *testing.T) {
+	testCases := map[string]struct {
+		tmpl string
+		data any
+		want string
+	}{
+		"empty string": {
+			tmpl: `{{.Value | default "standard"}}`,
+			data: map[string]any{"Value": ""},
+			want: "standard",
+		},
+		"missing key": {
+			tmpl: `{{.Missing | default "standard"}}`,
+			data: map[string]any{},
+			want: "standard",
+		},
+		"set string": {
+			tmpl: `{{.Value | default "standard"}}`,
+			data: map[string]any{"Value": "premium"},
+			want: "premium",
+		},
+		"zero int": {
+			tmpl: `{{.Value | default 42}}`,
+			data: map[string]any{"Value": 0},
+			want: "42",
+		},
+		"empty predicate": {
+			tmpl: `{{if empty .Value}}empty{{else}}set{{end}}`,
+			data: map[string]any{"Value": []string{}},
+			want: "empty",
+		},
+		"non-empty predicate": {
+			tmpl: `{{if empty .Value}}empty{{else}}set{{end}}`,
+			data: map[string]any{"Value": []string{"a"}},
+			want: "set",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			tmpl, err := template.New(name).Funcs(DefaultFuncMap()).Parse(tc.tmpl)
+			assert.NoError(err)
+			out := new(strings.Builder)
+			assert.NoError(tmpl.Execute(out, tc.data))
+			assert.Equal(tc.want, out.String())
+		})
+	}
+}
+
+func TestPad(t *testing.T) {
+	testCases := map[string]struct {
+		tmpl    string
+		data    any
+		want    string
+		wantErr bool
+	}{
+		"numeric string": {
+			tmpl: `{{.Value | padLeft 3 "0"}}`,
+			data: map[string]any{"Value": "1"},
+			want: "001",
+		},
+		"int": {
+			tmpl: `{{.Value | padLeft 3 "0"}}`,
+			data: map[string]any{"Value": 42},
+			want: "042",
+		},
+		"string right": {
+			tmpl: `{{.Value | padRight 6 "-"}}`,
+			data: map[string]any{"Value": "abc"},
+			want: "abc---",
+		},
+		"multibyte": {
+			tmpl: `{{.Value | padLeft 4 "·"}}`,
+			data: map[string]any{"Value": "äb"},
+			want: "··äb",
+		},
+		"longer than width": {
+			tmpl: `{{.Value | padLeft 2 "0"}}`,
+			data: map[string]any{"Value": "1234"},
+			want: "1234",
+		},
+		"negative width": {
+			tmpl: `{{.Value | padRight -1 "0"}}`,
+			data: map[string]any{"Value": 7},
+			want: "7",
+		},
+		"version parts": {
+			tmpl: `v{{padLeft 3 "0" .Major}}.{{padLeft 3 "0" .Minor}}.{{padLeft 3 "0" .Patch}}`,
+			data: map[string]any{"Major": "1", "Minor": "2", "Patch": "3"},
+			want: "v001.002.003",
+		},
+		"multiple pad characters": {
+			tmpl:    `{{.Value | padLeft 3 "00"}}`,
+			data:    map[string]any{"Value": "1"},
+			wantErr: true,
+		},
+		"empty pad": {
+			tmpl:    `{{.Value | padLeft 3 ""}}`,
+			data:    map[string]any{"Value": "1"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			tmpl, err := template.New(name).Funcs(DefaultFuncMap()).Parse(tc.tmpl)
+			assert.NoError(err)
+			out := new(strings.Builder)
+			err = tmpl.Execute(out, tc.data)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, out.String())
+		})
+	}
+}
+
+func TestSemverFuncs(t *testing.T) {
+	testCases := map[string]struct {
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		"major": {
+			tmpl: `{{semverMajor "1.2.3"}}`,
+			want: "1",
+		},
+		"major minor": {
+			tmpl: `{{semverMajorMinor "1.2.3"}}`,
+			want: "1.2",
+		},
+		"bump major": {
+			tmpl: `{{semverBump "major" "1.2.3"}}`,
+			want: "2.0.0",
+		},
+		"bump minor": {
+			tmpl: `{{semverBump "minor" "1.2.3"}}`,
+			want: "1.3.0",
+		},
+		"bump patch": {
+			tmpl: `{{semverBump "patch" "1.2.3"}}`,
+			want: "1.2.4",
+		},
+		"composed": {
+			tmpl: `{{semverBump "minor" "1.2.3" | semverMajorMinor}}`,
+			want: "1.3",
+		},
+		"bump unknown component": {
+			tmpl:    `{{semverBump "build" "1.2.3"}}`,
+			wantErr: true,
+		},
+		"invalid version": {
+			tmpl:    `{{semverMajor "1.2"}}`,
+			wantErr: true,
+		},
+		"non-numeric version": {
+			tmpl:    `{{semverMajorMinor "1.x.3"}}`,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			tmpl, err := template.New(name).Funcs(DefaultFuncMap()).Parse(tc.tmpl)
+			assert.NoError(err)
+			out := new(strings.Builder)
+			err = tmpl.Execute(out, nil)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, out.String())
+		})
+	}
+}
+
+func TestReplaceRegex(t *testing.T) {
+	testCases := map[string]struct {
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		"strip build suffix": {
+			tmpl: `{{replaceRegex "1.2.3+build.42" "\\+.*$" ""}}`,
+			want: "1.2.3",
+		},
+		"no match": {
+			tmpl: `{{replaceRegex "1.2.3" "\\+.*$" ""}}`,
+			want: "1.2.3",
+		},
+		"all matches": {
+			tmpl: `{{replaceRegex "1.2.3" "[.]" "-"}}`,
+			want: "1-2-3",
+		},
+		"capture groups": {
+			tmpl: `{{replaceRegex "1.2.3" "^(\\d+)\\.(\\d+)\\..*$" "v${1}-${2}"}}`,
+			want: "v1-2",
+		},
+		"named capture groups": {
+			tmpl: `{{replaceRegex "my_image" "^(?P<prefix>[a-z]+)_(?P<suffix>[a-z]+)$" "$suffix-$prefix"}}`,
+			want: "image-my",
+		},
+		"invalid pattern": {
+			tmpl:    `{{replaceRegex "1.2.3" "(" ""}}`,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			tmpl, err := template.New(name).Funcs(DefaultFuncMap()).Parse(tc.tmpl)
+			assert.NoError(err)
+			out := new(strings.Builder)
+			err = tmpl.Execute(out, nil)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, out.String())
+		})
+	}
+}
@@ -10,20 +10,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/BurntSushi/toml"
-	"github.com/edgelesssys/uplosi/aws"
-	"github.com/edgelesssys/uplosi/azure"
+	// Built-in providers register themselves on import.
+	_ "github.com/edgelesssys/uplosi/aws"
+	_ "github.com/edgelesssys/uplosi/azure"
 	"github.com/edgelesssys/uplosi/config"
-	"github.com/edgelesssys/uplosi/gcp"
-	"github.com/edgelesssys/uplosi/openstack"
+	_ "github.com/edgelesssys/uplosi/gcp"
+	_ "github.com/edgelesssys/uplosi/openstack"
+	"github.com/edgelesssys/uplosi/provider"
+	_ "github.com/edgelesssys/uplosi/scaleway"
 	"github.com/spf13/cobra"
 	"golang.org/x/mod/semver"
 )
@@ -37,6 +40,7 @@ func newUploadCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "upload <image>",
 		Short: "Upload an image to a cloud provider",
+		Long:  "Upload an image to a cloud provider. The image is a local path, a URL, or - to read the image from stdin.",
 		Args:  cobra.ExactArgs(1),
 		RunE:  runUpload,
 	}
@@ -44,28 +48,44 @@ func newUploadCmd() *cobra.Command {
 	cmd.Flags().StringSlice("enable-variant-glob", []string{"*"}, "list of variant name globs to enable")
 	cmd.Flags().StringSlice("disable-variant-glob", nil, "list of variant name globs to disable")
 	cmd.Flags().StringP("config", "c", "", fmt.Sprintf("path to directory %s and %s resides in", configName, configDir))
+	cmd.Flags().String("post-upload-hook", "", "executable to run after each successful variant upload, called with the image references as arguments")
+	cmd.Flags().Bool("ignore-hook-errors", false, "log errors of the post-upload hook instead of failing")
+	cmd.Flags().String("log-level", "info", "log level, one of debug, info, warn or error")
+	cmd.Flags().String("region", "", "upload to this region or location instead of the configured one, e.g. a sandbox region")
+	cmd.Flags().String("state-file", "", "file to record successfully uploaded variants in, which are skipped when re-running after a failure")
+	cmd.Flags().Bool("preflight", false, "check credentials and permissions for all variants before uploading any of them")
+	cmd.Flags().Bool("mock", false, "upload to in-memory fakes of the cloud APIs and log the API calls instead of creating anything in the cloud")
 
 	return cmd
 }
 
 func runUpload(cmd *cobra.Command, args []string) error {
-	logger := log.New(cmd.ErrOrStderr(), "", log.LstdFlags)
-	imagePath := args[0]
-
 	flags, err := parseUploadFlags(cmd)
 	if err != nil {
 		return fmt.Errorf("parsing flags: %w", err)
 	}
+	logger := slog.New(slog.NewTextHandler(cmd.ErrOrStderr(), &slog.HandlerOptions{Level: flags.logLevel}))
 
 	conf, err := parseConfigFiles(flags.configPath)
 	if err != nil {
 		return fmt.Errorf("parsing config files: %w", err)
 	}
+	conf.RenderOptions = append(conf.RenderOptions, config.WithRegionOverride(flags.region))
+
+	var providerOpts []provider.Option
+	if flags.mock {
+		logger.Warn("Running in mock mode, nothing is created in the cloud")
+		rec := &provider.Recorder{}
+		providerOpts = append(providerOpts, provider.WithMock(rec))
+		// The calls are also logged if an upload fails.
+		defer logRecordedCalls(logger, rec)
+	}
 
 	versionFiles := map[string][]byte{}
+	readVersionFile := config.RetryingFileLookup(os.ReadFile, 3, 100*time.Millisecond)
 	versionFileLookup := func(name string) ([]byte, error) {
 		if _, ok := versionFiles[name]; !ok {
-			ver, err := os.ReadFile(name)
+			ver, err := readVersionFile(name)
 			if err != nil {
 				return nil, fmt.Errorf("reading version file: %w", err)
 			}
@@ -74,27 +94,114 @@ func runUpload(cmd *cobra.Command, args []string) error {
 		return versionFiles[name], nil
 	}
 
+	tmpDir, err := os.MkdirTemp("", "uplosi-")
+	if err != nil {
+		return fmt.Errorf("creating temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	source := newImageSource(args[0], tmpDir, logger)
+	if source.path == stdinArg {
+		logger.Info("Reading image from stdin")
+		req, cleanup, err := provider.NewStreamRequest(cmd.InOrStdin())
+		if err != nil {
+			return fmt.Errorf("reading image from stdin: %w", err)
+		}
+		defer func() {
+			if err := cleanup(); err != nil {
+				logger.Warn("Removing image read from stdin failed", "error", err)
+			}
+		}()
+		source.path, err = requestPath(req)
+		if err != nil {
+			return fmt.Errorf("reading image from stdin: %w", err)
+		}
+	}
+	if source.url == nil {
+		source.path, err = decompressImage(source.path, tmpDir, logger)
+		if err != nil {
+			return fmt.Errorf("decompressing image: %w", err)
+		}
+	}
+	// The image is only hashed (and images given by URL downloaded) if a template uses the digest.
+	conf.RenderOptions = append(conf.RenderOptions, config.WithImageDigest(func() (string, error) {
+		return source.imageDigest(cmd.Context())
+	}))
+
+	var completed []string
+	if flags.stateFile != "" {
+		completed, err = readCompletedVariants(flags.stateFile)
+		if err != nil {
+			return fmt.Errorf("reading state file: %w", err)
+		}
+		if len(completed) > 0 {
+			logger.Info("Skipping variants completed in a previous run", "variants", completed)
+		}
+	}
+
+	selected := func(name string) bool {
+		return filterGlobAny(flags.enableVariantGlobs, name) && !filterGlobAny(flags.disableVariantGlobs, name)
+	}
+	if flags.incrementVersion {
+		if err := checkIncrementVersion(conf, selected); err != nil {
+			return err
+		}
+	}
+	if err := conf.ResolveAutoVersions(versionFileLookup, func(cfg config.Config) ([]string, error) {
+		return listImageVersions(cmd.Context(), cfg, logger, providerOpts...)
+	}, config.FilterSkipCompleted(completed), selected); err != nil {
+		return fmt.Errorf("resolving image versions: %w", err)
+	}
+
+	var hook postUploadHook
+	if flags.postUploadHook != "" {
+		hook = commandHook(flags.postUploadHook, cmd.ErrOrStderr(), cmd.ErrOrStderr())
+	}
+
+	if flags.preflight {
+		if err := conf.ForEach(func(name string, cfg config.Config) error {
+			return preflightVariant(cmd.Context(), name, cfg, logger.With("variant", name), providerOpts...)
+		}, versionFileLookup, config.FilterSkipCompleted(completed), selected); err != nil {
+			return fmt.Errorf("running preflight checks: %w", err)
+		}
+	}
+
 	allRefs := []string{}
-	err = conf.ForEach(
-		func(name string, cfg config.Config) error {
-			refs, err := uploadVariant(cmd.Context(), imagePath, name, cfg, logger)
+	err = conf.ForEachRendered(
+		func(name string, cfg config.Config, rendered []byte) error {
+			logger.Debug("Rendered config", "variant", name, "config", string(rendered))
+			result, err := uploadVariant(cmd.Context(), source, name, cfg, logger.With("variant", name), providerOpts...)
 			if err != nil {
 				return err
 			}
-			allRefs = append(allRefs, refs...)
+			allRefs = append(allRefs, result.Refs...)
+			if hook != nil {
+				if err := hook(cmd.Context(), result); err != nil {
+					if !flags.ignoreHookErrors {
+						return fmt.Errorf("post-upload hook: %w", err)
+					}
+					logger.Warn("Post-upload hook failed", "variant", name, "error", err)
+				}
+			}
+			if flags.stateFile != "" && name != "" {
+				if err := markVariantCompleted(flags.stateFile, name); err != nil {
+					return fmt.Errorf("writing state file: %w", err)
+				}
+			}
 			return nil
 		},
 		versionFileLookup,
-		func(name string) bool {
-			return filterGlobAny(flags.enableVariantGlobs, name)
-		},
-		func(name string) bool {
-			return !filterGlobAny(flags.disableVariantGlobs, name)
-		},
+		config.FilterSkipCompleted(completed),
+		selected,
 	)
 	if err != nil {
 		return fmt.Errorf("uploading variants: %w", err)
 	}
+	if flags.stateFile != "" {
+		// All variants are uploaded, so the next run starts from scratch.
+		if err := os.Remove(flags.stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing state file: %w", err)
+		}
+	}
 
 	for _, ref := range allRefs {
 		fmt.Println(ref)
@@ -118,70 +225,135 @@ func runUpload(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func uploadVariant(ctx context.Context, imagePath, variant string, config config.Config, logger *log.Logger) ([]string, error) {
-	var prepper Prepper
-	var upload Uploader
-	var err error
+// checkIncrementVersion fails if a selected variant reads its version from a key of the version file,
+// as only plain version files can be incremented.
+func checkIncrementVersion(conf *config.ConfigFile, selected func(name string) bool) error {
+	if conf.Base.ImageVersionFileKey != "" {
+		return errors.New("increment-version flag can't be used with imageVersionFileKey")
+	}
+	for name, variant := range conf.Variants {
+		if selected(name) && variant.ImageVersionFileKey != "" {
+			return fmt.Errorf("increment-version flag can't be used with imageVersionFileKey of variant %s", name)
+		}
+	}
+	return nil
+}
 
+func uploadVariant(ctx context.Context, source *imageSource, variant string, cfg config.Config, logger *slog.Logger,
+	opts ...provider.Option,
+) (uploadResult, error) {
 	if len(variant) > 0 {
-		log.Println("Uploading variant", variant)
+		logger.Info("Uploading variant", "provider", cfg.Provider)
+	}
+	for _, warning := range cfg.Warnings {
+		logger.Warn(warning)
 	}
 
-	switch strings.ToLower(config.Provider) {
-	case "aws":
-		prepper = &aws.Prepper{}
-		upload, err = aws.NewUploader(config, logger)
-		if err != nil {
-			return nil, fmt.Errorf("creating aws uploader: %w", err)
-		}
-	case "azure":
-		prepper = &azure.Prepper{}
-		upload, err = azure.NewUploader(config, logger)
-		if err != nil {
-			return nil, fmt.Errorf("creating azure uploader: %w", err)
-		}
-	case "gcp":
-		prepper = &gcp.Prepper{}
-		upload, err = gcp.NewUploader(config, logger)
-		if err != nil {
-			return nil, fmt.Errorf("creating gcp uploader: %w", err)
-		}
-	case "openstack":
-		prepper = &openstack.Prepper{}
-		upload, err = openstack.NewUploader(config, logger)
-		if err != nil {
-			return nil, fmt.Errorf("creating openstack uploader: %w", err)
+	prepper, upload, err := provider.New(cfg, logger, opts...)
+	if err != nil {
+		return uploadResult{}, err
+	}
+
+	if source.url != nil {
+		importer, ok := upload.(provider.URLImporter)
+		if ok && importer.CanImportURL(source.url) {
+			logger.Info("Importing image from URL", "provider", cfg.Provider, "host", source.url.Host, "path", source.url.Path)
+			refs, err := importer.ImportURL(ctx, source.url)
+			if err != nil {
+				return uploadResult{}, fmt.Errorf("importing image: %w", sanitizeError(err))
+			}
+			return finishedUpload(ctx, source, variant, cfg, refs, upload, logger)
 		}
-	default:
-		return nil, fmt.Errorf("unknown provider: %s", config.Provider)
+		logger.Debug("Provider can't import the image from the URL, uploading it instead", "provider", cfg.Provider)
+	}
+	imagePath, err := source.localPath(ctx)
+	if err != nil {
+		return uploadResult{}, err
 	}
 
 	tmpDir, err := os.MkdirTemp("", "uplosi-")
 	if err != nil {
-		return nil, fmt.Errorf("creating temp dir: %w", err)
+		return uploadResult{}, fmt.Errorf("creating temp dir: %w", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
 	imagePath, err = prepper.Prepare(ctx, imagePath, tmpDir)
 	if err != nil {
-		return nil, fmt.Errorf("preparing image: %w", err)
+		return uploadResult{}, fmt.Errorf("preparing image: %w", sanitizeError(err))
 	}
 	image, err := os.Open(imagePath)
 	if err != nil {
-		return nil, fmt.Errorf("opening image: %w", err)
+		return uploadResult{}, fmt.Errorf("opening image: %w", err)
 	}
 	defer image.Close()
 	imageFi, err := image.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("getting image stats: %w", err)
+		return uploadResult{}, fmt.Errorf("getting image stats: %w", err)
 	}
 
 	refs, err := upload.Upload(ctx, image, imageFi.Size())
 	if err != nil {
-		return nil, fmt.Errorf("uploading image: %w", err)
+		return uploadResult{}, fmt.Errorf("uploading image: %w", sanitizeError(err))
 	}
+	return finishedUpload(ctx, source, variant, cfg, refs, upload, logger)
+}
 
-	return refs, nil
+// preflightVariant checks the credentials and permissions for the variant without uploading anything.
+func preflightVariant(ctx context.Context, variant string, cfg config.Config, logger *slog.Logger, opts ...provider.Option) error {
+	logger.Info("Running preflight check", "provider", cfg.Provider)
+	if err := provider.Preflight(ctx, cfg, logger, opts...); err != nil {
+		if variant != "" {
+			return fmt.Errorf("variant %s: %w", variant, sanitizeError(err))
+		}
+		return sanitizeError(err)
+	}
+	return nil
+}
+
+// finishedUpload assembles the result of a finished upload and writes its manifest.
+func finishedUpload(ctx context.Context, source *imageSource, variant string, cfg config.Config, refs []string, upload provider.Uploader, logger *slog.Logger) (uploadResult, error) {
+	result := uploadResult{
+		Variant:       variant,
+		Provider:      cfg.Provider,
+		Refs:          refs,
+		StepDurations: upload.StepDurations(),
+	}
+	if reporter, ok := upload.(provider.ChecksumReporter); ok {
+		result.Checksums = reporter.Checksums()
+	}
+	logger.Info("Upload finished", "provider", cfg.Provider, "refs", refs, "durations", result.StepDurations, "checksums", result.Checksums)
+	if err := writeManifests(ctx, source, cfg, result, upload, logger); err != nil {
+		return uploadResult{}, fmt.Errorf("writing manifest: %w", err)
+	}
+	return result, nil
+}
+
+// writeManifests writes the manifest of the upload to the configured local path and object key, if any.
+func writeManifests(ctx context.Context, source *imageSource, cfg config.Config, result uploadResult, upload provider.Uploader, logger *slog.Logger) error {
+	if cfg.Manifest.Path == "" && cfg.Manifest.Key == "" {
+		return nil
+	}
+	// The digest is only computed during rendering if a template uses it.
+	if cfg.ImageDigest == "" && source.url == nil {
+		var err error
+		if cfg.ImageDigest, err = source.imageDigest(ctx); err != nil {
+			return err
+		}
+	}
+	m := newManifest(result, cfg, time.Now())
+	if cfg.Manifest.Path != "" {
+		if err := writeManifest(cfg.Manifest.Path, m); err != nil {
+			return err
+		}
+		logger.Info("Wrote manifest", "path", cfg.Manifest.Path)
+	}
+	if cfg.Manifest.Key != "" {
+		if err := writeManifestObject(ctx, upload, cfg.Manifest.Key, m); err != nil {
+			return sanitizeError(err)
+		}
+		logger.Info("Wrote manifest", "key", cfg.Manifest.Key)
+	}
+	return nil
 }
 
 type uploadFlags struct {
@@ -189,6 +361,13 @@ type uploadFlags struct {
 	enableVariantGlobs  []string
 	disableVariantGlobs []string
 	configPath          string
+	postUploadHook      string
+	ignoreHookErrors    bool
+	logLevel            slog.Level
+	region              string
+	stateFile           string
+	preflight           bool
+	mock                bool
 }
 
 func parseUploadFlags(cmd *cobra.Command) (*uploadFlags, error) {
@@ -208,14 +387,73 @@ func parseUploadFlags(cmd *cobra.Command) (*uploadFlags, error) {
 	if err != nil {
 		return nil, fmt.Errorf("getting config flag: %w", err)
 	}
+	postUploadHook, err := cmd.Flags().GetString("post-upload-hook")
+	if err != nil {
+		return nil, fmt.Errorf("getting post-upload-hook flag: %w", err)
+	}
+	ignoreHookErrors, err := cmd.Flags().GetBool("ignore-hook-errors")
+	if err != nil {
+		return nil, fmt.Errorf("getting ignore-hook-errors flag: %w", err)
+	}
+	logLevelFlag, err := cmd.Flags().GetString("log-level")
+	if err != nil {
+		return nil, fmt.Errorf("getting log-level flag: %w", err)
+	}
+	region, err := cmd.Flags().GetString("region")
+	if err != nil {
+		return nil, fmt.Errorf("getting region flag: %w", err)
+	}
+	stateFile, err := cmd.Flags().GetString("state-file")
+	if err != nil {
+		return nil, fmt.Errorf("getting state-file flag: %w", err)
+	}
+	preflight, err := cmd.Flags().GetBool("preflight")
+	if err != nil {
+		return nil, fmt.Errorf("getting preflight flag: %w", err)
+	}
+	mock, err := cmd.Flags().GetBool("mock")
+	if err != nil {
+		return nil, fmt.Errorf("getting mock flag: %w", err)
+	}
+	if mock {
+		// Mock uploads must not leave traces outside of the fakes.
+		switch {
+		case incrementVersion:
+			return nil, errors.New("mock flag can't be used with increment-version")
+		case stateFile != "":
+			return nil, errors.New("mock flag can't be used with state-file")
+		case postUploadHook != "":
+			return nil, errors.New("mock flag can't be used with post-upload-hook")
+		}
+	}
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(logLevelFlag)); err != nil {
+		return nil, fmt.Errorf("parsing log-level flag: %w", err)
+	}
 	return &uploadFlags{
 		incrementVersion:    incrementVersion,
 		enableVariantGlobs:  enableVariantGlobs,
 		disableVariantGlobs: disableVariantGlobs,
 		configPath:          configPath,
+		postUploadHook:      postUploadHook,
+		ignoreHookErrors:    ignoreHookErrors,
+		logLevel:            logLevel,
+		region:              region,
+		stateFile:           stateFile,
+		preflight:           preflight,
+		mock:                mock,
 	}, nil
 }
 
+// logRecordedCalls logs the API calls made by the uploaders in mock mode.
+func logRecordedCalls(logger *slog.Logger, rec *provider.Recorder) {
+	calls := rec.Calls()
+	for _, call := range calls {
+		logger.Info("Recorded API call", "provider", call.Provider, "operation", call.Operation)
+	}
+	logger.Info("Mock mode finished", "calls", len(calls))
+}
+
 func filterGlobAny(globs []string, name string) bool {
 	for _, glob := range globs {
 		if ok, _ := filepath.Match(glob, name); ok {
@@ -225,16 +463,22 @@ func filterGlobAny(globs []string, name string) bool {
 	return false
 }
 
-func readTOMLFile(path string, data any) error {
-	configFile, err := os.OpenFile(path, os.O_RDONLY, os.ModeAppend)
+// listImageVersions returns the versions of the existing images described by the config.
+func listImageVersions(ctx context.Context, cfg config.Config, logger *slog.Logger, opts ...provider.Option) ([]string, error) {
+	_, uploader, err := provider.New(cfg, logger, opts...)
 	if err != nil {
-		return fmt.Errorf("opening file: %w", err)
+		return nil, err
 	}
-	defer configFile.Close()
-	if _, err := toml.NewDecoder(configFile).Decode(data); err != nil {
-		return fmt.Errorf("decoding file: %w", err)
+	lister, ok := uploader.(provider.VersionLister)
+	if !ok {
+		return nil, fmt.Errorf("image version %q is not supported for provider %s", config.AutoVersion, cfg.Provider)
 	}
-	return nil
+	versions, err := lister.ImageVersions(ctx)
+	if err != nil {
+		return nil, sanitizeError(err)
+	}
+	logger.Debug("Found existing image versions", "name", cfg.Name, "versions", versions)
+	return versions, nil
 }
 
 func writeVersionFile(path string, data []byte) error {
@@ -249,49 +493,31 @@ func writeVersionFile(path string, data []byte) error {
 	return nil
 }
 
-type Prepper interface {
-	Prepare(ctx context.Context, imagePath, tmpDir string) (string, error)
-}
-
-type Uploader interface {
-	Upload(ctx context.Context, image io.ReadSeeker, size int64) (refs []string, retErr error)
-}
-
 func parseConfigFiles(configPath string) (*config.ConfigFile, error) {
 	configLocation := path.Join(configPath, configName)
 	configDirLocation := path.Join(configPath, configDir)
 
-	var conf config.ConfigFile
-	if err := readTOMLFile(configLocation, &conf); err != nil {
-		return nil, fmt.Errorf("reading config: %w", err)
+	// The config directory is optional.
+	dirPaths, err := config.DirConfigPaths(configDirLocation)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
 	}
+	configPaths := append([]string{configLocation}, dirPaths...)
 
-	dirEntries, err := os.ReadDir(configDirLocation)
-	if os.IsNotExist(err) {
-		return &conf, nil
-	}
+	conf, err := config.LoadMerged(configPaths, os.ReadFile)
 	if err != nil {
-		return nil, fmt.Errorf("reading config dir: %w", err)
-	}
-	for _, dirEntry := range dirEntries {
-		var cfgOverlay config.ConfigFile
-		if dirEntry.IsDir() {
-			continue
-		}
-		if filepath.Ext(dirEntry.Name()) != ".conf" {
-			continue
-		}
-		if err := readTOMLFile(filepath.Join(configDir, dirEntry.Name()), &cfgOverlay); err != nil {
-			return nil, fmt.Errorf("reading config: %w", err)
-		}
-		if err := conf.Merge(cfgOverlay); err != nil {
-			return nil, fmt.Errorf("merging config: %w", err)
-		}
+		return nil, fmt.Errorf("reading config: %w", err)
 	}
 	return &conf, nil
 }
 
 func incrementSemver(version string) (string, error) {
+	// Keep the "v" prefix of version files using the format of git tags.
+	var prefix string
+	if strings.HasPrefix(version, "v") {
+		prefix = "v"
+		version = strings.TrimPrefix(version, "v")
+	}
 	canonical := strings.TrimPrefix(semver.Canonical("v"+version), "v")
 	parts := strings.Split(canonical, ".")
 	if len(parts) != 3 {
@@ -305,5 +531,5 @@ func incrementSemver(version string) (string, error) {
 	}
 
 	patchNum++
-	return fmt.Sprintf("%s.%s.%d", parts[0], parts[1], patchNum), nil
+	return fmt.Sprintf("%s%s.%s.%d", prefix, parts[0], parts[1], patchNum), nil
 }
@@ -7,8 +7,13 @@ SPDX-License-Identifier: Apache-2.0
 package main
 
 import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/edgelesssys/uplosi/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,6 +29,7 @@ func TestIncrementSemver(t *testing.T) {
 		{ver: "0.0.10", want: "0.0.11"},
 		{ver: "1.15", want: "1.15.1"},
 		{ver: "1.15.1", want: "1.15.2"},
+		{ver: "v1.2.3", want: "v1.2.4"},
 	}
 
 	for _, tc := range testCases {
@@ -39,3 +45,148 @@ func TestIncrementSemver(t *testing.T) {
 		})
 	}
 }
+
+func TestParseUploadFlagsLogLevel(t *testing.T) {
+	testCases := map[string]struct {
+		args    []string
+		want    slog.Level
+		wantErr bool
+	}{
+		"default":       {want: slog.LevelInfo},
+		"debug":         {args: []string{"--log-level", "debug"}, want: slog.LevelDebug},
+		"upper case":    {args: []string{"--log-level", "WARN"}, want: slog.LevelWarn},
+		"invalid level": {args: []string{"--log-level", "verbose"}, wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			cmd := newUploadCmd()
+			assert.NoError(cmd.ParseFlags(tc.args))
+			flags, err := parseUploadFlags(cmd)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, flags.logLevel)
+		})
+	}
+}
+
+func TestParseUploadFlagsMock(t *testing.T) {
+	testCases := map[string]struct {
+		args    []string
+		want    bool
+		wantErr bool
+	}{
+		"default":                 {},
+		"mock":                    {args: []string{"--mock"}, want: true},
+		"with increment-version":  {args: []string{"--mock", "-i"}, wantErr: true},
+		"with state-file":         {args: []string{"--mock", "--state-file", "state"}, wantErr: true},
+		"with post-upload-hook":   {args: []string{"--mock", "--post-upload-hook", "hook.sh"}, wantErr: true},
+		"state-file without mock": {args: []string{"--state-file", "state"}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			cmd := newUploadCmd()
+			assert.NoError(cmd.ParseFlags(tc.args))
+			flags, err := parseUploadFlags(cmd)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, flags.mock)
+		})
+	}
+}
+
+func TestRunUploadMock(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	conf := `[base]
+provider = "aws"
+name = "my-image"
+imageVersion = "1.0.0"
+
+[base.aws]
+region = "eu-central-1"
+replicationRegions = []
+bucket = "my-bucket"
+`
+	assert.NoError(os.WriteFile(filepath.Join(dir, configName), []byte(conf), 0o644))
+	image := filepath.Join(dir, "image.raw")
+	assert.NoError(os.WriteFile(image, make([]byte, 4096), 0o644))
+
+	cmd := newUploadCmd()
+	var stderr bytes.Buffer
+	cmd.SetErr(&stderr)
+	cmd.SetArgs([]string{"--mock", "--preflight", "-c", dir, image})
+	assert.NoError(cmd.Execute())
+	assert.Contains(stderr.String(), "operation=sts.GetCallerIdentity")
+	assert.Contains(stderr.String(), "operation=ec2.RegisterImage")
+}
+
+func TestParseConfigFiles(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(dir, configName), []byte("[base]\nname = \"image\"\n"), 0o644))
+
+	// The config directory is optional.
+	conf, err := parseConfigFiles(dir)
+	assert.NoError(err)
+	assert.Equal("image", conf.Base.Name)
+
+	assert.NoError(os.Mkdir(filepath.Join(dir, configDir), 0o755))
+	assert.NoError(os.WriteFile(filepath.Join(dir, configDir, "name.toml"), []byte("[base]\nname = \"other\"\n"), 0o644))
+	conf, err = parseConfigFiles(dir)
+	assert.NoError(err)
+	assert.Equal("other", conf.Base.Name)
+}
+
+func TestCheckIncrementVersion(t *testing.T) {
+	onlyA := func(name string) bool { return name == "a" }
+	testCases := map[string]struct {
+		conf    config.ConfigFile
+		wantErr bool
+	}{
+		"plain version file": {
+			conf: config.ConfigFile{
+				Base:     config.Config{ImageVersionFile: "version.txt"},
+				Variants: map[string]config.Config{"a": {}, "b": {}},
+			},
+		},
+		"key in base": {
+			conf: config.ConfigFile{
+				Base: config.Config{ImageVersionFile: "metadata.json", ImageVersionFileKey: "version"},
+			},
+			wantErr: true,
+		},
+		"key in selected variant": {
+			conf: config.ConfigFile{
+				Variants: map[string]config.Config{"a": {ImageVersionFile: "metadata.json", ImageVersionFileKey: "version"}},
+			},
+			wantErr: true,
+		},
+		"key in unselected variant": {
+			conf: config.ConfigFile{
+				Variants: map[string]config.Config{"b": {ImageVersionFile: "metadata.json", ImageVersionFileKey: "version"}},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			err := checkIncrementVersion(&tc.conf, onlyA)
+			if tc.wantErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+}